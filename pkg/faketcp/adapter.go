@@ -5,7 +5,6 @@ import (
 	"net"
 	"time"
 
-	"github.com/openbmx/lightweight-tunnel/pkg/iptables"
 	"github.com/openbmx/lightweight-tunnel/pkg/rawsocket"
 )
 
@@ -17,6 +16,12 @@ const (
 	ModeUDP Mode = iota
 	// ModeRaw uses raw sockets with real TCP headers (真正的TCP伪装，类似udp2raw)
 	ModeRaw
+	// ModeTCP sends length-prefixed packets over kernel TCP (no raw sockets or root needed)
+	ModeTCP
+	// ModeWS sends packets as binary WebSocket messages (through HTTP proxies and CDNs)
+	ModeWS
+	// ModeWSS is ModeWS over TLS
+	ModeWSS
 )
 
 var (
@@ -26,6 +31,45 @@ var (
 	EnableRawSocket = false
 )
 
+// RSTFilter selects how the kernel's RSTs on raw socket connections are suppressed
+type RSTFilter int
+
+const (
+	// RSTFilterIPTables drops RSTs with iptables rules on the local port
+	RSTFilterIPTables RSTFilter = iota
+	// RSTFilterEBPF drops RSTs for our connections with a TC egress eBPF program,
+	// falling back to iptables where it cannot be loaded
+	RSTFilterEBPF
+)
+
+// RSTFilterMode is the current RST suppression method (default: iptables)
+var RSTFilterMode = RSTFilterIPTables
+
+// SetRSTFilter sets the RST suppression method
+func SetRSTFilter(filter RSTFilter) {
+	RSTFilterMode = filter
+}
+
+// FirewallBackend selects the firewall used for drop-RST rules
+type FirewallBackend int
+
+const (
+	// FirewallAuto uses nftables when it can be managed over netlink, otherwise iptables
+	FirewallAuto FirewallBackend = iota
+	// FirewallIPTables runs the iptables binary
+	FirewallIPTables
+	// FirewallNFTables uses a dedicated nftables table over netlink
+	FirewallNFTables
+)
+
+// FirewallBackendMode is the current firewall backend (default: auto)
+var FirewallBackendMode = FirewallAuto
+
+// SetFirewallBackend sets the firewall backend
+func SetFirewallBackend(backend FirewallBackend) {
+	FirewallBackendMode = backend
+}
+
 // SetMode sets the fake TCP mode
 func SetMode(mode Mode) {
 	CurrentMode = mode
@@ -75,6 +119,8 @@ type ListenerAdapter interface {
 // Ensure both types implement the interfaces
 var _ ConnAdapter = (*Conn)(nil)
 var _ ConnAdapter = (*ConnRaw)(nil)
+var _ ConnAdapter = (*StreamConn)(nil)
+var _ ConnAdapter = (*WSConn)(nil)
 
 // UDPListener wraps Listener to implement ListenerAdapter
 type UDPListener struct {
@@ -87,7 +133,7 @@ func (l *UDPListener) Accept() (ConnAdapter, error) {
 	if err != nil {
 		return nil, err
 	}
-	return conn, nil
+	return frameServer(conn), nil
 }
 
 // RawListener wraps ListenerRaw to implement ListenerAdapter
@@ -101,15 +147,55 @@ func (l *RawListener) Accept() (ConnAdapter, error) {
 	if err != nil {
 		return nil, err
 	}
-	return conn, nil
+	return frameServer(conn), nil
+}
+
+// TCPListener wraps StreamListener to implement ListenerAdapter
+type TCPListener struct {
+	*StreamListener
+}
+
+// Accept wraps the stream listener Accept
+func (l *TCPListener) Accept() (ConnAdapter, error) {
+	conn, err := l.StreamListener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return frameServer(conn), nil
+}
+
+// WSListener wraps WebSocketListener to implement ListenerAdapter
+type WSListener struct {
+	*WebSocketListener
+}
+
+// Accept wraps the WebSocket listener Accept
+func (l *WSListener) Accept() (ConnAdapter, error) {
+	conn, err := l.WebSocketListener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return frameServer(conn), nil
 }
 
 // DialWithMode creates a connection using specified mode
 func DialWithMode(remoteAddr string, timeout time.Duration, mode Mode) (ConnAdapter, error) {
-	if mode == ModeRaw {
-		return DialRaw(remoteAddr, timeout)
+	var conn ConnAdapter
+	var err error
+	switch mode {
+	case ModeRaw:
+		conn, err = DialRaw(remoteAddr, timeout)
+	case ModeTCP:
+		conn, err = DialStream(remoteAddr, timeout)
+	case ModeWS, ModeWSS:
+		conn, err = DialWebSocket(remoteAddr, timeout, mode == ModeWSS)
+	default:
+		conn, err = Dial(remoteAddr, timeout)
 	}
-	return Dial(remoteAddr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return frameClient(conn, timeout)
 }
 
 // ListenWithMode creates a listener using specified mode
@@ -121,6 +207,20 @@ func ListenWithMode(addr string, mode Mode) (ListenerAdapter, error) {
 		}
 		return &RawListener{listener}, nil
 	}
+	if mode == ModeTCP {
+		listener, err := ListenStream(addr)
+		if err != nil {
+			return nil, err
+		}
+		return &TCPListener{listener}, nil
+	}
+	if mode == ModeWS || mode == ModeWSS {
+		listener, err := ListenWebSocket(addr, mode == ModeWSS)
+		if err != nil {
+			return nil, err
+		}
+		return &WSListener{listener}, nil
+	}
 	listener, err := Listen(addr)
 	if err != nil {
 		return nil, err
@@ -135,6 +235,12 @@ func ModeString(mode Mode) string {
 		return "UDP (fake TCP headers in payload)"
 	case ModeRaw:
 		return "Raw Socket (real TCP packets with iptables)"
+	case ModeTCP:
+		return "TCP (length-prefixed packets over kernel TCP)"
+	case ModeWS:
+		return "WebSocket (binary messages over HTTP)"
+	case ModeWSS:
+		return "WebSocket over TLS (binary messages over HTTPS)"
 	default:
 		return fmt.Sprintf("Unknown mode (%d)", mode)
 	}
@@ -149,9 +255,9 @@ func CheckRawSocketSupport() error {
 	}
 	testSock.Close()
 	
-	// Check iptables availability
-	if err := iptables.CheckIPTablesAvailable(); err != nil {
-		return fmt.Errorf("iptables not available: %v", err)
+	// Check firewall availability (only a fallback with the eBPF RST filter)
+	if err := checkFirewall(); err != nil && RSTFilterMode != RSTFilterEBPF {
+		return err
 	}
 	
 	return nil
@@ -7,6 +7,7 @@ import (
 	"log"
 	"math/big"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -98,18 +99,19 @@ type IPHeader struct {
 
 // Conn represents a fake TCP connection over UDP
 type Conn struct {
-	udpConn     *net.UDPConn
-	localAddr   *net.UDPAddr
-	remoteAddr  *net.UDPAddr
-	srcPort     uint16
-	dstPort     uint16
-	seqNum      uint32
-	ackNum      uint32
-	mu          sync.Mutex
-	isConnected bool        // true if UDP socket is connected, false if shared listener socket
-	recvQueue   chan []byte // for listener connections
-	closed      int32       // atomic flag: 1 if connection is closed, 0 otherwise
-	closeOnce   sync.Once   // ensures channel is closed only once
+	udpConn      *net.UDPConn
+	localAddr    *net.UDPAddr
+	remoteAddr   *net.UDPAddr
+	srcPort      uint16
+	dstPort      uint16
+	seqNum       uint32
+	ackNum       uint32
+	mu           sync.Mutex
+	isConnected  bool         // true if UDP socket is connected, false if shared listener socket
+	recvQueue    chan []byte  // for listener connections
+	closed       int32        // atomic flag: 1 if connection is closed, 0 otherwise
+	closeOnce    sync.Once    // ensures channel is closed only once
+	readDeadline readDeadline // for listener connections
 }
 
 // Listener accepts and dispatches fake TCP connections
@@ -425,7 +427,7 @@ func (c *Conn) WritePacket(data []byte) error {
 			_, err = c.udpConn.WriteToUDP(packet, c.remoteAddr)
 		}
 		if err != nil {
-			return fmt.Errorf("failed to send packet: %v", err)
+			return fmt.Errorf("failed to send packet: %w", err)
 		}
 
 		// Update sequence number and counters
@@ -444,18 +446,25 @@ func (c *Conn) WritePacket(data []byte) error {
 func (c *Conn) ReadPacket() ([]byte, error) {
 	if !c.isConnected {
 		// Listener connection - read from queue with proper closed check
+		timeout, changed := c.readDeadline.wait(ListenerReadTimeout)
+		if timeout <= 0 {
+			return nil, &net.OpError{Op: "read", Net: "udp", Err: os.ErrDeadlineExceeded}
+		}
 		select {
 		case payload, ok := <-c.recvQueue:
 			if !ok {
 				return nil, fmt.Errorf("connection closed")
 			}
 			return payload, nil
-		case <-time.After(ListenerReadTimeout):
+		case <-time.After(timeout):
 			// Check if closed during timeout (using atomic read)
 			if atomic.LoadInt32(&c.closed) != 0 {
 				return nil, fmt.Errorf("connection closed")
 			}
-			return nil, &net.OpError{Op: "read", Net: "udp", Err: fmt.Errorf("timeout")}
+			return nil, &net.OpError{Op: "read", Net: "udp", Err: os.ErrDeadlineExceeded}
+		case <-changed:
+			// The deadline moved; the caller re-checks and reads again
+			return nil, &net.OpError{Op: "read", Net: "udp", Err: os.ErrDeadlineExceeded}
 		}
 	}
 
@@ -710,8 +719,14 @@ func (c *Conn) SetDeadline(t time.Time) error {
 	return c.udpConn.SetDeadline(t)
 }
 
-// SetReadDeadline sets read deadline
+// SetReadDeadline sets read deadline. Listener connections share the
+// listener's socket, so their deadline only applies to their own queue;
+// setting it wakes a blocked ReadPacket with a timeout error.
 func (c *Conn) SetReadDeadline(t time.Time) error {
+	if !c.isConnected {
+		c.readDeadline.set(t)
+		return nil
+	}
 	return c.udpConn.SetReadDeadline(t)
 }
 
@@ -719,3 +734,38 @@ func (c *Conn) SetReadDeadline(t time.Time) error {
 func (c *Conn) SetWriteDeadline(t time.Time) error {
 	return c.udpConn.SetWriteDeadline(t)
 }
+
+// readDeadline is the read deadline of a connection whose ReadPacket waits
+// on a queue rather than a socket
+type readDeadline struct {
+	mu       sync.Mutex
+	deadline time.Time
+	changed  chan struct{} // Closed when the deadline is set
+}
+
+func (d *readDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deadline = t
+	if d.changed != nil {
+		close(d.changed)
+		d.changed = nil
+	}
+}
+
+// wait returns how long a read may block, at most timeout and not past the
+// deadline (<= 0 once it passed), and a channel closed when the deadline is
+// set again
+func (d *readDeadline) wait(timeout time.Duration) (time.Duration, <-chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.deadline.IsZero() {
+		if left := time.Until(d.deadline); left < timeout {
+			timeout = left
+		}
+	}
+	if d.changed == nil {
+		d.changed = make(chan struct{})
+	}
+	return timeout, d.changed
+}
@@ -2,17 +2,21 @@ package faketcp
 
 import (
 	"crypto/rand"
-	"encoding/binary"
 	"fmt"
 	"log"
 	"math/big"
 	"net"
+	"os"
+	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/openbmx/lightweight-tunnel/pkg/iptables"
+	"github.com/openbmx/lightweight-tunnel/pkg/nftables"
 	"github.com/openbmx/lightweight-tunnel/pkg/rawsocket"
+	"github.com/openbmx/lightweight-tunnel/pkg/rstfilter"
 )
 
 const (
@@ -29,18 +33,28 @@ type ConnRaw struct {
 	srcPort       uint16
 	dstPort       uint16
 	seqNum        uint32
-	ackNum        uint32
+	rcv           recvState // Receive sequence space, source of the ACK number
 	mu            sync.Mutex
 	isConnected   bool // true if client connection, false if server listener connection
 	recvQueue     chan []byte
 	closed        int32
-	closeOnce     sync.Once
-	iptablesMgr   *iptables.IPTablesManager
+	done          chan struct{} // Closed when either side closes the connection, ends ReadPacket
+	doneOnce      sync.Once
+	doneErr       error
+	finSent       bool           // Our FIN went out (guarded by mu)
+	finACKed      bool           // The peer acknowledged our FIN (guarded by mu)
+	peerFIN       bool           // The peer's FIN arrived (guarded by mu)
+	closeDone     chan struct{}  // Closed when both FINs are acknowledged
+	lastChallenge time.Time      // Last challenge ACK sent for a reset (guarded by mu)
+	ruleMgr       rstRuleManager // nil when the eBPF RST filter is used
+	rstFilter     *rstfilter.Filter
+	stack         *stackState // Per-connection state of the TCP stack profile
 	stopCh        chan struct{}
 	wg            sync.WaitGroup
 	isListener    bool      // true表示这是listener接受的连接，不需要启动recvLoop
-	ownsResources bool      // true表示拥有rawSocket和iptablesMgr的所有权，关闭时需要清理
+	ownsResources bool      // true表示拥有rawSocket和RST过滤（ruleMgr/rstFilter）的所有权，关闭时需要清理
 	lastActivity  time.Time // Last time this connection had activity (for cleanup)
+	readDeadline  readDeadline
 }
 
 // NewConnRaw creates a new raw socket connection
@@ -57,11 +71,18 @@ func NewConnRaw(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort ui
 		return nil, fmt.Errorf("failed to create raw socket: %v", err)
 	}
 
-	// Create iptables manager and add rules
-	iptablesMgr := iptables.NewIPTablesManager()
-	if err := iptablesMgr.AddRuleForPort(localPort, !isClient); err != nil {
+	// Keep the kernel from resetting the connection
+	rstFilter, ruleMgr, err := suppressRSTs(rawSock, localPort, !isClient)
+	if err != nil {
 		rawSock.Close()
-		return nil, fmt.Errorf("failed to add iptables rule: %v", err)
+		return nil, err
+	}
+	if rstFilter != nil {
+		if err := rstFilter.AddConn(localIP, localPort, remoteIP, remotePort); err != nil {
+			rstFilter.Close()
+			rawSock.Close()
+			return nil, fmt.Errorf("failed to add eBPF RST filter entry: %v", err)
+		}
 	}
 
 	conn := &ConnRaw{
@@ -73,15 +94,23 @@ func NewConnRaw(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort ui
 		srcPort:       localPort,
 		dstPort:       remotePort,
 		seqNum:        isn,
-		ackNum:        0,
 		isConnected:   false, // 握手未完成，初始为false
 		recvQueue:     make(chan []byte, rawRecvQueueSize),
-		iptablesMgr:   iptablesMgr,
+		done:          make(chan struct{}),
+		closeDone:     make(chan struct{}),
+		ruleMgr:       ruleMgr,
+		rstFilter:     rstFilter,
+		stack:         newStackState(TCPProfile),
 		stopCh:        make(chan struct{}),
 		isListener:    false,
 		ownsResources: true, // 客户端连接拥有资源所有权
 	}
 
+	// Re-add the rule if another tool removes it
+	if ruleMgr != nil {
+		go ruleMgr.MonitorAndReAdd(conn.stopCh)
+	}
+
 	// 只有客户端连接才启动recvLoop，服务端连接由acceptLoop统一分发
 	if isClient {
 		conn.wg.Add(1)
@@ -148,9 +177,6 @@ func DialRaw(remoteAddr string, timeout time.Duration) (*ConnRaw, error) {
 
 // performHandshake performs TCP three-way handshake
 func (c *ConnRaw) performHandshake(timeout time.Duration) error {
-	// Build TCP options
-	tcpOptions := c.buildTCPOptions()
-
 	// Retry mechanism for SYN
 	maxRetries := 3
 	retryInterval := 500 * time.Millisecond
@@ -161,8 +187,7 @@ func (c *ConnRaw) performHandshake(timeout time.Duration) error {
 		}
 
 		// Send SYN
-		err := c.rawSocket.SendPacket(c.localIP, c.localPort, c.remoteIP, c.remotePort,
-			c.seqNum, 0, SYN, tcpOptions, nil)
+		err := c.sendSegment(c.seqNum, SYN, nil)
 		if err != nil {
 			continue
 		}
@@ -183,11 +208,10 @@ func (c *ConnRaw) performHandshake(timeout time.Duration) error {
 				if hdr.Flags&(SYN|ACK) == (SYN | ACK) {
 					// Got SYN-ACK
 					c.seqNum++ // SYN consumes one sequence number
-					c.ackNum = hdr.SeqNum + 1
+					c.rcv.init(hdr.SeqNum + 1)
 
 					// Send ACK
-					err = c.rawSocket.SendPacket(c.localIP, c.localPort, c.remoteIP, c.remotePort,
-						c.seqNum, c.ackNum, ACK, tcpOptions, nil)
+					err = c.sendSegment(c.seqNum, ACK, nil)
 					if err != nil {
 						return fmt.Errorf("failed to send ACK: %v", err)
 					}
@@ -236,14 +260,20 @@ func (c *ConnRaw) recvLoop() {
 		// Set read timeout to allow checking stopCh
 		c.rawSocket.SetReadTimeout(0, 100000) // 100ms = 100000 microseconds
 
-		srcIP, srcPort, dstIP, dstPort, seq, ack, flags, payload, err := c.rawSocket.RecvPacket(buf)
+		seg, err := c.rawSocket.RecvSegment(buf)
 		if err != nil {
 			// Timeout or other errors - continue
 			continue
 		}
+		srcIP, srcPort, dstIP, dstPort := seg.SrcIP, seg.SrcPort, seg.DstIP, seg.DstPort
+		seq, flags, payload := seg.Seq, seg.Flags, seg.Payload
+
+		c.mu.Lock()
+		connected := c.isConnected
+		c.mu.Unlock()
 
 		// Filter packets: only accept packets for our connection
-		if c.isConnected {
+		if connected {
 			// Client mode: accept packets from server
 			if !srcIP.Equal(c.remoteIP) || srcPort != c.remotePort {
 				continue
@@ -257,54 +287,31 @@ func (c *ConnRaw) recvLoop() {
 				continue
 			}
 		}
+		pawsOK := c.stack.onReceive(flags, seq, c.rcv.lastAckSent(), seg.Options)
 
-		// Update ack number and immediately acknowledge payload to keep TCP disguise realistic
-		if len(payload) > 0 {
-			c.mu.Lock()
-			c.ackNum = seq + uint32(len(payload))
-			ackToSend := c.ackNum
-			seqToUse := c.seqNum
-			c.mu.Unlock()
-
-			if c.isConnected {
-				if err := c.rawSocket.SendPacket(c.localIP, c.srcPort, c.remoteIP, c.dstPort,
-					seqToUse, ackToSend, ACK, c.buildTCPOptions(), nil); err != nil {
-					log.Printf("Failed to send ACK to %s:%d: %v", c.remoteIP, c.remotePort, err)
+		if connected {
+			if flags&RST != 0 {
+				if c.onRST(seq, flags) {
+					log.Printf("Received RST from %s:%d, closing connection", srcIP, srcPort)
 				}
+				continue
+			}
+			if flags&ACK != 0 {
+				c.onACK(seg.Ack)
+			}
+			// Track and acknowledge payload like a receiving stack, dropping duplicates
+			if len(payload) > 0 && c.handleData(seq, payload, pawsOK) {
+				c.queueSegment(seg)
+			}
+			if flags&FIN != 0 && pawsOK {
+				log.Printf("Received FIN from %s:%d, closing connection", srcIP, srcPort)
+				c.onPeerFIN(seq, len(payload))
 			}
-		}
-
-		// 只在已连接状态下过滤payload=0的包
-		// 握手期间（!isConnected）需要处理SYN-ACK等控制包
-		if c.isConnected && len(payload) == 0 {
 			continue
 		}
 
-		// Build packet data including TCP header for compatibility
-		// Format: TCP header + payload
-		tcpHdr := &TCPHeader{
-			SrcPort:    srcPort,
-			DstPort:    dstPort,
-			SeqNum:     seq,
-			AckNum:     ack,
-			DataOffset: 5,
-			Flags:      flags,
-			Window:     65535,
-		}
-
-		headerBytes := serializeTCPHeaderStatic(tcpHdr)
-		fullData := make([]byte, len(headerBytes)+len(payload))
-		copy(fullData, headerBytes)
-		copy(fullData[len(headerBytes):], payload)
-
-		// Queue received data
-		if atomic.LoadInt32(&c.closed) == 0 {
-			select {
-			case c.recvQueue <- fullData:
-			default:
-				// Queue full, drop packet
-			}
-		}
+		// 握手期间（!isConnected）需要处理SYN-ACK等控制包
+		c.queueSegment(seg)
 	}
 }
 
@@ -336,11 +343,9 @@ func (c *ConnRaw) WritePacket(data []byte) error {
 		}
 		segment := data[offset:end]
 
-		tcpOptions := c.buildTCPOptions()
-		err := c.rawSocket.SendPacket(c.localIP, c.srcPort, c.remoteIP, c.dstPort,
-			c.seqNum, c.ackNum, PSH|ACK, tcpOptions, segment)
+		err := c.sendSegment(c.seqNum, PSH|ACK, segment)
 		if err != nil {
-			return fmt.Errorf("failed to send packet: %v", err)
+			return fmt.Errorf("failed to send packet: %w", err)
 		}
 
 		c.seqNum += uint32(len(segment))
@@ -351,95 +356,127 @@ func (c *ConnRaw) WritePacket(data []byte) error {
 
 // ReadPacket receives data (API compatibility)
 func (c *ConnRaw) ReadPacket() ([]byte, error) {
+	timeout := 30 * time.Second // 30秒超时，适合隧道长连接
 	if !c.isConnected {
-		// Listener connection - read from queue
-		select {
-		case data, ok := <-c.recvQueue:
-			if !ok {
-				return nil, fmt.Errorf("connection closed")
-			}
-			// Extract payload (skip TCP header)
-			if len(data) < TCPHeaderSize {
-				return nil, fmt.Errorf("invalid packet")
-			}
-			hdr := parseTCPHeader(data)
-			if hdr == nil {
-				return nil, fmt.Errorf("failed to parse TCP header")
-			}
-			headerLen := int(hdr.DataOffset) * 4
-			if headerLen < TCPHeaderSize {
-				headerLen = TCPHeaderSize
-			}
-			if len(data) <= headerLen {
-				// No payload, return empty
-				return []byte{}, nil
-			}
-			return data[headerLen:], nil
-		case <-time.After(ListenerReadTimeout):
-			if atomic.LoadInt32(&c.closed) != 0 {
-				return nil, fmt.Errorf("connection closed")
-			}
-			return nil, &net.OpError{Op: "read", Net: "tcp", Err: fmt.Errorf("timeout")}
-		}
+		// Listener connection
+		timeout = ListenerReadTimeout
 	}
 
-	// Connected socket - read from queue
+	timeout, changed := c.readDeadline.wait(timeout)
+	if timeout <= 0 {
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	}
+
+	var data []byte
 	select {
-	case data, ok := <-c.recvQueue:
-		if !ok {
-			return nil, fmt.Errorf("connection closed")
-		}
-		// Extract payload
-		if len(data) < TCPHeaderSize {
-			return nil, fmt.Errorf("invalid packet")
-		}
-		hdr := parseTCPHeader(data)
-		if hdr == nil {
-			return nil, fmt.Errorf("failed to parse TCP header")
-		}
-		headerLen := int(hdr.DataOffset) * 4
-		if headerLen < TCPHeaderSize {
-			headerLen = TCPHeaderSize
-		}
-		if len(data) <= headerLen {
-			return []byte{}, nil
+	case data = <-c.recvQueue:
+	case <-c.done:
+		// 先交付关闭前已到达的数据
+		select {
+		case data = <-c.recvQueue:
+		default:
+			return nil, c.doneErr
 		}
-		return data[headerLen:], nil
-	case <-time.After(30 * time.Second): // 30秒超时，适合隧道长连接
-		return nil, &net.OpError{Op: "read", Net: "tcp", Err: fmt.Errorf("timeout")}
+	case <-time.After(timeout):
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	case <-changed:
+		// The deadline moved; the caller re-checks and reads again
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
 	}
-}
 
-// buildTCPOptions builds TCP options
-func (c *ConnRaw) buildTCPOptions() []byte {
-	opts := make([]byte, 0)
-
-	// MSS
-	mssOpt := make([]byte, 4)
-	mssOpt[0] = 2
-	mssOpt[1] = 4
-	binary.BigEndian.PutUint16(mssOpt[2:], 1460)
-	opts = append(opts, mssOpt...)
+	// Extract payload (skip TCP header)
+	if len(data) < TCPHeaderSize {
+		return nil, fmt.Errorf("invalid packet")
+	}
+	hdr := parseTCPHeader(data)
+	if hdr == nil {
+		return nil, fmt.Errorf("failed to parse TCP header")
+	}
+	headerLen := int(hdr.DataOffset) * 4
+	if headerLen < TCPHeaderSize {
+		headerLen = TCPHeaderSize
+	}
+	if len(data) <= headerLen {
+		// No payload, return empty
+		return []byte{}, nil
+	}
+	return data[headerLen:], nil
+}
 
-	// NOP
-	opts = append(opts, 1)
+// sendSegment sends a segment of the connection with the options and
+// header fields of its stack profile. Segments with ACK set acknowledge all
+// data received in order so far.
+func (c *ConnRaw) sendSegment(seq uint32, flags uint8, payload []byte) error {
+	var ack uint32
+	if flags&ACK != 0 {
+		ack = c.rcv.acknowledge()
+	}
+	fields := c.stack.headerFields(flags)
+	if flags&SYN == 0 {
+		// Advertise the room left in the receive queue
+		free := cap(c.recvQueue) - len(c.recvQueue)
+		fields.Window = uint16(int(fields.Window) * free / cap(c.recvQueue))
+	}
+	return c.rawSocket.SendSegment(c.localIP, c.srcPort, c.remoteIP, c.dstPort,
+		seq, ack, flags, fields, c.stack.options(flags), payload)
+}
 
-	// Window scale
-	opts = append(opts, 3, 3, 7)
+// handleData tracks the sequence range of a received payload and
+// acknowledges it: duplicates and out-of-order data at once, in-order data
+// every second segment or after the delayed ACK timeout. A segment failing
+// PAWS is not acknowledged, but its data is still delivered if new: fake-TCP
+// peers never retransmit, so it cannot be had again. It reports whether the
+// payload is new.
+func (c *ConnRaw) handleData(seq uint32, payload []byte, pawsOK bool) bool {
+	isNew, ackNow := c.rcv.receive(seq, len(payload), time.Now())
+	if !pawsOK {
+		return isNew
+	}
+	if ackNow {
+		c.sendACK()
+	} else {
+		c.rcv.delayACK(c.sendACK)
+	}
+	return isNew
+}
 
-	// SACK permitted
-	opts = append(opts, 4, 2)
+// sendACK sends a pure ACK
+func (c *ConnRaw) sendACK() {
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return
+	}
+	c.mu.Lock()
+	seq := c.seqNum
+	c.mu.Unlock()
+	if err := c.sendSegment(seq, ACK, nil); err != nil {
+		log.Printf("Failed to send ACK to %s:%d: %v", c.remoteIP, c.remotePort, err)
+	}
+}
 
-	// Timestamp
-	tsOpt := make([]byte, 10)
-	tsOpt[0] = 8
-	tsOpt[1] = 10
-	binary.BigEndian.PutUint32(tsOpt[2:], uint32(time.Now().Unix()))
-	binary.BigEndian.PutUint32(tsOpt[6:], 0)
-	opts = append(opts, 1) // NOP before TS
-	opts = append(opts, tsOpt...)
+// queueSegment hands a received segment to the reader as TCP header plus
+// payload
+func (c *ConnRaw) queueSegment(seg *rawsocket.Segment) {
+	tcpHdr := &TCPHeader{
+		SrcPort:    seg.SrcPort,
+		DstPort:    seg.DstPort,
+		SeqNum:     seg.Seq,
+		AckNum:     seg.Ack,
+		DataOffset: 5,
+		Flags:      seg.Flags,
+		Window:     seg.Window,
+	}
+	headerBytes := serializeTCPHeaderStatic(tcpHdr)
+	fullData := make([]byte, len(headerBytes)+len(seg.Payload))
+	copy(fullData, headerBytes)
+	copy(fullData[len(headerBytes):], seg.Payload)
 
-	return opts
+	if atomic.LoadInt32(&c.closed) == 0 {
+		select {
+		case c.recvQueue <- fullData:
+		default:
+			// Queue full, drop packet
+		}
+	}
 }
 
 // Close closes the connection
@@ -448,13 +485,34 @@ func (c *ConnRaw) Close() error {
 		return nil
 	}
 
-	// Send FIN
+	c.shutdown(errConnClosed)
+	c.rcv.stop()
+
+	// Send FIN. A listener connection leaves the rest of the closing
+	// handshake and TIME_WAIT to the listener; a client waits for it here
+	// while recvLoop answers the peer, and if it closed first stays in
+	// TIME_WAIT in the background.
 	c.mu.Lock()
-	tcpOptions := c.buildTCPOptions()
-	c.rawSocket.SendPacket(c.localIP, c.srcPort, c.remoteIP, c.dstPort,
-		c.seqNum, c.ackNum, FIN|ACK, tcpOptions, nil)
+	first := !c.peerFIN
 	c.mu.Unlock()
+	c.sendFIN()
+	if c.ownsResources && c.isConnected {
+		select {
+		case <-c.closeDone:
+			if first {
+				time.AfterFunc(timeWaitDuration, c.release)
+				return nil
+			}
+		case <-time.After(finWaitTimeout):
+		}
+	}
 
+	c.release()
+	return nil
+}
+
+// release stops the receive loop and frees the resources the connection owns
+func (c *ConnRaw) release() {
 	// Stop receive loop
 	close(c.stopCh)
 	c.wg.Wait()
@@ -466,18 +524,16 @@ func (c *ConnRaw) Close() error {
 			log.Printf("Error closing raw socket: %v", err)
 		}
 
-		// Remove iptables rules
-		if err := c.iptablesMgr.RemoveAllRules(); err != nil {
-			log.Printf("Error removing iptables rules: %v", err)
+		// Remove RST suppression
+		if c.rstFilter != nil {
+			c.rstFilter.Close()
+		}
+		if c.ruleMgr != nil {
+			if err := c.ruleMgr.RemoveAllRules(); err != nil {
+				log.Printf("Error removing firewall rules: %v", err)
+			}
 		}
 	}
-
-	// Close receive queue
-	c.closeOnce.Do(func() {
-		close(c.recvQueue)
-	})
-
-	return nil
 }
 
 // LocalAddr returns local address
@@ -496,13 +552,16 @@ func (c *ConnRaw) RemoteAddr() net.Addr {
 	}
 }
 
-// SetDeadline sets read and write deadlines (no-op for raw sockets)
+// SetDeadline sets the read deadline; writes never block on raw sockets
 func (c *ConnRaw) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
 	return nil
 }
 
-// SetReadDeadline sets read deadline (no-op for raw sockets)
+// SetReadDeadline sets the read deadline. Setting it wakes a blocked
+// ReadPacket with a timeout error.
 func (c *ConnRaw) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
 	return nil
 }
 
@@ -519,22 +578,30 @@ func randomUint32Value() uint32 {
 
 // ListenerRaw listens for raw socket connections
 type ListenerRaw struct {
-	rawSocket   *rawsocket.RawSocket
-	localIP     net.IP
-	localPort   uint16
-	connMap     map[string]*ConnRaw
-	mu          sync.RWMutex
-	iptablesMgr *iptables.IPTablesManager
-	acceptQueue chan *ConnRaw
-	stopCh      chan struct{}
-	wg          sync.WaitGroup
+	rawSocket     *rawsocket.RawSocket
+	localIP       net.IP
+	localPort     uint16
+	connMap       map[string]*ConnRaw
+	timeWait      map[string]*timeWaitConn // Closed connections answering retransmissions
+	halfOpen      map[string]*halfOpenConn // Peers sent a SYN-ACK, let through the socket filter
+	halfOpenPerIP map[string]int
+	cookies       *synCookies
+	counters      listenerCounters
+	resets        int       // Resets sent to unknown peers since resetsSince
+	resetsSince   time.Time // Start of the current second of resets
+	mu            sync.RWMutex
+	ruleMgr       rstRuleManager // nil when the eBPF RST filter is used
+	rstFilter     *rstfilter.Filter
+	acceptQueue   chan *ConnRaw
+	stopCh        chan struct{}
+	wg            sync.WaitGroup
 }
 
 const (
 	// staleConnectionTimeout defines how long a connection can be idle before being cleaned up
 	staleConnectionTimeout = 60 * time.Second
 	// cleanupInterval defines how often to run the connection cleanup
-	cleanupInterval = 30 * time.Second
+	cleanupInterval = 10 * time.Second
 	// shutdownTimeout is the maximum time to wait for goroutines during listener shutdown
 	shutdownTimeout = 3 * time.Second
 )
@@ -566,21 +633,43 @@ func ListenRaw(addr string) (*ListenerRaw, error) {
 		return nil, fmt.Errorf("failed to create raw socket: %v", err)
 	}
 
-	// Create iptables manager and add rules
-	iptablesMgr := iptables.NewIPTablesManager()
-	if err := iptablesMgr.AddRuleForPort(localPort, true); err != nil {
+	// Receive through a TPACKET_V3 ring where available
+	if err := rawSock.EnableRing(); err != nil {
+		log.Printf("⚠️  TPACKET_V3 receive ring unavailable (%v), using recvfrom", err)
+	} else {
+		log.Printf("✅ TPACKET_V3 receive ring enabled for port %d", localPort)
+	}
+
+	// Keep the kernel from resetting connections
+	rstFilter, ruleMgr, err := suppressRSTs(rawSock, localPort, true)
+	if err != nil {
 		rawSock.Close()
-		return nil, fmt.Errorf("failed to add iptables rule: %v", err)
+		return nil, err
 	}
 
 	listener := &ListenerRaw{
-		rawSocket:   rawSock,
-		localIP:     localIP,
-		localPort:   localPort,
-		connMap:     make(map[string]*ConnRaw),
-		iptablesMgr: iptablesMgr,
-		acceptQueue: make(chan *ConnRaw, 10),
-		stopCh:      make(chan struct{}),
+		rawSocket:     rawSock,
+		localIP:       localIP,
+		localPort:     localPort,
+		connMap:       make(map[string]*ConnRaw),
+		timeWait:      make(map[string]*timeWaitConn),
+		halfOpen:      make(map[string]*halfOpenConn),
+		halfOpenPerIP: make(map[string]int),
+		cookies:       newSYNCookies(),
+		ruleMgr:       ruleMgr,
+		rstFilter:     rstFilter,
+		acceptQueue:   make(chan *ConnRaw, acceptBacklog),
+		stopCh:        make(chan struct{}),
+	}
+
+	// Only SYNs pass the kernel filter until connections are tracked
+	listener.mu.Lock()
+	listener.updateFilterLocked()
+	listener.mu.Unlock()
+
+	// Re-add the rule if another tool removes it
+	if ruleMgr != nil {
+		go ruleMgr.MonitorAndReAdd(listener.stopCh)
 	}
 
 	// Start accept loop
@@ -608,10 +697,12 @@ func (l *ListenerRaw) acceptLoop() {
 		}
 
 		l.rawSocket.SetReadTimeout(0, 100000) // 100ms
-		srcIP, srcPort, dstIP, dstPort, seq, ack, flags, payload, err := l.rawSocket.RecvPacket(buf)
+		seg, err := l.rawSocket.RecvSegment(buf)
 		if err != nil {
 			continue
 		}
+		srcIP, srcPort, dstPort := seg.SrcIP, seg.SrcPort, seg.DstPort
+		seq, flags, payload := seg.Seq, seg.Flags, seg.Payload
 
 		// Filter packets for our port
 		if dstPort != l.localPort {
@@ -623,95 +714,46 @@ func (l *ListenerRaw) acceptLoop() {
 		l.mu.Lock()
 		conn, exists := l.connMap[connKey]
 
-		// Remove stale closed connection entries to allow reconnection from the same peer
+		// Closed connections go to TIME_WAIT, which answers their last segments
 		if exists && atomic.LoadInt32(&conn.closed) != 0 {
-			delete(l.connMap, connKey)
+			l.enterTimeWaitLocked(connKey)
 			conn = nil
 			exists = false
 		}
-
-		// 1. 处理新连接的SYN
-		if !exists && (flags&SYN != 0) && (flags&ACK == 0) {
-			isn, _ := randomUint32()
-
-			newConn := &ConnRaw{
-				rawSocket:     l.rawSocket,
-				localIP:       dstIP,
-				localPort:     dstPort,
-				remoteIP:      srcIP,
-				remotePort:    srcPort,
-				srcPort:       dstPort,
-				dstPort:       srcPort,
-				seqNum:        isn,
-				ackNum:        seq + 1,
-				isConnected:   false,
-				recvQueue:     make(chan []byte, rawRecvQueueSize),
-				iptablesMgr:   l.iptablesMgr,
-				stopCh:        make(chan struct{}),
-				isListener:    true,
-				ownsResources: false,      // 服务端连接不拥有资源（共享）
-				lastActivity:  time.Now(), // Initialize lastActivity
-			}
-
-			// Send SYN-ACK
-			tcpOptions := newConn.buildTCPOptions()
-			err := l.rawSocket.SendPacket(dstIP, dstPort, srcIP, srcPort,
-				newConn.seqNum, newConn.ackNum, SYN|ACK, tcpOptions, nil)
-			if err != nil {
+		if tw, ok := l.timeWait[connKey]; ok && !exists {
+			if flags&SYN == 0 || flags&ACK != 0 {
+				l.timeWaitSegmentLocked(connKey, tw, seq, flags, len(payload))
 				l.mu.Unlock()
 				continue
 			}
+			// A new SYN from the same peer ends TIME_WAIT
+			l.removeTimeWaitLocked(connKey)
+		}
 
-			newConn.seqNum++ // SYN consumes sequence number
-			l.connMap[connKey] = newConn
+		// 1. 新连接的SYN：无状态地用cookie应答
+		if !exists && (flags&SYN != 0) && (flags&ACK == 0) {
+			l.handleSYNLocked(connKey, seg)
 			l.mu.Unlock()
 			continue
 		}
 
-		// 2. 处理握手的ACK（第三次握手）
-		if exists && !conn.isConnected && (flags&ACK != 0) && (flags&SYN == 0) {
-			conn.isConnected = true
-			conn.mu.Lock()
-			conn.ackNum = seq + uint32(len(payload))
-			conn.lastActivity = time.Now()
-			conn.mu.Unlock()
+		// 2. 第三次握手的ACK：cookie有效才建立连接
+		if !exists && flags&(SYN|ACK|RST|FIN) == ACK {
+			conn = l.handleCookieLocked(connKey, seg)
 			l.mu.Unlock()
-
-			// 放入acceptQueue（非阻塞方式）
-			go func(c *ConnRaw) {
-				select {
-				case l.acceptQueue <- c:
-				case <-time.After(2 * time.Second):
-					l.mu.Lock()
-					delete(l.connMap, connKey)
-					l.mu.Unlock()
-				}
-			}(conn)
-
 			// 如果ACK带了数据，也要处理
-			if len(payload) > 0 {
-				tcpHdr := &TCPHeader{
-					SrcPort:    srcPort,
-					DstPort:    dstPort,
-					SeqNum:     seq,
-					AckNum:     ack,
-					DataOffset: 5,
-					Flags:      flags,
-					Window:     65535,
-				}
-				headerBytes := serializeTCPHeaderStatic(tcpHdr)
-				fullData := make([]byte, len(headerBytes)+len(payload))
-				copy(fullData, headerBytes)
-				copy(fullData[len(headerBytes):], payload)
-
-				select {
-				case conn.recvQueue <- fullData:
-				default:
-				}
+			if conn != nil && len(payload) > 0 &&
+				conn.handleData(seq, payload, conn.stack.onReceive(flags, seq, conn.rcv.lastAckSent(), seg.Options)) {
+				conn.queueSegment(seg)
 			}
 			continue
 		}
 
+		pawsOK := true
+		if exists {
+			pawsOK = conn.stack.onReceive(flags, seq, conn.rcv.lastAckSent(), seg.Options)
+		}
+
 		// 3. 处理已连接的数据包
 		if exists && conn.isConnected {
 			// Update last activity time for all packets (including control packets)
@@ -719,85 +761,44 @@ func (l *ListenerRaw) acceptLoop() {
 			conn.lastActivity = time.Now()
 			conn.mu.Unlock()
 
-			// Handle FIN packets (connection close)
-			// Note: We ignore RST packets from clients in raw socket mode because they
-			// are often false positives from the kernel or network middleboxes (especially
-			// on macOS). Only FIN packets are used for graceful connection closure.
-			if flags&FIN != 0 {
-				// Connection is being closed gracefully
-				log.Printf("Received FIN from %s:%d, closing connection", srcIP, srcPort)
-
-				// Mark connection as closed
-				atomic.StoreInt32(&conn.closed, 1)
-
-				// Send ACK for FIN
-				conn.mu.Lock()
-				conn.ackNum = seq + 1 // FIN consumes one sequence number
-				ackToSend := conn.ackNum
-				seqToUse := conn.seqNum
-				conn.mu.Unlock()
-
-				if err := l.rawSocket.SendPacket(conn.localIP, conn.srcPort, conn.remoteIP, conn.dstPort,
-					seqToUse, ackToSend, ACK, conn.buildTCPOptions(), nil); err != nil {
-					log.Printf("Failed to send ACK for FIN to %s:%d: %v", conn.remoteIP, conn.remotePort, err)
+			// Only RST+ACK at the expected sequence number closes the connection;
+			// plain RSTs are often false positives from the kernel (especially on macOS)
+			if flags&RST != 0 {
+				if conn.onRST(seq, flags) {
+					log.Printf("Received RST from %s:%d, closing connection", srcIP, srcPort)
+					l.removeConnLocked(connKey)
+					l.updateFilterLocked()
 				}
-
-				// Remove from connection map
-				delete(l.connMap, connKey)
 				l.mu.Unlock()
 				continue
 			}
-
-			// Ignore RST packets - they are often false positives in raw socket mode
-			if flags&RST != 0 {
-				// Log but don't close connection - RST is often from kernel/middleboxes
-				// Connection will be cleaned up by timeout if it's actually dead
-				l.mu.Unlock()
-				continue
+			if flags&ACK != 0 {
+				conn.onACK(seg.Ack)
 			}
 
 			// 只处理有实际数据的包，忽略纯ACK、keepalive等控制包
-			if len(payload) > 0 {
-				conn.mu.Lock()
-				conn.ackNum = seq + uint32(len(payload))
-				conn.lastActivity = time.Now()
-				ackToSend := conn.ackNum
-				seqToUse := conn.seqNum
-				conn.mu.Unlock()
-
-				// 立即回 ACK，避免长时间无反向流量导致被误判为异常
-				if err := l.rawSocket.SendPacket(conn.localIP, conn.srcPort, conn.remoteIP, conn.dstPort,
-					seqToUse, ackToSend, ACK, conn.buildTCPOptions(), nil); err != nil {
-					log.Printf("Failed to send ACK to %s:%d: %v", conn.remoteIP, conn.remotePort, err)
-				}
-
-				tcpHdr := &TCPHeader{
-					SrcPort:    srcPort,
-					DstPort:    dstPort,
-					SeqNum:     seq,
-					AckNum:     ack,
-					DataOffset: 5,
-					Flags:      flags,
-					Window:     65535,
-				}
-
-				headerBytes := serializeTCPHeaderStatic(tcpHdr)
-				fullData := make([]byte, len(headerBytes)+len(payload))
-				copy(fullData, headerBytes)
-				copy(fullData[len(headerBytes):], payload)
+			// 按序号跟踪并确认（累计/延迟 ACK），重复包只回 ACK 不再上交
+			if len(payload) > 0 && conn.handleData(seq, payload, pawsOK) {
+				conn.queueSegment(seg)
+			}
 
-				select {
-				case conn.recvQueue <- fullData:
-				default:
-					// 队列满，丢弃
+			// FIN: acknowledge it and end ReadPacket so the tunnel closes the
+			// connection, whose own FIN then completes the teardown
+			if flags&FIN != 0 && pawsOK {
+				log.Printf("Received FIN from %s:%d, closing connection", srcIP, srcPort)
+				if conn.onPeerFIN(seq, len(payload)) {
+					// We closed first
+					l.enterTimeWaitLocked(connKey)
 				}
 			}
-			// FIN/RST包不需要放入queue，连接关闭会由其他机制处理
 			l.mu.Unlock()
 			continue
 		}
 
-		// 其他情况：未知连接或无效状态的包，直接忽略
+		// 其他情况：未知连接的包，用RST告知对端连接已不存在
+		if !exists {
+			l.resetUnknownLocked(seg)
+		}
 		l.mu.Unlock()
 	}
 }
@@ -806,15 +807,8 @@ func (l *ListenerRaw) acceptLoop() {
 func (l *ListenerRaw) Accept() (*ConnRaw, error) {
 	select {
 	case conn := <-l.acceptQueue:
-		// 清空握手期间积压的控制包
-		for {
-			select {
-			case <-conn.recvQueue:
-				// 丢弃
-			default:
-				return conn, nil
-			}
-		}
+		// acceptLoop只把数据放入recvQueue，握手后到达的数据已被确认，不能丢弃
+		return conn, nil
 	case <-l.stopCh:
 		return nil, fmt.Errorf("listener closed")
 	}
@@ -826,6 +820,7 @@ func (l *ListenerRaw) cleanupLoop() {
 
 	ticker := time.NewTicker(cleanupInterval)
 	defer ticker.Stop()
+	var stats ListenerStats
 
 	for {
 		select {
@@ -833,6 +828,9 @@ func (l *ListenerRaw) cleanupLoop() {
 			return
 		case <-ticker.C:
 			l.cleanupStaleConnections()
+			l.expireTimeWait(time.Now())
+			l.expireHalfOpen(time.Now())
+			l.logStats(&stats)
 		}
 	}
 }
@@ -869,7 +867,7 @@ func (l *ListenerRaw) cleanupStaleConnections() {
 			if conn, exists := l.connMap[key]; exists {
 				// Double-check the connection is still stale
 				if atomic.LoadInt32(&conn.closed) != 0 {
-					delete(l.connMap, key)
+					l.enterTimeWaitLocked(key)
 					continue
 				}
 				conn.mu.Lock()
@@ -878,15 +876,62 @@ func (l *ListenerRaw) cleanupStaleConnections() {
 				if !lastActivity.IsZero() && now.Sub(lastActivity) > staleConnectionTimeout {
 					// Close the stale connection
 					atomic.StoreInt32(&conn.closed, 1)
-					delete(l.connMap, key)
+					l.removeConnLocked(key)
 					log.Printf("Cleaned up stale connection from %s (idle for %v)", key, now.Sub(lastActivity))
 				}
 			}
 		}
+		l.updateFilterLocked()
 		l.mu.Unlock()
 	}
 }
 
+// removeConnLocked removes a connection from connMap and stops suppressing
+// the kernel's RSTs for it. Must be called with l.mu held.
+func (l *ListenerRaw) removeConnLocked(key string) {
+	conn, exists := l.connMap[key]
+	if !exists {
+		return
+	}
+	delete(l.connMap, key)
+	l.unfilterConn(key, conn)
+}
+
+// unfilterConn stops suppressing the kernel's RSTs for a connection
+func (l *ListenerRaw) unfilterConn(key string, conn *ConnRaw) {
+	if l.rstFilter != nil {
+		if err := l.rstFilter.RemoveConn(conn.localIP, conn.localPort, conn.remoteIP, conn.remotePort); err != nil {
+			log.Printf("⚠️  Failed to remove eBPF RST filter entry for %s: %v", key, err)
+		}
+	}
+}
+
+// updateFilterLocked updates the kernel socket filter to the current set of
+// connections, including those in TIME_WAIT and half-open ones: segments from
+// known peers pass, SYNs from anyone, and a sample of the other segments to
+// answer with a reset. While the half-open table is full
+// the filter passes the whole port, so that peers answered without an entry
+// can complete the handshake. Must be called with l.mu held.
+func (l *ListenerRaw) updateFilterLocked() {
+	var peers []rawsocket.Endpoint
+	n := len(l.connMap) + len(l.timeWait) + len(l.halfOpen)
+	if n <= rawsocket.MaxFilterPeers && len(l.halfOpen) < maxHalfOpen {
+		peers = make([]rawsocket.Endpoint, 0, n)
+		for _, conn := range l.connMap {
+			peers = append(peers, rawsocket.Endpoint{IP: conn.remoteIP, Port: conn.remotePort})
+		}
+		for _, tw := range l.timeWait {
+			peers = append(peers, rawsocket.Endpoint{IP: tw.conn.remoteIP, Port: tw.conn.remotePort})
+		}
+		for _, ho := range l.halfOpen {
+			peers = append(peers, rawsocket.Endpoint{IP: ho.ip, Port: ho.port})
+		}
+	}
+	if err := l.rawSocket.SetPeerFilter(peers, true, unknownSample); err != nil && runtime.GOOS == "linux" {
+		log.Printf("⚠️  Failed to update socket filter: %v", err)
+	}
+}
+
 // Close closes the listener
 func (l *ListenerRaw) Close() error {
 	close(l.stopCh)
@@ -905,9 +950,14 @@ func (l *ListenerRaw) Close() error {
 		log.Printf("Timeout waiting for listener goroutines to stop; continuing shutdown")
 	}
 
-	// Remove iptables rules
-	if err := l.iptablesMgr.RemoveAllRules(); err != nil {
-		log.Printf("Error removing iptables rules: %v", err)
+	// Remove RST suppression
+	if l.rstFilter != nil {
+		l.rstFilter.Close()
+	}
+	if l.ruleMgr != nil {
+		if err := l.ruleMgr.RemoveAllRules(); err != nil {
+			log.Printf("Error removing firewall rules: %v", err)
+		}
 	}
 
 	// Close raw socket
@@ -921,3 +971,110 @@ func (l *ListenerRaw) Addr() net.Addr {
 		Port: int(l.localPort),
 	}
 }
+
+// rstRuleManager is a firewall backend holding drop-RST rules
+type rstRuleManager interface {
+	AddRuleForPort(port uint16, isServer bool) error
+	RemoveAllRules() error
+	MonitorAndReAdd(stopCh <-chan struct{})
+}
+
+// suppressRSTs keeps the kernel from answering segments on localPort with
+// RSTs: with the eBPF RST filter selected and loadable, through a TC egress
+// program whose connection map the caller fills in, otherwise with a
+// firewall rule for the whole port. The rule skips segments sent from
+// rawSock, which are marked so that our own RSTs still get out.
+func suppressRSTs(rawSock *rawsocket.RawSocket, localPort uint16, isServer bool) (*rstfilter.Filter, rstRuleManager, error) {
+	if RSTFilterMode == RSTFilterEBPF {
+		filter, err := rstfilter.New()
+		if err == nil && isServer {
+			if err = filter.AddListener(localPort); err != nil {
+				filter.Close()
+			}
+		}
+		if err == nil {
+			log.Printf("✅ eBPF RST filter enabled for port %d", localPort)
+			return filter, nil, nil
+		}
+		log.Printf("⚠️  eBPF RST filter unavailable (%v), falling back to firewall rules", err)
+	}
+
+	if err := rawSock.SetMark(iptables.OwnMark); err != nil {
+		return nil, nil, fmt.Errorf("failed to mark raw socket: %v", err)
+	}
+	ruleMgr, err := newRuleManager()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ruleMgr.AddRuleForPort(localPort, isServer); err != nil {
+		ruleMgr.RemoveAllRules()
+		return nil, nil, fmt.Errorf("failed to add firewall rule: %v", err)
+	}
+	return nil, ruleMgr, nil
+}
+
+// newRuleManager creates a rule manager for the selected firewall backend.
+// In auto mode a failure to set up nftables falls back to iptables.
+func newRuleManager() (rstRuleManager, error) {
+	if useNFTables() {
+		mgr, err := nftables.NewNFTablesManager()
+		if err == nil {
+			return mgr, nil
+		}
+		if FirewallBackendMode == FirewallNFTables {
+			return nil, err
+		}
+		log.Printf("⚠️  nftables unavailable (%v), falling back to iptables", err)
+	}
+	return iptables.NewIPTablesManager(), nil
+}
+
+// useNFTables reports whether drop-RST rules go to nftables
+func useNFTables() bool {
+	switch FirewallBackendMode {
+	case FirewallNFTables:
+		return true
+	case FirewallIPTables:
+		return false
+	}
+	return runtime.GOOS == "linux" && nftables.CheckNFTablesAvailable() == nil
+}
+
+// CleanupRules removes drop-RST rules left behind by processes that are no
+// longer running (e.g. killed before they could clean up), or with all set
+// every rule tagged by any instance, from both firewall backends. It returns
+// the number of rules removed.
+func CleanupRules(all bool) (int, error) {
+	removed := 0
+	var errs []string
+	if runtime.GOOS == "linux" && nftables.CheckNFTablesAvailable() == nil {
+		n, err := nftables.CleanupRules(all)
+		removed += n
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("nftables: %v", err))
+		}
+	}
+	if runtime.GOOS == "linux" && iptables.CheckIPTablesAvailable() == nil {
+		n, err := iptables.CleanupRules(all)
+		removed += n
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("iptables: %v", err))
+		}
+	}
+	if len(errs) > 0 {
+		return removed, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	iptables.RemoveStaleLocks()
+	return removed, nil
+}
+
+// checkFirewall checks that the selected firewall backend can be used
+func checkFirewall() error {
+	if useNFTables() {
+		return nftables.CheckNFTablesAvailable()
+	}
+	if err := iptables.CheckIPTablesAvailable(); err != nil {
+		return fmt.Errorf("iptables not available: %v", err)
+	}
+	return nil
+}
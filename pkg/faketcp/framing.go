@@ -0,0 +1,630 @@
+package faketcp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Framing makes the payload of fake-TCP segments look like a known protocol
+// instead of bare ciphertext. The client opens with a handshake of that
+// protocol, and after it every packet travels in one record or frame of it,
+// so a segment still carries exactly one packet.
+type Framing int
+
+const (
+	// FramingNone sends packets as they are
+	FramingNone Framing = iota
+	// FramingTLS looks like a TLS 1.3 session: ClientHello with SNI,
+	// ServerHello and an encrypted server flight, then application_data records
+	FramingTLS
+	// FramingHTTP looks like a WebSocket: an HTTP/1.1 Upgrade request and
+	// 101 response, then binary frames
+	FramingHTTP
+)
+
+// DefaultFramingHost is the SNI or Host header unless another is set
+const DefaultFramingHost = "www.microsoft.com"
+
+// framingHandshakeTimeout bounds how long the server holds back packets
+// written before the client's handshake arrived
+const framingHandshakeTimeout = 10 * time.Second
+
+var (
+	// FramingMode is the framing of new connections (default: none)
+	FramingMode = FramingNone
+	// FramingHost is the server name clients put in the SNI or Host header
+	FramingHost = DefaultFramingHost
+)
+
+var errFramingHandshake = errors.New("framing handshake failed")
+
+// HandshakeError is returned by the first read of a framed server connection
+// whose first segment is no handshake of the framing. Segment is that
+// segment, so the server can answer it like the service it imitates.
+type HandshakeError struct {
+	Segment []byte
+	Err     error
+}
+
+func (e *HandshakeError) Error() string { return e.Err.Error() }
+func (e *HandshakeError) Unwrap() error { return e.Err }
+
+// Unframed returns the connection under the framing of conn, or conn itself
+// if it is not framed. Writes to it go out as they are, without waiting for
+// the client's handshake.
+func Unframed(conn ConnAdapter) ConnAdapter {
+	if c, ok := conn.(*framedConn); ok {
+		return c.ConnAdapter
+	}
+	return conn
+}
+
+// SetFraming sets the framing of new connections: "none", "tls" or "http".
+// host is the server name clients announce, DefaultFramingHost if empty.
+func SetFraming(name, host string) error {
+	switch name {
+	case "", "none":
+		FramingMode = FramingNone
+	case "tls":
+		FramingMode = FramingTLS
+	case "http":
+		FramingMode = FramingHTTP
+	default:
+		return fmt.Errorf("unknown framing %q (available: none, tls, http)", name)
+	}
+	if host == "" {
+		host = DefaultFramingHost
+	}
+	FramingHost = host
+	return nil
+}
+
+// FramingOverhead returns the most bytes the framing adds to a packet
+func FramingOverhead() int {
+	switch FramingMode {
+	case FramingTLS:
+		return tlsRecordHeaderLen
+	case FramingHTTP:
+		return wsMaxHeaderLen
+	}
+	return 0
+}
+
+// framedConn wraps packets of a connection in records of its framing
+type framedConn struct {
+	ConnAdapter
+	framing Framing
+	client  bool
+
+	handshaken bool          // Server side, only touched by the reader
+	ready      chan struct{} // Closed when the handshake is done
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+// frameClient runs the client side of the framing handshake on a new
+// connection and returns it wrapped
+func frameClient(conn ConnAdapter, timeout time.Duration) (ConnAdapter, error) {
+	if FramingMode == FramingNone {
+		return conn, nil
+	}
+	c := newFramedConn(conn, FramingMode, true)
+	var err error
+	switch c.framing {
+	case FramingTLS:
+		err = c.clientTLSHandshake(FramingHost, timeout)
+	case FramingHTTP:
+		err = c.clientHTTPHandshake(FramingHost, timeout)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	close(c.ready)
+	return c, nil
+}
+
+// frameServer wraps an accepted connection. Its handshake is answered on the
+// first read, so Accept never waits for a slow or silent client.
+func frameServer(conn ConnAdapter) ConnAdapter {
+	if FramingMode == FramingNone {
+		return conn
+	}
+	return newFramedConn(conn, FramingMode, false)
+}
+
+func newFramedConn(conn ConnAdapter, framing Framing, client bool) *framedConn {
+	return &framedConn{
+		ConnAdapter: conn,
+		framing:     framing,
+		client:      client,
+		ready:       make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+}
+
+// WritePacket sends data in one record. On the server it waits for the
+// client's handshake, which must come first on the wire.
+func (c *framedConn) WritePacket(data []byte) error {
+	select {
+	case <-c.ready:
+	default:
+		timer := time.NewTimer(framingHandshakeTimeout)
+		defer timer.Stop()
+		select {
+		case <-c.ready:
+		case <-c.closed:
+			return fmt.Errorf("connection closed")
+		case <-timer.C:
+			return fmt.Errorf("%w: no handshake from client", errFramingHandshake)
+		}
+	}
+	if c.framing == FramingTLS {
+		return c.ConnAdapter.WritePacket(tlsRecord(tlsApplicationData, data))
+	}
+	return c.ConnAdapter.WritePacket(wsFrame(data, c.client))
+}
+
+// ReadPacket returns the packet in the next record, skipping records that
+// only belong to the disguise
+func (c *framedConn) ReadPacket() ([]byte, error) {
+	for {
+		packet, err := c.ConnAdapter.ReadPacket()
+		if err != nil || len(packet) == 0 {
+			return packet, err
+		}
+		if !c.client && !c.handshaken {
+			if err := c.serverHandshake(packet); err != nil {
+				if errors.Is(err, errFramingHandshake) {
+					return nil, &HandshakeError{Segment: packet, Err: err}
+				}
+				return nil, err
+			}
+			c.handshaken = true
+			close(c.ready)
+			continue
+		}
+
+		var payload []byte
+		var ok bool
+		if c.framing == FramingTLS {
+			payload, ok = parseTLSRecord(packet)
+		} else {
+			payload, ok = parseWSFrame(packet)
+		}
+		if ok {
+			return payload, nil
+		}
+	}
+}
+
+// Close closes the connection and releases writers waiting for the handshake
+func (c *framedConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.ConnAdapter.Close()
+}
+
+// Abort resets the connection where the transport supports it
+func (c *framedConn) Abort() error {
+	if a, ok := c.ConnAdapter.(interface{ Abort() error }); ok {
+		c.closeOnce.Do(func() { close(c.closed) })
+		return a.Abort()
+	}
+	return c.Close()
+}
+
+// serverHandshake answers the client's first packet
+func (c *framedConn) serverHandshake(packet []byte) error {
+	var reply []byte
+	var err error
+	if c.framing == FramingTLS {
+		reply, err = tlsServerFlight(packet)
+	} else {
+		reply, err = wsUpgradeResponse(packet)
+	}
+	if err != nil {
+		return err
+	}
+	return c.ConnAdapter.WritePacket(reply)
+}
+
+// readHandshake reads the server's answer to the client's handshake
+func (c *framedConn) readHandshake(timeout time.Duration) ([]byte, error) {
+	type result struct {
+		data []byte
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		for {
+			data, err := c.ConnAdapter.ReadPacket()
+			if err == nil && len(data) == 0 {
+				continue
+			}
+			ch <- result{data, err}
+			return
+		}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.data, r.err
+	case <-timer.C:
+		// The caller closes the connection, which ends the read
+		return nil, fmt.Errorf("%w: no answer from server within %v", errFramingHandshake, timeout)
+	}
+}
+
+// TLS record types and handshake message types
+const (
+	tlsChangeCipherSpec = 0x14
+	tlsHandshake        = 0x16
+	tlsApplicationData  = 0x17
+
+	tlsClientHelloType = 0x01
+	tlsServerHelloType = 0x02
+
+	tlsRecordHeaderLen = 5
+)
+
+// TLS extensions used in the hellos
+const (
+	extServerName           = 0x0000
+	extStatusRequest        = 0x0005
+	extSupportedGroups      = 0x000a
+	extECPointFormats       = 0x000b
+	extSignatureAlgorithms  = 0x000d
+	extALPN                 = 0x0010
+	extSCT                  = 0x0012
+	extPadding              = 0x0015
+	extExtendedMasterSecret = 0x0017
+	extSessionTicket        = 0x0023
+	extSupportedVersions    = 0x002b
+	extPSKModes             = 0x002d
+	extKeyShare             = 0x0033
+	extRenegotiationInfo    = 0xff01
+)
+
+// clientCipherSuites is the cipher suite list of current browsers
+var clientCipherSuites = []uint16{
+	0x1301, 0x1302, 0x1303, // TLS 1.3
+	0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8,
+	0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+}
+
+// clientHelloPaddedLen is the length BoringSSL pads ClientHellos of 256 to
+// 511 bytes to, working around middleboxes that choke on those lengths
+const clientHelloPaddedLen = 512
+
+// clientTLSHandshake sends a ClientHello for host and reads the server flight
+func (c *framedConn) clientTLSHandshake(host string, timeout time.Duration) error {
+	if err := c.ConnAdapter.WritePacket(tlsClientHello(host)); err != nil {
+		return err
+	}
+	reply, err := c.readHandshake(timeout)
+	if err != nil {
+		return err
+	}
+	if len(reply) < tlsRecordHeaderLen+1 || reply[0] != tlsHandshake || reply[tlsRecordHeaderLen] != tlsServerHelloType {
+		return fmt.Errorf("%w: no ServerHello", errFramingHandshake)
+	}
+
+	// The client's flight: ChangeCipherSpec for middlebox compatibility
+	// and the encrypted Finished
+	flight := tlsRecord(tlsChangeCipherSpec, []byte{0x01})
+	flight = append(flight, tlsRecord(tlsApplicationData, randomBytes(53))...)
+	return c.ConnAdapter.WritePacket(flight)
+}
+
+// tlsClientHello builds a TLS 1.3 ClientHello record offering what browsers offer
+func tlsClientHello(host string) []byte {
+	var ext []byte
+	name := []byte(host)
+	sni := appendU16(nil, uint16(len(name)+3))
+	sni = append(sni, 0) // host_name
+	sni = appendU16(sni, uint16(len(name)))
+	sni = append(sni, name...)
+	ext = appendExtension(ext, extServerName, sni)
+	ext = appendExtension(ext, extExtendedMasterSecret, nil)
+	ext = appendExtension(ext, extRenegotiationInfo, []byte{0})
+	ext = appendExtension(ext, extSupportedGroups, []byte{0, 6, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x18})
+	ext = appendExtension(ext, extECPointFormats, []byte{1, 0})
+	ext = appendExtension(ext, extSessionTicket, nil)
+	ext = appendExtension(ext, extALPN, []byte{0, 12, 2, 'h', '2', 8, 'h', 't', 't', 'p', '/', '1', '.', '1'})
+	ext = appendExtension(ext, extStatusRequest, []byte{1, 0, 0, 0, 0})
+	ext = appendExtension(ext, extSignatureAlgorithms, []byte{0, 16,
+		0x04, 0x03, 0x08, 0x04, 0x04, 0x01, 0x05, 0x03, 0x08, 0x05, 0x05, 0x01, 0x08, 0x06, 0x06, 0x01})
+	ext = appendExtension(ext, extSCT, nil)
+	keyShare := []byte{0, 36, 0x00, 0x1d, 0, 32}
+	ext = appendExtension(ext, extKeyShare, append(keyShare, randomBytes(32)...))
+	ext = appendExtension(ext, extPSKModes, []byte{1, 1})
+	ext = appendExtension(ext, extSupportedVersions, []byte{4, 0x03, 0x04, 0x03, 0x03})
+
+	body := []byte{0x03, 0x03}
+	body = append(body, randomBytes(32)...)
+	body = append(body, 32)
+	body = append(body, randomBytes(32)...) // Legacy session ID
+	body = appendU16(body, uint16(2*len(clientCipherSuites)))
+	for _, suite := range clientCipherSuites {
+		body = appendU16(body, suite)
+	}
+	body = append(body, 1, 0) // Null compression
+
+	// Handshake header, body and extensions length come before the extensions
+	if n := 4 + len(body) + 2 + len(ext); n > 255 && n < clientHelloPaddedLen {
+		pad := clientHelloPaddedLen - n - 4
+		if pad < 1 {
+			pad = 1
+		}
+		ext = appendExtension(ext, extPadding, make([]byte, pad))
+	}
+	body = appendU16(body, uint16(len(ext)))
+	body = append(body, ext...)
+	return tlsRecordVersion(tlsHandshake, 0x0301, tlsHandshakeMessage(tlsClientHelloType, body))
+}
+
+// tlsServerFlight answers a ClientHello with a ServerHello selecting TLS 1.3,
+// ChangeCipherSpec and a record standing for the encrypted extensions,
+// certificate and Finished
+func tlsServerFlight(clientHello []byte) ([]byte, error) {
+	// Record header, handshake header, version and random precede the session ID
+	const sessionIDAt = tlsRecordHeaderLen + 4 + 2 + 32
+	if len(clientHello) <= sessionIDAt || clientHello[0] != tlsHandshake || clientHello[tlsRecordHeaderLen] != tlsClientHelloType {
+		return nil, fmt.Errorf("%w: no ClientHello", errFramingHandshake)
+	}
+	sessionID := clientHello[sessionIDAt+1:]
+	if n := int(clientHello[sessionIDAt]); n <= 32 && n <= len(sessionID) {
+		sessionID = sessionID[:n]
+	} else {
+		return nil, fmt.Errorf("%w: malformed ClientHello", errFramingHandshake)
+	}
+
+	var ext []byte
+	ext = appendExtension(ext, extSupportedVersions, []byte{0x03, 0x04})
+	keyShare := []byte{0x00, 0x1d, 0, 32}
+	ext = appendExtension(ext, extKeyShare, append(keyShare, randomBytes(32)...))
+
+	body := []byte{0x03, 0x03}
+	body = append(body, randomBytes(32)...)
+	body = append(body, byte(len(sessionID)))
+	body = append(body, sessionID...)
+	body = appendU16(body, 0x1301) // TLS_AES_128_GCM_SHA256
+	body = append(body, 0)         // Null compression
+	body = appendU16(body, uint16(len(ext)))
+	body = append(body, ext...)
+
+	flight := tlsRecord(tlsHandshake, tlsHandshakeMessage(tlsServerHelloType, body))
+	flight = append(flight, tlsRecord(tlsChangeCipherSpec, []byte{0x01})...)
+	// Sized like a compressed certificate chain, within one segment
+	encrypted := 700 + int(randomUint32Value()%400)
+	return append(flight, tlsRecord(tlsApplicationData, randomBytes(encrypted))...), nil
+}
+
+// parseTLSRecord returns the payload of an application_data record filling
+// the whole packet; anything else is not one of our packets
+func parseTLSRecord(packet []byte) ([]byte, bool) {
+	if len(packet) < tlsRecordHeaderLen || packet[0] != tlsApplicationData || packet[1] != 0x03 {
+		return nil, false
+	}
+	if int(binary.BigEndian.Uint16(packet[3:5])) != len(packet)-tlsRecordHeaderLen {
+		return nil, false
+	}
+	return packet[tlsRecordHeaderLen:], true
+}
+
+func tlsRecord(typ byte, payload []byte) []byte {
+	return tlsRecordVersion(typ, 0x0303, payload)
+}
+
+func tlsRecordVersion(typ byte, version uint16, payload []byte) []byte {
+	out := make([]byte, tlsRecordHeaderLen, tlsRecordHeaderLen+len(payload))
+	out[0] = typ
+	binary.BigEndian.PutUint16(out[1:3], version)
+	binary.BigEndian.PutUint16(out[3:5], uint16(len(payload)))
+	return append(out, payload...)
+}
+
+func tlsHandshakeMessage(typ byte, body []byte) []byte {
+	n := len(body)
+	out := append(make([]byte, 0, 4+n), typ, byte(n>>16), byte(n>>8), byte(n))
+	return append(out, body...)
+}
+
+func appendExtension(b []byte, typ uint16, data []byte) []byte {
+	b = appendU16(b, typ)
+	b = appendU16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+func appendU16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// WebSocket framing (RFC 6455)
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+	wsFin            = 0x80
+	wsMask           = 0x80
+
+	// wsMaxHeaderLen is the header of a masked frame of up to 64 KiB
+	wsMaxHeaderLen = 2 + 2 + 4
+
+	wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// clientHTTPHandshake sends an Upgrade request for host and checks the response
+func (c *framedConn) clientHTTPHandshake(host string, timeout time.Duration) error {
+	key := base64.StdEncoding.EncodeToString(randomBytes(16))
+	if err := c.ConnAdapter.WritePacket(wsUpgradeRequest("/", host, key)); err != nil {
+		return err
+	}
+	reply, err := c.readHandshake(timeout)
+	if err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(reply)), nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errFramingHandshake, err)
+	}
+	resp.Body.Close()
+	return checkWSUpgrade(resp, key)
+}
+
+// wsUpgradeRequest builds the Upgrade request a browser sends for path on host
+func wsUpgradeRequest(path, host, key string) []byte {
+	return []byte("GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"User-Agent: Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+}
+
+// checkWSUpgrade checks the response to an Upgrade request sent with key
+func checkWSUpgrade(resp *http.Response, key string) error {
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return fmt.Errorf("%w: upgrade refused: %s", errFramingHandshake, resp.Status)
+	}
+	return nil
+}
+
+// wsUpgradeResponse answers a WebSocket Upgrade request
+func wsUpgradeResponse(packet []byte) ([]byte, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(packet)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errFramingHandshake, err)
+	}
+	key, err := wsUpgradeKey(req)
+	if err != nil {
+		return nil, err
+	}
+	return wsSwitchingProtocols(key), nil
+}
+
+// wsUpgradeKey returns the key of a WebSocket Upgrade request
+func wsUpgradeKey(req *http.Request) (string, error) {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") || key == "" {
+		return "", fmt.Errorf("%w: not a WebSocket upgrade", errFramingHandshake)
+	}
+	return key, nil
+}
+
+// wsSwitchingProtocols accepts an Upgrade request sent with key
+func wsSwitchingProtocols(key string) []byte {
+	return []byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Server: nginx\r\n" +
+		"Date: " + time.Now().UTC().Format(http.TimeFormat) + "\r\n" +
+		"Connection: upgrade\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n")
+}
+
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// wsFrame builds a binary frame; frames from the client must be masked
+func wsFrame(payload []byte, masked bool) []byte {
+	return wsOpFrame(wsOpBinary, payload, masked)
+}
+
+// wsOpFrame builds a final frame of any opcode
+func wsOpFrame(op byte, payload []byte, masked bool) []byte {
+	n := len(payload)
+	out := make([]byte, 0, 2+8+4+n)
+	out = append(out, wsFin|op)
+	var maskBit byte
+	if masked {
+		maskBit = wsMask
+	}
+	switch {
+	case n < 126:
+		out = append(out, maskBit|byte(n))
+	case n <= 0xffff:
+		out = append(out, maskBit|126)
+		out = appendU16(out, uint16(n))
+	default:
+		out = append(out, maskBit|127)
+		out = binary.BigEndian.AppendUint64(out, uint64(n))
+	}
+	if !masked {
+		return append(out, payload...)
+	}
+	key := randomBytes(4)
+	out = append(out, key...)
+	start := len(out)
+	out = append(out, payload...)
+	for i := range payload {
+		out[start+i] ^= key[i&3]
+	}
+	return out
+}
+
+// parseWSFrame returns the payload of a binary frame filling the whole
+// packet, unmasked in place; control frames and anything else are skipped
+func parseWSFrame(packet []byte) ([]byte, bool) {
+	if len(packet) < 2 || packet[0] != wsFin|wsOpBinary {
+		return nil, false
+	}
+	masked := packet[1]&wsMask != 0
+	n := uint64(packet[1] &^ wsMask)
+	pos := 2
+	switch n {
+	case 126:
+		if len(packet) < pos+2 {
+			return nil, false
+		}
+		n = uint64(binary.BigEndian.Uint16(packet[pos:]))
+		pos += 2
+	case 127:
+		if len(packet) < pos+8 {
+			return nil, false
+		}
+		n = binary.BigEndian.Uint64(packet[pos:])
+		pos += 8
+	}
+	var key []byte
+	if masked {
+		if len(packet) < pos+4 {
+			return nil, false
+		}
+		key = packet[pos : pos+4]
+		pos += 4
+	}
+	if uint64(len(packet)-pos) != n {
+		return nil, false
+	}
+	payload := packet[pos:]
+	if masked {
+		for i := range payload {
+			payload[i] ^= key[i&3]
+		}
+	}
+	return payload, true
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
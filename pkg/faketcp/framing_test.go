@@ -0,0 +1,167 @@
+package faketcp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeConn is one end of an in-memory packet connection
+type pipeConn struct {
+	in, out chan []byte
+}
+
+func newPipe() (*pipeConn, *pipeConn) {
+	a, b := make(chan []byte, 16), make(chan []byte, 16)
+	return &pipeConn{in: a, out: b}, &pipeConn{in: b, out: a}
+}
+
+func (p *pipeConn) WritePacket(data []byte) error {
+	p.out <- append([]byte(nil), data...)
+	return nil
+}
+
+func (p *pipeConn) ReadPacket() ([]byte, error) {
+	data, ok := <-p.in
+	if !ok {
+		return nil, errPeerClosed
+	}
+	return data, nil
+}
+
+func (p *pipeConn) Close() error                       { return nil }
+func (p *pipeConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (p *pipeConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (p *pipeConn) SetDeadline(t time.Time) error      { return nil }
+func (p *pipeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (p *pipeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// TestFraming tests that packets pass both ways after each handshake, and
+// that each packet travels in one record of the framing
+func TestFraming(t *testing.T) {
+	defer SetFraming("none", "")
+
+	for _, name := range []string{"tls", "http"} {
+		t.Run(name, func(t *testing.T) {
+			if err := SetFraming(name, "example.com"); err != nil {
+				t.Fatal(err)
+			}
+			clientEnd, serverEnd := newPipe()
+			server := frameServer(serverEnd)
+
+			// The server answers the handshake on its first read
+			received := make(chan []byte, 1)
+			go func() {
+				data, err := server.ReadPacket()
+				if err != nil {
+					t.Errorf("Server ReadPacket: %v", err)
+				}
+				received <- data
+			}()
+			client, err := frameClient(clientEnd, time.Second)
+			if err != nil {
+				t.Fatalf("Client handshake: %v", err)
+			}
+
+			packet := bytes.Repeat([]byte{0xab}, 1300)
+			if err := client.WritePacket(packet); err != nil {
+				t.Fatal(err)
+			}
+			if got := <-received; !bytes.Equal(got, packet) {
+				t.Fatalf("Server received %d bytes, want %d", len(got), len(packet))
+			}
+
+			if err := server.WritePacket([]byte("pong")); err != nil {
+				t.Fatal(err)
+			}
+			wire := <-clientEnd.in
+			if len(wire) > len("pong")+FramingOverhead() {
+				t.Errorf("Record of %d bytes exceeds the overhead", len(wire))
+			}
+			clientEnd.in <- wire
+			if got, err := client.ReadPacket(); err != nil || string(got) != "pong" {
+				t.Fatalf("Client ReadPacket = %q, %v", got, err)
+			}
+		})
+	}
+}
+
+// TestFramingHandshakeError tests that a first segment that is no handshake
+// comes back to the server with the error, and that the unframed connection
+// writes without waiting for a handshake
+func TestFramingHandshakeError(t *testing.T) {
+	defer SetFraming("none", "")
+	if err := SetFraming("tls", ""); err != nil {
+		t.Fatal(err)
+	}
+	clientEnd, serverEnd := newPipe()
+	server := frameServer(serverEnd)
+
+	clientEnd.WritePacket([]byte("GET / HTTP/1.1\r\n\r\n"))
+	_, err := server.ReadPacket()
+	var hsErr *HandshakeError
+	if !errors.As(err, &hsErr) || string(hsErr.Segment) != "GET / HTTP/1.1\r\n\r\n" {
+		t.Fatalf("ReadPacket error %v, want the junk segment back", err)
+	}
+
+	raw := Unframed(server)
+	if raw != ConnAdapter(serverEnd) {
+		t.Fatal("Unframed did not return the wrapped connection")
+	}
+	if err := raw.WritePacket([]byte("decoy")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-clientEnd.in; string(got) != "decoy" {
+		t.Errorf("Client received %q, want the decoy as is", got)
+	}
+}
+
+// TestTLSClientHello tests that the ClientHello is a well-formed record
+// carrying the SNI, padded like BoringSSL's
+func TestTLSClientHello(t *testing.T) {
+	hello := tlsClientHello("cdn.example.com")
+	if hello[0] != tlsHandshake || hello[5] != tlsClientHelloType {
+		t.Fatalf("Not a ClientHello: %x", hello[:6])
+	}
+	if n := int(hello[3])<<8 | int(hello[4]); n != len(hello)-tlsRecordHeaderLen || n != clientHelloPaddedLen {
+		t.Errorf("Record length %d, packet %d", n, len(hello))
+	}
+	if !bytes.Contains(hello, []byte("cdn.example.com")) {
+		t.Errorf("SNI missing")
+	}
+
+	flight, err := tlsServerFlight(hello)
+	if err != nil {
+		t.Fatalf("tlsServerFlight: %v", err)
+	}
+	if !bytes.Contains(flight, hello[44:76]) {
+		t.Errorf("ServerHello does not echo the session ID")
+	}
+	if _, err := tlsServerFlight([]byte("GET / HTTP/1.1\r\n\r\n")); !errors.Is(err, errFramingHandshake) {
+		t.Errorf("Junk accepted as ClientHello: %v", err)
+	}
+}
+
+// TestParseFrames tests that records of another kind or length are skipped
+func TestParseFrames(t *testing.T) {
+	if _, ok := parseTLSRecord(tlsRecord(tlsChangeCipherSpec, []byte{1})); ok {
+		t.Errorf("ChangeCipherSpec taken for data")
+	}
+	record := tlsRecord(tlsApplicationData, []byte("data"))
+	if _, ok := parseTLSRecord(record[:len(record)-1]); ok {
+		t.Errorf("Truncated record accepted")
+	}
+
+	for _, n := range []int{0, 125, 126, 1400, 70000} {
+		payload := bytes.Repeat([]byte{0x5a}, n)
+		got, ok := parseWSFrame(wsFrame(payload, true))
+		if !ok || !bytes.Equal(got, payload) {
+			t.Errorf("Masked frame of %d bytes: ok %v", n, ok)
+		}
+	}
+	if _, ok := parseWSFrame([]byte{wsFin | 0x9, 0}); ok {
+		t.Errorf("Ping taken for data")
+	}
+}
@@ -0,0 +1,321 @@
+package faketcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/rawsocket"
+)
+
+// TCP stack fingerprints. Passive fingerprinting (p0f, JA4T and the like)
+// looks at the SYN and SYN-ACK: which options are present and in what
+// order, the window and window scale, the TTL and how the IP ID changes.
+// A Profile reproduces one real stack, and the fake-TCP connections send
+// their segments the way that stack would: MSS, window scale and SACK
+// permitted only in the handshake, timestamps on every segment only if both
+// sides offered them.
+
+// TCP option kinds
+const (
+	optEOL      = 0
+	optNOP      = 1
+	optMSS      = 2
+	optWS       = 3
+	optSACKPerm = 4
+	optTS       = 8
+)
+
+// IPIDMode is how a stack picks the IP ID of its segments
+type IPIDMode int
+
+const (
+	// IPIDPerConnection increments a counter per connection from a random start (Linux)
+	IPIDPerConnection IPIDMode = iota
+	// IPIDGlobal increments one counter shared by all connections (Windows)
+	IPIDGlobal
+	// IPIDRandom picks a random ID for every segment (macOS)
+	IPIDRandom
+)
+
+// Profile describes how a TCP/IP stack fills in the fields used to
+// fingerprint it
+type Profile struct {
+	Name           string
+	SYNOptions     []byte // Option kinds of a SYN in order, NOP and EOL included
+	MSS            uint16
+	WindowScale    uint8
+	SYNWindow      uint16 // Window of SYN and SYN-ACK (never scaled)
+	Window         uint16 // Window of later segments, scaled by WindowScale
+	TTL            uint8
+	IPID           IPIDMode
+	ZeroSYNACKIPID bool // SYN-ACKs carry IP ID 0
+}
+
+// timestamps reports whether the stack offers TCP timestamps
+func (p *Profile) timestamps() bool {
+	for _, kind := range p.SYNOptions {
+		if kind == optTS {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultProfile is the profile used unless another is selected
+const DefaultProfile = "linux-6.x"
+
+var profiles = map[string]*Profile{
+	"linux-6.x": {
+		Name:           "linux-6.x",
+		SYNOptions:     []byte{optMSS, optSACKPerm, optTS, optNOP, optWS},
+		MSS:            1460,
+		WindowScale:    7,
+		SYNWindow:      64240,
+		Window:         502,
+		TTL:            64,
+		IPID:           IPIDPerConnection,
+		ZeroSYNACKIPID: true,
+	},
+	"windows-11": {
+		Name:        "windows-11",
+		SYNOptions:  []byte{optMSS, optNOP, optWS, optNOP, optNOP, optSACKPerm},
+		MSS:         1460,
+		WindowScale: 8,
+		SYNWindow:   64240,
+		Window:      1026,
+		TTL:         128,
+		IPID:        IPIDGlobal,
+	},
+	"macos": {
+		Name:        "macos",
+		SYNOptions:  []byte{optMSS, optNOP, optWS, optNOP, optNOP, optTS, optSACKPerm, optEOL, optEOL},
+		MSS:         1460,
+		WindowScale: 6,
+		SYNWindow:   65535,
+		Window:      2048,
+		TTL:         64,
+		IPID:        IPIDRandom,
+	},
+	"android": {
+		Name:           "android",
+		SYNOptions:     []byte{optMSS, optSACKPerm, optTS, optNOP, optWS},
+		MSS:            1460,
+		WindowScale:    9,
+		SYNWindow:      65535,
+		Window:         1369,
+		TTL:            64,
+		IPID:           IPIDPerConnection,
+		ZeroSYNACKIPID: true,
+	},
+}
+
+// TCPProfile is the stack profile of new connections (default: linux-6.x)
+var TCPProfile = profiles[DefaultProfile]
+
+// LookupProfile returns the profile with the given name
+func LookupProfile(name string) (*Profile, error) {
+	p, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown TCP profile %q (available: %v)", name, ProfileNames())
+	}
+	return p, nil
+}
+
+// ProfileNames returns the names of all profiles
+func ProfileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetProfile sets the stack profile of new connections
+func SetProfile(name string) error {
+	p, err := LookupProfile(name)
+	if err != nil {
+		return err
+	}
+	TCPProfile = p
+	return nil
+}
+
+// globalIPID is the IP ID counter of IPIDGlobal profiles
+var globalIPID = randomUint32Value()
+
+// stackState is the per-connection side of a profile: the timestamp clock,
+// the IP ID counter and the options the peer offered in its SYN or SYN-ACK.
+type stackState struct {
+	mu       sync.Mutex
+	profile  *Profile
+	tsBase   time.Time
+	tsOffset uint32 // Random start of the timestamp clock
+	tsRecent uint32 // Last TSval received, echoed as TSecr
+	ipID     uint16
+
+	// Options offered by the peer, known once its SYN or SYN-ACK arrived
+	peerSeen bool
+	peerTS   bool
+	peerWS   bool
+	peerSACK bool
+}
+
+func newStackState(p *Profile) *stackState {
+	return &stackState{
+		profile:  p,
+		tsBase:   time.Now(),
+		tsOffset: randomUint32Value(),
+		ipID:     uint16(randomUint32Value()),
+	}
+}
+
+// onReceive records the options of a segment from the peer. Timestamps
+// follow RFC 7323: TS.Recent only takes TSvals of segments at or below the
+// last acknowledgment sent, and a segment whose TSval is older than TS.Recent
+// fails PAWS, which is reported by returning false.
+func (s *stackState) onReceive(flags uint8, seq, lastAck uint32, options []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if flags&SYN != 0 {
+		s.peerSeen = true
+		s.peerTS, s.peerWS, s.peerSACK = false, false, false
+	}
+	ok := true
+	scanOptions(options, func(kind byte, data []byte) {
+		switch kind {
+		case optTS:
+			if len(data) != 8 {
+				return
+			}
+			tsval := binary.BigEndian.Uint32(data[0:4])
+			if flags&SYN != 0 {
+				s.peerTS = true
+				s.tsRecent = tsval
+				return
+			}
+			if seqBefore(tsval, s.tsRecent) {
+				ok = flags&RST != 0
+				return
+			}
+			if !seqBefore(lastAck, seq) {
+				s.tsRecent = tsval
+			}
+		case optWS:
+			if flags&SYN != 0 {
+				s.peerWS = true
+			}
+		case optSACKPerm:
+			if flags&SYN != 0 {
+				s.peerSACK = true
+			}
+		}
+	})
+	return ok
+}
+
+// options builds the TCP options of a segment with the given flags
+func (s *stackState) options(flags uint8) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.profile
+
+	if flags&SYN == 0 {
+		// Only timestamps outlive the handshake, aligned by two NOPs
+		if !s.timestampsLocked() {
+			return nil
+		}
+		opts := []byte{optNOP, optNOP}
+		return s.appendTimestampLocked(opts)
+	}
+
+	// A SYN-ACK only answers options the SYN offered
+	synAck := flags&ACK != 0
+	opts := make([]byte, 0, 24)
+	for _, kind := range p.SYNOptions {
+		switch kind {
+		case optMSS:
+			opts = append(opts, optMSS, 4, byte(p.MSS>>8), byte(p.MSS))
+		case optWS:
+			if !synAck || s.peerWS {
+				opts = append(opts, optWS, 3, p.WindowScale)
+			}
+		case optSACKPerm:
+			if !synAck || s.peerSACK {
+				opts = append(opts, optSACKPerm, 2)
+			}
+		case optTS:
+			if !synAck || s.peerTS {
+				opts = s.appendTimestampLocked(opts)
+			}
+		default:
+			opts = append(opts, kind)
+		}
+	}
+	return opts
+}
+
+// timestampsLocked reports whether both sides use timestamps
+func (s *stackState) timestampsLocked() bool {
+	return s.profile.timestamps() && s.peerSeen && s.peerTS
+}
+
+// appendTimestampLocked appends a timestamp option: a millisecond clock with
+// a random per-connection offset, echoing the peer's last TSval
+func (s *stackState) appendTimestampLocked(opts []byte) []byte {
+	tsval := s.tsOffset + uint32(time.Since(s.tsBase).Milliseconds())
+	opts = append(opts, optTS, 10)
+	opts = binary.BigEndian.AppendUint32(opts, tsval)
+	return binary.BigEndian.AppendUint32(opts, s.tsRecent)
+}
+
+// headerFields returns the window, TTL and IP ID of the next segment
+func (s *stackState) headerFields(flags uint8) rawsocket.HeaderFields {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.profile
+
+	fields := rawsocket.HeaderFields{Window: p.SYNWindow, TTL: p.TTL}
+	if flags&SYN == 0 && s.peerSeen && s.peerWS {
+		fields.Window = p.Window
+	}
+	switch {
+	case flags&(SYN|ACK) == SYN|ACK && p.ZeroSYNACKIPID:
+		fields.IPID = 0
+	case p.IPID == IPIDGlobal:
+		fields.IPID = uint16(atomic.AddUint32(&globalIPID, 1))
+	case p.IPID == IPIDRandom:
+		fields.IPID = uint16(randomUint32Value())
+	default:
+		s.ipID++
+		fields.IPID = s.ipID
+	}
+	return fields
+}
+
+// scanOptions calls fn with the kind and data of each TCP option
+func scanOptions(options []byte, fn func(kind byte, data []byte)) {
+	for i := 0; i < len(options); {
+		kind := options[i]
+		switch kind {
+		case optEOL:
+			return
+		case optNOP:
+			i++
+			continue
+		}
+		if i+1 >= len(options) {
+			return
+		}
+		length := int(options[i+1])
+		if length < 2 || i+length > len(options) {
+			return
+		}
+		fn(kind, options[i+2:i+length])
+		i += length
+	}
+}
@@ -0,0 +1,94 @@
+package faketcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// optionKinds returns the option kinds of a segment in order, NOPs included
+func optionKinds(options []byte) []byte {
+	var kinds []byte
+	for i := 0; i < len(options); {
+		kinds = append(kinds, options[i])
+		if options[i] == optNOP || options[i] == optEOL {
+			i++
+			continue
+		}
+		i += int(options[i+1])
+	}
+	return kinds
+}
+
+// TestProfileSYNOptions tests that SYNs carry the options of each profile in
+// its order
+func TestProfileSYNOptions(t *testing.T) {
+	for _, name := range ProfileNames() {
+		p, _ := LookupProfile(name)
+		s := newStackState(p)
+		opts := s.options(SYN)
+		if got := optionKinds(opts); !bytes.Equal(got, p.SYNOptions) {
+			t.Errorf("%s: SYN option kinds %v, want %v", name, got, p.SYNOptions)
+		}
+		if len(opts) > 40 {
+			t.Errorf("%s: %d bytes of options", name, len(opts))
+		}
+		fields := s.headerFields(SYN)
+		if fields.Window != p.SYNWindow || fields.TTL != p.TTL {
+			t.Errorf("%s: SYN window %d TTL %d", name, fields.Window, fields.TTL)
+		}
+	}
+	if _, err := LookupProfile("bsd"); err == nil {
+		t.Errorf("Unknown profile accepted")
+	}
+}
+
+// TestProfileNegotiation tests that SYN-ACKs only answer offered options and
+// that timestamps continue after the handshake only if both sides use them
+func TestProfileNegotiation(t *testing.T) {
+	linux, _ := LookupProfile("linux-6.x")
+	windows, _ := LookupProfile("windows-11")
+
+	// Windows client to Linux server: no timestamps anywhere
+	client := newStackState(windows)
+	server := newStackState(linux)
+	server.onReceive(SYN, 0, 0, client.options(SYN))
+	synAck := server.options(SYN | ACK)
+	if got, want := optionKinds(synAck), []byte{optMSS, optSACKPerm, optNOP, optWS}; !bytes.Equal(got, want) {
+		t.Errorf("SYN-ACK option kinds %v, want %v", got, want)
+	}
+	client.onReceive(SYN|ACK, 0, 0, synAck)
+	if opts := server.options(ACK); opts != nil {
+		t.Errorf("Server data options %v without client timestamps", opts)
+	}
+	if opts := client.options(ACK); opts != nil {
+		t.Errorf("Windows data options %v", opts)
+	}
+	if fields := server.headerFields(SYN | ACK); fields.IPID != 0 {
+		t.Errorf("Linux SYN-ACK IP ID %d", fields.IPID)
+	}
+	if fields := server.headerFields(ACK); fields.Window != linux.Window {
+		t.Errorf("Scaled window %d, want %d", fields.Window, linux.Window)
+	}
+
+	// Linux to Linux: TSecr echoes the peer's TSval
+	client = newStackState(linux)
+	server = newStackState(linux)
+	syn := client.options(SYN)
+	server.onReceive(SYN, 0, 0, syn)
+	synAck = server.options(SYN | ACK)
+	client.onReceive(SYN|ACK, 0, 0, synAck)
+	ack := client.options(ACK)
+	if got, want := optionKinds(ack), []byte{optNOP, optNOP, optTS}; !bytes.Equal(got, want) {
+		t.Fatalf("Data option kinds %v, want %v", got, want)
+	}
+	tsIndex := bytes.IndexByte(synAck, optTS)
+	serverTSval := binary.BigEndian.Uint32(synAck[tsIndex+2:])
+	if tsecr := binary.BigEndian.Uint32(ack[8:12]); tsecr != serverTSval {
+		t.Errorf("TSecr %d, want %d", tsecr, serverTSval)
+	}
+	clientTSval := binary.BigEndian.Uint32(syn[bytes.IndexByte(syn, optTS)+2:])
+	if tsecr := binary.BigEndian.Uint32(synAck[tsIndex+6:]); tsecr != clientTSval {
+		t.Errorf("SYN-ACK TSecr %d, want %d", tsecr, clientTSval)
+	}
+}
@@ -0,0 +1,230 @@
+package faketcp
+
+import (
+	"sync"
+	"time"
+)
+
+// Receive-side sequence tracking. Stateful firewalls (conntrack and carrier
+// middleboxes) follow both directions of a TCP flow and mark segments whose
+// acknowledgment goes backwards or points at data that was never sent as
+// INVALID. The receiver therefore acknowledges cumulatively, like a real
+// stack: the ACK number only moves past contiguous data, duplicates are
+// recognised and answered with an immediate ACK, and in-order data is
+// acknowledged every second segment or after the delayed ACK timeout.
+//
+// Fake-TCP peers never retransmit, so a gap below out-of-order data is only
+// waited for until holeTimeout and then acknowledged as if it had been
+// filled; the flow looks like a retransmission that observers missed. The
+// data of a given up gap is still delivered if it arrives late.
+
+const (
+	// delayedACKTimeout is how long an ACK is held back waiting for a
+	// second segment (Linux's minimum delayed ACK timeout)
+	delayedACKTimeout = 40 * time.Millisecond
+	// holeTimeout is how long a gap below out-of-order data is waited for
+	holeTimeout = 200 * time.Millisecond
+	// maxOOORanges bounds the out-of-order ranges kept; beyond it the
+	// oldest gap is given up
+	maxOOORanges = 32
+	// maxSkippedRanges bounds the given up gaps remembered for late data
+	maxSkippedRanges = 32
+)
+
+// seqBefore reports whether a comes before b in sequence space
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// seqRange is a range of received sequence numbers [start, end)
+type seqRange struct {
+	start, end uint32
+}
+
+// recvState is the receive side of a connection's sequence space
+type recvState struct {
+	mu        sync.Mutex
+	nxt       uint32     // Next expected sequence number, everything before it is acknowledged
+	ooo       []seqRange // Out-of-order data above nxt, sorted and disjoint
+	holeSince time.Time  // When the gap at nxt appeared
+	skipped   []seqRange // Given up gaps below nxt whose data was not seen, oldest first
+	pending   int        // In-order segments not acknowledged yet
+	lastAck   uint32     // Last acknowledgment number sent
+	timer     *time.Timer
+}
+
+// init starts tracking after the peer's SYN
+func (r *recvState) init(nxt uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nxt = nxt
+	r.lastAck = nxt
+	r.ooo = nil
+	r.skipped = nil
+	r.pending = 0
+}
+
+// receive records a data segment. It reports whether the segment carries new
+// data and whether it must be acknowledged at once rather than delayed.
+func (r *recvState) receive(seq uint32, n int, now time.Time) (isNew, ackNow bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	skipped := r.skipHolesLocked(now)
+
+	end := seq + uint32(n)
+	if !seqBefore(r.nxt, end) {
+		// Entirely below nxt: late data of a given up gap, or a duplicate
+		return r.fillSkippedLocked(seq, end), true
+	}
+
+	if !seqBefore(r.nxt, seq) {
+		// In order: advance over it and any out-of-order data it joins
+		r.nxt = end
+		filled := len(r.ooo) > 0
+		for len(r.ooo) > 0 && !seqBefore(r.nxt, r.ooo[0].start) {
+			if seqBefore(r.nxt, r.ooo[0].end) {
+				r.nxt = r.ooo[0].end
+			}
+			r.ooo = r.ooo[1:]
+		}
+		if len(r.ooo) > 0 {
+			r.holeSince = now
+		}
+		r.pending++
+		// A filled or given up gap is acknowledged at once, like a
+		// retransmission would be
+		return true, filled || skipped || r.pending >= 2
+	}
+
+	// Out of order: keep the range and send a duplicate ACK at once
+	i := 0
+	for i < len(r.ooo) && seqBefore(r.ooo[i].end, seq) {
+		i++
+	}
+	if i < len(r.ooo) && !seqBefore(seq, r.ooo[i].start) && !seqBefore(r.ooo[i].end, end) {
+		return false, true
+	}
+	if len(r.ooo) == 0 {
+		r.holeSince = now
+	}
+	rng := seqRange{seq, end}
+	j := i
+	for j < len(r.ooo) && !seqBefore(end, r.ooo[j].start) {
+		if seqBefore(r.ooo[j].start, rng.start) {
+			rng.start = r.ooo[j].start
+		}
+		if seqBefore(rng.end, r.ooo[j].end) {
+			rng.end = r.ooo[j].end
+		}
+		j++
+	}
+	r.ooo = append(r.ooo[:i], append([]seqRange{rng}, r.ooo[j:]...)...)
+	return true, true
+}
+
+// skipHolesLocked gives up gaps that were waited for long enough, or the
+// oldest ones when too many ranges are kept. It reports whether nxt moved.
+func (r *recvState) skipHolesLocked(now time.Time) bool {
+	skipped := false
+	for len(r.ooo) > 0 && (now.Sub(r.holeSince) >= holeTimeout || len(r.ooo) > maxOOORanges) {
+		r.skipped = append(r.skipped, seqRange{r.nxt, r.ooo[0].start})
+		if len(r.skipped) > maxSkippedRanges {
+			r.skipped = r.skipped[1:]
+		}
+		r.nxt = r.ooo[0].end
+		r.ooo = r.ooo[1:]
+		r.holeSince = now
+		skipped = true
+	}
+	return skipped
+}
+
+// fillSkippedLocked removes [start, end) from the given up gaps and reports
+// whether it overlapped any, i.e. whether it carries data not seen before
+func (r *recvState) fillSkippedLocked(start, end uint32) bool {
+	filled := false
+	kept := r.skipped[:0]
+	for _, h := range r.skipped {
+		if !seqBefore(start, h.end) || !seqBefore(h.start, end) {
+			kept = append(kept, h)
+			continue
+		}
+		filled = true
+		if seqBefore(h.start, start) {
+			kept = append(kept, seqRange{h.start, start})
+		}
+		if seqBefore(end, h.end) {
+			kept = append(kept, seqRange{end, h.end})
+		}
+	}
+	r.skipped = kept
+	return filled
+}
+
+// advance moves nxt forward to a sequence number the peer used up, e.g.
+// after its FIN
+func (r *recvState) advance(nxt uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if seqBefore(r.nxt, nxt) {
+		r.nxt = nxt
+		r.ooo = nil
+	}
+}
+
+// acknowledge returns the acknowledgment number to send, recording that
+// everything before it is acknowledged and cancelling the delayed ACK
+func (r *recvState) acknowledge() uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending = 0
+	r.lastAck = r.nxt
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	return r.nxt
+}
+
+// next returns the next expected sequence number
+func (r *recvState) next() uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.nxt
+}
+
+// lastAckSent returns the last acknowledgment number sent
+func (r *recvState) lastAckSent() uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastAck
+}
+
+// delayACK arranges for send to be called after the delayed ACK timeout
+// unless an ACK goes out before
+func (r *recvState) delayACK(send func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timer != nil {
+		return
+	}
+	r.timer = time.AfterFunc(delayedACKTimeout, func() {
+		r.mu.Lock()
+		due := r.pending > 0
+		r.timer = nil
+		r.mu.Unlock()
+		if due {
+			send()
+		}
+	})
+}
+
+// stop cancels the delayed ACK
+func (r *recvState) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
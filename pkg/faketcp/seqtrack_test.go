@@ -0,0 +1,97 @@
+package faketcp
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRecvState tests cumulative acknowledgment, duplicate detection and
+// the handling of gaps and their late data, across sequence number
+// wraparound
+func TestRecvState(t *testing.T) {
+	var r recvState
+	start := uint32(0xffffff00)
+	r.init(start)
+	now := time.Now()
+
+	steps := []struct {
+		name          string
+		seq           uint32
+		n             int
+		after         time.Duration
+		isNew, ackNow bool
+		nxt           uint32
+	}{
+		{"first segment is delayed", start, 100, 0, true, false, start + 100},
+		{"second segment is acked", start + 100, 100, 0, true, true, start + 200},
+		{"duplicate", start + 100, 100, 0, false, true, start + 200},
+		{"out of order across wrap", start + 300, 100, 0, true, true, start + 200},
+		{"out of order again", start + 400, 100, 0, true, true, start + 200},
+		{"duplicate out of order", start + 300, 200, 0, false, true, start + 200},
+		{"gap filled", start + 200, 100, 0, true, true, start + 500},
+		{"second gap", start + 600, 100, 0, true, true, start + 500},
+		{"gap given up", start + 700, 100, holeTimeout, true, true, start + 800},
+		{"in order after gap", start + 800, 100, holeTimeout, true, false, start + 900},
+		{"late data of given up gap", start + 550, 50, holeTimeout, true, true, start + 900},
+		{"late data again", start + 550, 50, holeTimeout, false, true, start + 900},
+		{"rest of given up gap", start + 500, 100, holeTimeout, true, true, start + 900},
+		{"gap now complete", start + 500, 50, holeTimeout, false, true, start + 900},
+	}
+	for _, s := range steps {
+		isNew, ackNow := r.receive(s.seq, s.n, now.Add(s.after))
+		if isNew != s.isNew || ackNow != s.ackNow {
+			t.Errorf("%s: isNew %v ackNow %v, want %v %v", s.name, isNew, ackNow, s.isNew, s.ackNow)
+		}
+		if r.nxt != s.nxt {
+			t.Errorf("%s: nxt %#x, want %#x", s.name, r.nxt, s.nxt)
+		}
+		if s.ackNow {
+			if ack := r.acknowledge(); ack != s.nxt {
+				t.Errorf("%s: ack %#x", s.name, ack)
+			}
+		}
+	}
+	if r.lastAckSent() != start+900 {
+		t.Errorf("Last ACK %#x", r.lastAckSent())
+	}
+}
+
+// TestPAWS tests that old timestamps are rejected and that TS.Recent only
+// follows segments at the left edge of the window
+func TestPAWS(t *testing.T) {
+	linux, _ := LookupProfile("linux-6.x")
+	s := newStackState(linux)
+	ts := func(tsval uint32) []byte {
+		return []byte{optNOP, optNOP, optTS, 10, byte(tsval >> 24), byte(tsval >> 16), byte(tsval >> 8), byte(tsval), 0, 0, 0, 0}
+	}
+	s.onReceive(SYN, 1000, 0, ts(500))
+
+	if !s.onReceive(ACK, 1001, 1001, ts(510)) || s.tsRecent != 510 {
+		t.Errorf("In-order segment: TS.Recent %d", s.tsRecent)
+	}
+	if !s.onReceive(ACK, 1101, 1001, ts(520)) || s.tsRecent != 510 {
+		t.Errorf("Segment above last ACK updated TS.Recent to %d", s.tsRecent)
+	}
+	if s.onReceive(ACK, 1001, 1001, ts(505)) {
+		t.Errorf("Old timestamp passed PAWS")
+	}
+	if !s.onReceive(RST, 1001, 1001, ts(505)) {
+		t.Errorf("RST failed PAWS")
+	}
+}
+
+// TestHandleDataPAWS tests that new data failing PAWS is delivered, once,
+// without being acknowledged
+func TestHandleDataPAWS(t *testing.T) {
+	c := &ConnRaw{}
+	c.rcv.init(1000)
+	if !c.handleData(1000, make([]byte, 100), false) {
+		t.Fatalf("Expected new data failing PAWS to be delivered")
+	}
+	if c.handleData(1000, make([]byte, 100), false) {
+		t.Fatalf("Expected the duplicate to be dropped")
+	}
+	if c.rcv.lastAckSent() != 1000 {
+		t.Fatalf("Expected no ACK for data failing PAWS, last ACK %d", c.rcv.lastAckSent())
+	}
+}
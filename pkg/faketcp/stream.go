@@ -0,0 +1,203 @@
+package faketcp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream transport: packets over a kernel TCP connection, each prefixed with
+// its length. It needs neither raw sockets nor firewall rules, so it runs
+// without root, at the price of TCP's own retransmissions and head-of-line
+// blocking when the path loses packets.
+const (
+	streamHeaderLen = 2 // Big-endian packet length
+	// MaxStreamPacketSize is the largest packet the stream transport carries
+	MaxStreamPacketSize = 0xffff
+)
+
+// StreamConn is a packet connection over kernel TCP
+type StreamConn struct {
+	conn     *net.TCPConn
+	reader   *bufio.Reader
+	rmu      sync.Mutex // Serializes readers so packets are not interleaved
+	wmu      sync.Mutex // Serializes writers
+	deadline packetDeadline
+}
+
+// packetDeadline keeps a read deadline set from outside a stream connection
+// apart from the socket deadlines ReadPacket uses. The outside deadline cuts
+// short the wait for the next packet (e.g. to wake the reader) but never a
+// packet that is arriving, as losing the rest of it would desynchronize the
+// stream; such a packet is read whole and the deadline applies to the next.
+type packetDeadline struct {
+	mu       sync.Mutex
+	deadline time.Time // Set by SetReadDeadline, zero for none
+	inPacket bool
+}
+
+// waitNext sets the socket deadline for waiting for the next packet
+func (d *packetDeadline) waitNext(conn net.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inPacket = false
+	d.applyLocked(conn)
+}
+
+// readRest sets the socket deadline for reading the rest of a packet
+func (d *packetDeadline) readRest(conn net.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inPacket = true
+	conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+}
+
+// set records an outside deadline, applying it right away unless a packet
+// is arriving
+func (d *packetDeadline) set(conn net.Conn, t time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deadline = t
+	if d.inPacket {
+		return nil
+	}
+	return d.applyLocked(conn)
+}
+
+func (d *packetDeadline) applyLocked(conn net.Conn) error {
+	wait := time.Now().Add(ReadTimeoutDuration)
+	if !d.deadline.IsZero() && d.deadline.Before(wait) {
+		wait = d.deadline
+	}
+	return conn.SetReadDeadline(wait)
+}
+
+// StreamListener accepts stream connections
+type StreamListener struct {
+	listener *net.TCPListener
+}
+
+func newStreamConn(conn *net.TCPConn) *StreamConn {
+	conn.SetNoDelay(true)
+	return &StreamConn{conn: conn, reader: bufio.NewReaderSize(conn, 64*1024)}
+}
+
+// DialStream connects to the remote address over kernel TCP
+func DialStream(remoteAddr string, timeout time.Duration) (*StreamConn, error) {
+	conn, err := net.DialTimeout("tcp", remoteAddr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial TCP: %v", err)
+	}
+	return newStreamConn(conn.(*net.TCPConn)), nil
+}
+
+// ListenStream listens for stream connections on addr
+func ListenStream(addr string) (*StreamListener, error) {
+	laddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve address: %v", err)
+	}
+	listener, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on TCP: %v", err)
+	}
+	return &StreamListener{listener: listener}, nil
+}
+
+// Accept waits for the next stream connection
+func (l *StreamListener) Accept() (*StreamConn, error) {
+	conn, err := l.listener.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	return newStreamConn(conn), nil
+}
+
+// Close stops listening
+func (l *StreamListener) Close() error {
+	return l.listener.Close()
+}
+
+// Addr returns the listener's network address
+func (l *StreamListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// WritePacket sends data as one length-prefixed packet
+func (c *StreamConn) WritePacket(data []byte) error {
+	if len(data) > MaxStreamPacketSize {
+		return fmt.Errorf("payload size %d exceeds maximum %d bytes", len(data), MaxStreamPacketSize)
+	}
+	buf := make([]byte, streamHeaderLen+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(len(data)))
+	copy(buf[streamHeaderLen:], data)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.conn.Write(buf); err != nil {
+		return fmt.Errorf("failed to send packet: %v", err)
+	}
+	return nil
+}
+
+// ReadPacket receives the next packet. Like the UDP transport it gives up
+// after ReadTimeoutDuration with a timeout error, so callers can check for
+// shutdown; a packet that started arriving is read whole.
+func (c *StreamConn) ReadPacket() ([]byte, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	// Peek keeps a partially received header buffered across timeouts
+	c.deadline.waitNext(c.conn)
+	header, err := c.reader.Peek(streamHeaderLen)
+	if err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(header))
+	c.reader.Discard(streamHeaderLen)
+
+	// Losing the rest of the packet would desynchronize the stream
+	c.deadline.readRest(c.conn)
+	packet := make([]byte, n)
+	if _, err := io.ReadFull(c.reader, packet); err != nil {
+		c.conn.Close()
+		return nil, fmt.Errorf("truncated packet: %v", err)
+	}
+	return packet, nil
+}
+
+// Close closes the connection
+func (c *StreamConn) Close() error {
+	return c.conn.Close()
+}
+
+// LocalAddr returns the local address
+func (c *StreamConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address
+func (c *StreamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline sets read and write deadlines (see SetReadDeadline)
+func (c *StreamConn) SetDeadline(t time.Time) error {
+	c.deadline.set(c.conn, t)
+	return c.conn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline. A packet that is arriving when it
+// passes is still read whole.
+func (c *StreamConn) SetReadDeadline(t time.Time) error {
+	return c.deadline.set(c.conn, t)
+}
+
+// SetWriteDeadline sets the write deadline
+func (c *StreamConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,237 @@
+package faketcp
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestTransports tests that packets pass both ways, whole and in order, over
+// the transports that run without raw sockets
+func TestTransports(t *testing.T) {
+	for name, mode := range map[string]Mode{"udp": ModeUDP, "tcp": ModeTCP} {
+		t.Run(name, func(t *testing.T) {
+			listener, err := ListenWithMode("127.0.0.1:0", mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			accepted := make(chan ConnAdapter, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					t.Errorf("Accept: %v", err)
+				}
+				accepted <- conn
+			}()
+			client, err := DialWithMode(listener.Addr().String(), time.Second, mode)
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			defer client.Close()
+
+			packets := [][]byte{[]byte("first"), bytes.Repeat([]byte{0xcd}, 1400), {0x01}}
+			for _, p := range packets {
+				if err := client.WritePacket(p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			server := <-accepted
+			if server == nil {
+				t.FailNow()
+			}
+			defer server.Close()
+			for _, want := range packets {
+				got, err := readSkippingTimeouts(server)
+				if err != nil || !bytes.Equal(got, want) {
+					t.Fatalf("Server read %d bytes, %v; want %d bytes", len(got), err, len(want))
+				}
+			}
+
+			if err := server.WritePacket([]byte("reply")); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := readSkippingTimeouts(client); err != nil || string(got) != "reply" {
+				t.Fatalf("Client read %q, %v", got, err)
+			}
+		})
+	}
+}
+
+// readSkippingTimeouts reads the next non-empty packet
+func readSkippingTimeouts(conn ConnAdapter) ([]byte, error) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, err := conn.ReadPacket()
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && time.Now().Before(deadline) {
+			continue
+		}
+		if err == nil && len(data) == 0 {
+			continue
+		}
+		return data, err
+	}
+}
+
+// TestStreamReadTimeout tests that a read timing out midway through a packet
+// header does not lose the stream's framing
+func TestStreamReadTimeout(t *testing.T) {
+	listener, err := ListenStream("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	raw, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	raw.Write([]byte{0x00})
+	if _, err := conn.ReadPacket(); err == nil {
+		t.Fatal("ReadPacket returned with half a header")
+	} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("ReadPacket error %v is not a timeout", err)
+	}
+	raw.Write([]byte{0x03, 'a', 'b', 'c'})
+	if got, err := conn.ReadPacket(); err != nil || string(got) != "abc" {
+		t.Fatalf("ReadPacket = %q, %v", got, err)
+	}
+
+	if err := conn.WritePacket(make([]byte, MaxStreamPacketSize+1)); err == nil {
+		t.Errorf("Oversized packet accepted")
+	}
+}
+
+// TestReadDeadlineMidPacket tests that a read deadline passing while a
+// packet arrives on a stream connection lets the packet be read whole, keeps
+// the connection open and only cuts short the wait for the next packet
+func TestReadDeadlineMidPacket(t *testing.T) {
+	listener, err := ListenStream("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	raw, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	stream, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	ws := &WSConn{conn: local, reader: bufio.NewReader(local)}
+	wsFrame := wsOpFrame(wsOpBinary, []byte("abcdef"), false)
+
+	for _, tc := range []struct {
+		name   string
+		conn   ConnAdapter
+		writer net.Conn
+		packet []byte
+	}{
+		{"tcp", stream, raw, []byte{0x00, 0x06, 'a', 'b', 'c', 'd', 'e', 'f'}},
+		{"ws", ws, remote, wsFrame},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			go func() {
+				tc.writer.Write(tc.packet[:4])
+				time.Sleep(50 * time.Millisecond)
+				// Wake the reader while it waits for the rest of the packet
+				tc.conn.SetReadDeadline(time.Now())
+				time.Sleep(50 * time.Millisecond)
+				tc.writer.Write(tc.packet[4:])
+			}()
+			if got, err := tc.conn.ReadPacket(); err != nil || string(got) != "abcdef" {
+				t.Fatalf("ReadPacket = %q, %v", got, err)
+			}
+
+			// The passed deadline applies to the next packet
+			start := time.Now()
+			if _, err := tc.conn.ReadPacket(); err == nil {
+				t.Fatal("ReadPacket returned without a packet")
+			} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				t.Fatalf("ReadPacket error %v is not a timeout", err)
+			}
+			if elapsed := time.Since(start); elapsed >= ReadTimeoutDuration {
+				t.Errorf("Expected the passed deadline to end the wait at once, took %v", elapsed)
+			}
+
+			// The connection is still usable once the deadline is cleared
+			tc.conn.SetReadDeadline(time.Time{})
+			go tc.writer.Write(tc.packet)
+			if got, err := readSkippingTimeouts(tc.conn); err != nil || string(got) != "abcdef" {
+				t.Fatalf("ReadPacket after clearing the deadline = %q, %v", got, err)
+			}
+		})
+	}
+}
+
+// TestListenerReadDeadline tests that setting the read deadline of a UDP
+// listener connection wakes a blocked ReadPacket, and that clearing it lets
+// the next packet through
+func TestListenerReadDeadline(t *testing.T) {
+	listener, err := ListenWithMode("127.0.0.1:0", ModeUDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := DialWithMode(listener.Addr().String(), time.Second, ModeUDP)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	if err := client.WritePacket([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer server.Close()
+	if got, err := readSkippingTimeouts(server); err != nil || string(got) != "hello" {
+		t.Fatalf("Server read %q, %v", got, err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := server.ReadPacket()
+		errCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	server.SetReadDeadline(time.Now())
+	select {
+	case err := <-errCh:
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Fatalf("Expected a timeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadPacket not woken by the deadline")
+	}
+	if _, err := server.ReadPacket(); err == nil {
+		t.Fatal("Expected reads to fail past the deadline")
+	}
+
+	server.SetReadDeadline(time.Time{})
+	if err := client.WritePacket([]byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readSkippingTimeouts(server); err != nil || string(got) != "again" {
+		t.Fatalf("Server read %q, %v", got, err)
+	}
+}
@@ -0,0 +1,340 @@
+package faketcp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"hash"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/rawsocket"
+)
+
+// SYN flood protection. A listener answers SYNs without allocating a
+// connection: the ISN of its SYN-ACK is a cookie, a keyed hash of the
+// 4-tuple, the peer's ISN and a coarse clock that also carries the options
+// the SYN offered. Only a third ACK acknowledging a valid cookie creates a
+// ConnRaw, so a spoofed SYN costs one hash and one SYN-ACK.
+//
+// The socket filter only passes SYNs and known peers, so peers that were sent
+// a SYN-ACK are kept in a small half-open table, limited per source address
+// and in total, to let their third ACK and first data through. While the
+// table is full the filter falls back to the listening port alone, and
+// cookies keep working without table entries until the flood stops.
+// Completed connections are capped too, and a full accept queue drops new
+// ones instead of piling them up.
+
+const (
+	// cookieSlot is the granularity of the cookie clock; a cookie is valid
+	// in the slot it was made in and the next one
+	cookieSlot = 64 * time.Second
+	// halfOpenTimeout is how long a half-open entry waits for the third ACK
+	halfOpenTimeout = 10 * time.Second
+	// maxHalfOpenPerIP bounds the half-open entries of one source address;
+	// further SYNs from it are dropped
+	maxHalfOpenPerIP = 16
+	// maxHalfOpen bounds the half-open table
+	maxHalfOpen = 256
+	// maxListenerConns bounds the connections of a listener
+	maxListenerConns = 4096
+	// acceptBacklog is the number of connections waiting for Accept
+	acceptBacklog = 128
+)
+
+// Options of the SYN carried in a cookie
+const (
+	cookieTS   = 1 << 0
+	cookieWS   = 1 << 1
+	cookieSACK = 1 << 2
+)
+
+// synCookies makes and checks the ISNs of stateless SYN-ACKs. It is only used
+// from the accept loop.
+type synCookies struct {
+	mac hash.Hash
+	buf [21]byte
+	sum []byte
+}
+
+func newSYNCookies() *synCookies {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Printf("⚠️  Failed to generate SYN cookie secret: %v", err)
+	}
+	return &synCookies{mac: hmac.New(sha256.New, secret)}
+}
+
+// cookieSlotAt returns the cookie clock at t
+func cookieSlotAt(t time.Time) uint32 {
+	return uint32(t.Unix() / int64(cookieSlot/time.Second))
+}
+
+// make returns the ISN answering a SYN: 5 bits of clock, 3 option bits and
+// 24 bits of hash
+func (s *synCookies) make(seg *rawsocket.Segment, opts uint8, now time.Time) uint32 {
+	return s.cookie(seg, seg.Seq, cookieSlotAt(now), opts)
+}
+
+// check reports whether the acknowledgment of a third ACK is a valid cookie
+// and returns the options it carries
+func (s *synCookies) check(seg *rawsocket.Segment, now time.Time) (uint8, bool) {
+	isn := seg.Ack - 1
+	opts := uint8(isn>>24) & 0x07
+	cur := cookieSlotAt(now)
+	for _, slot := range []uint32{cur, cur - 1} {
+		if slot&0x1f != isn>>27 {
+			continue
+		}
+		want := s.cookie(seg, seg.Seq-1, slot, opts)
+		return opts, subtle.ConstantTimeEq(int32(want), int32(isn)) == 1
+	}
+	return 0, false
+}
+
+func (s *synCookies) cookie(seg *rawsocket.Segment, peerISN, slot uint32, opts uint8) uint32 {
+	b := s.buf[:]
+	copy(b[0:4], seg.SrcIP.To4())
+	binary.BigEndian.PutUint16(b[4:6], seg.SrcPort)
+	copy(b[6:10], seg.DstIP.To4())
+	binary.BigEndian.PutUint16(b[10:12], seg.DstPort)
+	binary.BigEndian.PutUint32(b[12:16], peerISN)
+	binary.BigEndian.PutUint32(b[16:20], slot)
+	b[20] = opts
+	s.mac.Reset()
+	s.mac.Write(b)
+	s.sum = s.mac.Sum(s.sum[:0])
+	h := binary.BigEndian.Uint32(s.sum) & 0x00ffffff
+	return (slot&0x1f)<<27 | uint32(opts&0x07)<<24 | h
+}
+
+// cookieOptions returns the cookie bits of the options a SYN offered
+func cookieOptions(options []byte) uint8 {
+	var opts uint8
+	scanOptions(options, func(kind byte, data []byte) {
+		switch kind {
+		case optTS:
+			if len(data) == 8 {
+				opts |= cookieTS
+			}
+		case optWS:
+			opts |= cookieWS
+		case optSACKPerm:
+			opts |= cookieSACK
+		}
+	})
+	return opts
+}
+
+// newStackStateFromCookie rebuilds the stack state of a connection opened by
+// a cookie. The peer's options come from the cookie, and the timestamp clock
+// continues from the TSval of our SYN-ACK, which the third ACK echoes.
+func newStackStateFromCookie(p *Profile, opts uint8, options []byte) *stackState {
+	s := newStackState(p)
+	s.peerSeen = true
+	s.peerTS = opts&cookieTS != 0
+	s.peerWS = opts&cookieWS != 0
+	s.peerSACK = opts&cookieSACK != 0
+	scanOptions(options, func(kind byte, data []byte) {
+		if kind == optTS && len(data) == 8 {
+			s.tsRecent = binary.BigEndian.Uint32(data[0:4])
+			s.tsOffset = binary.BigEndian.Uint32(data[4:8])
+		}
+	})
+	return s
+}
+
+// halfOpenConn is a peer that was sent a SYN-ACK and may answer it
+type halfOpenConn struct {
+	ip      net.IP
+	port    uint16
+	expires time.Time
+}
+
+// ListenerStats counts how a listener handled connection attempts
+type ListenerStats struct {
+	SYNs           uint64 // SYNs received
+	Accepted       uint64 // Connections opened by a valid cookie
+	InvalidCookies uint64 // ACKs from unknown peers without a valid cookie
+	DroppedPerIP   uint64 // SYNs dropped by the per-address half-open limit
+	HalfOpenFull   uint64 // SYNs answered without a half-open entry
+	DroppedCap     uint64 // Handshakes dropped by the connection cap
+	DroppedBacklog uint64 // Handshakes dropped because Accept fell behind
+	Resets         uint64 // Segments from unknown peers answered with a reset
+	HalfOpen       int    // Current half-open entries
+	Conns          int    // Current connections
+}
+
+// listenerCounters are the counters of ListenerStats, updated atomically
+type listenerCounters struct {
+	syns, accepted, invalidCookies, droppedPerIP, halfOpenFull, droppedCap, droppedBacklog, resets uint64
+}
+
+// Stats returns the listener's connection counters
+func (l *ListenerRaw) Stats() ListenerStats {
+	l.mu.RLock()
+	halfOpen, conns := len(l.halfOpen), len(l.connMap)
+	l.mu.RUnlock()
+	c := &l.counters
+	return ListenerStats{
+		SYNs:           atomic.LoadUint64(&c.syns),
+		Accepted:       atomic.LoadUint64(&c.accepted),
+		InvalidCookies: atomic.LoadUint64(&c.invalidCookies),
+		DroppedPerIP:   atomic.LoadUint64(&c.droppedPerIP),
+		HalfOpenFull:   atomic.LoadUint64(&c.halfOpenFull),
+		DroppedCap:     atomic.LoadUint64(&c.droppedCap),
+		DroppedBacklog: atomic.LoadUint64(&c.droppedBacklog),
+		Resets:         atomic.LoadUint64(&c.resets),
+		HalfOpen:       halfOpen,
+		Conns:          conns,
+	}
+}
+
+// handleSYNLocked answers a SYN with a cookie SYN-ACK, recording the peer in
+// the half-open table if the limits allow. Must be called with l.mu held.
+func (l *ListenerRaw) handleSYNLocked(key string, seg *rawsocket.Segment) {
+	atomic.AddUint64(&l.counters.syns, 1)
+	now := time.Now()
+
+	if ho, exists := l.halfOpen[key]; exists {
+		// A retransmitted SYN
+		ho.expires = now.Add(halfOpenTimeout)
+	} else {
+		ipKey := seg.SrcIP.String()
+		switch {
+		case l.halfOpenPerIP[ipKey] >= maxHalfOpenPerIP:
+			atomic.AddUint64(&l.counters.droppedPerIP, 1)
+			return
+		case len(l.halfOpen) >= maxHalfOpen:
+			atomic.AddUint64(&l.counters.halfOpenFull, 1)
+		default:
+			l.halfOpen[key] = &halfOpenConn{ip: seg.SrcIP, port: seg.SrcPort, expires: now.Add(halfOpenTimeout)}
+			l.halfOpenPerIP[ipKey]++
+			l.updateFilterLocked()
+		}
+	}
+
+	opts := cookieOptions(seg.Options)
+	isn := l.cookies.make(seg, opts, now)
+	stack := newStackState(TCPProfile)
+	stack.onReceive(SYN, seg.Seq, seg.Seq, seg.Options)
+	err := l.rawSocket.SendSegment(seg.DstIP, seg.DstPort, seg.SrcIP, seg.SrcPort, isn, seg.Seq+1, SYN|ACK,
+		stack.headerFields(SYN|ACK), stack.options(SYN|ACK), nil)
+	if err != nil {
+		log.Printf("Failed to send SYN-ACK to %s: %v", key, err)
+	}
+}
+
+// handleCookieLocked opens the connection acknowledged by a third ACK with a
+// valid cookie and queues it for Accept. It returns nil, and resets the
+// peer, if the segment is not such an ACK or the connection cannot be taken,
+// so that the peer does not take the handshake for complete. Must be called
+// with l.mu held.
+func (l *ListenerRaw) handleCookieLocked(key string, seg *rawsocket.Segment) *ConnRaw {
+	now := time.Now()
+	opts, ok := l.cookies.check(seg, now)
+	if !ok {
+		atomic.AddUint64(&l.counters.invalidCookies, 1)
+		l.resetUnknownLocked(seg)
+		return nil
+	}
+	if l.removeHalfOpenLocked(key) {
+		l.updateFilterLocked()
+	}
+	if len(l.connMap) >= maxListenerConns {
+		atomic.AddUint64(&l.counters.droppedCap, 1)
+		l.resetUnknownLocked(seg)
+		return nil
+	}
+
+	conn := &ConnRaw{
+		rawSocket:     l.rawSocket,
+		localIP:       seg.DstIP,
+		localPort:     seg.DstPort,
+		remoteIP:      seg.SrcIP,
+		remotePort:    seg.SrcPort,
+		srcPort:       seg.DstPort,
+		dstPort:       seg.SrcPort,
+		seqNum:        seg.Ack,
+		isConnected:   true,
+		recvQueue:     make(chan []byte, rawRecvQueueSize),
+		done:          make(chan struct{}),
+		closeDone:     make(chan struct{}),
+		ruleMgr:       l.ruleMgr,
+		rstFilter:     l.rstFilter,
+		stack:         newStackStateFromCookie(TCPProfile, opts, seg.Options),
+		stopCh:        make(chan struct{}),
+		isListener:    true,
+		ownsResources: false, // 服务端连接不拥有资源（共享）
+		lastActivity:  now,
+	}
+	conn.rcv.init(seg.Seq)
+
+	select {
+	case l.acceptQueue <- conn:
+	default:
+		atomic.AddUint64(&l.counters.droppedBacklog, 1)
+		l.resetUnknownLocked(seg)
+		return nil
+	}
+	atomic.AddUint64(&l.counters.accepted, 1)
+
+	l.connMap[key] = conn
+	l.updateFilterLocked()
+	if l.rstFilter != nil {
+		if err := l.rstFilter.AddConn(seg.DstIP, seg.DstPort, seg.SrcIP, seg.SrcPort); err != nil {
+			log.Printf("⚠️  Failed to add eBPF RST filter entry for %s: %v", key, err)
+		}
+	}
+	return conn
+}
+
+// removeHalfOpenLocked drops a half-open entry and reports whether it
+// existed. Must be called with l.mu held.
+func (l *ListenerRaw) removeHalfOpenLocked(key string) bool {
+	ho, exists := l.halfOpen[key]
+	if !exists {
+		return false
+	}
+	delete(l.halfOpen, key)
+	ipKey := ho.ip.String()
+	if l.halfOpenPerIP[ipKey]--; l.halfOpenPerIP[ipKey] <= 0 {
+		delete(l.halfOpenPerIP, ipKey)
+	}
+	return true
+}
+
+// expireHalfOpen drops half-open entries whose third ACK never came
+func (l *ListenerRaw) expireHalfOpen(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	expired := false
+	for key, ho := range l.halfOpen {
+		if now.After(ho.expires) {
+			l.removeHalfOpenLocked(key)
+			expired = true
+		}
+	}
+	if expired {
+		l.updateFilterLocked()
+	}
+}
+
+// logStats reports the counters since last if any limit was hit
+func (l *ListenerRaw) logStats(last *ListenerStats) {
+	s := l.Stats()
+	if s.DroppedPerIP != last.DroppedPerIP || s.HalfOpenFull != last.HalfOpenFull ||
+		s.DroppedCap != last.DroppedCap || s.DroppedBacklog != last.DroppedBacklog {
+		log.Printf("⚠️  SYN flood protection on port %d: %d SYNs, %d accepted, %d invalid cookies, "+
+			"%d dropped by per-IP limit, %d without half-open entry, %d dropped by connection cap, "+
+			"%d dropped by full accept queue (%d half-open, %d connections)",
+			l.localPort, s.SYNs-last.SYNs, s.Accepted-last.Accepted, s.InvalidCookies-last.InvalidCookies,
+			s.DroppedPerIP-last.DroppedPerIP, s.HalfOpenFull-last.HalfOpenFull,
+			s.DroppedCap-last.DroppedCap, s.DroppedBacklog-last.DroppedBacklog, s.HalfOpen, s.Conns)
+	}
+	*last = s
+}
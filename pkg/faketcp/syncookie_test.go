@@ -0,0 +1,98 @@
+package faketcp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/rawsocket"
+)
+
+// TestSYNCookie tests that a third ACK is only accepted with the cookie of
+// its own SYN, within two clock slots, and that the SYN's options come back
+func TestSYNCookie(t *testing.T) {
+	s := newSYNCookies()
+	now := time.Now()
+	syn := &rawsocket.Segment{
+		SrcIP: net.IPv4(10, 0, 0, 2).To4(), SrcPort: 41000,
+		DstIP: net.IPv4(10, 0, 0, 1).To4(), DstPort: 9000,
+		Seq: 0xfffffff0, Flags: SYN,
+	}
+	opts := uint8(cookieTS | cookieSACK)
+	isn := s.make(syn, opts, now)
+	ack := *syn
+	ack.Seq, ack.Ack, ack.Flags = syn.Seq+1, isn+1, ACK
+
+	if got, ok := s.check(&ack, now); !ok || got != opts {
+		t.Fatalf("Valid cookie: options %#x, ok %v", got, ok)
+	}
+	if _, ok := s.check(&ack, now.Add(cookieSlot)); !ok {
+		t.Errorf("Cookie from the previous slot rejected")
+	}
+	if _, ok := s.check(&ack, now.Add(2*cookieSlot)); ok {
+		t.Errorf("Expired cookie accepted")
+	}
+
+	other := ack
+	other.SrcPort++
+	if _, ok := s.check(&other, now); ok {
+		t.Errorf("Cookie accepted from another port")
+	}
+	other = ack
+	other.Ack ^= 1 << 24 // Flip an option bit
+	if _, ok := s.check(&other, now); ok {
+		t.Errorf("Cookie with altered options accepted")
+	}
+	if _, ok := newSYNCookies().check(&ack, now); ok {
+		t.Errorf("Cookie accepted with another secret")
+	}
+}
+
+// TestStackStateFromCookie tests that a connection opened by a cookie keeps
+// the negotiated options and continues the SYN-ACK's timestamp clock
+func TestStackStateFromCookie(t *testing.T) {
+	linux, _ := LookupProfile("linux-6.x")
+	synOpts := []byte{optMSS, 4, 0x05, 0xb4, optSACKPerm, 2, optTS, 10, 0, 0, 0, 1, 0, 0, 0, 0, optNOP, optWS, 3, 7}
+	opts := cookieOptions(synOpts)
+	if opts != cookieTS|cookieWS|cookieSACK {
+		t.Fatalf("Cookie options %#x", opts)
+	}
+
+	ackOpts := []byte{optNOP, optNOP, optTS, 10, 0, 0, 0, 5, 0x12, 0x34, 0x56, 0x78}
+	s := newStackStateFromCookie(linux, opts, ackOpts)
+	if !s.peerTS || !s.peerWS || !s.peerSACK {
+		t.Errorf("Options lost: %+v", s)
+	}
+	if s.tsRecent != 5 {
+		t.Errorf("TS.Recent %d", s.tsRecent)
+	}
+	data := s.options(ACK)
+	if len(data) != 12 {
+		t.Fatalf("Options %x", data)
+	}
+	tsval := uint32(data[4])<<24 | uint32(data[5])<<16 | uint32(data[6])<<8 | uint32(data[7])
+	if tsval-0x12345678 > 1000 {
+		t.Errorf("TSval %#x does not continue the SYN-ACK's", tsval)
+	}
+}
+
+// TestSYNCookieBacklogFullResets tests that a handshake with a valid cookie
+// that cannot be queued for Accept is reset rather than left half done
+func TestSYNCookieBacklogFullResets(t *testing.T) {
+	listener, addr := newRawTestListener(t)
+	defer listener.Close()
+	listener.mu.Lock()
+	listener.acceptQueue = make(chan *ConnRaw)
+	listener.mu.Unlock()
+
+	client, err := DialRaw(addr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("DialRaw: %v", err)
+	}
+	defer client.Close()
+
+	waitReset(t, client)
+	if s := listener.Stats(); s.DroppedBacklog == 0 || s.Resets == 0 {
+		t.Errorf("Expected a dropped and reset handshake, got %+v", s)
+	}
+}
@@ -0,0 +1,302 @@
+package faketcp
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/rawsocket"
+)
+
+// Connection teardown. Closing a connection sends FIN+ACK like a real stack,
+// and the peer's FIN is acknowledged and ends ReadPacket at once, so the
+// tunnel notices a closed connection in one round trip instead of after its
+// idle timeout. The side that closed first, listener or client, keeps the
+// connection in TIME_WAIT for a while, answering retransmitted FINs and stray
+// segments with an ACK instead of letting the kernel reset them. Resets do
+// not end TIME_WAIT (RFC 1337).
+//
+// Abort ends a connection with an RST+ACK instead, like a stack without a
+// listening socket would, and leaves nothing in TIME_WAIT. A listener answers
+// segments of connections it does not know the same way, e.g. after a
+// restart, so that their clients reconnect at once.
+//
+// Resets follow RFC 5961: only an RST+ACK at exactly the next expected
+// sequence number closes the connection, other resets in the window get a
+// challenge ACK. Plain RSTs are what a kernel without our socket answers to
+// segments carrying ACK (e.g. on macOS, where they cannot be suppressed), so
+// they never close the connection by themselves; one in the window gets a
+// challenge ACK too, which a listener that lost the connection answers with
+// an RST+ACK and a live peer ignores.
+
+const (
+	// finWaitTimeout bounds how long a client's Close waits for the closing
+	// handshake before releasing its socket
+	finWaitTimeout = 1 * time.Second
+	// timeWaitDuration is how long a closed connection stays in TIME_WAIT
+	timeWaitDuration = 20 * time.Second
+	// maxTimeWait bounds the TIME_WAIT table of a listener
+	maxTimeWait = 4096
+	// rstWindow is the part of the sequence space above the next expected
+	// sequence number in which a reset gets a challenge ACK
+	rstWindow = 1 << 16
+	// challengeACKInterval is the least time between two challenge ACKs of a
+	// connection, which keeps a peer kernel resetting each of them from
+	// starting a storm
+	challengeACKInterval = time.Second
+	// maxResetsPerSecond bounds the resets a listener sends to unknown peers
+	maxResetsPerSecond = 100
+	// unknownSample is how many segments from unknown peers the listener's
+	// socket filter lets through one of
+	unknownSample = 16
+)
+
+// connAborted is the closed value of a connection ended by Abort
+const connAborted = 2
+
+var (
+	errConnClosed = errors.New("connection closed")
+	errPeerClosed = errors.New("connection closed by peer")
+	errPeerReset  = errors.New("connection reset by peer")
+)
+
+// timeWaitConn is a closed connection kept to answer retransmissions
+type timeWaitConn struct {
+	conn    *ConnRaw
+	expires time.Time
+}
+
+// shutdown ends ReadPacket with err once queued data is read. The first
+// reason wins.
+func (c *ConnRaw) shutdown(err error) {
+	c.doneOnce.Do(func() {
+		c.doneErr = err
+		close(c.done)
+	})
+}
+
+// Abort resets the connection instead of closing it. Its eBPF RST filter
+// entry is removed first so that the RST gets out; firewall rules let it
+// out anyway, as they skip the segments we mark as our own.
+func (c *ConnRaw) Abort() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, connAborted) {
+		return nil
+	}
+	c.shutdown(errConnClosed)
+	c.rcv.stop()
+
+	if c.rstFilter != nil {
+		if err := c.rstFilter.RemoveConn(c.localIP, c.localPort, c.remoteIP, c.remotePort); err != nil {
+			log.Printf("⚠️  Failed to remove eBPF RST filter entry for %s:%d: %v", c.remoteIP, c.remotePort, err)
+		}
+	}
+	c.mu.Lock()
+	err := c.sendSegment(c.seqNum, RST|ACK, nil)
+	c.mu.Unlock()
+
+	c.release()
+	return err
+}
+
+// sendFIN sends our FIN, which consumes one sequence number
+func (c *ConnRaw) sendFIN() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.finSent {
+		return
+	}
+	c.finSent = true
+	if err := c.sendSegment(c.seqNum, FIN|ACK, nil); err != nil {
+		log.Printf("Failed to send FIN to %s:%d: %v", c.remoteIP, c.remotePort, err)
+	}
+	c.seqNum++
+}
+
+// onACK records the peer acknowledging our FIN
+func (c *ConnRaw) onACK(ack uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.finSent && !c.finACKed && ack == c.seqNum {
+		c.finACKed = true
+		c.checkClosedLocked()
+	}
+}
+
+// onPeerFIN acknowledges the peer's FIN and shuts the connection down. It
+// reports whether our FIN went out first, which puts the connection in
+// TIME_WAIT.
+func (c *ConnRaw) onPeerFIN(seq uint32, payloadLen int) bool {
+	c.rcv.advance(seq + uint32(payloadLen) + 1)
+
+	c.mu.Lock()
+	c.peerFIN = true
+	c.checkClosedLocked()
+	seqToUse := c.seqNum
+	finSent := c.finSent
+	c.mu.Unlock()
+
+	if err := c.sendSegment(seqToUse, ACK, nil); err != nil {
+		log.Printf("Failed to send ACK for FIN to %s:%d: %v", c.remoteIP, c.remotePort, err)
+	}
+	c.shutdown(errPeerClosed)
+	return finSent
+}
+
+// checkClosedLocked signals Close once both FINs are acknowledged. Must be
+// called with c.mu held.
+func (c *ConnRaw) checkClosedLocked() {
+	if c.peerFIN && c.finACKed {
+		select {
+		case <-c.closeDone:
+		default:
+			close(c.closeDone)
+		}
+	}
+}
+
+// rstVerdict is what a reset from the peer does to a connection
+type rstVerdict int
+
+const (
+	rstIgnore    rstVerdict = iota // Outside the window
+	rstChallenge                   // Answered with a challenge ACK
+	rstClose                       // Closes the connection
+)
+
+// classifyRST decides what a reset from the peer does
+func (c *ConnRaw) classifyRST(seq uint32, flags uint8) rstVerdict {
+	nxt := c.rcv.next()
+	switch {
+	case seq == nxt && flags&ACK != 0:
+		return rstClose
+	case seq == nxt || seqBefore(nxt, seq) && seqBefore(seq, nxt+rstWindow):
+		return rstChallenge
+	}
+	return rstIgnore
+}
+
+// onRST handles a reset from the peer and reports whether it closed the
+// connection
+func (c *ConnRaw) onRST(seq uint32, flags uint8) bool {
+	switch c.classifyRST(seq, flags) {
+	case rstClose:
+		c.shutdown(errPeerReset)
+		return true
+	case rstChallenge:
+		c.mu.Lock()
+		now := time.Now()
+		due := now.Sub(c.lastChallenge) >= challengeACKInterval
+		if due {
+			c.lastChallenge = now
+		}
+		c.mu.Unlock()
+		if due {
+			c.sendACK()
+		}
+	}
+	return false
+}
+
+// enterTimeWaitLocked moves a closed connection from connMap to the
+// TIME_WAIT table. Its RST suppression stays in place until it expires. Must
+// be called with l.mu held.
+func (l *ListenerRaw) enterTimeWaitLocked(key string) {
+	conn, exists := l.connMap[key]
+	if !exists {
+		return
+	}
+	if len(l.timeWait) >= maxTimeWait || atomic.LoadInt32(&conn.closed) == connAborted {
+		l.removeConnLocked(key)
+		return
+	}
+	delete(l.connMap, key)
+	l.timeWait[key] = &timeWaitConn{conn: conn, expires: time.Now().Add(timeWaitDuration)}
+}
+
+// removeTimeWaitLocked drops a connection from the TIME_WAIT table. Must be
+// called with l.mu held.
+func (l *ListenerRaw) removeTimeWaitLocked(key string) {
+	tw, exists := l.timeWait[key]
+	if !exists {
+		return
+	}
+	delete(l.timeWait, key)
+	l.unfilterConn(key, tw.conn)
+}
+
+// timeWaitSegmentLocked answers a segment for a connection in TIME_WAIT: a
+// FIN or data is acknowledged again, a reset is ignored. Must be called with
+// l.mu held.
+func (l *ListenerRaw) timeWaitSegmentLocked(key string, tw *timeWaitConn, seq uint32, flags uint8, payloadLen int) {
+	conn := tw.conn
+	switch {
+	case flags&RST != 0:
+		// Ending TIME_WAIT early would let old duplicates of the connection
+		// be taken for a new one (RFC 1337)
+	case flags&FIN != 0 || payloadLen > 0:
+		if flags&FIN != 0 {
+			conn.rcv.advance(seq + uint32(payloadLen) + 1)
+		}
+		conn.mu.Lock()
+		seqToUse := conn.seqNum
+		conn.mu.Unlock()
+		if err := conn.sendSegment(seqToUse, ACK, nil); err != nil {
+			log.Printf("Failed to send TIME_WAIT ACK to %s: %v", key, err)
+		}
+	}
+}
+
+// expireTimeWait drops connections whose TIME_WAIT is over
+func (l *ListenerRaw) expireTimeWait(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	expired := false
+	for key, tw := range l.timeWait {
+		if now.After(tw.expires) {
+			l.removeTimeWaitLocked(key)
+			expired = true
+		}
+	}
+	if expired {
+		l.updateFilterLocked()
+	}
+}
+
+// resetUnknownLocked answers a segment of a connection the listener does not
+// know with an RST+ACK, at most maxResetsPerSecond times a second. Must be
+// called with l.mu held.
+func (l *ListenerRaw) resetUnknownLocked(seg *rawsocket.Segment) {
+	if seg.Flags&RST != 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(l.resetsSince) >= time.Second {
+		l.resetsSince, l.resets = now, 0
+	}
+	if l.resets >= maxResetsPerSecond {
+		return
+	}
+	l.resets++
+	atomic.AddUint64(&l.counters.resets, 1)
+
+	// The reset takes the place of the segment the peer expects next, and
+	// acknowledges everything it sent
+	seq := seg.Ack
+	if seg.Flags&ACK == 0 {
+		seq = 0
+	}
+	ack := seg.Seq + uint32(len(seg.Payload))
+	if seg.Flags&SYN != 0 {
+		ack++
+	}
+	if seg.Flags&FIN != 0 {
+		ack++
+	}
+	stack := newStackState(TCPProfile)
+	err := l.rawSocket.SendSegment(seg.DstIP, seg.DstPort, seg.SrcIP, seg.SrcPort, seq, ack, RST|ACK,
+		stack.headerFields(RST|ACK), nil, nil)
+	if err != nil {
+		log.Printf("Failed to send RST to %s:%d: %v", seg.SrcIP, seg.SrcPort, err)
+	}
+}
@@ -0,0 +1,149 @@
+package faketcp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/rawsocket"
+)
+
+// TestReadAfterShutdown tests that data queued before the peer closed is
+// still read, followed by the reason the connection closed
+func TestReadAfterShutdown(t *testing.T) {
+	c := &ConnRaw{
+		isConnected: true,
+		recvQueue:   make(chan []byte, 4),
+		done:        make(chan struct{}),
+	}
+	c.queueSegment(&rawsocket.Segment{Flags: PSH | ACK, Payload: []byte("last")})
+	c.shutdown(errPeerClosed)
+	c.shutdown(errPeerReset)
+
+	if data, err := c.ReadPacket(); err != nil || string(data) != "last" {
+		t.Fatalf("ReadPacket = %q, %v", data, err)
+	}
+	if _, err := c.ReadPacket(); err != errPeerClosed {
+		t.Fatalf("ReadPacket error %v, want %v", err, errPeerClosed)
+	}
+}
+
+// TestOnRST tests that only RST+ACK at the expected sequence number resets
+// the connection
+func TestOnRST(t *testing.T) {
+	c := &ConnRaw{done: make(chan struct{})}
+	c.rcv.init(1000)
+
+	for _, r := range []struct {
+		seq   uint32
+		flags uint8
+		want  rstVerdict
+	}{
+		{1000, RST | ACK, rstClose},
+		{1000, RST, rstChallenge}, // Plain RSTs never close by themselves
+		{1500, RST | ACK, rstChallenge},
+		{1500, RST, rstChallenge},
+		{500, RST | ACK, rstIgnore},
+		{1000 + rstWindow, RST, rstIgnore},
+	} {
+		if got := c.classifyRST(r.seq, r.flags); got != r.want {
+			t.Errorf("Expected verdict %d for RST seq %d flags %#x, got %d", r.want, r.seq, r.flags, got)
+		}
+	}
+
+	if c.onRST(500, RST|ACK) {
+		t.Errorf("RST below the window accepted")
+	}
+	if !c.onRST(1000, RST|ACK) {
+		t.Fatalf("RST+ACK at the expected sequence number ignored")
+	}
+	select {
+	case <-c.done:
+	default:
+		t.Errorf("Connection not shut down")
+	}
+	if c.doneErr != errPeerReset {
+		t.Errorf("Close reason %v", c.doneErr)
+	}
+}
+
+// newRawTestListener starts a raw listener on a random loopback port with
+// the eBPF RST filter, skipping the test where raw sockets are unavailable
+func newRawTestListener(t *testing.T) (*ListenerRaw, string) {
+	prev := RSTFilterMode
+	RSTFilterMode = RSTFilterEBPF
+	t.Cleanup(func() { RSTFilterMode = prev })
+
+	addr := fmt.Sprintf("127.0.0.1:%d", 30000+randomUint32Value()%20000)
+	listener, err := ListenRaw(addr)
+	if err != nil {
+		t.Skipf("Raw sockets unavailable: %v", err)
+	}
+	return listener, addr
+}
+
+// waitReset writes to conn until ReadPacket fails, and checks that it
+// failed because the peer reset the connection
+func waitReset(t *testing.T, conn *ConnRaw) {
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			_, err := conn.ReadPacket()
+			if netErr, ok := err.(net.Error); err != nil && (!ok || !netErr.Timeout()) {
+				readErr <- err
+				return
+			}
+		}
+	}()
+	deadline := time.After(5 * time.Second)
+	for {
+		conn.WritePacket([]byte("stale"))
+		select {
+		case err := <-readErr:
+			if err != errPeerReset {
+				t.Fatalf("Expected %v, got %v", errPeerReset, err)
+			}
+			return
+		case <-time.After(20 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("Expected the connection to be reset")
+		}
+	}
+}
+
+// TestServerRestartResets tests that a client whose server restarted is reset
+// by the new listener instead of waiting for its idle timeout
+func TestServerRestartResets(t *testing.T) {
+	listener, addr := newRawTestListener(t)
+	accepted := make(chan *ConnRaw, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	client, err := DialRaw(addr, 2*time.Second)
+	if err != nil {
+		listener.Close()
+		t.Fatalf("DialRaw: %v", err)
+	}
+	defer client.Close()
+	select {
+	case <-accepted:
+	case <-time.After(2 * time.Second):
+		listener.Close()
+		t.Fatalf("Expected the connection to be accepted")
+	}
+
+	// The server goes away without closing the connection and comes back
+	listener.Close()
+	if listener, err = ListenRaw(addr); err != nil {
+		t.Fatalf("ListenRaw after restart: %v", err)
+	}
+	defer listener.Close()
+
+	waitReset(t, client)
+	if listener.Stats().Resets == 0 {
+		t.Errorf("Expected the reset to be counted")
+	}
+}
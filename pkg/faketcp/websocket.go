@@ -0,0 +1,460 @@
+package faketcp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WebSocket transport: packets as binary messages of a WebSocket connection,
+// over TLS for wss. It passes HTTP-only proxies and CDNs: the client can
+// reach the server through an HTTP CONNECT proxy, and the server can sit
+// behind a reverse proxy that forwards one path to it.
+const (
+	// wsMaxMessage bounds the messages accepted from the peer
+	wsMaxMessage = 1 << 20
+	// wsMaxPendingUpgrades bounds the connections still in their handshake
+	wsMaxPendingUpgrades = 64
+)
+
+// WebSocketOptions configures the ws and wss transports
+type WebSocketOptions struct {
+	Path     string // Path of the Upgrade request (default "/")
+	Host     string // Client: Host header and TLS server name (default: the remote address)
+	Proxy    string // Client: HTTP CONNECT proxy, http://[user:password@]host:port
+	CertFile string // wss server: certificate (PEM)
+	KeyFile  string // wss server: private key (PEM)
+	Insecure bool   // wss client: skip verification of the server certificate
+}
+
+var (
+	wsOptions = WebSocketOptions{Path: "/"}
+	wsProxy   *url.URL
+	wsCert    *tls.Certificate
+)
+
+var errWSClosed = errors.New("websocket closed by peer")
+
+// SetWebSocket sets the options of new ws and wss connections
+func SetWebSocket(opts WebSocketOptions) error {
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	if opts.Path[0] != '/' {
+		return fmt.Errorf("websocket path %q must start with /", opts.Path)
+	}
+	var proxy *url.URL
+	if opts.Proxy != "" {
+		u, err := url.Parse(opts.Proxy)
+		if err != nil || u.Scheme != "http" || u.Hostname() == "" {
+			return fmt.Errorf("invalid proxy %q (want http://[user:password@]host:port)", opts.Proxy)
+		}
+		proxy = u
+	}
+	var cert *tls.Certificate
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		c, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load websocket certificate: %v", err)
+		}
+		cert = &c
+	}
+	wsOptions, wsProxy, wsCert = opts, proxy, cert
+	return nil
+}
+
+// WSConn is a packet connection over WebSocket
+type WSConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	client bool       // Frames from the client are masked
+	rmu    sync.Mutex // Serializes readers so messages are not interleaved
+	wmu    sync.Mutex // Serializes writers
+
+	deadline packetDeadline
+}
+
+// WebSocketListener accepts WebSocket connections, upgrading them in the
+// background so slow handshakes do not hold up Accept
+type WebSocketListener struct {
+	listener  net.Listener
+	ready     chan *WSConn
+	pending   chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// DialWebSocket connects to the remote address, through the proxy if one is
+// set, and upgrades the connection
+func DialWebSocket(remoteAddr string, timeout time.Duration, secure bool) (*WSConn, error) {
+	conn, err := wsDialTCP(remoteAddr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	host := wsOptions.Host
+	if host == "" {
+		host = remoteAddr
+		// Browsers leave the default port out of the Host header
+		if h, port, err := net.SplitHostPort(remoteAddr); err == nil && ((secure && port == "443") || (!secure && port == "80")) {
+			host = h
+		}
+	}
+	if secure {
+		serverName, _, err := net.SplitHostPort(host)
+		if err != nil {
+			serverName = host
+		}
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: wsOptions.Insecure,
+			NextProtos:         []string{"http/1.1"},
+		})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake failed: %v", err)
+		}
+		conn = tlsConn
+	}
+
+	key := base64.StdEncoding.EncodeToString(randomBytes(16))
+	if _, err := conn.Write(wsUpgradeRequest(wsOptions.Path, host, key)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send upgrade request: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read upgrade response: %v", err)
+	}
+	if err := checkWSUpgrade(resp, key); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &WSConn{conn: conn, reader: reader, client: true}, nil
+}
+
+// wsDialTCP opens the TCP connection to addr, tunnelled through the HTTP
+// proxy if one is set
+func wsDialTCP(addr string, timeout time.Duration) (net.Conn, error) {
+	if wsProxy == nil {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial TCP: %v", err)
+		}
+		return conn, nil
+	}
+
+	proxyAddr := wsProxy.Host
+	if wsProxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(wsProxy.Hostname(), "80")
+	}
+	conn, err := net.DialTimeout("tcp", proxyAddr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial proxy: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	request := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if user := wsProxy.User; user != nil {
+		password, _ := user.Password()
+		request += "Proxy-Authorization: Basic " +
+			base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)) + "\r\n"
+	}
+	if _, err := conn.Write([]byte(request + "\r\n")); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read proxy response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT: %s", resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		// The server never speaks first, so this cannot be its data
+		conn.Close()
+		return nil, fmt.Errorf("proxy sent data after its CONNECT response")
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// ListenWebSocket listens for WebSocket connections on addr; a wss listener
+// needs the certificate of SetWebSocket
+func ListenWebSocket(addr string, secure bool) (*WebSocketListener, error) {
+	if secure && wsCert == nil {
+		return nil, fmt.Errorf("a wss server needs a certificate and key (or plain ws behind a TLS reverse proxy)")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on TCP: %v", err)
+	}
+	if secure {
+		listener = tls.NewListener(listener, &tls.Config{
+			Certificates: []tls.Certificate{*wsCert},
+			NextProtos:   []string{"http/1.1"},
+		})
+	}
+	l := &WebSocketListener{
+		listener: listener,
+		ready:    make(chan *WSConn, tunables.ListenerQueueSize),
+		pending:  make(chan struct{}, wsMaxPendingUpgrades),
+		closed:   make(chan struct{}),
+	}
+	go l.serve()
+	return l, nil
+}
+
+// serve accepts TCP connections and upgrades them
+func (l *WebSocketListener) serve() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			l.Close()
+			return
+		}
+		select {
+		case l.pending <- struct{}{}:
+			go func() {
+				defer func() { <-l.pending }()
+				l.upgrade(conn)
+			}()
+		default:
+			conn.Close()
+		}
+	}
+}
+
+// upgrade answers the Upgrade request of a new connection; other requests,
+// and upgrades of other paths, get the 404 of a plain web server
+func (l *WebSocketListener) upgrade(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	key, err := wsUpgradeKey(req)
+	if err != nil || req.URL.Path != wsOptions.Path {
+		conn.Write(wsNotFound())
+		conn.Close()
+		return
+	}
+	if _, err := conn.Write(wsSwitchingProtocols(key)); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	select {
+	case l.ready <- &WSConn{conn: conn, reader: reader}:
+	case <-l.closed:
+		conn.Close()
+	default:
+		log.Printf("accept queue full (%d), dropping websocket connection from %s", tunables.ListenerQueueSize, conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// wsNotFound is the response of nginx to an unknown path
+func wsNotFound() []byte {
+	body := "<html>\r\n<head><title>404 Not Found</title></head>\r\n<body>\r\n" +
+		"<center><h1>404 Not Found</h1></center>\r\n<hr><center>nginx</center>\r\n</body>\r\n</html>\r\n"
+	return []byte("HTTP/1.1 404 Not Found\r\n" +
+		"Server: nginx\r\n" +
+		"Date: " + time.Now().UTC().Format(http.TimeFormat) + "\r\n" +
+		"Content-Type: text/html\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"Connection: close\r\n\r\n" + body)
+}
+
+// Accept waits for the next upgraded connection
+func (l *WebSocketListener) Accept() (*WSConn, error) {
+	select {
+	case conn := <-l.ready:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops listening
+func (l *WebSocketListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.listener.Close()
+	})
+	return err
+}
+
+// Addr returns the listener's network address
+func (l *WebSocketListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// WritePacket sends data as one binary message
+func (c *WSConn) WritePacket(data []byte) error {
+	return c.writeFrame(wsOpBinary, data)
+}
+
+func (c *WSConn) writeFrame(op byte, payload []byte) error {
+	frame := wsOpFrame(op, payload, c.client)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.conn.Write(frame); err != nil {
+		return fmt.Errorf("failed to send packet: %v", err)
+	}
+	return nil
+}
+
+// ReadPacket receives the next data message, answering pings on the way.
+// Like the other transports it gives up after ReadTimeoutDuration with a
+// timeout error while no frame is arriving; a message that started arriving
+// is read whole.
+func (c *WSConn) ReadPacket() ([]byte, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	var message []byte
+	inMessage := false
+	for {
+		if !inMessage {
+			// Peek keeps a partially received header buffered across timeouts
+			c.deadline.waitNext(c.conn)
+			if _, err := c.reader.Peek(2); err != nil {
+				return nil, err
+			}
+		}
+		// Losing the rest of the frame would desynchronize the stream
+		c.deadline.readRest(c.conn)
+		op, fin, payload, err := readWSFrame(c.reader)
+		if err == nil && len(message)+len(payload) > wsMaxMessage {
+			err = fmt.Errorf("message exceeds %d bytes", wsMaxMessage)
+		}
+		if err != nil {
+			c.conn.Close()
+			return nil, err
+		}
+
+		switch op {
+		case wsOpBinary, wsOpText, wsOpContinuation:
+			if op != wsOpContinuation && inMessage {
+				c.conn.Close()
+				return nil, fmt.Errorf("new message inside a fragmented one")
+			}
+			message = append(message, payload...)
+			inMessage = !fin
+			if fin {
+				if message == nil {
+					message = []byte{}
+				}
+				return message, nil
+			}
+		case wsOpPing:
+			c.writeFrame(wsOpPong, payload)
+		case wsOpClose:
+			c.writeFrame(wsOpClose, payload)
+			c.conn.Close()
+			return nil, errWSClosed
+		}
+	}
+}
+
+// readWSFrame reads one frame, returning its opcode, FIN bit and unmasked
+// payload
+func readWSFrame(r *bufio.Reader) (byte, bool, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, false, nil, err
+	}
+	fin := header[0]&wsFin != 0
+	op := header[0] & 0x0f
+	masked := header[1]&wsMask != 0
+	n := uint64(header[1] &^ wsMask)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, false, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, false, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > wsMaxMessage {
+		return 0, false, nil, fmt.Errorf("frame of %d bytes exceeds %d", n, wsMaxMessage)
+	}
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return 0, false, nil, err
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, false, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= key[i&3]
+		}
+	}
+	return op, fin, payload, nil
+}
+
+// Close closes the connection
+func (c *WSConn) Close() error {
+	return c.conn.Close()
+}
+
+// LocalAddr returns the local address
+func (c *WSConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address; behind a reverse proxy, the proxy's
+func (c *WSConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline sets read and write deadlines (see SetReadDeadline)
+func (c *WSConn) SetDeadline(t time.Time) error {
+	c.deadline.set(c.conn, t)
+	return c.conn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline. A message that is arriving when it
+// passes is still read whole.
+func (c *WSConn) SetReadDeadline(t time.Time) error {
+	return c.deadline.set(c.conn, t)
+}
+
+// SetWriteDeadline sets the write deadline
+func (c *WSConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
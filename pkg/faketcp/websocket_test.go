@@ -0,0 +1,218 @@
+package faketcp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWebSocket tests that packets pass both ways over ws, over wss, and
+// through an authenticating CONNECT proxy
+func TestWebSocket(t *testing.T) {
+	defer SetWebSocket(WebSocketOptions{})
+	certFile, keyFile := writeTestCert(t)
+	proxy := startConnectProxy(t, "alice", "s3cret")
+
+	tests := []struct {
+		name string
+		mode Mode
+		opts WebSocketOptions
+	}{
+		{"ws", ModeWS, WebSocketOptions{Path: "/tunnel"}},
+		{"wss", ModeWSS, WebSocketOptions{Path: "/tunnel", CertFile: certFile, KeyFile: keyFile, Insecure: true}},
+		{"proxy", ModeWS, WebSocketOptions{Path: "/tunnel", Proxy: "http://alice:s3cret@" + proxy}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetWebSocket(tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			listener, err := ListenWithMode("127.0.0.1:0", tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			client, err := DialWithMode(listener.Addr().String(), 2*time.Second, tt.mode)
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			defer client.Close()
+			server, err := listener.Accept()
+			if err != nil {
+				t.Fatalf("Accept: %v", err)
+			}
+			defer server.Close()
+
+			packet := bytes.Repeat([]byte{0x42}, 1400)
+			if err := client.WritePacket(packet); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := readSkippingTimeouts(server); err != nil || !bytes.Equal(got, packet) {
+				t.Fatalf("Server read %d bytes, %v", len(got), err)
+			}
+			if err := server.WritePacket([]byte("reply")); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := readSkippingTimeouts(client); err != nil || string(got) != "reply" {
+				t.Fatalf("Client read %q, %v", got, err)
+			}
+		})
+	}
+
+	t.Run("proxy auth", func(t *testing.T) {
+		SetWebSocket(WebSocketOptions{Proxy: "http://alice:wrong@" + proxy})
+		if _, err := DialWebSocket("127.0.0.1:1", time.Second, false); err == nil || !strings.Contains(err.Error(), "407") {
+			t.Errorf("Dial with wrong proxy password: %v", err)
+		}
+	})
+}
+
+// TestWebSocketUpgradePath tests that requests for other paths get a 404 and
+// never reach Accept
+func TestWebSocketUpgradePath(t *testing.T) {
+	defer SetWebSocket(WebSocketOptions{})
+	SetWebSocket(WebSocketOptions{Path: "/tunnel"})
+	listener, err := ListenWebSocket("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	for _, request := range []string{
+		string(wsUpgradeRequest("/", "example.com", "dGhlIHNhbXBsZSBub25jZQ==")),
+		"GET /tunnel HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	} {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(request))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err != nil || resp.StatusCode != http.StatusNotFound || resp.Header.Get("Server") != "nginx" {
+			t.Errorf("Response to %q: %v, %v", strings.SplitN(request, "\r\n", 2)[0], resp, err)
+		}
+	}
+	select {
+	case conn := <-listener.ready:
+		t.Errorf("Connection from %s accepted", conn.RemoteAddr())
+	default:
+	}
+}
+
+// TestWSReadPacket tests that fragmented messages are reassembled and pings
+// answered
+func TestWSReadPacket(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	conn := &WSConn{conn: local, reader: bufio.NewReader(local)}
+
+	go func() {
+		remote.Write([]byte{wsOpBinary, 0x80 | 3, 1, 2, 3, 4, 'a', 'b', 'c'}) // Masked, not final
+		remote.Write(wsOpFrame(wsOpPing, []byte("hi"), true))
+		remote.Write(wsOpFrame(wsOpContinuation, []byte("def"), true))
+	}()
+	pong := make(chan []byte, 1)
+	go func() {
+		op, _, payload, err := readWSFrame(bufio.NewReader(remote))
+		if err != nil || op != wsOpPong {
+			t.Errorf("Expected pong, got opcode %d, %v", op, err)
+		}
+		pong <- payload
+	}()
+
+	got, err := conn.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{'a' ^ 1, 'b' ^ 2, 'c' ^ 3, 'd', 'e', 'f'}
+	if !bytes.Equal(got, want) {
+		t.Errorf("ReadPacket = %q, want %q", got, want)
+	}
+	if p := <-pong; string(p) != "hi" {
+		t.Errorf("Pong carries %q", p)
+	}
+}
+
+// startConnectProxy runs an HTTP CONNECT proxy requiring basic authentication
+func startConnectProxy(t *testing.T, user, password string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				if req.Header.Get("Proxy-Authorization") != auth {
+					conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n"))
+					return
+				}
+				upstream, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"))
+					return
+				}
+				defer upstream.Close()
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go io.Copy(upstream, reader)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// writeTestCert writes a self-signed certificate and its key
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
@@ -0,0 +1,135 @@
+package iptables
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Rule ownership. Every firewall rule added by this process is tagged with
+// an instance tag naming the process, and the process holds an flock on a
+// lock file named after the tag for as long as it runs. Rules whose lock
+// file exists but is no longer locked were left behind by a process that
+// was killed and can be removed. PIDs are not compared: processes in other
+// PID namespaces (containers sharing the network namespace) may reuse ours
+// or be invisible to kill(2).
+
+// TagPrefix starts every instance tag
+const TagPrefix = "lightweight-tunnel:"
+
+// OwnMark is the firewall mark of the segments this program sends itself.
+// Drop-RST rules only match unmarked segments, so they keep dropping the
+// kernel's RSTs but let out the RSTs we send on purpose (e.g. on Abort).
+const OwnMark = 0x4c54
+
+// lockDir holds the lock files of running instances
+var lockDir = "/run/lightweight-tunnel"
+
+var (
+	instanceTag = newInstanceTag()
+	lockOnce    sync.Once
+	lockFile    *os.File // Held until the process exits
+)
+
+// newInstanceTag builds the tag of this process: its PID plus a random part
+// telling it apart from any other process with the same PID.
+func newInstanceTag() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s%d:%s", TagPrefix, os.Getpid(), hex.EncodeToString(b))
+}
+
+// InstanceTag returns the tag of this process, locking its lock file first
+// so that rules carrying the tag are never taken for orphans
+func InstanceTag() string {
+	lockOnce.Do(lockInstance)
+	return instanceTag
+}
+
+// lockInstance creates and locks the lock file of this process. If that
+// fails the rules of this process are never cleaned up automatically, which
+// is the safe side.
+func lockInstance() {
+	path, _ := lockPath(instanceTag)
+	if err := os.MkdirAll(lockDir, 0755); err != nil {
+		log.Printf("⚠️  Failed to create lock directory %s: %v", lockDir, err)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		log.Printf("⚠️  Failed to create lock file %s: %v", path, err)
+		return
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		log.Printf("⚠️  Failed to lock %s: %v", path, err)
+		f.Close()
+		return
+	}
+	lockFile = f
+}
+
+// lockPath returns the lock file of an instance tag
+func lockPath(tag string) (string, bool) {
+	if !strings.HasPrefix(tag, TagPrefix) {
+		return "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(tag, TagPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	if _, err := strconv.Atoi(parts[0]); err != nil {
+		return "", false
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil {
+		return "", false
+	}
+	return filepath.Join(lockDir, parts[0]+"-"+parts[1]+".lock"), true
+}
+
+// IsOrphanTag reports whether tag belongs to a process that is no longer
+// running: its lock file exists and nobody holds it. Tags of other tools,
+// and tags without a lock file (e.g. of an instance with its own /run), are
+// never orphans.
+func IsOrphanTag(tag string) bool {
+	if tag == instanceTag {
+		return false
+	}
+	path, ok := lockPath(tag)
+	if !ok {
+		return false
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err != nil {
+		return false
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return true
+}
+
+// RemoveStaleLocks deletes the lock files nobody holds any more. It should
+// only run once the rules of those instances are gone, as their rules are
+// no longer recognised as orphans afterwards.
+func RemoveStaleLocks() {
+	paths, _ := filepath.Glob(filepath.Join(lockDir, "*.lock"))
+	for _, path := range paths {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			continue
+		}
+		if syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil {
+			os.Remove(path)
+		}
+		f.Close()
+	}
+}
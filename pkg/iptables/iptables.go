@@ -7,8 +7,12 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 )
 
+// unmarked matches the segments not sent by us, see OwnMark
+var unmarked = fmt.Sprintf("-m mark ! --mark %#x", OwnMark)
+
 // IPTablesManager manages iptables rules for raw socket TCP
 type IPTablesManager struct {
 	rules []string
@@ -39,12 +43,13 @@ func (m *IPTablesManager) AddRuleForPort(port uint16, isServer bool) error {
 		// Server: drop RST packets sent by kernel in response to raw TCP packets
 		// Match TCP packets destined to port 9000 with RST flag set
 		// This catches RST packets kernel sends when it doesn't recognize our raw TCP sessions
-		rule = fmt.Sprintf("OUTPUT -p tcp --dport %d --tcp-flags RST RST -j DROP", port)
+		rule = fmt.Sprintf("OUTPUT -p tcp --dport %d --tcp-flags RST RST %s -j DROP", port, unmarked)
 	} else {
 		// Client: drop RST packets sent by kernel for our outgoing raw TCP connections
 		// Match TCP packets from our source port with RST flag set
-		rule = fmt.Sprintf("OUTPUT -p tcp --sport %d --tcp-flags RST RST -j DROP", port)
+		rule = fmt.Sprintf("OUTPUT -p tcp --sport %d --tcp-flags RST RST %s -j DROP", port, unmarked)
 	}
+	rule = tagRule(rule)
 
 	// Check if rule already exists
 	if m.ruleExists(rule) {
@@ -83,18 +88,20 @@ func (m *IPTablesManager) AddRuleForConnection(localIP string, localPort uint16,
 	if isServer {
 		// Server: drop RST for this specific connection
 		rules = []string{
-			fmt.Sprintf("OUTPUT -p tcp --tcp-flags RST RST -s %s --sport %d -d %s --dport %d -j DROP",
-				localIP, localPort, remoteIP, remotePort),
+			fmt.Sprintf("OUTPUT -p tcp --tcp-flags RST RST -s %s --sport %d -d %s --dport %d %s -j DROP",
+				localIP, localPort, remoteIP, remotePort, unmarked),
 		}
 	} else {
 		// Client: drop RST for this specific connection
 		rules = []string{
-			fmt.Sprintf("OUTPUT -p tcp --tcp-flags RST RST -s %s --sport %d -d %s --dport %d -j DROP",
-				localIP, localPort, remoteIP, remotePort),
+			fmt.Sprintf("OUTPUT -p tcp --tcp-flags RST RST -s %s --sport %d -d %s --dport %d %s -j DROP",
+				localIP, localPort, remoteIP, remotePort, unmarked),
 		}
 	}
 
 	for _, rule := range rules {
+		rule = tagRule(rule)
+
 		// Check if rule already exists
 		if m.ruleExists(rule) {
 			log.Printf("iptables rule already exists: %s", rule)
@@ -174,9 +181,9 @@ func (m *IPTablesManager) ruleExists(rule string) bool {
 // GenerateRule generates an iptables rule string without adding it
 func GenerateRule(port uint16, isServer bool) string {
 	if isServer {
-		return fmt.Sprintf("iptables -A OUTPUT -p tcp --tcp-flags RST RST --sport %d -j DROP", port)
+		return fmt.Sprintf("iptables -A OUTPUT -p tcp --tcp-flags RST RST --sport %d %s -j DROP", port, unmarked)
 	}
-	return fmt.Sprintf("iptables -A OUTPUT -p tcp --tcp-flags RST RST --sport %d -j DROP", port)
+	return fmt.Sprintf("iptables -A OUTPUT -p tcp --tcp-flags RST RST --sport %d %s -j DROP", port, unmarked)
 }
 
 // isMacOS checks if the current OS is macOS
@@ -202,46 +209,110 @@ func CheckIPTablesAvailable() error {
 	return nil
 }
 
-// ClearAllRules removes all rules (static method for cleanup)
+// monitorInterval is how often MonitorAndReAdd checks the rules
+const monitorInterval = 10 * time.Second
+
+// MonitorAndReAdd monitors iptables and automatically re-adds rules if they are removed
+// (e.g. by a firewall manager reloading its ruleset)
 // On macOS, this is a no-op
-func ClearAllRules(port uint16) error {
+func (m *IPTablesManager) MonitorAndReAdd(stopCh <-chan struct{}) {
 	if isMacOS() {
-		return nil
+		<-stopCh
+		return
 	}
 
-	rules := []string{
-		fmt.Sprintf("OUTPUT -p tcp --tcp-flags RST RST --sport %d -j DROP", port),
-		fmt.Sprintf("OUTPUT -p tcp --tcp-flags RST RST --dport %d -j DROP", port),
+	ticker := time.NewTicker(monitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		m.mu.Lock()
+		for _, rule := range m.rules {
+			if m.ruleExists(rule) {
+				continue
+			}
+			args := append([]string{"-A"}, strings.Split(rule, " ")...)
+			if output, err := exec.Command("iptables", args...).CombinedOutput(); err != nil {
+				log.Printf("⚠️  Failed to re-add removed iptables rule %s: %v, output: %s", rule, err, output)
+				continue
+			}
+			log.Printf("⚠️  iptables rule was removed externally, re-added: iptables -A %s", rule)
+		}
+		m.mu.Unlock()
 	}
+}
 
-	var errors []string
-	for _, rule := range rules {
-		// Try to remove the rule (ignore errors if it doesn't exist)
-		args := strings.Split(rule, " ")
-		args = append([]string{"-D"}, args...)
+// tagRule tags a rule with the instance tag of this process
+func tagRule(rule string) string {
+	return strings.Replace(rule, " -j ", " -m comment --comment "+InstanceTag()+" -j ", 1)
+}
 
-		cmd := exec.Command("iptables", args...)
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			// Ignore "No chain/target/match by that name" errors
-			if !strings.Contains(string(output), "No chain/target/match") {
-				errors = append(errors, fmt.Sprintf("failed to remove rule '%s': %v", rule, err))
-			}
+// CleanupRules removes tagged rules from the OUTPUT chain: those of processes
+// that are no longer running, or with all set every tagged rule. It returns
+// the number of rules removed.
+// On macOS, this is a no-op
+func CleanupRules(all bool) (int, error) {
+	if isMacOS() {
+		return 0, nil
+	}
+
+	output, err := exec.Command("iptables", "-S", "OUTPUT").CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list iptables rules: %v, output: %s", err, output)
+	}
+
+	removed := 0
+	var errors []string
+	for _, r := range parseTaggedRules(string(output)) {
+		if !all && !IsOrphanTag(r.tag) {
+			continue
+		}
+		args := append([]string{"-D"}, r.spec...)
+		if out, err := exec.Command("iptables", args...).CombinedOutput(); err != nil {
+			errors = append(errors, fmt.Sprintf("failed to remove rule '%s': %v, output: %s", strings.Join(r.spec, " "), err, out))
+			continue
 		}
+		log.Printf("Removed iptables rule of %s: %s", r.tag, strings.Join(r.spec, " "))
+		removed++
 	}
 
 	if len(errors) > 0 {
-		return fmt.Errorf("errors clearing rules: %s", strings.Join(errors, "; "))
+		return removed, fmt.Errorf("errors cleaning up rules: %s", strings.Join(errors, "; "))
 	}
+	return removed, nil
+}
 
-	return nil
+// taggedRule is a rule listed by iptables -S that carries an instance tag
+type taggedRule struct {
+	spec []string // Rule specification after -A, starting with the chain
+	tag  string
 }
 
-// MonitorAndReAdd monitors iptables and automatically re-adds rules if they are removed
-func (m *IPTablesManager) MonitorAndReAdd(stopCh <-chan struct{}) {
-	// This is a placeholder for future implementation
-	// Can periodically check if rules still exist and re-add them if necessary
-	<-stopCh
+// parseTaggedRules extracts the tagged rules from iptables -S output
+func parseTaggedRules(output string) []taggedRule {
+	var rules []taggedRule
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "-A" {
+			continue
+		}
+		r := taggedRule{spec: make([]string, 0, len(fields)-1)}
+		for i, f := range fields[1:] {
+			f = strings.Trim(f, "\"")
+			if fields[i] == "--comment" && strings.HasPrefix(f, TagPrefix) {
+				r.tag = f
+			}
+			r.spec = append(r.spec, f)
+		}
+		if r.tag != "" {
+			rules = append(rules, r)
+		}
+	}
+	return rules
 }
 
 // GetRules returns all active rules managed by this manager
@@ -0,0 +1,78 @@
+package iptables
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestParseTaggedRules tests finding tagged rules in iptables -S output
+func TestParseTaggedRules(t *testing.T) {
+	output := `-P OUTPUT ACCEPT
+-A OUTPUT -p tcp -m tcp --sport 9000 --tcp-flags RST RST -m comment --comment "lightweight-tunnel:123:00ff00ff" -j DROP
+-A OUTPUT -p tcp -m tcp --dport 22 -m comment --comment "ssh" -j ACCEPT
+-A OUTPUT -p tcp -m tcp --sport 9001 --tcp-flags RST RST -j DROP
+`
+	rules := parseTaggedRules(output)
+	if len(rules) != 1 {
+		t.Fatalf("Expected 1 tagged rule, got %d", len(rules))
+	}
+	if rules[0].tag != "lightweight-tunnel:123:00ff00ff" {
+		t.Errorf("Unexpected tag %q", rules[0].tag)
+	}
+	want := "OUTPUT -p tcp -m tcp --sport 9000 --tcp-flags RST RST -m comment --comment lightweight-tunnel:123:00ff00ff -j DROP"
+	if got := strings.Join(rules[0].spec, " "); got != want {
+		t.Errorf("Unexpected rule spec:\n got %s\nwant %s", got, want)
+	}
+}
+
+// TestIsOrphanTag tests recognising tags of processes that are gone by their
+// lock files
+func TestIsOrphanTag(t *testing.T) {
+	oldDir := lockDir
+	lockDir = t.TempDir()
+	defer func() { lockDir = oldDir }()
+
+	if IsOrphanTag(InstanceTag()) {
+		t.Errorf("Own tag reported as orphan")
+	}
+	if IsOrphanTag("ssh") {
+		t.Errorf("Foreign tag reported as orphan")
+	}
+
+	// Without a lock file nothing is known about the owner, e.g. a process
+	// with our PID in another PID namespace
+	samePID := fmt.Sprintf("%s%d:deadbeef", TagPrefix, os.Getpid())
+	if IsOrphanTag(samePID) {
+		t.Errorf("Tag without a lock file reported as orphan")
+	}
+
+	// A held lock file belongs to a running process
+	path, _ := lockPath(samePID)
+	held, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := syscall.Flock(int(held.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatalf("Flock: %v", err)
+	}
+	if IsOrphanTag(samePID) {
+		t.Errorf("Tag with a held lock file reported as orphan")
+	}
+	RemoveStaleLocks()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Held lock file removed: %v", err)
+	}
+
+	// Once the process is gone its lock is released
+	held.Close()
+	if !IsOrphanTag(samePID) {
+		t.Errorf("Tag with a released lock file not reported as orphan")
+	}
+	RemoveStaleLocks()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Stale lock file not removed: %v", err)
+	}
+}
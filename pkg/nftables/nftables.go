@@ -0,0 +1,43 @@
+// Package nftables manages the firewall rules that keep the kernel from
+// resetting raw socket TCP connections on hosts using nftables. Unlike
+// package iptables it talks to the kernel over netlink instead of running a
+// binary, and keeps all of its rules in one dedicated table that can be
+// removed as a whole.
+package nftables
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/iptables"
+)
+
+const (
+	// TableName is the nftables table holding all rules of the tunnel
+	TableName = "lightweight-tunnel"
+	// ChainName is the output chain in TableName
+	ChainName = "output"
+
+	tcpFlagRST = 0x04
+
+	// monitorInterval is how often MonitorAndReAdd checks the rules
+	monitorInterval = 10 * time.Second
+)
+
+// ruleTag prefixes a rule description with the instance tag of this process
+// (see iptables.InstanceTag), which is how rules are owned
+func ruleTag(rule string) string {
+	return iptables.InstanceTag() + " " + rule
+}
+
+// instanceOf returns the instance tag of a rule tag
+func instanceOf(tag string) string {
+	instance, _, _ := strings.Cut(tag, " ")
+	return instance
+}
+
+// portTag identifies the rule of a local port
+func portTag(port uint16) string {
+	return fmt.Sprintf("rst-drop sport %d", port)
+}
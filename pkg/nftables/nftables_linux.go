@@ -0,0 +1,281 @@
+package nftables
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	nft "github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/openbmx/lightweight-tunnel/pkg/iptables"
+	"golang.org/x/sys/unix"
+)
+
+// NFTablesManager manages drop-RST rules in the lightweight-tunnel nftables
+// table. Rules are added and removed over netlink in atomic batches and are
+// tagged with the instance tag of the process so they can be found again.
+// The table is shared by all processes, so a manager only ever deletes its
+// own rules and leaves the table in place.
+type NFTablesManager struct {
+	mu    sync.Mutex
+	conn  *nft.Conn
+	rules []nftRule
+	done  bool
+}
+
+// nftRule is a rule added by a manager, kept to re-add it if removed
+type nftRule struct {
+	tag   string
+	exprs []expr.Any
+}
+
+var (
+	policyAccept = nft.ChainPolicyAccept
+	table        = &nft.Table{Family: nft.TableFamilyIPv4, Name: TableName}
+	chain        = &nft.Chain{
+		Name:     ChainName,
+		Table:    table,
+		Type:     nft.ChainTypeFilter,
+		Hooknum:  nft.ChainHookOutput,
+		Priority: nft.ChainPriorityFilter,
+		Policy:   &policyAccept,
+	}
+)
+
+// NewNFTablesManager creates a manager, setting up the table and its output
+// chain if they do not exist yet.
+func NewNFTablesManager() (*NFTablesManager, error) {
+	conn, err := nft.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open nftables netlink connection: %v", err)
+	}
+
+	conn.AddTable(table)
+	conn.AddChain(chain)
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to create nftables table %s: %v", TableName, err)
+	}
+	return &NFTablesManager{conn: conn}, nil
+}
+
+// AddRuleForPort adds a rule dropping RST packets sent from a local port.
+// isServer is accepted for symmetry with IPTablesManager: the kernel's RSTs
+// leave from our port on both sides.
+func (m *NFTablesManager) AddRuleForPort(port uint16, isServer bool) error {
+	tag := portTag(port)
+	exprs := append(matchTCP(), matchPayload(expr.PayloadBaseTransportHeader, 0, binaryutil.BigEndian.PutUint16(port))...)
+	return m.addRule(tag, exprs)
+}
+
+// RemoveAllRules removes all rules added by this manager.
+func (m *NFTablesManager) RemoveAllRules() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.done {
+		return nil
+	}
+	m.done = true
+
+	tags := make(map[string]bool, len(m.rules))
+	for _, r := range m.rules {
+		tags[r.tag] = true
+	}
+	m.rules = nil
+	if _, err := m.deleteRules(func(t string) bool { return tags[t] }); err != nil {
+		return fmt.Errorf("failed to remove nftables rules: %v", err)
+	}
+	return nil
+}
+
+// GetRules returns the tags of the rules added by this manager
+func (m *NFTablesManager) GetRules() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rules := make([]string, 0, len(m.rules))
+	for _, r := range m.rules {
+		rules = append(rules, r.tag)
+	}
+	return rules
+}
+
+// MonitorAndReAdd periodically checks the rules of this manager and re-adds
+// the table, chain or rules if another tool removed them (e.g. a firewall
+// manager flushing the ruleset)
+func (m *NFTablesManager) MonitorAndReAdd(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(monitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		m.mu.Lock()
+		if !m.done && len(m.rules) > 0 {
+			if err := m.restoreRules(); err != nil {
+				log.Printf("⚠️  Failed to restore nftables rules: %v", err)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// restoreRules re-creates missing rules in one batch, together with the
+// table and chain if needed. Must be called with m.mu held.
+func (m *NFTablesManager) restoreRules() error {
+	present := make(map[string]bool)
+	if rules, err := m.conn.GetRules(table, chain); err == nil {
+		for _, r := range rules {
+			present[string(r.UserData)] = true
+		}
+	}
+
+	var missing []nftRule
+	for _, r := range m.rules {
+		if !present[r.tag] {
+			missing = append(missing, r)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	m.conn.AddTable(table)
+	m.conn.AddChain(chain)
+	for _, r := range missing {
+		m.conn.AddRule(&nft.Rule{Table: table, Chain: chain, Exprs: r.exprs, UserData: []byte(r.tag)})
+	}
+	if err := m.conn.Flush(); err != nil {
+		return err
+	}
+	log.Printf("⚠️  %d nftables rules were removed externally, re-added", len(missing))
+	return nil
+}
+
+func (m *NFTablesManager) addRule(tag string, exprs []expr.Any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.done {
+		return fmt.Errorf("nftables manager is closed")
+	}
+	tag = ruleTag(tag)
+	for _, r := range m.rules {
+		if r.tag == tag {
+			return nil
+		}
+	}
+
+	exprs = append(exprs, matchRST()...)
+	exprs = append(exprs, matchUnmarked()...)
+	exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictDrop})
+	// The table may have been deleted by another tool, so
+	// make sure it exists in the same batch
+	m.conn.AddTable(table)
+	m.conn.AddChain(chain)
+	m.conn.AddRule(&nft.Rule{
+		Table:    table,
+		Chain:    chain,
+		Exprs:    exprs,
+		UserData: []byte(tag),
+	})
+	if err := m.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to add nftables rule %s: %v", tag, err)
+	}
+	m.rules = append(m.rules, nftRule{tag: tag, exprs: exprs})
+	log.Printf("Added nftables rule: %s", tag)
+	return nil
+}
+
+// deleteRules deletes the rules whose tag matches in one batch. It returns
+// the number of rules deleted.
+func (m *NFTablesManager) deleteRules(match func(tag string) bool) (int, error) {
+	return deleteRules(m.conn, match)
+}
+
+func deleteRules(conn *nft.Conn, match func(tag string) bool) (int, error) {
+	if _, err := conn.ListTableOfFamily(TableName, nft.TableFamilyIPv4); err != nil {
+		// No table, nothing to delete
+		return 0, nil
+	}
+	rules, err := conn.GetRules(table, chain)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, r := range rules {
+		if match(string(r.UserData)) {
+			if err := conn.DelRule(r); err != nil {
+				return 0, err
+			}
+			deleted++
+		}
+	}
+	if deleted == 0 {
+		return 0, nil
+	}
+	if err := conn.Flush(); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// matchTCP matches TCP packets.
+func matchTCP() []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+	}
+}
+
+// matchPayload matches packet bytes at an offset from a header.
+func matchPayload(base expr.PayloadBase, offset uint32, data []byte) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: base, Offset: offset, Len: uint32(len(data))},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data},
+	}
+}
+
+// matchRST matches TCP segments with the RST flag set.
+func matchRST() []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 13, Len: 1},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 1, Mask: []byte{tcpFlagRST}, Xor: []byte{0}},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0}},
+	}
+}
+
+// matchUnmarked matches packets without our own firewall mark, so the RSTs
+// we send on purpose are not dropped.
+func matchUnmarked() []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(iptables.OwnMark)},
+	}
+}
+
+// CheckNFTablesAvailable checks if nftables can be managed over netlink
+func CheckNFTablesAvailable() error {
+	conn, err := nft.New()
+	if err != nil {
+		return fmt.Errorf("nftables not available: %v", err)
+	}
+	if _, err := conn.ListTablesOfFamily(nft.TableFamilyIPv4); err != nil {
+		return fmt.Errorf("nftables not available: %v", err)
+	}
+	return nil
+}
+
+// CleanupRules deletes tagged rules of processes that are no longer running,
+// or with all set every rule. It returns the number of rules deleted.
+func CleanupRules(all bool) (int, error) {
+	conn, err := nft.New()
+	if err != nil {
+		return 0, err
+	}
+	return deleteRules(conn, func(tag string) bool {
+		return all || iptables.IsOrphanTag(instanceOf(tag))
+	})
+}
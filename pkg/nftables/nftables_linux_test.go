@@ -0,0 +1,126 @@
+package nftables
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+
+	nft "github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+// TestNFTablesManager tests rule lifecycle in a private network namespace
+// (needs root)
+func TestNFTablesManager(t *testing.T) {
+	skip := make(chan error, 1)
+	done := make(chan error, 1)
+	go func() {
+		// The thread is left in the new namespace and discarded on exit
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			skip <- fmt.Errorf("cannot create network namespace: %v", err)
+			return
+		}
+		if err := CheckNFTablesAvailable(); err != nil {
+			skip <- err
+			return
+		}
+		done <- testManager()
+	}()
+	select {
+	case err := <-skip:
+		t.Skipf("%v", err)
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testManager() error {
+	countRules := func() int {
+		conn, _ := nft.New()
+		rules, err := conn.GetRules(table, chain)
+		if err != nil {
+			return -1
+		}
+		return len(rules)
+	}
+
+	a, err := NewNFTablesManager()
+	if err != nil {
+		return fmt.Errorf("NewNFTablesManager: %v", err)
+	}
+	b, err := NewNFTablesManager()
+	if err != nil {
+		return fmt.Errorf("NewNFTablesManager: %v", err)
+	}
+	if err := a.AddRuleForPort(9000, true); err != nil {
+		return fmt.Errorf("AddRuleForPort: %v", err)
+	}
+	if err := a.AddRuleForPort(9000, true); err != nil {
+		return fmt.Errorf("AddRuleForPort again: %v", err)
+	}
+	if err := b.AddRuleForPort(30000, false); err != nil {
+		return fmt.Errorf("AddRuleForPort: %v", err)
+	}
+	if err := b.AddRuleForPort(30001, false); err != nil {
+		return fmt.Errorf("AddRuleForPort: %v", err)
+	}
+	if n := countRules(); n != 3 {
+		return fmt.Errorf("Expected 3 rules, got %d", n)
+	}
+
+	// Rules removed by another tool are restored
+	if err := deleteTable(); err != nil {
+		return fmt.Errorf("deleting table: %v", err)
+	}
+	for _, m := range []*NFTablesManager{a, b} {
+		m.mu.Lock()
+		err := m.restoreRules()
+		m.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("restoreRules: %v", err)
+		}
+	}
+	if n := countRules(); n != 3 {
+		return fmt.Errorf("Expected 3 rules after restoring, got %d", n)
+	}
+
+	// Only rules of processes that are gone are cleaned up
+	if n, err := CleanupRules(false); err != nil || n != 0 {
+		return fmt.Errorf("CleanupRules removed %d rules of a running process: %v", n, err)
+	}
+
+	// The table stays while another manager uses it
+	if err := a.RemoveAllRules(); err != nil {
+		return fmt.Errorf("RemoveAllRules: %v", err)
+	}
+	if n := countRules(); n != 2 || len(b.GetRules()) != 2 {
+		return fmt.Errorf("Expected 2 rules after the first manager left, got %d", n)
+	}
+	if err := b.RemoveAllRules(); err != nil {
+		return fmt.Errorf("RemoveAllRules: %v", err)
+	}
+	if n := countRules(); n != 0 {
+		return fmt.Errorf("Expected 0 rules after the last manager left, got %d", n)
+	}
+
+	// The shared table stays for other processes
+	conn, _ := nft.New()
+	if _, err := conn.ListTableOfFamily(TableName, nft.TableFamilyIPv4); err != nil {
+		return fmt.Errorf("table deleted by a manager: %v", err)
+	}
+	return nil
+}
+
+// deleteTable deletes the table the way another tool flushing the ruleset
+// would
+func deleteTable() error {
+	conn, err := nft.New()
+	if err != nil {
+		return err
+	}
+	conn.DelTable(table)
+	return conn.Flush()
+}
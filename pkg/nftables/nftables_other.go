@@ -0,0 +1,47 @@
+//go:build !linux
+
+package nftables
+
+import "fmt"
+
+var errNotSupported = fmt.Errorf("nftables is only supported on Linux")
+
+// NFTablesManager manages drop-RST rules in the lightweight-tunnel nftables
+// table (Linux only)
+type NFTablesManager struct{}
+
+// NewNFTablesManager fails outside Linux
+func NewNFTablesManager() (*NFTablesManager, error) {
+	return nil, errNotSupported
+}
+
+// AddRuleForPort adds a rule dropping RST packets sent from a local port
+func (m *NFTablesManager) AddRuleForPort(port uint16, isServer bool) error {
+	return errNotSupported
+}
+
+// RemoveAllRules removes all rules added by this manager
+func (m *NFTablesManager) RemoveAllRules() error {
+	return nil
+}
+
+// GetRules returns the tags of the rules added by this manager
+func (m *NFTablesManager) GetRules() []string {
+	return nil
+}
+
+// MonitorAndReAdd re-adds rules removed by other tools (no-op outside Linux)
+func (m *NFTablesManager) MonitorAndReAdd(stopCh <-chan struct{}) {
+	<-stopCh
+}
+
+// CleanupRules deletes rules of processes that are no longer running
+// (no-op outside Linux)
+func CleanupRules(all bool) (int, error) {
+	return 0, nil
+}
+
+// CheckNFTablesAvailable checks if nftables can be managed over netlink
+func CheckNFTablesAvailable() error {
+	return errNotSupported
+}
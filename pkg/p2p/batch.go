@@ -0,0 +1,278 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+)
+
+// Batched UDP I/O for the P2P socket. On Linux, ipv4.PacketConn's ReadBatch
+// and WriteBatch map to recvmmsg/sendmmsg, so one system call moves up to
+// BatchSize datagrams; on other platforms x/net falls back to one datagram
+// per call. Where the kernel supports it, UDP GRO hands over several
+// datagrams from the same peer coalesced in one buffer, and UDP GSO sends a
+// run of equal-sized datagrams to one peer as a single super-datagram.
+const (
+	// BatchSize is the number of datagrams read or written per system call
+	BatchSize = 32
+	// MaxDatagramSize is the largest single P2P datagram accepted
+	MaxDatagramSize = 9216
+	// SendQueueSize is the number of outgoing packets buffered for the sender
+	SendQueueSize = 1024
+
+	maxGROSize     = 65535 // Receive buffer size with UDP GRO
+	maxGSOSize     = 65000 // Upper bound of one GSO super-datagram payload
+	maxGSOSegments = 64    // UDP_MAX_SEGMENTS
+
+	solUDP     = 17  // SOL_UDP
+	udpSegment = 103 // UDP_SEGMENT (Linux)
+	udpGRO     = 104 // UDP_GRO (Linux)
+)
+
+// outPacket is a datagram waiting in the send queue.
+type outPacket struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// batchPacketConn is the batched I/O of an ipv4.PacketConn.
+type batchPacketConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// batchConn wraps the P2P UDP socket with batched reads and writes.
+type batchConn struct {
+	conn    *net.UDPConn
+	pc      batchPacketConn
+	gro     bool
+	gso     bool
+	rmsgs   []ipv4.Message
+	wmsgs   []ipv4.Message
+	wcounts []int  // Packets carried by each of wmsgs
+	wbuf    []byte // Scratch space for GSO super-datagrams
+	oob     []byte // Scratch space for GSO control messages
+}
+
+func newBatchConn(conn *net.UDPConn) *batchConn {
+	b := &batchConn{
+		conn: conn,
+		pc:   ipv4.NewPacketConn(conn),
+	}
+	if runtime.GOOS == "linux" {
+		b.gro = setUDPOption(conn, udpGRO, 1) == nil
+		b.gso = getUDPOption(conn, udpSegment) == nil
+	}
+
+	bufSize := MaxDatagramSize
+	if b.gro {
+		bufSize = maxGROSize
+	}
+	b.rmsgs = make([]ipv4.Message, BatchSize)
+	for i := range b.rmsgs {
+		b.rmsgs[i].Buffers = [][]byte{make([]byte, bufSize)}
+		b.rmsgs[i].OOB = make([]byte, syscall.CmsgSpace(4))
+	}
+	b.wmsgs = make([]ipv4.Message, BatchSize)
+	b.oob = make([]byte, 0, BatchSize*syscall.CmsgSpace(2))
+	return b
+}
+
+// readBatch reads up to BatchSize datagrams and calls handle for each of
+// them, splitting GRO-coalesced buffers back into datagrams. data points
+// into the receive buffers and is only valid during the call.
+func (b *batchConn) readBatch(handle func(data []byte, addr *net.UDPAddr)) error {
+	for i := range b.rmsgs {
+		b.rmsgs[i].OOB = b.rmsgs[i].OOB[:cap(b.rmsgs[i].OOB)]
+	}
+	n, err := b.pc.ReadBatch(b.rmsgs, 0)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		msg := &b.rmsgs[i]
+		addr, ok := msg.Addr.(*net.UDPAddr)
+		if !ok || msg.N == 0 {
+			continue
+		}
+		data := msg.Buffers[0][:msg.N]
+		seg := 0
+		if b.gro {
+			seg = groSegmentSize(msg.OOB[:msg.NN])
+		}
+		if seg <= 0 || seg >= len(data) {
+			handle(data, addr)
+			continue
+		}
+		for off := 0; off < len(data); off += seg {
+			end := off + seg
+			if end > len(data) {
+				end = len(data)
+			}
+			handle(data[off:end], addr)
+		}
+	}
+	return nil
+}
+
+// writeBatch sends the packets, coalescing runs of equal-sized packets to
+// the same peer with UDP GSO when available. GSO is switched off for good
+// if the kernel rejects it, and the packets not sent yet are sent again
+// without it.
+func (b *batchConn) writeBatch(pkts []outPacket) error {
+	msgs := b.buildMessages(pkts)
+	sent, err := b.writeMessages(msgs)
+	if err != nil && b.gso && len(msgs) < len(pkts) && isGSOError(err) {
+		b.gso = false
+		_, err = b.writeMessages(b.buildMessages(pkts[sent:]))
+	}
+	return err
+}
+
+// writeMessages sends messages built by buildMessages and returns the number
+// of packets they carried that went out before an error.
+func (b *batchConn) writeMessages(msgs []ipv4.Message) (int, error) {
+	sent := 0
+	for i := 0; i < len(msgs); {
+		n, err := b.pc.WriteBatch(msgs[i:], 0)
+		for _, c := range b.wcounts[i : i+n] {
+			sent += c
+		}
+		i += n
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// buildMessages turns the packets into messages, one per packet or, with
+// GSO, one per run of packets that can share a super-datagram.
+func (b *batchConn) buildMessages(pkts []outPacket) []ipv4.Message {
+	msgs := b.wmsgs[:0]
+	b.wcounts = b.wcounts[:0]
+	b.wbuf = b.wbuf[:0]
+	b.oob = b.oob[:0]
+	for i := 0; i < len(pkts); {
+		n := 1
+		if b.gso {
+			n = gsoRun(pkts[i:])
+		}
+		msg := ipv4.Message{Addr: pkts[i].addr}
+		if n == 1 {
+			msg.Buffers = [][]byte{pkts[i].data}
+		} else {
+			start := len(b.wbuf)
+			for _, p := range pkts[i : i+n] {
+				b.wbuf = append(b.wbuf, p.data...)
+			}
+			msg.Buffers = [][]byte{b.wbuf[start:]}
+			start = len(b.oob)
+			b.oob = appendGSOControl(b.oob, uint16(len(pkts[i].data)))
+			msg.OOB = b.oob[start:]
+		}
+		msgs = append(msgs, msg)
+		b.wcounts = append(b.wcounts, n)
+		i += n
+	}
+	return msgs
+}
+
+// gsoRun returns how many packets from the start of pkts can be sent as one
+// GSO super-datagram: same peer, equal sizes, only the last may be shorter.
+func gsoRun(pkts []outPacket) int {
+	size := len(pkts[0].data)
+	if size == 0 {
+		return 1
+	}
+	total := size
+	n := 1
+	for n < len(pkts) && n < maxGSOSegments {
+		p := pkts[n]
+		if len(p.data) > size || len(p.data) == 0 || total+len(p.data) > maxGSOSize ||
+			!p.addr.IP.Equal(pkts[0].addr.IP) || p.addr.Port != pkts[0].addr.Port {
+			break
+		}
+		total += len(p.data)
+		n++
+		if len(p.data) < size {
+			break
+		}
+	}
+	return n
+}
+
+// appendGSOControl appends a UDP_SEGMENT control message.
+func appendGSOControl(oob []byte, segSize uint16) []byte {
+	start := len(oob)
+	space := syscall.CmsgSpace(2)
+	for i := 0; i < space; i++ {
+		oob = append(oob, 0)
+	}
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[start]))
+	h.Level = solUDP
+	h.Type = udpSegment
+	h.SetLen(syscall.CmsgLen(2))
+	binary.NativeEndian.PutUint16(oob[start+syscall.CmsgLen(0):], segSize)
+	return oob
+}
+
+// groSegmentSize returns the segment size from a UDP_GRO control message,
+// or 0 if the datagram was not coalesced.
+func groSegmentSize(oob []byte) int {
+	cmsgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, c := range cmsgs {
+		if c.Header.Level != solUDP || c.Header.Type != udpGRO {
+			continue
+		}
+		switch {
+		case len(c.Data) >= 4:
+			return int(binary.NativeEndian.Uint32(c.Data))
+		case len(c.Data) >= 2:
+			return int(binary.NativeEndian.Uint16(c.Data))
+		}
+	}
+	return 0
+}
+
+// isGSOError reports whether a send failed because the kernel or the
+// network device cannot do UDP GSO.
+func isGSOError(err error) bool {
+	return errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.EOPNOTSUPP)
+}
+
+func setUDPOption(conn *net.UDPConn, opt, value int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), solUDP, opt, value)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+func getUDPOption(conn *net.UDPConn, opt int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		_, serr = syscall.GetsockoptInt(int(fd), solUDP, opt)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,132 @@
+package p2p
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// TestBatchConnLoopback tests batched sends and receives over loopback,
+// including runs that qualify for GSO and the short trailing datagram
+func TestBatchConnLoopback(t *testing.T) {
+	rx, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("UDP not available: %v", err)
+	}
+	defer rx.Close()
+	tx, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer tx.Close()
+
+	sender, receiver := newBatchConn(tx), newBatchConn(rx)
+	dst := rx.LocalAddr().(*net.UDPAddr)
+
+	var want [][]byte
+	var pkts []outPacket
+	for i := 0; i < 20; i++ {
+		size := 1200
+		if i == 9 || i == 19 {
+			size = 300
+		}
+		data := bytes.Repeat([]byte{byte(i)}, size)
+		want = append(want, data)
+		pkts = append(pkts, outPacket{data: data, addr: dst})
+	}
+	if err := sender.writeBatch(pkts); err != nil {
+		t.Fatalf("writeBatch: %v", err)
+	}
+
+	var got [][]byte
+	deadline := time.Now().Add(2 * time.Second)
+	for len(got) < len(want) && time.Now().Before(deadline) {
+		rx.SetReadDeadline(deadline)
+		err := receiver.readBatch(func(data []byte, addr *net.UDPAddr) {
+			got = append(got, append([]byte(nil), data...))
+		})
+		if err != nil {
+			t.Fatalf("readBatch: %v", err)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d datagrams, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("Datagram %d mismatch: got %d bytes of %d", i, len(got[i]), got[i][0])
+		}
+	}
+}
+
+// TestGSORun tests how packets are grouped into GSO super-datagrams
+func TestGSORun(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	b := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1000}
+	pkt := func(size int, addr *net.UDPAddr) outPacket {
+		return outPacket{data: make([]byte, size), addr: addr}
+	}
+
+	if n := gsoRun([]outPacket{pkt(100, a), pkt(100, a), pkt(50, a), pkt(100, a)}); n != 3 {
+		t.Errorf("Expected run to end after the short packet, got %d", n)
+	}
+	if n := gsoRun([]outPacket{pkt(100, a), pkt(100, b)}); n != 1 {
+		t.Errorf("Expected run to end at a different peer, got %d", n)
+	}
+	if n := gsoRun([]outPacket{pkt(100, a), pkt(200, a)}); n != 1 {
+		t.Errorf("Expected run to end at a larger packet, got %d", n)
+	}
+}
+
+// gsoFailConn accepts plain datagrams and rejects GSO messages with EIO.
+type gsoFailConn struct {
+	sent [][]byte
+}
+
+func (c *gsoFailConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	return 0, syscall.EAGAIN
+}
+
+func (c *gsoFailConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	for i, m := range ms {
+		if len(m.OOB) > 0 {
+			return i, syscall.EIO
+		}
+		c.sent = append(c.sent, append([]byte(nil), m.Buffers[0]...))
+	}
+	return len(ms), nil
+}
+
+// TestWriteBatchGSOFallback tests that when a GSO send fails partway through
+// a batch, only the packets not sent yet are sent again without GSO
+func TestWriteBatchGSOFallback(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	b := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1000}
+	pc := &gsoFailConn{}
+	conn := &batchConn{pc: pc, gso: true, wmsgs: make([]ipv4.Message, BatchSize)}
+
+	pkts := []outPacket{
+		{data: []byte{0}, addr: a},
+		{data: []byte{1}, addr: b},
+		{data: []byte{2}, addr: b},
+		{data: []byte{3}, addr: b},
+	}
+	if err := conn.writeBatch(pkts); err != nil {
+		t.Fatalf("writeBatch: %v", err)
+	}
+	if conn.gso {
+		t.Errorf("Expected GSO to be turned off after EIO")
+	}
+	if len(pc.sent) != len(pkts) {
+		t.Fatalf("Expected %d datagrams, got %d", len(pkts), len(pc.sent))
+	}
+	for i, data := range pc.sent {
+		if !bytes.Equal(data, pkts[i].data) {
+			t.Errorf("Datagram %d: expected %v, got %v", i, pkts[i].data, data)
+		}
+	}
+}
@@ -99,6 +99,8 @@ type Manager struct {
 	localPort           int
 	connections         map[string]*Connection // Key: peer tunnel IP string
 	listener            *net.UDPConn
+	batch               *batchConn       // Batched reads/writes on the listener
+	sendQueue           chan outPacket   // Outgoing data packets for the batch sender
 	peers               map[string]*PeerInfo // Peer information
 	mu                  sync.RWMutex
 	stopCh              chan struct{}
@@ -117,6 +119,7 @@ func NewManager(port int) *Manager {
 		connections:       make(map[string]*Connection),
 		peers:             make(map[string]*PeerInfo),
 		stopCh:            make(chan struct{}),
+		sendQueue:         make(chan outPacket, SendQueueSize),
 		natDetector:       nat.NewDetector(port, 5*time.Second),
 		myNATType:         nat.NATUnknown,
 		keepaliveInterval: KeepaliveInterval, // Default to 15 seconds
@@ -142,22 +145,24 @@ func (m *Manager) Start() error {
 	}
 	
 	m.listener = conn
+	m.batch = newBatchConn(conn)
 	
 	// Get actual port if auto-assigned
 	if m.localPort == 0 {
 		m.localPort = conn.LocalAddr().(*net.UDPAddr).Port
 	}
 	
-	log.Printf("P2P manager listening on UDP port %d", m.localPort)
+	log.Printf("P2P manager listening on UDP port %d (batch I/O, GRO: %v, GSO: %v)", m.localPort, m.batch.gro, m.batch.gso)
 	
 	// Note: UPnP automatic port forwarding is not fully implemented yet
 	// Gateway discovery works, but full IGD port mapping requires additional libraries
 	// For production use with UPnP, integrate github.com/huin/goupnp
 	// Manual port forwarding or STUN/hole-punching remains the primary method
 	
-	// Start packet receiver
-	m.wg.Add(1)
+	// Start packet receiver and batch sender
+	m.wg.Add(2)
 	go m.receivePackets()
+	go m.sendPackets()
 	
 	// Start keepalive sender
 	m.wg.Add(1)
@@ -202,7 +207,8 @@ func (m *Manager) Stop() {
 	}
 }
 
-// SetPacketHandler sets the callback for received packets
+// SetPacketHandler sets the callback for received packets. The data slice is
+// reused for the next batch, so the handler must copy anything it keeps.
 func (m *Manager) SetPacketHandler(handler func(peerIP net.IP, data []byte)) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -495,7 +501,8 @@ func (m *Manager) performHandshakeInternal(conn *Connection, isLocal bool) {
 	log.Printf("Handshake attempts completed for %s, waiting for peer response", conn.PeerIP)
 }
 
-// SendPacket sends a packet to a peer via P2P
+// SendPacket queues a packet for a peer via P2P. The packet is written by the
+// batch sender, which takes ownership of data.
 func (m *Manager) SendPacket(peerIP net.IP, data []byte) error {
 	m.mu.RLock()
 	conn, exists := m.connections[peerIP.String()]
@@ -508,16 +515,57 @@ func (m *Manager) SendPacket(peerIP net.IP, data []byte) error {
 	// Record packet being sent (for quality monitoring)
 	m.RecordPacketSent(peerIP)
 	
-	// Send via UDP listener
-	_, err := m.listener.WriteToUDP(data, conn.RemoteAddr)
-	return err
+	select {
+	case m.sendQueue <- outPacket{data: data, addr: conn.RemoteAddr}:
+		return nil
+	default:
+		return fmt.Errorf("P2P send queue full")
+	}
 }
 
-// receivePackets receives packets from UDP socket
-func (m *Manager) receivePackets() {
+// sendPackets drains the send queue and writes packets in batches
+func (m *Manager) sendPackets() {
 	defer m.wg.Done()
 	
-	buf := make([]byte, 2048)
+	pkts := make([]outPacket, 0, BatchSize)
+	for {
+		select {
+		case <-m.stopCh:
+			return
+		case p := <-m.sendQueue:
+			pkts = append(pkts[:0], p)
+		}
+		
+		// Collect whatever else is already queued, without waiting
+	collect:
+		for len(pkts) < BatchSize {
+			select {
+			case p := <-m.sendQueue:
+				pkts = append(pkts, p)
+			default:
+				break collect
+			}
+		}
+		
+		if err := m.batch.writeBatch(pkts); err != nil {
+			select {
+			case <-m.stopCh:
+				return
+			default:
+				log.Printf("P2P send error: %v", err)
+			}
+		}
+		for i := range pkts {
+			pkts[i] = outPacket{}
+		}
+	}
+}
+
+// receivePackets receives packets from UDP socket in batches. Data passed to
+// the packet handler points into the receive buffers and is only valid
+// during the call.
+func (m *Manager) receivePackets() {
+	defer m.wg.Done()
 	
 	for {
 		select {
@@ -527,7 +575,7 @@ func (m *Manager) receivePackets() {
 		}
 		
 		m.listener.SetReadDeadline(time.Now().Add(ReadTimeout))
-		n, remoteAddr, err := m.listener.ReadFromUDP(buf)
+		err := m.batch.readBatch(m.handleDatagram)
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				continue
@@ -540,41 +588,39 @@ func (m *Manager) receivePackets() {
 			}
 			continue
 		}
+	}
+}
+
+// handleDatagram processes one received datagram
+func (m *Manager) handleDatagram(data []byte, remoteAddr *net.UDPAddr) {
+	// Handle handshake messages
+	if string(data) == "P2P_HANDSHAKE" {
+		m.handleHandshake(remoteAddr)
+		return
+	}
+	
+	// Handle keepalive messages
+	if string(data) == "P2P_KEEPALIVE" {
+		m.handleKeepalive(remoteAddr)
+		return
+	}
+	
+	// Find which peer this packet is from
+	peerIP := m.findPeerByAddr(remoteAddr)
+	if peerIP != nil {
+		// Update peer's last seen time
+		m.updatePeerLastSeen(peerIP)
 		
-		if n > 0 {
-			data := make([]byte, n)
-			copy(data, buf[:n])
-			
-			// Handle handshake messages
-			if string(data) == "P2P_HANDSHAKE" {
-				m.handleHandshake(remoteAddr)
-				continue
-			}
-			
-			// Handle keepalive messages
-			if string(data) == "P2P_KEEPALIVE" {
-				m.handleKeepalive(remoteAddr)
-				continue
-			}
-			
-			// Find which peer this packet is from
-			peerIP := m.findPeerByAddr(remoteAddr)
-			if peerIP != nil {
-				// Update peer's last seen time
-				m.updatePeerLastSeen(peerIP)
-				
-				// Record packet received (for quality monitoring)
-				m.RecordPacketReceived(peerIP)
-				
-				// Call packet handler
-				m.mu.RLock()
-				handler := m.onPacket
-				m.mu.RUnlock()
-				
-				if handler != nil {
-					handler(peerIP, data)
-				}
-			}
+		// Record packet received (for quality monitoring)
+		m.RecordPacketReceived(peerIP)
+		
+		// Call packet handler
+		m.mu.RLock()
+		handler := m.onPacket
+		m.mu.RUnlock()
+		
+		if handler != nil {
+			handler(peerIP, data)
 		}
 	}
 }
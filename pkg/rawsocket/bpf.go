@@ -0,0 +1,120 @@
+package rawsocket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/bpf"
+)
+
+// Classic BPF socket filters. The programs run on packets starting at the IP
+// header, which is what both raw IP sockets and SOCK_DGRAM packet sockets
+// hand to their filters.
+
+const soAttachFilter = 26 // SO_ATTACH_FILTER (Linux)
+
+// sockFprog mirrors struct sock_fprog.
+type sockFprog struct {
+	Len    uint16
+	Filter *bpf.RawInstruction
+}
+
+// Endpoint is a remote TCP address let through by a peer filter.
+type Endpoint struct {
+	IP   net.IP
+	Port uint16
+}
+
+const (
+	// MaxFilterPeers caps the peers listed in a filter program (5
+	// instructions each, the kernel allows 4096); with more peers the filter
+	// falls back to the local port only.
+	MaxFilterPeers = 512
+
+	filterAccept = 0x40000 // Bytes of an accepted packet to queue
+	tcpFlagSYN   = 0x02
+)
+
+// buildFilter builds a program that passes unfragmented TCP segments to
+// localPort. With a non-nil peers list only segments from those endpoints
+// pass, plus any SYN when acceptSYN is set so new connections can still be
+// opened, and with sample (a power of two) set one in sample segments from
+// anyone else, picked at random, so that they can be answered without
+// handling all of them. A nil list filters on the local port only.
+func buildFilter(localPort uint16, peers []Endpoint, acceptSYN bool, sample uint32) ([]bpf.RawInstruction, error) {
+	prog := []bpf.Instruction{
+		bpf.LoadAbsolute{Off: 9, Size: 1}, // IP protocol
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: IPPROTO_TCP, SkipTrue: 5},
+		bpf.LoadAbsolute{Off: 6, Size: 2}, // Flags + fragment offset
+		bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 3},
+		bpf.LoadMemShift{Off: 0},          // X = IP header length
+		bpf.LoadIndirect{Off: 2, Size: 2}, // TCP destination port
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(localPort), SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+	}
+	if peers == nil || len(peers) > MaxFilterPeers {
+		return bpf.Assemble(append(prog, bpf.RetConstant{Val: filterAccept}))
+	}
+
+	if acceptSYN {
+		prog = append(prog,
+			bpf.LoadIndirect{Off: 13, Size: 1}, // TCP flags
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: tcpFlagSYN, SkipFalse: 1},
+			bpf.RetConstant{Val: filterAccept},
+		)
+	}
+	prog = append(prog,
+		bpf.LoadAbsolute{Off: 12, Size: 4}, // Source address
+		bpf.StoreScratch{Src: bpf.RegA, N: 0},
+		bpf.LoadIndirect{Off: 0, Size: 2}, // TCP source port
+		bpf.StoreScratch{Src: bpf.RegA, N: 1},
+	)
+	for _, p := range peers {
+		ip4 := p.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+		prog = append(prog,
+			bpf.LoadScratch{Dst: bpf.RegA, N: 0},
+			bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: binary.BigEndian.Uint32(ip4), SkipTrue: 3},
+			bpf.LoadScratch{Dst: bpf.RegA, N: 1},
+			bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: uint32(p.Port), SkipTrue: 1},
+			bpf.RetConstant{Val: filterAccept},
+		)
+	}
+	if sample > 0 {
+		prog = append(prog,
+			bpf.LoadExtension{Num: bpf.ExtRand},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: sample - 1},
+			bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 0, SkipTrue: 1},
+			bpf.RetConstant{Val: filterAccept},
+		)
+	}
+	return bpf.Assemble(append(prog, bpf.RetConstant{Val: 0}))
+}
+
+// dropAllFilter builds a program that drops every packet.
+func dropAllFilter() ([]bpf.RawInstruction, error) {
+	return bpf.Assemble([]bpf.Instruction{bpf.RetConstant{Val: 0}})
+}
+
+// attachFilter attaches a classic BPF program to a socket.
+func attachFilter(fd int, prog []bpf.RawInstruction) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("socket filters are only supported on Linux")
+	}
+	if len(prog) == 0 {
+		return fmt.Errorf("empty filter program")
+	}
+	fprog := sockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), syscall.SOL_SOCKET, soAttachFilter,
+		uintptr(unsafe.Pointer(&fprog)), unsafe.Sizeof(fprog), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package rawsocket
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+// buildTestSegment builds an IPv4 TCP segment to dstPort
+func buildTestSegment(dstPort uint16, payload []byte) []byte {
+	tcp := BuildTCPHeader(40000, dstPort, 1, 0, 0x18, 65535, nil)
+	ip := BuildIPHeader(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), IPPROTO_TCP, len(tcp)+len(payload))
+	return append(append(ip, tcp...), payload...)
+}
+
+// newFilterVM assembles a filter program into a BPF VM
+func newFilterVM(t *testing.T, prog []bpf.RawInstruction, err error) *bpf.VM {
+	if err != nil {
+		t.Fatalf("buildFilter: %v", err)
+	}
+	insns, ok := bpf.Disassemble(prog)
+	if !ok {
+		t.Fatalf("Program does not disassemble")
+	}
+	vm, err := bpf.NewVM(insns)
+	if err != nil {
+		t.Fatalf("NewVM: %v", err)
+	}
+	return vm
+}
+
+// TestPortFilter tests that the port-only program only passes unfragmented
+// TCP segments to the given port
+func TestPortFilter(t *testing.T) {
+	prog, err := buildFilter(8443, nil, false, 0)
+	vm := newFilterVM(t, prog, err)
+
+	udp := buildTestSegment(8443, nil)
+	udp[9] = 17
+	fragment := buildTestSegment(8443, nil)
+	binary.BigEndian.PutUint16(fragment[6:8], 0x0010)
+
+	cases := []struct {
+		name string
+		pkt  []byte
+		pass bool
+	}{
+		{"matching port", buildTestSegment(8443, []byte("data")), true},
+		{"other port", buildTestSegment(22, nil), false},
+		{"UDP", udp, false},
+		{"fragment", fragment, false},
+	}
+	for _, c := range cases {
+		n, err := vm.Run(c.pkt)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if (n > 0) != c.pass {
+			t.Errorf("%s: filter returned %d", c.name, n)
+		}
+	}
+}
+
+// TestPeerFilter tests that only known peers pass, plus SYNs from anyone
+// when requested
+func TestPeerFilter(t *testing.T) {
+	peers := []Endpoint{
+		{IP: net.IPv4(10, 0, 0, 9), Port: 1234},
+		{IP: net.IPv4(10, 0, 0, 1), Port: 40000},
+	}
+	prog, err := buildFilter(8443, peers, true, 0)
+	vm := newFilterVM(t, prog, err)
+
+	known := buildTestSegment(8443, []byte("data"))
+	stranger := buildTestSegment(8443, nil)
+	stranger[12+3] = 7 // 10.0.0.7
+	syn := append([]byte(nil), stranger...)
+	syn[IPHeaderSize+13] = tcpFlagSYN
+
+	for name, c := range map[string]struct {
+		pkt  []byte
+		pass bool
+	}{
+		"known peer":      {known, true},
+		"unknown peer":    {stranger, false},
+		"SYN from any":    {syn, true},
+		"peer wrong port": {buildTestSegment(22, nil), false},
+	} {
+		n, err := vm.Run(c.pkt)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if (n > 0) != c.pass {
+			t.Errorf("%s: filter returned %d", name, n)
+		}
+	}
+
+	// Without acceptSYN a SYN from a stranger is dropped
+	prog, err = buildFilter(8443, peers, false, 0)
+	if n, _ := newFilterVM(t, prog, err).Run(syn); n != 0 {
+		t.Errorf("SYN from unknown peer passed without acceptSYN")
+	}
+}
+
+// TestPeerFilterSample tests that a sampling filter still assembles and only
+// differs from the plain one by its sampling of other peers
+func TestPeerFilterSample(t *testing.T) {
+	peers := []Endpoint{{IP: net.IPv4(10, 0, 0, 9), Port: 1234}}
+	plain, err := buildFilter(8443, peers, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sampled, err := buildFilter(8443, peers, true, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sampled) != len(plain)+4 {
+		t.Fatalf("Expected 4 sampling instructions, got %d", len(sampled)-len(plain))
+	}
+	ins, _ := bpf.Disassemble(sampled[len(plain)-1 : len(plain)+1])
+	if ext, ok := ins[0].(bpf.LoadExtension); !ok || ext.Num != bpf.ExtRand {
+		t.Fatalf("Expected a random sample, got %v", ins[0])
+	}
+}
+
+// TestParseTCPPacketTrimsPadding tests that link-layer padding after the IP
+// packet is not taken as payload
+func TestParseTCPPacketTrimsPadding(t *testing.T) {
+	pkt := append(buildTestSegment(8443, nil), 0, 0, 0, 0, 0, 0)
+	seg, err := parseSegment(pkt)
+	if err != nil {
+		t.Fatalf("parseSegment: %v", err)
+	}
+	if seg.DstPort != 8443 || len(seg.Payload) != 0 {
+		t.Errorf("Unexpected dst port %d or payload %v", seg.DstPort, seg.Payload)
+	}
+}
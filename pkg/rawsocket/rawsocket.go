@@ -44,6 +44,10 @@ type RawSocket struct {
 	pcapHandle *pcap.Handle
 	pcapMu     sync.Mutex
 	pcapPacket chan []byte
+
+	// Linux: TPACKET_V3 receive ring (nil when receiving with recvfrom)
+	ring        *packetRing
+	readTimeout time.Duration
 }
 
 // NewRawSocket creates a new raw socket
@@ -141,6 +145,14 @@ func NewRawSocket(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort
 		pcapPacket: make(chan []byte, 100),
 	}
 
+	// On Linux, let the kernel drop every TCP segment that is not ours
+	// instead of copying all of them to this socket
+	if runtime.GOOS == "linux" {
+		if err := rs.attachDefaultFilter(); err != nil {
+			log.Printf("⚠️  Failed to attach socket filter: %v", err)
+		}
+	}
+
 	// On macOS, try to use libpcap for receiving packets
 	// This can bypass the raw socket limitation
 	if runtime.GOOS == "darwin" {
@@ -176,6 +188,50 @@ func NewRawSocket(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort
 	return rs, nil
 }
 
+// EnableRing switches receiving to a TPACKET_V3 memory-mapped ring that only
+// sees TCP segments to the local port. The raw socket itself is then only used
+// for sending, and a drop-all filter keeps the kernel from queueing every TCP
+// packet on the host to it. Linux only.
+func (rs *RawSocket) EnableRing() error {
+	ring, err := newPacketRing(rs.localPort)
+	if err != nil {
+		return err
+	}
+	if prog, err := dropAllFilter(); err == nil {
+		if err := attachFilter(rs.fd, prog); err != nil {
+			log.Printf("⚠️  Failed to attach drop filter to raw socket: %v", err)
+		}
+	}
+	rs.ring = ring
+	return nil
+}
+
+// SetPeerFilter restricts receiving to segments from the given peers, plus
+// any SYN when acceptSYN is set and a random one in sample (a power of two,
+// 0 for none) of the others. A nil list passes everything to the local port.
+// The filter goes to whichever socket receives (the ring if enabled).
+func (rs *RawSocket) SetPeerFilter(peers []Endpoint, acceptSYN bool, sample uint32) error {
+	prog, err := buildFilter(rs.localPort, peers, acceptSYN, sample)
+	if err != nil {
+		return err
+	}
+	fd := rs.fd
+	if rs.ring != nil {
+		fd = rs.ring.fd
+	}
+	return attachFilter(fd, prog)
+}
+
+// attachDefaultFilter filters on the local port and, for client sockets,
+// on the server's address and port once they are known.
+func (rs *RawSocket) attachDefaultFilter() error {
+	var peers []Endpoint
+	if !rs.isServer && rs.remoteIP != nil && rs.remotePort != 0 {
+		peers = []Endpoint{{IP: rs.remoteIP, Port: rs.remotePort}}
+	}
+	return rs.SetPeerFilter(peers, false, 0)
+}
+
 // pcapReceiver receives packets using libpcap (macOS workaround)
 func (rs *RawSocket) pcapReceiver() {
 	if rs.pcapHandle == nil {
@@ -252,6 +308,11 @@ func (rs *RawSocket) pcapReceiver() {
 
 // BuildIPHeader constructs an IPv4 header
 func BuildIPHeader(srcIP, dstIP net.IP, protocol uint8, payloadLen int) []byte {
+	return buildIPHeader(srcIP, dstIP, protocol, payloadLen, DefaultHeaderFields.TTL, DefaultHeaderFields.IPID)
+}
+
+// buildIPHeader constructs an IPv4 header with the given TTL and ID
+func buildIPHeader(srcIP, dstIP net.IP, protocol uint8, payloadLen int, ttl uint8, id uint16) []byte {
 	header := make([]byte, IPHeaderSize)
 
 	// Version (4 bits) + IHL (4 bits)
@@ -264,14 +325,14 @@ func BuildIPHeader(srcIP, dstIP net.IP, protocol uint8, payloadLen int) []byte {
 	totalLen := IPHeaderSize + payloadLen
 	binary.BigEndian.PutUint16(header[2:4], uint16(totalLen))
 
-	// Identification (can be random or incremental)
-	binary.BigEndian.PutUint16(header[4:6], uint16(12345)) // Simple ID
+	// Identification
+	binary.BigEndian.PutUint16(header[4:6], id)
 
 	// Flags (3 bits) + Fragment Offset (13 bits)
 	binary.BigEndian.PutUint16(header[6:8], IP_DF) // Don't fragment
 
 	// TTL
-	header[8] = 64
+	header[8] = ttl
 
 	// Protocol
 	header[9] = protocol
@@ -388,12 +449,31 @@ func CalculateChecksum(data []byte) uint16 {
 	return ^uint16(sum)
 }
 
+// HeaderFields are the IP and TCP header fields in which TCP/IP stacks
+// differ, chosen by the sender for every segment
+type HeaderFields struct {
+	Window uint16 // TCP receive window
+	TTL    uint8  // IP time to live
+	IPID   uint16 // IP identification
+}
+
+// DefaultHeaderFields are the header fields used by SendPacket
+var DefaultHeaderFields = HeaderFields{Window: 65535, TTL: 64, IPID: 12345}
+
 // SendPacket sends a raw IP packet with TCP header and payload
 func (rs *RawSocket) SendPacket(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16,
 	seq, ack uint32, flags uint8, tcpOptions, payload []byte) error {
+	return rs.SendSegment(srcIP, srcPort, dstIP, dstPort, seq, ack, flags, DefaultHeaderFields, tcpOptions, payload)
+}
+
+// SendSegment sends a raw IP packet with TCP header and payload, using the
+// given header fields. On macOS without IP_HDRINCL the kernel builds the IP
+// header and picks TTL and ID itself.
+func (rs *RawSocket) SendSegment(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16,
+	seq, ack uint32, flags uint8, fields HeaderFields, tcpOptions, payload []byte) error {
 
 	// Build TCP header (without checksum first)
-	tcpHeader := BuildTCPHeader(srcPort, dstPort, seq, ack, flags, 65535, tcpOptions)
+	tcpHeader := BuildTCPHeader(srcPort, dstPort, seq, ack, flags, fields.Window, tcpOptions)
 
 	// Use the local IP from the socket if available, otherwise use the provided srcIP
 	ipSrc := srcIP
@@ -415,7 +495,7 @@ func (rs *RawSocket) SendPacket(srcIP net.IP, srcPort uint16, dstIP net.IP, dstP
 		copy(packet[len(tcpHeader):], payload)
 	} else {
 		// Linux or same socket: build full IP packet with IP_HDRINCL
-		ipHeader := BuildIPHeader(ipSrc, dstIP, IPPROTO_TCP, len(tcpHeader)+len(payload))
+		ipHeader := buildIPHeader(ipSrc, dstIP, IPPROTO_TCP, len(tcpHeader)+len(payload), fields.TTL, fields.IPID)
 		packet = make([]byte, len(ipHeader)+len(tcpHeader)+len(payload))
 		copy(packet[0:], ipHeader)
 		copy(packet[len(ipHeader):], tcpHeader)
@@ -431,72 +511,62 @@ func (rs *RawSocket) SendPacket(srcIP net.IP, srcPort uint16, dstIP net.IP, dstP
 	// Use sendFd for sending (separate socket on macOS without IP_HDRINCL)
 	err := syscall.Sendto(rs.sendFd, packet, 0, &addr)
 	if err != nil {
-		return fmt.Errorf("failed to send packet: %v", err)
+		return fmt.Errorf("failed to send packet: %w", err)
 	}
 
 	return nil
 }
 
+// Segment is a received TCP segment
+type Segment struct {
+	SrcIP   net.IP
+	SrcPort uint16
+	DstIP   net.IP
+	DstPort uint16
+	Seq     uint32
+	Ack     uint32
+	Flags   uint8
+	Window  uint16
+	Options []byte // TCP options, including any padding
+	Payload []byte
+}
+
 // RecvPacket receives a raw IP packet and extracts TCP header and payload
 func (rs *RawSocket) RecvPacket(buf []byte) (srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16,
 	seq, ack uint32, flags uint8, payload []byte, err error) {
+	seg, err := rs.RecvSegment(buf)
+	if err != nil {
+		return nil, 0, nil, 0, 0, 0, 0, nil, err
+	}
+	return seg.SrcIP, seg.SrcPort, seg.DstIP, seg.DstPort, seg.Seq, seg.Ack, seg.Flags, seg.Payload, nil
+}
 
+// RecvSegment receives a raw IP packet and parses its TCP segment,
+// including the TCP options
+func (rs *RawSocket) RecvSegment(buf []byte) (*Segment, error) {
 	// On macOS, try to use libpcap first (if available)
 	if runtime.GOOS == "darwin" && rs.pcapHandle != nil {
 		select {
 		case packetData := <-rs.pcapPacket:
-			// Parse packet from pcap
-			if len(packetData) < IPHeaderSize+TCPHeaderSize {
-				return nil, 0, nil, 0, 0, 0, 0, nil, fmt.Errorf("packet too small: %d bytes", len(packetData))
-			}
-
 			// Copy to buf if it fits
 			if len(packetData) <= len(buf) {
 				copy(buf, packetData)
 			}
-
-			// Parse IP header
-			ipHeader := packetData[:IPHeaderSize]
-			ihl := (ipHeader[0] & 0x0F) * 4
-			if int(ihl) > len(packetData) {
-				return nil, 0, nil, 0, 0, 0, 0, nil, fmt.Errorf("invalid IP header length")
-			}
-
-			protocol := ipHeader[9]
-			if protocol != IPPROTO_TCP {
-				return nil, 0, nil, 0, 0, 0, 0, nil, fmt.Errorf("not a TCP packet")
-			}
-
-			srcIP = net.IPv4(ipHeader[12], ipHeader[13], ipHeader[14], ipHeader[15])
-			dstIP = net.IPv4(ipHeader[16], ipHeader[17], ipHeader[18], ipHeader[19])
-
-			// Parse TCP header
-			tcpStart := int(ihl)
-			if len(packetData) < tcpStart+TCPHeaderSize {
-				return nil, 0, nil, 0, 0, 0, 0, nil, fmt.Errorf("packet too small for TCP header")
-			}
-
-			tcpHeader := packetData[tcpStart : tcpStart+TCPHeaderSize]
-			srcPort = binary.BigEndian.Uint16(tcpHeader[0:2])
-			dstPort = binary.BigEndian.Uint16(tcpHeader[2:4])
-			seq = binary.BigEndian.Uint32(tcpHeader[4:8])
-			ack = binary.BigEndian.Uint32(tcpHeader[8:12])
-			dataOffset := (tcpHeader[12] >> 4) * 4
-			flags = tcpHeader[13]
-
-			// Extract payload
-			payloadStart := tcpStart + int(dataOffset)
-			if payloadStart < len(packetData) {
-				payload = make([]byte, len(packetData)-payloadStart)
-				copy(payload, packetData[payloadStart:])
-			}
-
-			return srcIP, srcPort, dstIP, dstPort, seq, ack, flags, payload, nil
+			return parseSegment(packetData)
 		case <-time.After(100 * time.Millisecond):
 			// Timeout - fall through to raw socket
 		}
 	}
 
+	// Linux: read from the receive ring when enabled
+	if rs.ring != nil {
+		data, err := rs.ring.read(rs.readTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return parseSegment(data)
+	}
+
 	// Fall back to raw socket (or use it on Linux)
 	n, _, err := syscall.Recvfrom(rs.fd, buf, 0)
 	if err != nil {
@@ -505,72 +575,89 @@ func (rs *RawSocket) RecvPacket(buf []byte) (srcIP net.IP, srcPort uint16, dstIP
 			if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK {
 				// This is expected on macOS - kernel processed the packet
 				// Return a timeout-like error that can be handled by the caller
-				return nil, 0, nil, 0, 0, 0, 0, nil, fmt.Errorf("packet not available (macOS kernel processed it)")
+				return nil, fmt.Errorf("packet not available (macOS kernel processed it)")
 			}
 			// Other errors on macOS
-			return nil, 0, nil, 0, 0, 0, 0, nil, fmt.Errorf("failed to receive packet on macOS: %v", err)
+			return nil, fmt.Errorf("failed to receive packet on macOS: %v", err)
 		}
-		return nil, 0, nil, 0, 0, 0, 0, nil, fmt.Errorf("failed to receive packet: %v", err)
+		return nil, fmt.Errorf("failed to receive packet: %v", err)
 	}
 
-	if n < IPHeaderSize+TCPHeaderSize {
-		return nil, 0, nil, 0, 0, 0, 0, nil, fmt.Errorf("packet too small: %d bytes", n)
+	return parseSegment(buf[:n])
+}
+
+// parseSegment parses an IPv4 TCP packet and copies out its options and
+// payload
+func parseSegment(data []byte) (*Segment, error) {
+	if len(data) < IPHeaderSize+TCPHeaderSize {
+		return nil, fmt.Errorf("packet too small: %d bytes", len(data))
+	}
+
+	// Trim link-layer padding (packet sockets see frames before IP does)
+	if totalLen := int(binary.BigEndian.Uint16(data[2:4])); totalLen >= IPHeaderSize && totalLen < len(data) {
+		data = data[:totalLen]
 	}
 
 	// Parse IP header
-	ipHeader := buf[:IPHeaderSize]
+	ipHeader := data[:IPHeaderSize]
 	ihl := (ipHeader[0] & 0x0F) * 4
-	if int(ihl) > n {
-		return nil, 0, nil, 0, 0, 0, 0, nil, fmt.Errorf("invalid IP header length")
+	if int(ihl) > len(data) {
+		return nil, fmt.Errorf("invalid IP header length")
 	}
 
 	protocol := ipHeader[9]
 	if protocol != IPPROTO_TCP {
-		return nil, 0, nil, 0, 0, 0, 0, nil, fmt.Errorf("not a TCP packet")
+		return nil, fmt.Errorf("not a TCP packet")
 	}
 
-	srcIP = net.IPv4(ipHeader[12], ipHeader[13], ipHeader[14], ipHeader[15])
-	dstIP = net.IPv4(ipHeader[16], ipHeader[17], ipHeader[18], ipHeader[19])
+	seg := &Segment{
+		SrcIP: net.IPv4(ipHeader[12], ipHeader[13], ipHeader[14], ipHeader[15]),
+		DstIP: net.IPv4(ipHeader[16], ipHeader[17], ipHeader[18], ipHeader[19]),
+	}
 
 	// Parse TCP header
 	tcpStart := int(ihl)
-	if n < tcpStart+TCPHeaderSize {
-		return nil, 0, nil, 0, 0, 0, 0, nil, fmt.Errorf("packet too small for TCP header")
+	if len(data) < tcpStart+TCPHeaderSize {
+		return nil, fmt.Errorf("packet too small for TCP header")
 	}
 
-	tcpHeader := buf[tcpStart : tcpStart+TCPHeaderSize]
-	srcPort = binary.BigEndian.Uint16(tcpHeader[0:2])
-	dstPort = binary.BigEndian.Uint16(tcpHeader[2:4])
-	seq = binary.BigEndian.Uint32(tcpHeader[4:8])
-	ack = binary.BigEndian.Uint32(tcpHeader[8:12])
-	dataOffset := (tcpHeader[12] >> 4) * 4
-	flags = tcpHeader[13]
+	tcpHeader := data[tcpStart : tcpStart+TCPHeaderSize]
+	seg.SrcPort = binary.BigEndian.Uint16(tcpHeader[0:2])
+	seg.DstPort = binary.BigEndian.Uint16(tcpHeader[2:4])
+	seg.Seq = binary.BigEndian.Uint32(tcpHeader[4:8])
+	seg.Ack = binary.BigEndian.Uint32(tcpHeader[8:12])
+	dataOffset := int(tcpHeader[12]>>4) * 4
+	seg.Flags = tcpHeader[13]
+	seg.Window = binary.BigEndian.Uint16(tcpHeader[14:16])
 
-	// Extract payload
-	payloadStart := tcpStart + int(dataOffset)
-	if payloadStart < n {
-		payload = make([]byte, n-payloadStart)
-		copy(payload, buf[payloadStart:n])
+	// Extract options and payload
+	payloadStart := tcpStart + dataOffset
+	if dataOffset > TCPHeaderSize && payloadStart <= len(data) {
+		seg.Options = make([]byte, dataOffset-TCPHeaderSize)
+		copy(seg.Options, data[tcpStart+TCPHeaderSize:payloadStart])
+	}
+	if payloadStart < len(data) {
+		seg.Payload = make([]byte, len(data)-payloadStart)
+		copy(seg.Payload, data[payloadStart:])
 	}
 
-	return srcIP, srcPort, dstIP, dstPort, seq, ack, flags, payload, nil
+	return seg, nil
 }
 
 // SetReadTimeout sets read timeout for the socket
 func (rs *RawSocket) SetReadTimeout(sec, usec int64) error {
-	tv := syscall.Timeval{
-		Sec:  sec,
-		Usec: int32(usec),
+	rs.readTimeout = time.Duration(sec)*time.Second + time.Duration(usec)*time.Microsecond
+	if rs.ring != nil {
+		// The ring waits in poll with the timeout, no socket option needed
+		return nil
 	}
+	tv := syscall.NsecToTimeval(rs.readTimeout.Nanoseconds())
 	return syscall.SetsockoptTimeval(rs.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
 }
 
 // SetWriteTimeout sets write timeout for the socket
 func (rs *RawSocket) SetWriteTimeout(sec, usec int64) error {
-	tv := syscall.Timeval{
-		Sec:  sec,
-		Usec: int32(usec),
-	}
+	tv := syscall.NsecToTimeval((time.Duration(sec)*time.Second + time.Duration(usec)*time.Microsecond).Nanoseconds())
 	return syscall.SetsockoptTimeval(rs.fd, syscall.SOL_SOCKET, syscall.SO_SNDTIMEO, &tv)
 }
 
@@ -584,6 +671,11 @@ func (rs *RawSocket) Close() error {
 		rs.pcapHandle = nil
 	}
 
+	if rs.ring != nil {
+		err = rs.ring.close()
+		rs.ring = nil
+	}
+
 	if rs.sendFd != rs.fd {
 		err = syscall.Close(rs.sendFd)
 	}
@@ -626,6 +718,18 @@ func (rs *RawSocket) SetSocketOption(level, name int, value interface{}) error {
 	}
 }
 
+// soMark is SO_MARK on Linux, which package syscall only defines there
+const soMark = 0x24
+
+// SetMark sets the firewall mark of the packets sent from the socket.
+// On other systems than Linux, this is a no-op.
+func (rs *RawSocket) SetMark(mark int) error {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+	return syscall.SetsockoptInt(rs.sendFd, syscall.SOL_SOCKET, soMark, mark)
+}
+
 // GetSocketOption gets a socket option
 func (rs *RawSocket) GetSocketOption(level, name int) (int, error) {
 	return syscall.GetsockoptInt(rs.fd, level, name)
@@ -655,6 +759,11 @@ func (rs *RawSocket) RemotePort() uint16 {
 func (rs *RawSocket) SetRemoteAddr(ip net.IP, port uint16) {
 	rs.remoteIP = ip
 	rs.remotePort = port
+	if runtime.GOOS == "linux" {
+		if err := rs.attachDefaultFilter(); err != nil {
+			log.Printf("⚠️  Failed to update socket filter: %v", err)
+		}
+	}
 }
 
 var _ = unsafe.Sizeof(0) // For future use
@@ -0,0 +1,223 @@
+package rawsocket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// TPACKET_V3 receive ring. Instead of one recvfrom per segment on the raw
+// socket, an AF_PACKET socket shares a memory-mapped ring of blocks with the
+// kernel. The kernel fills a block with many frames and hands it over as a
+// whole, so frames are read straight from the ring and a system call (poll)
+// is only needed when no filled block is waiting. A BPF filter keeps
+// everything but our port out of the ring.
+const (
+	afPacket             = 17     // AF_PACKET
+	ethPIP               = 0x0800 // ETH_P_IP
+	solPacket            = 263    // SOL_PACKET
+	packetRxRing         = 5      // PACKET_RX_RING
+	packetVersion        = 10     // PACKET_VERSION
+	packetIgnoreOutgoing = 23     // PACKET_IGNORE_OUTGOING
+	tpacketV3            = 2      // TPACKET_V3
+	packetOutgoing       = 4      // PACKET_OUTGOING
+	tpStatusUser         = 1      // TP_STATUS_USER
+	tpStatusKernel       = 0      // TP_STATUS_KERNEL
+
+	ringBlockSize  = 1 << 20 // Bytes per ring block
+	ringBlockCount = 16      // Number of blocks in the ring
+	ringFrameSize  = 1 << 11 // Nominal frame size (TPACKET_V3 frames are variable)
+	// ringRetireTimeoutMs closes a partially filled block after this many
+	// milliseconds so packets are not held back under light load.
+	ringRetireTimeoutMs = 1
+
+	// Offsets in struct tpacket_block_desc
+	blockStatusOff   = 8
+	blockNumPktsOff  = 12
+	blockFirstPktOff = 16
+	// Offsets in struct tpacket3_hdr
+	frameNextOff    = 0
+	frameSnaplenOff = 12
+	frameNetOff     = 26
+	// struct sockaddr_ll follows the aligned tpacket3_hdr
+	frameSllOff   = 48
+	sllPkttypeOff = 10
+)
+
+// tpacketReq3 mirrors struct tpacket_req3.
+type tpacketReq3 struct {
+	blockSize      uint32
+	blockNr        uint32
+	frameSize      uint32
+	frameNr        uint32
+	retireBlkTov   uint32
+	sizeofPriv     uint32
+	featureReqWord uint32
+}
+
+// sockaddrLL mirrors struct sockaddr_ll.
+type sockaddrLL struct {
+	family   uint16
+	protocol uint16
+	ifindex  int32
+	hatype   uint16
+	pkttype  uint8
+	halen    uint8
+	addr     [8]byte
+}
+
+// packetRing is a TPACKET_V3 receive ring.
+type packetRing struct {
+	fd        int
+	mem       []byte
+	block     int  // Index of the current block
+	inBlock   bool // The current block is owned by us
+	next      int  // Offset of the next frame in the current block
+	remaining int  // Frames left in the current block
+}
+
+// newPacketRing opens an AF_PACKET socket for IPv4 with a receive ring and a
+// filter that only passes TCP segments to port.
+func newPacketRing(port uint16) (*packetRing, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("TPACKET_V3 is only supported on Linux")
+	}
+	proto := int(htons(ethPIP))
+	fd, err := syscall.Socket(afPacket, syscall.SOCK_DGRAM, proto)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create packet socket: %v", err)
+	}
+	r := &packetRing{fd: fd}
+	if err := r.setup(port); err != nil {
+		r.close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *packetRing) setup(port uint16) error {
+	// Filter before the ring is mapped so nothing else is queued
+	prog, err := buildFilter(port, nil, false, 0)
+	if err != nil {
+		return err
+	}
+	if err := attachFilter(r.fd, prog); err != nil {
+		return fmt.Errorf("failed to attach filter: %v", err)
+	}
+	if err := syscall.SetsockoptInt(r.fd, solPacket, packetVersion, tpacketV3); err != nil {
+		return fmt.Errorf("failed to select TPACKET_V3: %v", err)
+	}
+	// Our own segments are seen on the way out too; skip them where the
+	// kernel supports it (they are also filtered by packet type below)
+	_ = syscall.SetsockoptInt(r.fd, solPacket, packetIgnoreOutgoing, 1)
+
+	req := tpacketReq3{
+		blockSize:    ringBlockSize,
+		blockNr:      ringBlockCount,
+		frameSize:    ringFrameSize,
+		frameNr:      ringBlockSize / ringFrameSize * ringBlockCount,
+		retireBlkTov: ringRetireTimeoutMs,
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(r.fd), solPacket, packetRxRing,
+		uintptr(unsafe.Pointer(&req)), unsafe.Sizeof(req), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to set up PACKET_RX_RING: %v", errno)
+	}
+
+	mem, err := syscall.Mmap(r.fd, 0, ringBlockSize*ringBlockCount, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("failed to map ring: %v", err)
+	}
+	r.mem = mem
+
+	sll := sockaddrLL{family: afPacket, protocol: htons(ethPIP)}
+	_, _, errno = syscall.Syscall(syscall.SYS_BIND, uintptr(r.fd), uintptr(unsafe.Pointer(&sll)), unsafe.Sizeof(sll))
+	if errno != 0 {
+		return fmt.Errorf("failed to bind packet socket: %v", errno)
+	}
+	return nil
+}
+
+// read returns the next received IP packet, waiting up to timeout for one.
+// The packet points into the ring and is only valid until the next call.
+func (r *packetRing) read(timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if r.remaining > 0 {
+			frame := r.blockOffset() + r.next
+			r.next += int(r.u32(frame + frameNextOff))
+			r.remaining--
+
+			if r.mem[frame+frameSllOff+sllPkttypeOff] == packetOutgoing {
+				continue
+			}
+			start := frame + int(binary.NativeEndian.Uint16(r.mem[frame+frameNetOff:]))
+			snaplen := int(r.u32(frame + frameSnaplenOff))
+			if start+snaplen > len(r.mem) {
+				continue
+			}
+			return r.mem[start : start+snaplen], nil
+		}
+
+		if r.inBlock {
+			// Hand the consumed block back to the kernel
+			atomic.StoreUint32(r.u32p(r.blockOffset()+blockStatusOff), tpStatusKernel)
+			r.inBlock = false
+			r.block = (r.block + 1) % ringBlockCount
+		}
+
+		base := r.blockOffset()
+		if atomic.LoadUint32(r.u32p(base+blockStatusOff))&tpStatusUser != 0 {
+			r.inBlock = true
+			r.next = int(r.u32(base + blockFirstPktOff))
+			r.remaining = int(r.u32(base + blockNumPktsOff))
+			continue
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, errRingTimeout
+		}
+		fds := []unix.PollFd{{Fd: int32(r.fd), Events: unix.POLLIN | unix.POLLERR}}
+		if _, err := unix.Poll(fds, int(wait/time.Millisecond)+1); err != nil && err != unix.EINTR {
+			return nil, fmt.Errorf("failed to poll ring: %v", err)
+		}
+	}
+}
+
+// errRingTimeout is returned when no packet arrived before the read timeout.
+var errRingTimeout = fmt.Errorf("ring read timeout")
+
+func (r *packetRing) blockOffset() int {
+	return r.block * ringBlockSize
+}
+
+func (r *packetRing) u32(off int) uint32 {
+	return binary.NativeEndian.Uint32(r.mem[off:])
+}
+
+func (r *packetRing) u32p(off int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&r.mem[off]))
+}
+
+// close unmaps the ring and closes the packet socket.
+func (r *packetRing) close() error {
+	if r.mem != nil {
+		syscall.Munmap(r.mem)
+		r.mem = nil
+	}
+	return syscall.Close(r.fd)
+}
+
+// htons converts a 16-bit value to network byte order.
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return binary.NativeEndian.Uint16(b[:])
+}
@@ -0,0 +1,331 @@
+package rstfilter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+)
+
+// eBPF RST suppression. The kernel has no socket for our fake-TCP
+// connections, so it answers their segments with RSTs. Instead of iptables
+// rules, a TC egress program looks up each outgoing RST in a hash map of our
+// connections' 4-tuples and drops it on a match. The map is updated as
+// connections open and close. On kernels with TCX (6.6+) the program and its
+// links go away with the process, so nothing is left behind after a crash;
+// older kernels get a legacy cls_bpf filter instead (see attachTC).
+//
+// A listener also registers its port: the kernel rejects a client's first
+// SYN before the connection is known, so RST+ACK replies with sequence
+// number 0 (the answer to a SYN) from that port are dropped too, as are plain
+// RSTs, the answer to a segment carrying ACK. A listener answering SYNs with
+// cookies only learns about a connection from its third ACK, which the kernel
+// has already rejected by then.
+const (
+	// MaxEntries is the capacity of the connection map
+	MaxEntries = 65536
+
+	ethPIP    = 0x0800
+	ethHdrLen = 14
+	tcpRST    = 0x04
+	tcpACK    = 0x10
+
+	skbProtocolOff = 16 // offsetof(struct __sk_buff, protocol)
+
+	tcActShot = 2  // TC_ACT_SHOT / TCX_DROP
+	tcxNext   = -1 // TC_ACT_UNSPEC / TCX_NEXT: let other programs decide
+
+	// Stack layout of the program
+	ipHdrOff  = -40 // 20 bytes of IP header
+	tcpHdrOff = -56 // First 14 bytes of TCP header
+	keyOff    = -72 // 12-byte map key
+)
+
+// Key is a connection 4-tuple as seen on an outgoing segment, in network
+// byte order: local address, remote address, local port, remote port.
+type Key [12]byte
+
+// NewKey builds the map key of a connection.
+func NewKey(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16) Key {
+	var k Key
+	if ip4 := localIP.To4(); ip4 != nil {
+		copy(k[0:4], ip4)
+	}
+	if ip4 := remoteIP.To4(); ip4 != nil {
+		copy(k[4:8], ip4)
+	}
+	binary.BigEndian.PutUint16(k[8:10], localPort)
+	binary.BigEndian.PutUint16(k[10:12], remotePort)
+	return k
+}
+
+// Filter is a loaded RST suppression program with its connection map.
+type Filter struct {
+	mu    sync.Mutex
+	conns *ebpf.Map
+	progs []*ebpf.Program
+	links []io.Closer // TCX links or legacy TC filters
+}
+
+// New loads the program and attaches it to the egress of every interface
+// that is up. Interfaces created later are not covered.
+func New() (*Filter, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("eBPF is only supported on Linux")
+	}
+	// Kernels before 5.11 account BPF memory against RLIMIT_MEMLOCK
+	_ = rlimit.RemoveMemlock()
+
+	conns, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "lt_rst_conns",
+		Type:       ebpf.Hash,
+		KeySize:    uint32(len(Key{})),
+		ValueSize:  8,
+		MaxEntries: MaxEntries,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create map: %v", err)
+	}
+	f := &Filter{conns: conns}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to list interfaces: %v", err)
+	}
+	progs := make(map[int32]*ebpf.Program)
+	var lastErr error
+	legacy := false
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		// Ethernet and loopback frames carry a MAC header, TUN-like
+		// devices start at the IP header
+		l2Len := int32(0)
+		if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) == 6 {
+			l2Len = ethHdrLen
+		}
+		prog, ok := progs[l2Len]
+		if !ok {
+			prog, err = newProgram(conns, l2Len)
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			progs[l2Len] = prog
+			f.progs = append(f.progs, prog)
+		}
+		l, err := f.attach(iface.Index, prog, &legacy)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		f.links = append(f.links, l)
+	}
+	if len(f.links) == 0 {
+		f.Close()
+		if lastErr == nil {
+			lastErr = errors.New("no interface is up")
+		}
+		return nil, fmt.Errorf("failed to attach TC egress program: %v", lastErr)
+	}
+	return f, nil
+}
+
+// attach attaches prog to the egress of an interface through TCX, or once
+// TCX turned out to be unsupported (legacy set), with a legacy TC filter.
+func (f *Filter) attach(ifindex int, prog *ebpf.Program, legacy *bool) (io.Closer, error) {
+	if !*legacy {
+		l, err := link.AttachTCX(link.TCXOptions{
+			Interface: ifindex,
+			Program:   prog,
+			Attach:    ebpf.AttachTCXEgress,
+		})
+		if err == nil {
+			return l, nil
+		}
+		if !errors.Is(err, ebpf.ErrNotSupported) {
+			return nil, err
+		}
+		log.Printf("⚠️  TCX not supported (needs kernel 6.6+), attaching the RST filter as a legacy TC filter")
+		*legacy = true
+	}
+	return attachTC(ifindex, prog)
+}
+
+// newProgram loads the TC program for interfaces whose frames start with
+// l2Len bytes of link-layer header.
+func newProgram(conns *ebpf.Map, l2Len int32) (*ebpf.Program, error) {
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Name:         "lt_rst_filter",
+		Type:         ebpf.SchedCLS,
+		AttachType:   ebpf.AttachNone, // Loadable before TCX existed
+		Instructions: programInstructions(conns.FD(), l2Len),
+		License:      "GPL",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load program: %v", err)
+	}
+	return prog, nil
+}
+
+// programInstructions generates the filter program. Headers are copied to
+// the stack with bpf_skb_load_bytes, which keeps the verifier happy without
+// bounds checks on direct packet access.
+func programInstructions(mapFD int, l2Len int32) asm.Instructions {
+	return asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+
+		// IPv4 only
+		asm.LoadMem(asm.R2, asm.R6, skbProtocolOff, asm.Word),
+		asm.JNE.Imm(asm.R2, int32(htons(ethPIP)), "pass"),
+
+		// Copy the IP header
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.Mov.Imm(asm.R2, l2Len),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, ipHdrOff),
+		asm.Mov.Imm(asm.R4, 20),
+		asm.FnSkbLoadBytes.Call(),
+		asm.JNE.Imm(asm.R0, 0, "pass"),
+		asm.LoadMem(asm.R2, asm.RFP, ipHdrOff+9, asm.Byte),
+		asm.JNE.Imm(asm.R2, 6, "pass"), // IPPROTO_TCP
+
+		// Copy the TCP header after the IP header and its options
+		asm.LoadMem(asm.R2, asm.RFP, ipHdrOff, asm.Byte),
+		asm.And.Imm(asm.R2, 0x0f),
+		asm.LSh.Imm(asm.R2, 2),
+		asm.Add.Imm(asm.R2, l2Len),
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, tcpHdrOff),
+		asm.Mov.Imm(asm.R4, 14),
+		asm.FnSkbLoadBytes.Call(),
+		asm.JNE.Imm(asm.R0, 0, "pass"),
+		asm.LoadMem(asm.R7, asm.RFP, tcpHdrOff+13, asm.Byte), // Flags
+		asm.Mov.Reg(asm.R2, asm.R7),
+		asm.And.Imm(asm.R2, tcpRST),
+		asm.JEq.Imm(asm.R2, 0, "pass"),
+
+		// Look up the 4-tuple
+		asm.LoadMem(asm.R2, asm.RFP, ipHdrOff+12, asm.Word),
+		asm.StoreMem(asm.RFP, keyOff, asm.R2, asm.Word),
+		asm.LoadMem(asm.R2, asm.RFP, ipHdrOff+16, asm.Word),
+		asm.StoreMem(asm.RFP, keyOff+4, asm.R2, asm.Word),
+		asm.LoadMem(asm.R2, asm.RFP, tcpHdrOff, asm.Half),
+		asm.StoreMem(asm.RFP, keyOff+8, asm.R2, asm.Half),
+		asm.LoadMem(asm.R2, asm.RFP, tcpHdrOff+2, asm.Half),
+		asm.StoreMem(asm.RFP, keyOff+10, asm.R2, asm.Half),
+		asm.LoadMapPtr(asm.R1, mapFD),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, keyOff),
+		asm.FnMapLookupElem.Call(),
+		asm.JNE.Imm(asm.R0, 0, "drop"),
+
+		// A listener port matches SYN rejections (RST+ACK, seq 0) and plain
+		// RSTs from anyone
+		asm.JEq.Imm(asm.R7, tcpRST, "listener"),
+		asm.JNE.Imm(asm.R7, tcpRST|tcpACK, "pass"),
+		asm.LoadMem(asm.R2, asm.RFP, tcpHdrOff+4, asm.Word),
+		asm.JNE.Imm(asm.R2, 0, "pass"),
+		asm.StoreImm(asm.RFP, keyOff, 0, asm.Word).WithSymbol("listener"),
+		asm.StoreImm(asm.RFP, keyOff+4, 0, asm.Word),
+		asm.StoreImm(asm.RFP, keyOff+10, 0, asm.Half),
+		asm.LoadMapPtr(asm.R1, mapFD),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, keyOff),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "pass"),
+
+		// Count and drop
+		asm.Mov.Imm(asm.R1, 1).WithSymbol("drop"),
+		asm.StoreXAdd(asm.R0, asm.R1, asm.DWord),
+		asm.Mov.Imm(asm.R0, tcActShot),
+		asm.Return(),
+
+		asm.Mov.Imm(asm.R0, tcxNext).WithSymbol("pass"),
+		asm.Return(),
+	}
+}
+
+// AddConn starts dropping RSTs the kernel sends on a connection.
+func (f *Filter) AddConn(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16) error {
+	return f.put(NewKey(localIP, localPort, remoteIP, remotePort))
+}
+
+// RemoveConn stops dropping RSTs on a connection.
+func (f *Filter) RemoveConn(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.conns.Delete(NewKey(localIP, localPort, remoteIP, remotePort))
+	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return err
+	}
+	return nil
+}
+
+// AddListener drops the kernel's rejections of SYNs and plain RSTs sent from
+// a listening port.
+func (f *Filter) AddListener(port uint16) error {
+	return f.put(NewKey(nil, port, nil, 0))
+}
+
+func (f *Filter) put(k Key) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var zero uint64
+	// Keep the drop counter of an existing entry
+	err := f.conns.Update(k, zero, ebpf.UpdateNoExist)
+	if err != nil && !errors.Is(err, ebpf.ErrKeyExist) {
+		return err
+	}
+	return nil
+}
+
+// Dropped returns the number of RSTs dropped for the current entries.
+func (f *Filter) Dropped() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var (
+		k     Key
+		n     uint64
+		total uint64
+	)
+	iter := f.conns.Iterate()
+	for iter.Next(&k, &n) {
+		total += n
+	}
+	return total
+}
+
+// Close detaches the program and releases the map.
+func (f *Filter) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, l := range f.links {
+		l.Close()
+	}
+	f.links = nil
+	for _, p := range f.progs {
+		p.Close()
+	}
+	f.progs = nil
+	return f.conns.Close()
+}
+
+// htons converts a 16-bit value to network byte order.
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return binary.NativeEndian.Uint16(b[:])
+}
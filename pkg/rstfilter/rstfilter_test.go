@@ -0,0 +1,90 @@
+package rstfilter
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/cilium/ebpf"
+)
+
+// buildFrame builds an Ethernet frame carrying a TCP segment
+func buildFrame(src net.IP, sport uint16, dst net.IP, dport uint16, seq uint32, flags byte) []byte {
+	frame := make([]byte, ethHdrLen+20+20)
+	binary.BigEndian.PutUint16(frame[12:14], ethPIP)
+	ip := frame[ethHdrLen:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], 40)
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:16], src.To4())
+	copy(ip[16:20], dst.To4())
+	tcp := ip[20:]
+	binary.BigEndian.PutUint16(tcp[0:2], sport)
+	binary.BigEndian.PutUint16(tcp[2:4], dport)
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	return frame
+}
+
+// TestProgram runs the generated program on test segments (needs root)
+func TestProgram(t *testing.T) {
+	conns, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.Hash,
+		KeySize:    uint32(len(Key{})),
+		ValueSize:  8,
+		MaxEntries: 16,
+	})
+	if err != nil {
+		t.Skipf("eBPF not available: %v", err)
+	}
+	defer conns.Close()
+	prog, err := newProgram(conns, ethHdrLen)
+	if err != nil {
+		t.Fatalf("newProgram: %v", err)
+	}
+	defer prog.Close()
+
+	f := &Filter{conns: conns}
+	local, remote := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	if err := f.AddConn(local, 30000, remote, 9000); err != nil {
+		t.Fatalf("AddConn: %v", err)
+	}
+	if err := f.AddListener(9000); err != nil {
+		t.Fatalf("AddListener: %v", err)
+	}
+
+	cases := []struct {
+		name string
+		data []byte
+		drop bool
+	}{
+		{"RST on a connection", buildFrame(local, 30000, remote, 9000, 1234, tcpRST), true},
+		{"ACK on a connection", buildFrame(local, 30000, remote, 9000, 1234, tcpACK), false},
+		{"RST on another connection", buildFrame(local, 30001, remote, 9000, 1234, tcpRST), false},
+		{"SYN rejection on the listener port", buildFrame(local, 9000, remote, 41000, 0, tcpRST|tcpACK), true},
+		{"ACK rejection on the listener port", buildFrame(local, 9000, remote, 41000, 77, tcpRST), true},
+		{"other RST+ACK on the listener port", buildFrame(local, 9000, remote, 41000, 77, tcpRST|tcpACK), false},
+	}
+	for _, c := range cases {
+		ret, err := prog.Run(&ebpf.RunOptions{Data: c.data})
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if (int32(ret) == tcActShot) != c.drop {
+			t.Errorf("%s: program returned %d", c.name, int32(ret))
+		}
+	}
+	if n := f.Dropped(); n != 3 {
+		t.Errorf("Expected 3 dropped RSTs, got %d", n)
+	}
+
+	if err := f.RemoveConn(local, 30000, remote, 9000); err != nil {
+		t.Fatalf("RemoveConn: %v", err)
+	}
+	ret, _ := prog.Run(&ebpf.RunOptions{Data: cases[0].data})
+	if int32(ret) == tcActShot {
+		t.Errorf("RST dropped after the connection was removed")
+	}
+}
@@ -0,0 +1,123 @@
+package rstfilter
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Legacy TC attachment for kernels before 6.6, which lack TCX: the program
+// is added as a direct-action cls_bpf filter on the egress hook of a clsact
+// qdisc, over rtnetlink. Unlike a TCX link the filter is not tied to the
+// process, so Close deletes it; a process that is killed leaves it behind.
+// The qdisc stays, as filters of other programs may hang off it.
+const (
+	tcHClsact       = 0xfffffff1 // TC_H_CLSACT, parent of the clsact qdisc
+	tcHClsactHandle = 0xffff0000 // TC_H_MAKE(TC_H_CLSACT, 0)
+	tcHEgress       = 0xfffffff3 // TC_H_MAKE(TC_H_CLSACT, TC_H_MIN_EGRESS)
+
+	tcaBPFFD            = 6 // TCA_BPF_FD
+	tcaBPFName          = 7 // TCA_BPF_NAME
+	tcaBPFFlags         = 8 // TCA_BPF_FLAGS
+	tcaBPFFlagActDirect = 1 // TCA_BPF_FLAG_ACT_DIRECT
+
+	tcFilterPrio = 0xc0de // Shared by the filters of all instances, told apart by handle
+)
+
+// tcFilter is a cls_bpf filter added by attachTC
+type tcFilter struct {
+	ifindex int
+	handle  uint32
+}
+
+// attachTC adds prog as an egress filter of an interface, creating the
+// clsact qdisc if needed
+func attachTC(ifindex int, prog *ebpf.Program) (*tcFilter, error) {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rtnetlink: %v", err)
+	}
+	defer conn.Close()
+
+	ae := netlink.NewAttributeEncoder()
+	ae.String(unix.TCA_KIND, "clsact")
+	attrs, err := ae.Encode()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Execute(netlink.Message{
+		Header: netlink.Header{Type: unix.RTM_NEWQDISC, Flags: netlink.Request | netlink.Acknowledge | netlink.Create},
+		Data:   append(tcMsg(ifindex, tcHClsactHandle, tcHClsact, 0), attrs...),
+	})
+	if err != nil && !errors.Is(err, unix.EEXIST) {
+		return nil, fmt.Errorf("failed to add clsact qdisc: %v", err)
+	}
+
+	f := &tcFilter{ifindex: ifindex}
+	for f.handle == 0 {
+		var b [4]byte
+		rand.Read(b[:])
+		f.handle = binary.NativeEndian.Uint32(b[:])
+	}
+	ae = netlink.NewAttributeEncoder()
+	ae.String(unix.TCA_KIND, "bpf")
+	ae.Nested(unix.TCA_OPTIONS, func(nae *netlink.AttributeEncoder) error {
+		nae.Uint32(tcaBPFFD, uint32(prog.FD()))
+		nae.String(tcaBPFName, "lt_rst_filter")
+		nae.Uint32(tcaBPFFlags, tcaBPFFlagActDirect)
+		return nil
+	})
+	if attrs, err = ae.Encode(); err != nil {
+		return nil, err
+	}
+	_, err = conn.Execute(netlink.Message{
+		Header: netlink.Header{Type: unix.RTM_NEWTFILTER, Flags: netlink.Request | netlink.Acknowledge | netlink.Create | netlink.Excl},
+		Data:   append(f.tcMsg(), attrs...),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add TC filter: %v", err)
+	}
+	return f, nil
+}
+
+// Close deletes the filter
+func (f *tcFilter) Close() error {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ae := netlink.NewAttributeEncoder()
+	ae.String(unix.TCA_KIND, "bpf")
+	attrs, err := ae.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Execute(netlink.Message{
+		Header: netlink.Header{Type: unix.RTM_DELTFILTER, Flags: netlink.Request | netlink.Acknowledge},
+		Data:   append(f.tcMsg(), attrs...),
+	})
+	return err
+}
+
+// tcMsg returns the struct tcmsg addressing the filter
+func (f *tcFilter) tcMsg() []byte {
+	return tcMsg(f.ifindex, f.handle, tcHEgress, tcFilterPrio<<16|uint32(htons(unix.ETH_P_ALL)))
+}
+
+// tcMsg builds a struct tcmsg
+func tcMsg(ifindex int, handle, parent, info uint32) []byte {
+	b := make([]byte, 20)
+	b[0] = unix.AF_UNSPEC
+	binary.NativeEndian.PutUint32(b[4:8], uint32(ifindex))
+	binary.NativeEndian.PutUint32(b[8:12], handle)
+	binary.NativeEndian.PutUint32(b[12:16], parent)
+	binary.NativeEndian.PutUint32(b[16:20], info)
+	return b
+}
@@ -0,0 +1,75 @@
+package rstfilter
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// TestAttachTC tests adding and deleting a legacy TC filter in a private
+// network namespace (needs root)
+func TestAttachTC(t *testing.T) {
+	conns, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.Hash,
+		KeySize:    uint32(len(Key{})),
+		ValueSize:  8,
+		MaxEntries: 16,
+	})
+	if err != nil {
+		t.Skipf("eBPF not available: %v", err)
+	}
+	defer conns.Close()
+	prog, err := newProgram(conns, ethHdrLen)
+	if err != nil {
+		t.Fatalf("newProgram: %v", err)
+	}
+	defer prog.Close()
+
+	skip := make(chan error, 1)
+	done := make(chan error, 1)
+	go func() {
+		// The thread is left in the new namespace and discarded on exit
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			skip <- fmt.Errorf("cannot create network namespace: %v", err)
+			return
+		}
+		lo, err := net.InterfaceByName("lo")
+		if err != nil {
+			skip <- err
+			return
+		}
+		first, err := attachTC(lo.Index, prog)
+		if err != nil {
+			done <- fmt.Errorf("attachTC: %v", err)
+			return
+		}
+		// A second filter shares the existing qdisc
+		second, err := attachTC(lo.Index, prog)
+		if err != nil {
+			done <- fmt.Errorf("second attachTC: %v", err)
+			return
+		}
+		if err := first.Close(); err != nil {
+			done <- fmt.Errorf("Close: %v", err)
+			return
+		}
+		if err := first.Close(); err == nil {
+			done <- fmt.Errorf("Filter still present after Close")
+			return
+		}
+		done <- second.Close()
+	}()
+	select {
+	case err := <-skip:
+		t.Skipf("%v", err)
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
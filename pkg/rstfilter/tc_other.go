@@ -0,0 +1,22 @@
+//go:build !linux
+
+package rstfilter
+
+import (
+	"fmt"
+
+	"github.com/cilium/ebpf"
+)
+
+// tcFilter is a TC filter (Linux only)
+type tcFilter struct{}
+
+// attachTC fails outside Linux
+func attachTC(ifindex int, prog *ebpf.Program) (*tcFilter, error) {
+	return nil, fmt.Errorf("TC filters are only supported on Linux")
+}
+
+// Close does nothing outside Linux
+func (f *tcFilter) Close() error {
+	return nil
+}
@@ -0,0 +1,144 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Batch container format (after the PacketTypeBatch byte):
+//
+//	[len:2][packet][len:2][packet]...
+//
+// Each inner packet is a raw IP packet prefixed by its big-endian length.
+// The whole container, including the type byte, never exceeds MTU+1 bytes so
+// it fits into a single fake-TCP segment just like a regular data frame.
+const (
+	batchLenPrefix  = 2  // Length prefix in front of each inner packet
+	maxBatchPackets = 64 // Upper bound on packets coalesced into one container
+)
+
+var errInvalidBatch = errors.New("malformed batch container")
+
+// collectBatch gathers packets that follow first in queue into batch until the
+// container would exceed limit bytes, maxBatchPackets is reached or latency
+// expires without a new packet arriving. Waiting ends early when either stop
+// channel is closed (a nil channel never is). A packet that does not fit is
+// returned as leftover and must be sent next by the caller to preserve ordering.
+func collectBatch(batch [][]byte, first []byte, queue <-chan []byte, limit int, latency time.Duration, stopCh, clientStopCh <-chan struct{}) ([][]byte, []byte) {
+	batch = append(batch, first)
+	size := 1 + batchLenPrefix + len(first)
+
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for len(batch) < maxBatchPackets {
+		// No room left for even the smallest IP packet
+		if size+batchLenPrefix+IPv4MinHeaderLen > limit {
+			return batch, nil
+		}
+
+		var packet []byte
+		select {
+		case packet = <-queue:
+		default:
+			if latency <= 0 {
+				return batch, nil
+			}
+			if timer == nil {
+				timer = time.NewTimer(latency)
+			}
+			select {
+			case packet = <-queue:
+			case <-timer.C:
+				return batch, nil
+			case <-stopCh:
+				return batch, nil
+			case <-clientStopCh:
+				return batch, nil
+			}
+		}
+
+		if size+batchLenPrefix+len(packet) > limit {
+			return batch, packet
+		}
+		batch = append(batch, packet)
+		size += batchLenPrefix + len(packet)
+	}
+	return batch, nil
+}
+
+// encodeBatch serializes packets into a PacketTypeBatch container using dst as
+// backing storage when it is large enough.
+func encodeBatch(dst []byte, packets [][]byte) []byte {
+	size := 1
+	for _, p := range packets {
+		size += batchLenPrefix + len(p)
+	}
+	if cap(dst) < size {
+		dst = make([]byte, size)
+	}
+	dst = dst[:size]
+
+	dst[0] = PacketTypeBatch
+	off := 1
+	for _, p := range packets {
+		binary.BigEndian.PutUint16(dst[off:], uint16(len(p)))
+		off += batchLenPrefix
+		off += copy(dst[off:], p)
+	}
+	return dst
+}
+
+// splitBatch returns the inner packets of a batch container payload (without
+// the leading type byte). The returned slices alias payload.
+func splitBatch(payload []byte) ([][]byte, error) {
+	var packets [][]byte
+	for off := 0; off < len(payload); {
+		if len(payload)-off < batchLenPrefix {
+			return nil, errInvalidBatch
+		}
+		n := int(binary.BigEndian.Uint16(payload[off:]))
+		off += batchLenPrefix
+		if n == 0 || n > len(payload)-off {
+			return nil, errInvalidBatch
+		}
+		packets = append(packets, payload[off:off+n])
+		off += n
+	}
+	if len(packets) == 0 {
+		return nil, errInvalidBatch
+	}
+	return packets, nil
+}
+
+// buildDataFrame turns a batch of outgoing packets into a single tunnel frame.
+// A lone packet is sent as a regular PacketTypeData frame so peers see exactly
+// the same traffic as without batching.
+func (t *Tunnel) buildDataFrame(batch [][]byte) []byte {
+	if len(batch) == 1 {
+		frame, _ := prependPacketType(batch[0], PacketTypeData)
+		return frame
+	}
+	return encodeBatch(t.getPacketBuffer(), batch)
+}
+
+// releaseBatch returns the packets of a batch and the container built for them
+// to the buffer pool.
+func (t *Tunnel) releaseBatch(batch [][]byte, frame []byte) {
+	if len(batch) > 1 {
+		t.releasePacketBuffer(frame)
+	}
+	for _, p := range batch {
+		t.releasePacketBuffer(p)
+	}
+}
+
+// batchLatency returns the configured time budget for filling a batch.
+func (t *Tunnel) batchLatency() time.Duration {
+	return time.Duration(t.config.BatchLatencyUs) * time.Microsecond
+}
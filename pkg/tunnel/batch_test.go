@@ -0,0 +1,105 @@
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestBatchRoundTrip tests that packets survive encoding into a batch container
+func TestBatchRoundTrip(t *testing.T) {
+	packets := [][]byte{
+		bytes.Repeat([]byte{0x45}, 40),
+		bytes.Repeat([]byte{0x46}, 60),
+		bytes.Repeat([]byte{0x47}, 1),
+	}
+
+	frame := encodeBatch(nil, packets)
+	if frame[0] != PacketTypeBatch {
+		t.Fatalf("Expected batch type byte, got 0x%02x", frame[0])
+	}
+
+	got, err := splitBatch(frame[1:])
+	if err != nil {
+		t.Fatalf("Failed to split batch: %v", err)
+	}
+	if len(got) != len(packets) {
+		t.Fatalf("Expected %d packets, got %d", len(packets), len(got))
+	}
+	for i := range packets {
+		if !bytes.Equal(got[i], packets[i]) {
+			t.Errorf("Packet %d mismatch", i)
+		}
+	}
+}
+
+// TestSplitBatchRejectsTruncated tests that malformed containers are rejected
+func TestSplitBatchRejectsTruncated(t *testing.T) {
+	frame := encodeBatch(nil, [][]byte{make([]byte, 30), make([]byte, 30)})
+	for _, payload := range [][]byte{frame[1 : len(frame)-1], {0x00}, {0x00, 0x00}, {}} {
+		if _, err := splitBatch(payload); err == nil {
+			t.Errorf("Expected error for payload of %d bytes", len(payload))
+		}
+	}
+}
+
+// TestCollectBatchRespectsLimit tests that a packet that would overflow the
+// container is handed back as leftover instead of being dropped
+func TestCollectBatchRespectsLimit(t *testing.T) {
+	queue := make(chan []byte, 4)
+	queue <- make([]byte, 100)
+	queue <- make([]byte, 100)
+	queue <- make([]byte, 100)
+
+	// Room for first + one more packet: 1 + 3*(2+100) > 250 >= 1 + 2*(2+100)
+	batch, leftover := collectBatch(nil, make([]byte, 100), queue, 250, 0, nil, nil)
+	if len(batch) != 2 {
+		t.Fatalf("Expected 2 packets in batch, got %d", len(batch))
+	}
+	if leftover == nil {
+		t.Fatalf("Expected leftover packet")
+	}
+	if len(queue) != 1 {
+		t.Fatalf("Expected 1 packet left in queue, got %d", len(queue))
+	}
+}
+
+// TestCollectBatchWaitsForLatency tests that a packet arriving within the
+// latency budget joins the batch
+func TestCollectBatchWaitsForLatency(t *testing.T) {
+	queue := make(chan []byte, 1)
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		queue <- make([]byte, 40)
+	}()
+
+	batch, leftover := collectBatch(nil, make([]byte, 40), queue, 1400, 500*time.Millisecond, nil, nil)
+	if len(batch) < 2 {
+		t.Fatalf("Expected late packet to join batch, got %d packets", len(batch))
+	}
+	if leftover != nil {
+		t.Fatalf("Unexpected leftover packet")
+	}
+}
+
+// TestCollectBatchStops tests that waiting for more packets ends when either
+// stop channel is closed
+func TestCollectBatchStops(t *testing.T) {
+	for _, which := range []string{"tunnel", "client"} {
+		stopCh, clientStopCh := make(chan struct{}), make(chan struct{})
+		if which == "tunnel" {
+			close(stopCh)
+		} else {
+			close(clientStopCh)
+		}
+
+		start := time.Now()
+		batch, _ := collectBatch(nil, make([]byte, 40), make(chan []byte), 1400, 5*time.Second, stopCh, clientStopCh)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("Expected closed %s stop channel to end the wait, took %v", which, elapsed)
+		}
+		if len(batch) != 1 {
+			t.Fatalf("Expected 1 packet in batch, got %d", len(batch))
+		}
+	}
+}
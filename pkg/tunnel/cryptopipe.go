@@ -0,0 +1,282 @@
+package tunnel
+
+import (
+	"log"
+	"sync"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/crypto"
+)
+
+// Parallel crypto pipeline. With crypto_workers > 0 the AEAD work is moved off
+// the reader and writer goroutines into a shared worker pool, in the style of
+// wireguard-go's encryption and decryption queues. Each connection direction
+// has a sequencer: a frame is queued to the sequencer in arrival order and to
+// the pool for processing, and a single consumer takes the frames from the
+// sequencer in that order, waiting for each one to finish, so packets reach
+// the wire or the TUN device in their original order whichever worker was
+// fastest.
+const (
+	maxCryptoWorkers   = 256
+	cryptoPoolQueueLen = 4096 // Frames waiting for a worker, all connections
+	cryptoSequencerLen = 1024 // Frames in flight per connection direction
+)
+
+// cryptoJob is one frame travelling through the pipeline.
+type cryptoJob struct {
+	in     []byte
+	out    []byte
+	err    error
+	cipher *crypto.Cipher // Cipher that decrypted the frame (nil if none)
+	gen    uint64
+	batch  [][]byte // Packets to release once the frame has been sent
+	work   func(j *cryptoJob)
+	ready  chan struct{}
+}
+
+var cryptoJobPool = sync.Pool{
+	New: func() interface{} {
+		return &cryptoJob{ready: make(chan struct{}, 1)}
+	},
+}
+
+// free clears a finished job and returns it to the pool.
+func (j *cryptoJob) free() {
+	for i := range j.batch {
+		j.batch[i] = nil
+	}
+	j.batch = j.batch[:0]
+	j.in, j.out, j.err = nil, nil, nil
+	j.cipher, j.gen = nil, 0
+	j.work = nil
+	cryptoJobPool.Put(j)
+}
+
+// cryptoPool is the worker pool shared by all sequencers of a tunnel.
+type cryptoPool struct {
+	jobs chan *cryptoJob
+}
+
+func newCryptoPool() *cryptoPool {
+	return &cryptoPool{jobs: make(chan *cryptoJob, cryptoPoolQueueLen)}
+}
+
+// worker processes jobs until stopCh is closed.
+func (p *cryptoPool) worker(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case j := <-p.jobs:
+			j.work(j)
+			j.ready <- struct{}{}
+		}
+	}
+}
+
+// cryptoSequencer keeps the frames of one connection direction in order.
+type cryptoSequencer struct {
+	pool    *cryptoPool
+	work    func(j *cryptoJob)
+	ordered chan *cryptoJob
+	stopCh  <-chan struct{}
+	doneCh  <-chan struct{} // Connection stop channel (nil if none)
+}
+
+func (p *cryptoPool) newSequencer(work func(j *cryptoJob), stopCh, doneCh <-chan struct{}) *cryptoSequencer {
+	return &cryptoSequencer{
+		pool:    p,
+		work:    work,
+		ordered: make(chan *cryptoJob, cryptoSequencerLen),
+		stopCh:  stopCh,
+		doneCh:  doneCh,
+	}
+}
+
+// submit queues a frame for processing. batch lists the packet buffers the
+// frame was built from. Returns false when the pipeline is stopping.
+func (s *cryptoSequencer) submit(in []byte, batch [][]byte) bool {
+	j := cryptoJobPool.Get().(*cryptoJob)
+	j.in = in
+	j.batch = append(j.batch[:0], batch...)
+	j.work = s.work
+
+	select {
+	case s.ordered <- j:
+	case <-s.stopCh:
+		return false
+	case <-s.doneCh:
+		return false
+	}
+	select {
+	case s.pool.jobs <- j:
+		return true
+	case <-s.stopCh:
+		return false
+	case <-s.doneCh:
+		return false
+	}
+}
+
+// run hands finished jobs to handle in submission order until handle returns
+// false or the pipeline stops.
+func (s *cryptoSequencer) run(handle func(j *cryptoJob) bool) {
+	for {
+		var j *cryptoJob
+		select {
+		case j = <-s.ordered:
+		case <-s.stopCh:
+			return
+		case <-s.doneCh:
+			return
+		}
+
+		select {
+		case <-j.ready:
+		case <-s.stopCh:
+			return
+		case <-s.doneCh:
+			return
+		}
+		ok := handle(j)
+		j.free()
+		if !ok {
+			return
+		}
+	}
+}
+
+// clearAfterAuth reports whether a frame that failed to decrypt is a data
+// frame the peer sent in the clear after authenticating (encrypt_after_auth).
+// Workers run ahead of the consumer, so a frame right behind the
+// authentication can be decrypted before the authentication is handled; the
+// consumer decides in order instead.
+func (t *Tunnel) clearAfterAuth(frame []byte, authenticated bool) bool {
+	return authenticated && t.config.EncryptAfterAuth && len(frame) > 0 && isDataFrameType(frame[0])
+}
+
+// cryptoWorkerCount returns the number of crypto workers to start, or 0 when
+// frames are encrypted and decrypted inline. The packets of all TUN queues
+// meet in one writer per connection, so with several queues and no workers
+// configured there is one worker per queue rather than encryption inline in
+// that writer.
+func (t *Tunnel) cryptoWorkerCount() int {
+	n := t.config.CryptoWorkers
+	if t.cipher == nil {
+		return 0
+	}
+	if n <= 0 {
+		if len(t.tunQueues) <= 1 {
+			return 0
+		}
+		n = len(t.tunQueues)
+	}
+	if n > maxCryptoWorkers {
+		n = maxCryptoWorkers
+	}
+	return n
+}
+
+// startCryptoPipeline starts the crypto worker pool and, in client mode, the
+// sequencers of the server connection.
+func (t *Tunnel) startCryptoPipeline() {
+	n := t.cryptoWorkerCount()
+	if n == 0 {
+		return
+	}
+	t.cryptoPool = newCryptoPool()
+	for i := 0; i < n; i++ {
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.cryptoPool.worker(t.stopCh)
+		}()
+	}
+	log.Printf("✅ Parallel crypto pipeline enabled with %d workers", n)
+
+	if t.config.Mode != "client" {
+		return
+	}
+	t.txCrypto = t.cryptoPool.newSequencer(func(j *cryptoJob) {
+		j.out, j.err = t.encryptPacket(j.in)
+	}, t.stopCh, nil)
+	t.rxCrypto = t.cryptoPool.newSequencer(func(j *cryptoJob) {
+		j.out, j.err = t.decryptPacket(j.in)
+	}, t.stopCh, nil)
+
+	t.wg.Add(2)
+	go func() {
+		defer t.wg.Done()
+		t.txCrypto.run(func(j *cryptoJob) bool {
+			if j.err != nil {
+				log.Printf("Encryption error: %v", j.err)
+			} else {
+				t.sendFrameToServer(j.out)
+			}
+			t.releaseBatch(j.batch, j.in)
+			return true
+		})
+	}()
+	go func() {
+		defer t.wg.Done()
+		t.rxCrypto.run(func(j *cryptoJob) bool {
+			if j.err != nil {
+				t.authMux.Lock()
+				authenticated := t.authenticated
+				t.authMux.Unlock()
+				if !t.clearAfterAuth(j.in, authenticated) {
+					logDecryptionError(j.err, j.in)
+					return true
+				}
+				j.out = j.in
+			}
+			return t.handleServerPacket(j.out)
+		})
+	}()
+}
+
+// startClientCrypto sets up the sequencers of a client connection (server
+// mode) and starts their consumers on the client's wait group.
+func (t *Tunnel) startClientCrypto(client *ClientConnection) {
+	if t.cryptoPool == nil {
+		return
+	}
+	client.txCrypto = t.cryptoPool.newSequencer(func(j *cryptoJob) {
+		j.out, j.err = t.encryptForClient(client, j.in)
+	}, t.stopCh, client.stopCh)
+	client.rxCrypto = t.cryptoPool.newSequencer(func(j *cryptoJob) {
+		j.out, j.cipher, j.gen, j.err = t.decryptPacketFromClient(client, j.in)
+	}, t.stopCh, client.stopCh)
+
+	client.wg.Add(2)
+	go func() {
+		defer client.wg.Done()
+		client.txCrypto.run(func(j *cryptoJob) bool {
+			if j.err != nil {
+				log.Printf("Client encryption error: %v", j.err)
+			} else {
+				t.sendFrameToClient(client, j.out, j.batch)
+			}
+			t.releaseBatch(j.batch, j.in)
+			return true
+		})
+	}()
+	go func() {
+		defer client.wg.Done()
+		client.rxCrypto.run(func(j *cryptoJob) bool {
+			if j.err != nil {
+				client.mu.RLock()
+				authenticated := client.authenticated
+				client.mu.RUnlock()
+				if !t.clearAfterAuth(j.in, authenticated) {
+					log.Printf("Client decryption error from %s (wrong key?): %v", client.currentConn().RemoteAddr(), j.err)
+					return true
+				}
+				j.out, j.cipher = j.in, nil
+			}
+			if j.cipher != nil {
+				client.setCipherWithGen(j.cipher, j.gen)
+			}
+			return t.handleClientPacket(client, j.out)
+		})
+	}()
+}
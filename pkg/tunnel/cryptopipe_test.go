@@ -0,0 +1,72 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+)
+
+// TestCryptoSequencerOrder tests that frames leave the sequencer in
+// submission order even when workers finish them out of order
+func TestCryptoSequencerOrder(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	pool := newCryptoPool()
+	for i := 0; i < 8; i++ {
+		go pool.worker(stopCh)
+	}
+	seq := pool.newSequencer(func(j *cryptoJob) {
+		// Earlier frames take longer so later ones finish first
+		time.Sleep(time.Duration(7-int(j.in[0])%8) * time.Millisecond)
+		j.out = []byte{j.in[0] + 1}
+	}, stopCh, nil)
+
+	const frames = 64
+	got := make(chan byte, frames)
+	go seq.run(func(j *cryptoJob) bool {
+		got <- j.out[0]
+		return true
+	})
+
+	for i := 0; i < frames; i++ {
+		if !seq.submit([]byte{byte(i)}, nil) {
+			t.Fatalf("submit %d failed", i)
+		}
+	}
+	for i := 0; i < frames; i++ {
+		select {
+		case b := <-got:
+			if b != byte(i+1) {
+				t.Fatalf("Frame %d out of order: got %d", i, b-1)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for frame %d", i)
+		}
+	}
+}
+
+// TestClearAfterAuth tests which frames the receive pipelines pass through
+// in the clear once encrypt_after_auth has authenticated the peer
+func TestClearAfterAuth(t *testing.T) {
+	tun := &Tunnel{config: &config.Config{EncryptAfterAuth: true}}
+	if tun.clearAfterAuth([]byte{PacketTypeData, 1}, false) {
+		t.Error("Data frame before authentication passed in the clear")
+	}
+	for _, typ := range []byte{PacketTypeData, PacketTypeBatch, PacketTypeFragment} {
+		if !tun.clearAfterAuth([]byte{typ, 1}, true) {
+			t.Errorf("Frame type %d after authentication not passed in the clear", typ)
+		}
+	}
+	if tun.clearAfterAuth([]byte{PacketTypeKeepalive}, true) {
+		t.Error("Control frame passed in the clear")
+	}
+	if tun.clearAfterAuth(nil, true) {
+		t.Error("Empty frame passed in the clear")
+	}
+	tun.config.EncryptAfterAuth = false
+	if tun.clearAfterAuth([]byte{PacketTypeData, 1}, true) {
+		t.Error("Data frame passed in the clear without encrypt_after_auth")
+	}
+}
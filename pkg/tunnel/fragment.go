@@ -0,0 +1,219 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Fragment format (after the PacketTypeFragment byte):
+//
+//	[id:4][index:1][count:1][data]
+//
+// Inner packets larger than the tunnel MTU are split into several fragments,
+// each sent (and encrypted) as its own frame, and reassembled by the peer.
+const (
+	fragmentHeaderLen = 1 + 4 + 1 + 1 // type + id + index + count
+
+	// DefaultTunMTU is the inner MTU advertised on the TUN device when
+	// fragmentation is enabled.
+	DefaultTunMTU = 1500
+
+	maxFragments          = 64              // Upper bound on fragments per inner packet
+	maxReassembledSize    = 65535           // Largest inner packet accepted for reassembly
+	maxPendingReassembly  = 256             // Max incomplete packets tracked per peer
+	fragmentReassemblyTTL = 2 * time.Second // Incomplete packets are dropped after this
+)
+
+var (
+	errInvalidFragment  = errors.New("malformed fragment")
+	errFragmentTooLarge = errors.New("reassembled packet too large")
+)
+
+// fragmentPacket splits packet into fragment frames of at most frameSize bytes
+// (including the fragment header). Returns nil when the packet would need more
+// than maxFragments fragments.
+func fragmentPacket(packet []byte, id uint32, frameSize int) [][]byte {
+	chunk := frameSize - fragmentHeaderLen
+	if chunk <= 0 {
+		return nil
+	}
+	count := (len(packet) + chunk - 1) / chunk
+	if count == 0 || count > maxFragments {
+		return nil
+	}
+
+	frames := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		start := i * chunk
+		end := start + chunk
+		if end > len(packet) {
+			end = len(packet)
+		}
+		frame := make([]byte, fragmentHeaderLen+end-start)
+		frame[0] = PacketTypeFragment
+		binary.BigEndian.PutUint32(frame[1:5], id)
+		frame[5] = byte(i)
+		frame[6] = byte(count)
+		copy(frame[fragmentHeaderLen:], packet[start:end])
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// fragmentSet collects the fragments of one inner packet.
+type fragmentSet struct {
+	parts    [][]byte
+	received int
+	size     int
+	created  time.Time
+}
+
+// reassembler rebuilds fragmented inner packets received from a single peer.
+// Memory is bounded by maxPendingReassembly incomplete packets, each of at
+// most maxReassembledSize bytes, and stale entries expire after ttl.
+type reassembler struct {
+	mu        sync.Mutex
+	pending   map[uint32]*fragmentSet
+	ttl       time.Duration
+	lastSweep time.Time
+}
+
+func newReassembler(ttl time.Duration) *reassembler {
+	return &reassembler{
+		pending: make(map[uint32]*fragmentSet),
+		ttl:     ttl,
+	}
+}
+
+// add stores a fragment payload (without the leading type byte) and returns
+// the complete inner packet once all fragments have arrived, or nil otherwise.
+func (r *reassembler) add(payload []byte, now time.Time) ([]byte, error) {
+	if len(payload) < fragmentHeaderLen-1 {
+		return nil, errInvalidFragment
+	}
+	id := binary.BigEndian.Uint32(payload[0:4])
+	index := int(payload[4])
+	count := int(payload[5])
+	data := payload[fragmentHeaderLen-1:]
+	if count == 0 || count > maxFragments || index >= count || len(data) == 0 {
+		return nil, errInvalidFragment
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now.Sub(r.lastSweep) >= r.ttl {
+		r.expireLocked(now)
+		r.lastSweep = now
+	}
+
+	set := r.pending[id]
+	if set == nil {
+		if len(r.pending) >= maxPendingReassembly {
+			r.expireLocked(now)
+			if len(r.pending) >= maxPendingReassembly {
+				r.evictOldestLocked()
+			}
+		}
+		set = &fragmentSet{parts: make([][]byte, count), created: now}
+		r.pending[id] = set
+	} else if len(set.parts) != count {
+		delete(r.pending, id)
+		return nil, errInvalidFragment
+	}
+
+	if set.parts[index] != nil {
+		// Duplicate fragment
+		return nil, nil
+	}
+	if set.size+len(data) > maxReassembledSize {
+		delete(r.pending, id)
+		return nil, errFragmentTooLarge
+	}
+	set.parts[index] = append([]byte(nil), data...)
+	set.received++
+	set.size += len(data)
+
+	if set.received < count {
+		return nil, nil
+	}
+
+	delete(r.pending, id)
+	packet := make([]byte, 0, set.size)
+	for _, part := range set.parts {
+		packet = append(packet, part...)
+	}
+	return packet, nil
+}
+
+// expireLocked drops incomplete packets older than the TTL.
+func (r *reassembler) expireLocked(now time.Time) {
+	for id, set := range r.pending {
+		if now.Sub(set.created) > r.ttl {
+			delete(r.pending, id)
+		}
+	}
+}
+
+// evictOldestLocked drops the oldest incomplete packet to make room.
+func (r *reassembler) evictOldestLocked() {
+	var oldestID uint32
+	var oldest time.Time
+	first := true
+	for id, set := range r.pending {
+		if first || set.created.Before(oldest) {
+			oldestID, oldest, first = id, set.created, false
+		}
+	}
+	if !first {
+		delete(r.pending, oldestID)
+	}
+}
+
+// tunMTU returns the MTU advertised on the TUN device. With fragmentation
+// enabled this is independent of the path MTU.
+func (t *Tunnel) tunMTU() int {
+	if t.config.EnableFragmentation && t.config.TunMTU > t.config.MTU {
+		return t.config.TunMTU
+	}
+	return t.config.MTU
+}
+
+// needsFragmentation reports whether an outgoing inner packet exceeds the
+// tunnel MTU and must be split into fragments.
+func (t *Tunnel) needsFragmentation(packet []byte, mtu int) bool {
+	return t.config.EnableFragmentation && len(packet) > mtu
+}
+
+// p2pReassembler returns the reassembler for fragments received from a P2P
+// peer, or nil when fragmentation is disabled.
+func (t *Tunnel) p2pReassembler(peerIP net.IP) *reassembler {
+	if t.p2pReassemblers == nil {
+		return nil
+	}
+	t.p2pReassemblersMu.Lock()
+	defer t.p2pReassemblersMu.Unlock()
+	key := peerIP.String()
+	reasm := t.p2pReassemblers[key]
+	if reasm == nil {
+		reasm = newReassembler(fragmentReassemblyTTL)
+		t.p2pReassemblers[key] = reasm
+	}
+	return reasm
+}
+
+// buildFragmentFrames splits an oversized inner packet into fragment frames
+// that each fit into a single tunnel frame.
+func (t *Tunnel) buildFragmentFrames(packet []byte, mtu int) [][]byte {
+	id := atomic.AddUint32(&t.fragmentID, 1)
+	frames := fragmentPacket(packet, id, mtu+1)
+	if frames == nil {
+		log.Printf("⚠️  Packet too large to fragment (%d bytes, MTU %d), dropping", len(packet), mtu)
+	}
+	return frames
+}
@@ -0,0 +1,131 @@
+package tunnel
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestFragmentReassembleOutOfOrder tests that fragments arriving out of order
+// are reassembled into the original packet
+func TestFragmentReassembleOutOfOrder(t *testing.T) {
+	packet := make([]byte, 1500)
+	for i := range packet {
+		packet[i] = byte(i)
+	}
+
+	frames := fragmentPacket(packet, 7, 600)
+	if len(frames) != 3 {
+		t.Fatalf("Expected 3 fragments, got %d", len(frames))
+	}
+	for _, f := range frames {
+		if len(f) > 600 {
+			t.Fatalf("Fragment exceeds frame size: %d", len(f))
+		}
+	}
+
+	r := newReassembler(fragmentReassemblyTTL)
+	now := time.Now()
+	for _, i := range []int{2, 0} {
+		got, err := r.add(frames[i][1:], now)
+		if err != nil || got != nil {
+			t.Fatalf("Unexpected result for fragment %d: %v, %v", i, got, err)
+		}
+	}
+	// Duplicates are ignored
+	if got, err := r.add(frames[0][1:], now); err != nil || got != nil {
+		t.Fatalf("Unexpected result for duplicate fragment: %v, %v", got, err)
+	}
+
+	got, err := r.add(frames[1][1:], now)
+	if err != nil {
+		t.Fatalf("Failed to reassemble: %v", err)
+	}
+	if !bytes.Equal(got, packet) {
+		t.Fatalf("Reassembled packet mismatch")
+	}
+	if len(r.pending) != 0 {
+		t.Fatalf("Expected no pending packets, got %d", len(r.pending))
+	}
+}
+
+// TestReassemblerExpiresAndBounds tests that incomplete packets time out and
+// that the number of pending packets stays bounded
+func TestReassemblerExpiresAndBounds(t *testing.T) {
+	r := newReassembler(time.Second)
+	now := time.Now()
+
+	for id := uint32(0); id < maxPendingReassembly+10; id++ {
+		frames := fragmentPacket(make([]byte, 100), id, 60)
+		if _, err := r.add(frames[0][1:], now); err != nil {
+			t.Fatalf("Failed to add fragment: %v", err)
+		}
+	}
+	if len(r.pending) > maxPendingReassembly {
+		t.Fatalf("Pending packets not bounded: %d", len(r.pending))
+	}
+
+	frames := fragmentPacket(make([]byte, 100), 1<<30, 60)
+	if _, err := r.add(frames[0][1:], now.Add(2*time.Second)); err != nil {
+		t.Fatalf("Failed to add fragment: %v", err)
+	}
+	if len(r.pending) != 1 {
+		t.Fatalf("Expected stale packets to expire, %d pending", len(r.pending))
+	}
+}
+
+// TestReassemblerRejectsMalformed tests that inconsistent fragments are rejected
+func TestReassemblerRejectsMalformed(t *testing.T) {
+	r := newReassembler(fragmentReassemblyTTL)
+	if _, err := r.add([]byte{0, 0, 0, 1, 3, 2, 0xff}, time.Now()); err == nil {
+		t.Fatalf("Expected error for index beyond count")
+	}
+	if _, err := r.add([]byte{0, 0, 0, 1, 0}, time.Now()); err == nil {
+		t.Fatalf("Expected error for truncated header")
+	}
+}
+
+// TestP2PFragmentReassembly tests that fragments received over P2P are
+// reassembled per peer, so equal fragment IDs of two peers do not mix
+func TestP2PFragmentReassembly(t *testing.T) {
+	receiver := newProbeTestTunnel(t, "p2p-fragment-key")
+	receiver.config.EnableFragmentation = true
+	receiver.recvQueue = make(chan []byte, 2)
+	receiver.p2pReassemblers = make(map[string]*reassembler)
+
+	peers := []net.IP{net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.4")}
+	var packets [][]byte
+	var frames [][][]byte
+	for i := range peers {
+		sender := newProbeTestTunnel(t, "p2p-fragment-key")
+		packet := bytes.Repeat([]byte{byte(i + 1)}, 1500)
+		packets = append(packets, packet)
+		frames = append(frames, sender.buildFragmentFrames(packet, 500))
+	}
+
+	// Interleave the fragments of both peers
+	for j := range frames[0] {
+		for i, peer := range peers {
+			encrypted, err := receiver.encryptPacket(frames[i][j])
+			if err != nil {
+				t.Fatalf("encryptPacket: %v", err)
+			}
+			receiver.handleP2PPacket(peer, encrypted)
+		}
+	}
+
+	if len(receiver.recvQueue) != len(peers) {
+		t.Fatalf("Expected %d reassembled packets, got %d", len(peers), len(receiver.recvQueue))
+	}
+	for i := range peers {
+		if got := <-receiver.recvQueue; !bytes.Equal(got, packets[i]) {
+			t.Errorf("Packet from peer %s was not reassembled intact", peers[i])
+		}
+	}
+
+	receiver.handlePeerDisconnect(peers[0])
+	if _, ok := receiver.p2pReassemblers[peers[0].String()]; ok {
+		t.Errorf("Expected reassembler of disconnected peer to be removed")
+	}
+}
@@ -0,0 +1,302 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// Port hopping. The server listens on every port of hop_ports; the client
+// moves its session to a new fake-TCP connection on another of them, from a
+// new source port, every hop_interval and whenever the server went silent.
+// The first packet on the new connection is a PacketTypeHop carrying a fresh
+// authentication request; the server swaps the connection of the existing
+// ClientConnection, so queues, cipher generation, FEC sessions and routes
+// carry over, and answers with PacketTypeHopResponse on the new connection.
+// Both ends wake the reader of the old connection, which moves on to the new
+// one and leaves the old one to a drain reader that closes it once nothing
+// arrived for hopDrainTime, so packets already in flight are not lost even
+// when the reader falls behind. A connection hopped away from before the
+// reader got to it goes to a drain reader right away.
+const (
+	hopDrainTime  = 2 * time.Second  // Old connection is closed after being idle this long
+	hopRetryDelay = 10 * time.Second // Wait after a failed hop
+	maxHopPorts   = 64               // Largest port range accepted
+)
+
+// ParsePortRange parses a port range like "9000-9015" (or a single port)
+func ParsePortRange(s string) (first, last int, err error) {
+	lo, hi, found := strings.Cut(s, "-")
+	if first, err = strconv.Atoi(strings.TrimSpace(lo)); err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	last = first
+	if found {
+		if last, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+			return 0, 0, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	if first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	if last-first+1 > maxHopPorts {
+		return 0, 0, fmt.Errorf("port range %q has more than %d ports", s, maxHopPorts)
+	}
+	return first, last, nil
+}
+
+// hopEnabled reports whether sessions hop between the ports of hop_ports
+func (t *Tunnel) hopEnabled() bool {
+	return t.config.HopPorts != "" && t.cipher != nil
+}
+
+// startHopListeners listens on the ports of the hop range the main listener
+// does not cover, with every transport mode
+func (t *Tunnel) startHopListeners() error {
+	if !t.hopEnabled() {
+		return nil
+	}
+	first, last, err := ParsePortRange(t.config.HopPorts)
+	if err != nil {
+		return err
+	}
+	host, mainPort, err := net.SplitHostPort(t.config.LocalAddr)
+	if err != nil {
+		return err
+	}
+	for port := first; port <= last; port++ {
+		if strconv.Itoa(port) == mainPort {
+			continue
+		}
+		for _, mode := range t.modes() {
+			l, err := faketcp.ListenWithMode(net.JoinHostPort(host, strconv.Itoa(port)), mode)
+			if err != nil {
+				t.closeExtraListeners()
+				return fmt.Errorf("failed to listen on hop port %d: %v", port, err)
+			}
+			t.extraListeners = append(t.extraListeners, l)
+		}
+	}
+	log.Printf("🔀 Port hopping: listening on ports %d-%d", first, last)
+	return nil
+}
+
+// hopTarget picks a server port of the hop range other than the current one
+func (t *Tunnel) hopTarget(current net.Addr) (string, error) {
+	first, last, err := ParsePortRange(t.config.HopPorts)
+	if err != nil {
+		return "", err
+	}
+	host, _, err := net.SplitHostPort(t.config.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+	port := first + rand.IntN(last-first+1)
+	if _, p, err := net.SplitHostPort(current.String()); err == nil && p == strconv.Itoa(port) && last > first {
+		// Shift to another port, wrapping around within the range
+		port = first + (port-first+1+rand.IntN(last-first))%(last-first+1)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// hopGap returns the time until the next scheduled hop: hop_interval with
+// ±25% jitter, or never if hops only follow stalls
+func (t *Tunnel) hopGap() time.Duration {
+	interval := time.Duration(t.config.HopInterval) * time.Second
+	if interval <= 0 {
+		return 0
+	}
+	return interval*3/4 + time.Duration(rand.Int64N(int64(interval/2)+1))
+}
+
+// hopLoop hops the session on schedule and when the server went silent for
+// two keepalive intervals, which is how throttling shows from the client
+func (t *Tunnel) hopLoop() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	stall := 2 * time.Duration(t.config.KeepaliveInterval) * time.Second
+	var next time.Time
+	if gap := t.hopGap(); gap > 0 {
+		next = time.Now().Add(gap)
+	}
+	lastAttempt := time.Now()
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		t.lastRecvMux.Lock()
+		silent := time.Since(t.lastRecvTime)
+		t.lastRecvMux.Unlock()
+
+		reason := ""
+		switch {
+		case stall > 0 && silent > stall && time.Since(lastAttempt) > stall:
+			reason = fmt.Sprintf("nothing received for %v", silent.Round(time.Second))
+		case !next.IsZero() && time.Now().After(next):
+			reason = "scheduled"
+		default:
+			continue
+		}
+
+		lastAttempt = time.Now()
+		if err := t.hop(reason); err != nil {
+			log.Printf("⚠️  Port hop failed: %v", err)
+			next = time.Now().Add(hopRetryDelay)
+			continue
+		}
+		next = time.Time{}
+		if gap := t.hopGap(); gap > 0 {
+			next = time.Now().Add(gap)
+		}
+	}
+}
+
+// hop moves the session to a new connection on another server port
+func (t *Tunnel) hop(reason string) error {
+	t.connMux.Lock()
+	old := t.conn
+	t.connMux.Unlock()
+	if old == nil {
+		// Reconnecting anyway
+		return nil
+	}
+
+	addr, err := t.hopTarget(old.RemoteAddr())
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(t.config.Timeout) * time.Second
+	conn, err := t.dial(addr, timeout)
+	if err != nil {
+		return err
+	}
+	packet, err := t.buildAuthRequest(PacketTypeHop)
+	if err == nil {
+		err = conn.WritePacket(packet)
+	}
+	var status string
+	if err == nil {
+		status, err = t.readStatus(conn, PacketTypeHopResponse)
+	}
+	if err == nil && status != "OK" {
+		err = fmt.Errorf("rejected by server: %s", status)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	t.connMux.Lock()
+	if t.conn != old {
+		// Reconnected meanwhile; the server follows the newer connection
+		t.connMux.Unlock()
+		conn.Close()
+		return nil
+	}
+	t.conn = conn
+	reading := t.readingConn == old
+	if reading {
+		t.hoppedConn = old
+	}
+	t.connMux.Unlock()
+
+	t.lastRecvMux.Lock()
+	t.lastRecvTime = time.Now()
+	t.lastRecvMux.Unlock()
+	// The new connection may take a different path
+	t.pmtu.trigger()
+	if reading {
+		// Wake the reader so it moves to the new connection and hands old
+		// to a drain reader
+		old.SetReadDeadline(time.Now())
+	} else {
+		// Hopped again before the reader got to old
+		t.drainHopped(old, &t.wg, t.receiveFromServer)
+	}
+
+	log.Printf("🔀 Hopped (%s): %s -> %s", reason, conn.LocalAddr(), conn.RemoteAddr())
+	return nil
+}
+
+// resumeClient moves the session of the client that opened conn with a hop
+// onto conn
+func (t *Tunnel) resumeClient(conn faketcp.ConnAdapter, auth *firstAuth) {
+	ip, _, _ := parseAuthRequest(auth.payload, time.Now())
+	client := t.getClientByIP(ip)
+	if client == nil {
+		log.Printf("Hop from %s for unknown session %s, closing", conn.RemoteAddr(), ip)
+		if reply, err := auth.cipher.Encrypt(append([]byte{PacketTypeHopResponse}, "UNKNOWN"...)); err == nil {
+			conn.WritePacket(reply)
+		}
+		conn.Close()
+		return
+	}
+
+	client.mu.Lock()
+	old := client.conn
+	client.conn = conn
+	reading := client.readingConn == old
+	if reading {
+		client.hoppedConn = old
+	}
+	client.mu.Unlock()
+
+	reply, err := t.encryptForClient(client, []byte{PacketTypeHopResponse, 'O', 'K'})
+	if err == nil {
+		err = conn.WritePacket(reply)
+	}
+	if err != nil {
+		log.Printf("Failed to answer hop from %s: %v", conn.RemoteAddr(), err)
+	}
+	// The new connection may take a different path
+	client.pmtu.trigger()
+	if reading {
+		// Wake the reader so it moves to the new connection and hands old
+		// to a drain reader
+		old.SetReadDeadline(time.Now())
+	} else {
+		// Hopped again before the reader got to old
+		t.drainHopped(old, &client.wg, func(p []byte) bool { return t.receiveFromClient(client, p) })
+	}
+
+	log.Printf("🔀 Client %s hopped: %s -> %s", ip, old.RemoteAddr(), conn.RemoteAddr())
+}
+
+// drainHopped reads a connection the session hopped away from and hands its
+// frames to receive, then closes it once it was idle for hopDrainTime
+func (t *Tunnel) drainHopped(conn faketcp.ConnAdapter, wg *sync.WaitGroup, receive func(packet []byte) bool) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer conn.Close()
+		last := time.Now()
+		for {
+			// Also replaces the deadline that woke the main reader
+			conn.SetReadDeadline(last.Add(hopDrainTime))
+			packet, err := conn.ReadPacket()
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() && time.Since(last) < hopDrainTime {
+					continue
+				}
+				return
+			}
+			last = time.Now()
+			if len(packet) > 0 && !receive(packet) {
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,244 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+func TestParsePortRange(t *testing.T) {
+	if first, last, err := ParsePortRange("9000-9015"); err != nil || first != 9000 || last != 9015 {
+		t.Errorf("ParsePortRange(9000-9015) = %d, %d, %v", first, last, err)
+	}
+	if first, last, err := ParsePortRange("9000"); err != nil || first != 9000 || last != 9000 {
+		t.Errorf("ParsePortRange(9000) = %d, %d, %v", first, last, err)
+	}
+	for _, s := range []string{"", "abc", "9015-9000", "0-5", "65530-65536", "9000-9100"} {
+		if _, _, err := ParsePortRange(s); err == nil {
+			t.Errorf("ParsePortRange(%q) accepted", s)
+		}
+	}
+}
+
+// TestHopTarget tests that hops stay in the range and leave the current port
+func TestHopTarget(t *testing.T) {
+	tun := &Tunnel{config: &config.Config{HopPorts: "9000-9003", RemoteAddr: "192.0.2.1:9000"}}
+	current := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9002}
+	for i := 0; i < 200; i++ {
+		addr, err := tun.hopTarget(current)
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, p, _ := net.SplitHostPort(addr)
+		port, _ := strconv.Atoi(p)
+		if host != "192.0.2.1" || port < 9000 || port > 9003 || port == current.Port {
+			t.Fatalf("hopTarget = %s", addr)
+		}
+	}
+}
+
+// TestCheckFirstAuthHop tests that a hop is admitted only when hopping is
+// configured
+func TestCheckFirstAuthHop(t *testing.T) {
+	server := newProbeTestTunnel(t, "hop-test-key")
+	client := newProbeTestTunnel(t, "hop-test-key")
+	now := time.Now()
+
+	packet, err := client.buildAuthRequest(PacketTypeHop)
+	if err != nil {
+		t.Fatalf("buildAuthRequest: %v", err)
+	}
+	if _, err := server.checkFirstAuth(packet, now); err == nil {
+		t.Errorf("Hop accepted without hop_ports")
+	}
+
+	server.config.HopPorts = "9000-9003"
+	packet, _ = client.buildAuthRequest(PacketTypeHop)
+	auth, err := server.checkFirstAuth(packet, now)
+	if err != nil {
+		t.Fatalf("Valid hop rejected: %v", err)
+	}
+	if !auth.hop {
+		t.Errorf("Hop admitted as a new session")
+	}
+	if ip, _, err := parseAuthRequest(auth.payload, now); err != nil || !ip.Equal(client.myTunnelIP) {
+		t.Errorf("Hop carries %v, %v", ip, err)
+	}
+}
+
+// newHopTestTunnel returns a tunnel over transport with port hopping on ports
+// first and first+1
+func newHopTestTunnel(t *testing.T, mode, transport, tunnelAddr string, first int) *Tunnel {
+	// NewTunnel sets the process-wide transport mode
+	prev := faketcp.GetMode()
+	t.Cleanup(func() { faketcp.SetMode(prev) })
+
+	cfg := config.DefaultConfig()
+	cfg.Mode = mode
+	cfg.Transport = transport
+	cfg.LocalAddr = net.JoinHostPort("127.0.0.1", strconv.Itoa(first))
+	cfg.RemoteAddr = cfg.LocalAddr
+	cfg.TunnelAddr = tunnelAddr
+	cfg.Key = "hop-e2e-key"
+	cfg.HopPorts = fmt.Sprintf("%d-%d", first, first+1)
+	cfg.HopInterval = 0
+	cfg.P2PEnabled = false
+	cfg.EnableMeshRouting = false
+	cfg.EnableXDP = false
+	cfg.EnableKernelTune = false
+	tun, err := NewTunnel(cfg, "")
+	if err != nil {
+		t.Fatalf("NewTunnel: %v", err)
+	}
+	return tun
+}
+
+// testIPPacket builds an IPv4 UDP packet from src to dst carrying seq
+func testIPPacket(src, dst net.IP, seq int) []byte {
+	pkt := make([]byte, IPv4MinHeaderLen+8+4)
+	pkt[0] = 0x45
+	pkt[2], pkt[3] = 0, byte(len(pkt))
+	pkt[8] = 64
+	pkt[9] = 17
+	copy(pkt[12:16], src.To4())
+	copy(pkt[16:20], dst.To4())
+	copy(pkt[IPv4MinHeaderLen+8:], strconv.AppendInt(nil, int64(1000+seq), 10))
+	return pkt
+}
+
+// TestHopEndToEnd tests that a session hops between server ports while
+// packets keep flowing both ways, well before the old connection drained,
+// and that on stream transports packets in flight during a hop are not lost
+func TestHopEndToEnd(t *testing.T) {
+	for _, transport := range []string{TransportUDP, TransportTCP, TransportWS} {
+		t.Run(transport, func(t *testing.T) {
+			testHopEndToEnd(t, transport)
+		})
+	}
+}
+
+func testHopEndToEnd(t *testing.T, transport string) {
+	// Both tunnels are created before either starts, as NewTunnel sets the
+	// process-wide transport settings
+	var server, client *Tunnel
+	var serverTUN *os.File
+	for attempt := 0; server == nil; attempt++ {
+		first := 20000 + rand.IntN(40000)
+		srv := newHopTestTunnel(t, "server", transport, "10.99.0.1/24", first)
+		client = newHopTestTunnel(t, "client", transport, "10.99.0.2/24", first)
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { r.Close(); w.Close() })
+		// Packets from the client end up in the pipe; nothing reads the TUN
+		srv.tunFile = &TunDevice{file: w, fd: int(w.Fd())}
+		if err := srv.startServer(); err != nil {
+			if attempt == 10 {
+				t.Fatalf("startServer: %v", err)
+			}
+			continue
+		}
+		server, serverTUN = srv, r
+	}
+	defer server.Stop()
+
+	if err := client.connectClient(); err != nil {
+		t.Fatalf("connectClient: %v", err)
+	}
+	defer client.Stop()
+	client.wg.Add(2)
+	go client.netReader()
+	go client.netWriter()
+
+	// Packets must cross within a fraction of the drain time
+	const maxDelay = hopDrainTime / 4
+	serverIP, clientIP := net.IPv4(10, 99, 0, 1), net.IPv4(10, 99, 0, 2)
+	seq := 0
+	send := func(stage string) {
+		seq++
+		up := testIPPacket(clientIP, serverIP, seq)
+		client.sendQueue <- up
+		if got := readPipe(serverTUN, maxDelay); !bytes.Equal(got, up) {
+			t.Fatalf("%s: client packet %d not delivered in time (got %d bytes)", stage, seq, len(got))
+		}
+	}
+	// The first packet registers the session's tunnel IP
+	send("first packet")
+	session := server.getClientByIP(clientIP)
+	if session == nil {
+		t.Fatal("Client not registered with the server")
+	}
+	exchange := func(stage string) {
+		send(stage)
+		down := testIPPacket(serverIP, clientIP, seq)
+		session.sendQueue <- down
+		select {
+		case got := <-client.recvQueue:
+			if !bytes.Equal(got, down) {
+				t.Fatalf("%s: server packet %d corrupted", stage, seq)
+			}
+		case <-time.After(maxDelay):
+			t.Fatalf("%s: server packet %d not delivered in time", stage, seq)
+		}
+	}
+
+	exchange("before hopping")
+	for i := 0; i < 3; i++ {
+		before := client.serverConn()
+		if err := client.hop("test"); err != nil {
+			t.Fatalf("hop %d: %v", i, err)
+		}
+		after := client.serverConn()
+		if after == before || session.currentConn().RemoteAddr().String() != after.LocalAddr().String() {
+			t.Fatalf("hop %d: session not moved to the new connection", i)
+		}
+		for j := 0; j < 3; j++ {
+			exchange(fmt.Sprintf("after hop %d", i))
+		}
+	}
+
+	if transport == TransportUDP {
+		// Datagrams may be lost under load anyway
+		return
+	}
+
+	// Hop while the server streams large packets, so that the client's
+	// reader is woken in the middle of one
+	const flowPackets = 1000
+	go func() {
+		for k := 0; k < flowPackets; k++ {
+			down := append(testIPPacket(serverIP, clientIP, 5000+k), make([]byte, 1000)...)
+			select {
+			case session.sendQueue <- down:
+			case <-time.After(5 * time.Second):
+				return
+			}
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if err := client.hop("test"); err != nil {
+			t.Fatalf("hop with traffic %d: %v", i, err)
+		}
+	}
+	received := make(map[string]bool)
+	timeout := time.After(10 * time.Second)
+	for len(received) < flowPackets {
+		select {
+		case got := <-client.recvQueue:
+			received[string(got[IPv4MinHeaderLen+8:IPv4MinHeaderLen+12])] = true
+		case <-timeout:
+			t.Fatalf("Only %d of %d packets sent during hops arrived", len(received), flowPackets)
+		}
+	}
+	exchange("after hopping with traffic")
+}
@@ -0,0 +1,312 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"runtime"
+)
+
+// ICMP feedback for oversized inner packets. When a packet read from the TUN
+// device does not fit into the tunnel MTU and may not be fragmented, the
+// tunnel answers like a router would: ICMP "fragmentation needed" (type 3
+// code 4) for IPv4 and ICMPv6 "packet too big" for IPv6, carrying the
+// next-hop MTU, so the sender's PMTUD converges instead of blackholing.
+const (
+	IPv6Version      = 6
+	IPv6HeaderLen    = 40
+	ipv4MinMTU       = 576  // Minimum MTU every IPv4 host must accept
+	ipv6MinMTU       = 1280 // Minimum IPv6 link MTU
+	icmpHeaderLen    = 8
+	ipv4FlagDF       = 0x4000
+	protoICMP        = 1
+	protoTCP         = 6
+	protoUDP         = 17
+	protoICMPv6      = 58
+	tcpOptionMSS     = 2
+	darwinAFInet6    = 30 // AF_INET6 on macOS utun devices
+	tcpFlagSYN       = 0x02
+	tcpMinHeaderLen  = 20
+	tcpIPv4Overhead  = 40 // IPv4 + TCP headers without options
+	tcpIPv6Overhead  = 60 // IPv6 + TCP headers without options
+	maxICMPQuoteIPv4 = ipv4MinMTU - IPv4MinHeaderLen - icmpHeaderLen
+	maxICMPQuoteIPv6 = ipv6MinMTU - IPv6HeaderLen - icmpHeaderLen
+)
+
+// packetTooBig reports whether an inner packet exceeds mtu and must not be
+// fragmented (DF set for IPv4; always for IPv6).
+func packetTooBig(packet []byte, mtu int) bool {
+	if len(packet) <= mtu || len(packet) < 1 {
+		return false
+	}
+	switch packet[0] >> 4 {
+	case IPv4Version:
+		if len(packet) < IPv4MinHeaderLen {
+			return false
+		}
+		return binary.BigEndian.Uint16(packet[6:8])&ipv4FlagDF != 0
+	case IPv6Version:
+		return len(packet) >= IPv6HeaderLen
+	}
+	return false
+}
+
+// buildFragNeeded builds an IPv4 ICMP "fragmentation needed" error for the
+// original packet, sent from the original destination back to its source.
+// Returns nil for packets that must not trigger ICMP errors.
+func buildFragNeeded(orig []byte, mtu int) []byte {
+	if len(orig) < IPv4MinHeaderLen {
+		return nil
+	}
+	ihl := int(orig[0]&0x0f) * 4
+	if ihl < IPv4MinHeaderLen || len(orig) < ihl {
+		return nil
+	}
+	// Never answer ICMP errors or non-first fragments (RFC 1122 3.2.2)
+	if binary.BigEndian.Uint16(orig[6:8])&0x1fff != 0 {
+		return nil
+	}
+	if orig[9] == protoICMP && len(orig) > ihl && isICMPError(orig[ihl]) {
+		return nil
+	}
+
+	quote := orig
+	if len(quote) > maxICMPQuoteIPv4 {
+		quote = quote[:maxICMPQuoteIPv4]
+	}
+
+	total := IPv4MinHeaderLen + icmpHeaderLen + len(quote)
+	pkt := make([]byte, total)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(total))
+	pkt[8] = 64 // TTL
+	pkt[9] = protoICMP
+	copy(pkt[12:16], orig[16:20]) // src = original destination
+	copy(pkt[16:20], orig[12:16]) // dst = original source
+	binary.BigEndian.PutUint16(pkt[10:12], internetChecksum(pkt[:IPv4MinHeaderLen], 0))
+
+	icmp := pkt[IPv4MinHeaderLen:]
+	icmp[0] = 3 // Destination unreachable
+	icmp[1] = 4 // Fragmentation needed and DF set
+	binary.BigEndian.PutUint16(icmp[6:8], uint16(mtu))
+	copy(icmp[icmpHeaderLen:], quote)
+	binary.BigEndian.PutUint16(icmp[2:4], internetChecksum(icmp, 0))
+	return pkt
+}
+
+// buildPacketTooBig builds an ICMPv6 "packet too big" error for the original
+// IPv6 packet. The reported MTU is never below the IPv6 minimum of 1280.
+func buildPacketTooBig(orig []byte, mtu int) []byte {
+	if len(orig) < IPv6HeaderLen {
+		return nil
+	}
+	// Do not answer ICMPv6 errors (RFC 4443 2.4); extension headers are not walked
+	if orig[6] == protoICMPv6 && len(orig) > IPv6HeaderLen && orig[IPv6HeaderLen] < 128 {
+		return nil
+	}
+	if mtu < ipv6MinMTU {
+		mtu = ipv6MinMTU
+	}
+
+	quote := orig
+	if len(quote) > maxICMPQuoteIPv6 {
+		quote = quote[:maxICMPQuoteIPv6]
+	}
+
+	payloadLen := icmpHeaderLen + len(quote)
+	pkt := make([]byte, IPv6HeaderLen+payloadLen)
+	pkt[0] = 0x60
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(payloadLen))
+	pkt[6] = protoICMPv6
+	pkt[7] = 64                  // Hop limit
+	copy(pkt[8:24], orig[24:40]) // src = original destination
+	copy(pkt[24:40], orig[8:24]) // dst = original source
+
+	icmp := pkt[IPv6HeaderLen:]
+	icmp[0] = 2 // Packet too big
+	icmp[1] = 0
+	binary.BigEndian.PutUint32(icmp[4:8], uint32(mtu))
+	copy(icmp[icmpHeaderLen:], quote)
+
+	// Checksum covers the IPv6 pseudo-header
+	var pseudo [40]byte
+	copy(pseudo[0:32], pkt[8:40])
+	binary.BigEndian.PutUint32(pseudo[32:36], uint32(payloadLen))
+	pseudo[39] = protoICMPv6
+	sum := checksumAdd(pseudo[:], 0)
+	binary.BigEndian.PutUint16(icmp[2:4], internetChecksum(icmp, sum))
+	return pkt
+}
+
+func isICMPError(icmpType byte) bool {
+	switch icmpType {
+	case 3, 4, 5, 11, 12:
+		return true
+	}
+	return false
+}
+
+// checksumAdd accumulates data into a one's complement sum.
+func checksumAdd(data []byte, sum uint32) uint32 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	return sum
+}
+
+// internetChecksum returns the RFC 1071 checksum of data plus an initial sum.
+func internetChecksum(data []byte, initial uint32) uint16 {
+	sum := checksumAdd(data, initial)
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// checksumUpdate16 incrementally updates a checksum after a 16-bit field
+// changed from old to new (RFC 1624, eqn. 3).
+func checksumUpdate16(check, old, new uint16) uint16 {
+	sum := uint32(^check) + uint32(^old) + uint32(new)
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// clampTCPMSS lowers the MSS option of a TCP SYN (or SYN-ACK) inside an IPv4 or
+// IPv6 packet so segments fit into mtu, fixing the TCP checksum incrementally.
+// Returns true if the packet was modified.
+func clampTCPMSS(packet []byte, mtu int) bool {
+	if len(packet) < 1 {
+		return false
+	}
+	var tcp []byte
+	var maxMSS int
+	switch packet[0] >> 4 {
+	case IPv4Version:
+		if len(packet) < IPv4MinHeaderLen || packet[9] != protoTCP {
+			return false
+		}
+		// Only the first fragment carries the TCP header
+		if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+			return false
+		}
+		ihl := int(packet[0]&0x0f) * 4
+		if ihl < IPv4MinHeaderLen || len(packet) < ihl+tcpMinHeaderLen {
+			return false
+		}
+		tcp = packet[ihl:]
+		maxMSS = mtu - tcpIPv4Overhead
+	case IPv6Version:
+		// Extension headers are not walked; TCP must directly follow the fixed header
+		if len(packet) < IPv6HeaderLen+tcpMinHeaderLen || packet[6] != protoTCP {
+			return false
+		}
+		tcp = packet[IPv6HeaderLen:]
+		maxMSS = mtu - tcpIPv6Overhead
+	default:
+		return false
+	}
+
+	if tcp[13]&tcpFlagSYN == 0 || maxMSS <= 0 {
+		return false
+	}
+	dataOff := int(tcp[12]>>4) * 4
+	if dataOff <= tcpMinHeaderLen || len(tcp) < dataOff {
+		return false
+	}
+
+	opts := tcp[tcpMinHeaderLen:dataOff]
+	for i := 0; i < len(opts); {
+		kind := opts[i]
+		if kind == 0 { // End of options
+			break
+		}
+		if kind == 1 { // NOP
+			i++
+			continue
+		}
+		if i+1 >= len(opts) {
+			break
+		}
+		optLen := int(opts[i+1])
+		if optLen < 2 || i+optLen > len(opts) {
+			break
+		}
+		if kind == tcpOptionMSS && optLen == 4 {
+			mss := binary.BigEndian.Uint16(opts[i+2:])
+			if int(mss) <= maxMSS {
+				return false
+			}
+			binary.BigEndian.PutUint16(opts[i+2:], uint16(maxMSS))
+			check := binary.BigEndian.Uint16(tcp[16:18])
+			binary.BigEndian.PutUint16(tcp[16:18], checksumUpdate16(check, mss, uint16(maxMSS)))
+			return true
+		}
+		i += optLen
+	}
+	return false
+}
+
+// replyPacketTooBig writes an ICMP "fragmentation needed"/"packet too big"
+// error back into the TUN device when packet exceeds mtu and may not be
+// fragmented. Returns true if the packet must be dropped.
+func (t *Tunnel) replyPacketTooBig(packet []byte, mtu int) bool {
+	if !t.config.ICMPFeedback || t.config.EnableFragmentation || t.isTAP() || !packetTooBig(packet, mtu) {
+		return false
+	}
+
+	var reply []byte
+	if packet[0]>>4 == IPv4Version {
+		reply = buildFragNeeded(packet, mtu)
+	} else {
+		reply = buildPacketTooBig(packet, mtu)
+	}
+	if reply != nil {
+		if err := t.writeTUNPacket(reply); err != nil {
+			log.Printf("⚠️  Failed to write ICMP packet-too-big to TUN: %v", err)
+		}
+	}
+	return true
+}
+
+// clampMSS applies MSS clamping to a packet when enabled. Ethernet frames in
+// TAP mode are left untouched.
+func (t *Tunnel) clampMSS(packet []byte, mtu int) {
+	if t.config.MSSClamp && !t.isTAP() {
+		clampTCPMSS(packet, mtu)
+	}
+}
+
+// writeTUNPacket writes a locally generated IP packet to the TUN device,
+// adding the protocol family header required by macOS utun devices.
+func (t *Tunnel) writeTUNPacket(packet []byte) error {
+	if runtime.GOOS == "darwin" {
+		af := byte(2) // AF_INET
+		if packet[0]>>4 == IPv6Version {
+			af = darwinAFInet6
+		}
+		writePacket := make([]byte, 4+len(packet))
+		writePacket[3] = af
+		copy(writePacket[4:], packet)
+		packet = writePacket
+	}
+	_, err := t.tunQueueFor(packet).Write(packet)
+	return err
+}
+
+// clientPathMTU returns the tunnel MTU towards the client that owns dstIP
+// (server mode).
+func (t *Tunnel) clientPathMTU(dstIP net.IP) int {
+	client := t.getClientByIP(dstIP)
+	if client == nil {
+		client = t.findRouteClient(dstIP)
+	}
+	if client == nil {
+		return t.config.MTU
+	}
+	return t.pathMTU(client.pmtu)
+}
@@ -0,0 +1,127 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// buildTestSYN builds an IPv4 TCP SYN with an MSS option and valid checksums
+func buildTestSYN(mss uint16, size int) []byte {
+	pkt := make([]byte, size)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(size))
+	binary.BigEndian.PutUint16(pkt[6:8], ipv4FlagDF)
+	pkt[8] = 64
+	pkt[9] = protoTCP
+	copy(pkt[12:16], []byte{10, 0, 0, 2})
+	copy(pkt[16:20], []byte{192, 168, 1, 10})
+	binary.BigEndian.PutUint16(pkt[10:12], internetChecksum(pkt[:20], 0))
+
+	tcp := pkt[20:]
+	binary.BigEndian.PutUint16(tcp[0:2], 40000)
+	binary.BigEndian.PutUint16(tcp[2:4], 443)
+	tcp[12] = 6 << 4 // 24-byte header with MSS option
+	tcp[13] = tcpFlagSYN
+	tcp[20] = tcpOptionMSS
+	tcp[21] = 4
+	binary.BigEndian.PutUint16(tcp[22:24], mss)
+	binary.BigEndian.PutUint16(tcp[16:18], tcpChecksum(pkt))
+	return pkt
+}
+
+// tcpChecksum computes the full TCP checksum of an IPv4 packet
+func tcpChecksum(pkt []byte) uint16 {
+	tcp := pkt[20:]
+	var pseudo [12]byte
+	copy(pseudo[0:8], pkt[12:20])
+	pseudo[9] = protoTCP
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(tcp)))
+	saved := binary.BigEndian.Uint16(tcp[16:18])
+	binary.BigEndian.PutUint16(tcp[16:18], 0)
+	sum := internetChecksum(tcp, checksumAdd(pseudo[:], 0))
+	binary.BigEndian.PutUint16(tcp[16:18], saved)
+	return sum
+}
+
+// TestFragNeededIsValid tests that the generated ICMP error is addressed back
+// to the sender with the next-hop MTU and valid checksums
+func TestFragNeededIsValid(t *testing.T) {
+	orig := buildTestSYN(1460, 1500)
+	if !packetTooBig(orig, 1400) {
+		t.Fatalf("Expected DF packet of 1500 bytes to be too big for MTU 1400")
+	}
+
+	reply := buildFragNeeded(orig, 1400)
+	if reply == nil {
+		t.Fatalf("Expected ICMP reply")
+	}
+	if internetChecksum(reply[:20], 0) != 0 {
+		t.Errorf("Invalid IP header checksum")
+	}
+	if internetChecksum(reply[20:], 0) != 0 {
+		t.Errorf("Invalid ICMP checksum")
+	}
+	if string(reply[16:20]) != string(orig[12:16]) || string(reply[12:16]) != string(orig[16:20]) {
+		t.Errorf("ICMP reply not addressed back to the sender")
+	}
+	if reply[20] != 3 || reply[21] != 4 || binary.BigEndian.Uint16(reply[26:28]) != 1400 {
+		t.Errorf("Unexpected ICMP header: type=%d code=%d mtu=%d", reply[20], reply[21], binary.BigEndian.Uint16(reply[26:28]))
+	}
+	if len(reply) > ipv4MinMTU {
+		t.Errorf("ICMP reply too large: %d", len(reply))
+	}
+
+	// Without DF the packet may be fragmented downstream
+	binary.BigEndian.PutUint16(orig[6:8], 0)
+	if packetTooBig(orig, 1400) {
+		t.Errorf("Packet without DF should not be reported as too big")
+	}
+}
+
+// TestPacketTooBigIPv6 tests the ICMPv6 checksum and minimum MTU
+func TestPacketTooBigIPv6(t *testing.T) {
+	orig := make([]byte, 1500)
+	orig[0] = 0x60
+	orig[6] = protoTCP
+	orig[8] = 0xfd
+	orig[24] = 0xfd
+	orig[39] = 1
+
+	reply := buildPacketTooBig(orig, 1000)
+	if reply == nil {
+		t.Fatalf("Expected ICMPv6 reply")
+	}
+	if got := binary.BigEndian.Uint32(reply[44:48]); got != ipv6MinMTU {
+		t.Errorf("Expected MTU clamped to %d, got %d", ipv6MinMTU, got)
+	}
+	var pseudo [40]byte
+	copy(pseudo[0:32], reply[8:40])
+	binary.BigEndian.PutUint32(pseudo[32:36], uint32(len(reply)-IPv6HeaderLen))
+	pseudo[39] = protoICMPv6
+	if internetChecksum(reply[IPv6HeaderLen:], checksumAdd(pseudo[:], 0)) != 0 {
+		t.Errorf("Invalid ICMPv6 checksum")
+	}
+	if len(reply) > ipv6MinMTU {
+		t.Errorf("ICMPv6 reply too large: %d", len(reply))
+	}
+}
+
+// TestClampTCPMSS tests that the MSS is lowered with a correct checksum and
+// that smaller MSS values are left alone
+func TestClampTCPMSS(t *testing.T) {
+	pkt := buildTestSYN(1460, 44)
+	if !clampTCPMSS(pkt, 1300) {
+		t.Fatalf("Expected MSS to be clamped")
+	}
+	if mss := binary.BigEndian.Uint16(pkt[42:44]); mss != 1260 {
+		t.Errorf("Expected MSS 1260, got %d", mss)
+	}
+	if got, want := binary.BigEndian.Uint16(pkt[36:38]), tcpChecksum(pkt); got != want {
+		t.Errorf("Checksum mismatch after clamp: got 0x%04x, want 0x%04x", got, want)
+	}
+
+	small := buildTestSYN(1200, 44)
+	if clampTCPMSS(small, 1300) {
+		t.Errorf("MSS below the limit should not be modified")
+	}
+}
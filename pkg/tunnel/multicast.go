@@ -0,0 +1,292 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// Multicast and broadcast forwarding. With enable_multicast the server
+// replicates IPv4 multicast and broadcast packets to the other clients (and
+// to its own TUN device) so service discovery such as mDNS and SSDP works
+// across the overlay. With igmp_snooping, routable multicast groups are only
+// sent to clients that joined them; the server acts as IGMP querier so
+// memberships are refreshed and expire when a client stops answering.
+const (
+	protoIGMP = 2
+
+	igmpQuery    = 0x11
+	igmpV1Report = 0x12
+	igmpV2Report = 0x16
+	igmpV2Leave  = 0x17
+	igmpV3Report = 0x22
+
+	igmpV3ModeIsInclude   = 1
+	igmpV3ChangeToInclude = 3
+
+	igmpQueryInterval      = 125 * time.Second // RFC 3376 default query interval
+	igmpQueryResponseTime  = 10 * time.Second  // Max response time advertised in queries
+	igmpMembershipInterval = 260 * time.Second // Query interval * robustness (2) + response time
+	maxMulticastGroups     = 1024              // Bound on tracked groups; further joins are ignored
+)
+
+var igmpAllHosts = net.IPv4(224, 0, 0, 1).To4()
+
+// isLinkLocalMulticast reports whether ip is in 224.0.0.0/24, which is always
+// flooded regardless of snooping state (RFC 4541 2.1.2).
+func isLinkLocalMulticast(ip net.IP) bool {
+	ip4 := ip.To4()
+	return ip4 != nil && ip4[0] == 224 && ip4[1] == 0 && ip4[2] == 0
+}
+
+// directedBroadcast returns the broadcast address of an IPv4 CIDR, or nil.
+func directedBroadcast(cidr string) net.IP {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil
+	}
+	ip4 := ipNet.IP.To4()
+	if ip4 == nil || len(ipNet.Mask) != net.IPv4len {
+		return nil
+	}
+	bcast := make(net.IP, net.IPv4len)
+	for i := range ip4 {
+		bcast[i] = ip4[i] | ^ipNet.Mask[i]
+	}
+	return bcast
+}
+
+// multicastGroups tracks which clients joined which IPv4 multicast groups.
+type multicastGroups struct {
+	mu      sync.RWMutex
+	members map[[4]byte]map[*ClientConnection]time.Time
+	ttl     time.Duration
+}
+
+func newMulticastGroups(ttl time.Duration) *multicastGroups {
+	return &multicastGroups{
+		members: make(map[[4]byte]map[*ClientConnection]time.Time),
+		ttl:     ttl,
+	}
+}
+
+func (g *multicastGroups) join(group [4]byte, client *ClientConnection, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	clients := g.members[group]
+	if clients == nil {
+		if len(g.members) >= maxMulticastGroups {
+			return
+		}
+		clients = make(map[*ClientConnection]time.Time)
+		g.members[group] = clients
+	}
+	clients[client] = now
+}
+
+func (g *multicastGroups) leave(group [4]byte, client *ClientConnection) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if clients := g.members[group]; clients != nil {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(g.members, group)
+		}
+	}
+}
+
+// removeClient drops all memberships of a disconnected client.
+func (g *multicastGroups) removeClient(client *ClientConnection) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for group, clients := range g.members {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(g.members, group)
+		}
+	}
+}
+
+// subscribers returns the clients with a live membership in group.
+func (g *multicastGroups) subscribers(group [4]byte, now time.Time) []*ClientConnection {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	clients := g.members[group]
+	result := make([]*ClientConnection, 0, len(clients))
+	for client, seen := range clients {
+		if now.Sub(seen) <= g.ttl {
+			result = append(result, client)
+		}
+	}
+	return result
+}
+
+// expire removes memberships that were not refreshed in time.
+func (g *multicastGroups) expire(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for group, clients := range g.members {
+		for client, seen := range clients {
+			if now.Sub(seen) > g.ttl {
+				delete(clients, client)
+			}
+		}
+		if len(clients) == 0 {
+			delete(g.members, group)
+		}
+	}
+}
+
+// parseIGMPMembership extracts the groups joined and left by an IGMP
+// membership report or leave message inside an IPv4 packet.
+func parseIGMPMembership(packet []byte) (joins, leaves [][4]byte) {
+	if len(packet) < IPv4MinHeaderLen || packet[0]>>4 != IPv4Version || packet[9] != protoIGMP {
+		return nil, nil
+	}
+	ihl := int(packet[0]&0x0f) * 4
+	if ihl < IPv4MinHeaderLen || len(packet) < ihl+8 {
+		return nil, nil
+	}
+	igmp := packet[ihl:]
+
+	var group [4]byte
+	switch igmp[0] {
+	case igmpV1Report, igmpV2Report:
+		copy(group[:], igmp[4:8])
+		joins = append(joins, group)
+	case igmpV2Leave:
+		copy(group[:], igmp[4:8])
+		leaves = append(leaves, group)
+	case igmpV3Report:
+		numRecords := int(binary.BigEndian.Uint16(igmp[6:8]))
+		rec := igmp[8:]
+		for i := 0; i < numRecords && len(rec) >= 8; i++ {
+			recordType := rec[0]
+			auxLen := int(rec[1]) * 4
+			numSources := int(binary.BigEndian.Uint16(rec[2:4]))
+			copy(group[:], rec[4:8])
+			// INCLUDE with an empty source list means the host left the group
+			if (recordType == igmpV3ModeIsInclude || recordType == igmpV3ChangeToInclude) && numSources == 0 {
+				leaves = append(leaves, group)
+			} else {
+				joins = append(joins, group)
+			}
+			next := 8 + numSources*4 + auxLen
+			if next > len(rec) {
+				break
+			}
+			rec = rec[next:]
+		}
+	}
+	return joins, leaves
+}
+
+// buildIGMPQuery builds an IGMPv2 general query from src to 224.0.0.1 with
+// TTL 1 and the Router Alert option.
+func buildIGMPQuery(src net.IP) []byte {
+	const ihl = IPv4MinHeaderLen + 4 // Router Alert option
+	pkt := make([]byte, ihl+8)
+	pkt[0] = 0x40 | ihl/4
+	pkt[1] = 0xc0 // Internetwork control
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 1 // TTL
+	pkt[9] = protoIGMP
+	copy(pkt[12:16], src.To4())
+	copy(pkt[16:20], igmpAllHosts)
+	copy(pkt[20:24], []byte{0x94, 0x04, 0x00, 0x00})
+	binary.BigEndian.PutUint16(pkt[10:12], internetChecksum(pkt[:ihl], 0))
+
+	igmp := pkt[ihl:]
+	igmp[0] = igmpQuery
+	igmp[1] = byte(igmpQueryResponseTime / (100 * time.Millisecond))
+	binary.BigEndian.PutUint16(igmp[2:4], internetChecksum(igmp, 0))
+	return pkt
+}
+
+// isMulticastOrBroadcast reports whether dstIP is an IPv4 multicast, limited
+// broadcast or tunnel subnet broadcast address.
+func (t *Tunnel) isMulticastOrBroadcast(dstIP net.IP) bool {
+	if dstIP.IsMulticast() || dstIP.Equal(net.IPv4bcast) {
+		return true
+	}
+	return t.tunnelBroadcast != nil && dstIP.Equal(t.tunnelBroadcast)
+}
+
+// multicastTargets returns the clients a multicast or broadcast packet must
+// be replicated to, excluding the sender.
+func (t *Tunnel) multicastTargets(dstIP net.IP, from *ClientConnection) []*ClientConnection {
+	var candidates []*ClientConnection
+	if t.mcastGroups != nil && dstIP.IsMulticast() && !isLinkLocalMulticast(dstIP) {
+		var group [4]byte
+		copy(group[:], dstIP.To4())
+		candidates = t.mcastGroups.subscribers(group, time.Now())
+	} else {
+		t.clientsMux.RLock()
+		candidates = make([]*ClientConnection, 0, len(t.clients))
+		for _, client := range t.clients {
+			candidates = append(candidates, client)
+		}
+		t.clientsMux.RUnlock()
+	}
+
+	targets := candidates[:0]
+	for _, client := range candidates {
+		if client != from {
+			targets = append(targets, client)
+		}
+	}
+	return targets
+}
+
+// replicateToClients copies a multicast or broadcast packet to every target
+// client (server mode). Clients whose send queue is full miss the packet
+// rather than delaying it for the others.
+func (t *Tunnel) replicateToClients(packet []byte, dstIP net.IP, from *ClientConnection) {
+	for _, client := range t.multicastTargets(dstIP, from) {
+		t.offerFrameToClient(client, packet)
+	}
+}
+
+// snoopIGMP updates group memberships from an IGMP message sent by a client.
+func (t *Tunnel) snoopIGMP(client *ClientConnection, packet []byte) {
+	if t.mcastGroups == nil {
+		return
+	}
+	joins, leaves := parseIGMPMembership(packet)
+	now := time.Now()
+	for _, group := range joins {
+		t.mcastGroups.join(group, client, now)
+	}
+	for _, group := range leaves {
+		t.mcastGroups.leave(group, client)
+	}
+}
+
+// igmpQuerierLoop periodically sends IGMP general queries to all clients so
+// their memberships are refreshed, and expires stale memberships.
+func (t *Tunnel) igmpQuerierLoop() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(igmpQueryInterval)
+	defer ticker.Stop()
+
+	query := buildIGMPQuery(t.myTunnelIP)
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case now := <-ticker.C:
+			t.mcastGroups.expire(now)
+			t.clientsMux.RLock()
+			clients := make([]*ClientConnection, 0, len(t.clients))
+			for _, client := range t.clients {
+				clients = append(clients, client)
+			}
+			t.clientsMux.RUnlock()
+			for _, client := range clients {
+				t.queueFrameToClient(client, query)
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+)
+
+// buildTestIGMP wraps an IGMP message into a minimal IPv4 packet
+func buildTestIGMP(igmp []byte) []byte {
+	pkt := make([]byte, IPv4MinHeaderLen+len(igmp))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 1
+	pkt[9] = protoIGMP
+	copy(pkt[IPv4MinHeaderLen:], igmp)
+	return pkt
+}
+
+// TestParseIGMPMembership tests IGMPv2 joins/leaves and IGMPv3 group records
+func TestParseIGMPMembership(t *testing.T) {
+	mdns := [4]byte{224, 0, 0, 251}
+	ssdp := [4]byte{239, 255, 255, 250}
+
+	joins, _ := parseIGMPMembership(buildTestIGMP([]byte{igmpV2Report, 0, 0, 0, 239, 255, 255, 250}))
+	if len(joins) != 1 || joins[0] != ssdp {
+		t.Fatalf("Unexpected IGMPv2 joins: %v", joins)
+	}
+	_, leaves := parseIGMPMembership(buildTestIGMP([]byte{igmpV2Leave, 0, 0, 0, 239, 255, 255, 250}))
+	if len(leaves) != 1 || leaves[0] != ssdp {
+		t.Fatalf("Unexpected IGMPv2 leaves: %v", leaves)
+	}
+
+	// IGMPv3: EXCLUDE {} for mDNS (join), TO_IN {} for SSDP (leave)
+	v3 := []byte{igmpV3Report, 0, 0, 0, 0, 0, 0, 2,
+		4, 0, 0, 0, 224, 0, 0, 251,
+		igmpV3ChangeToInclude, 0, 0, 0, 239, 255, 255, 250}
+	joins, leaves = parseIGMPMembership(buildTestIGMP(v3))
+	if len(joins) != 1 || joins[0] != mdns || len(leaves) != 1 || leaves[0] != ssdp {
+		t.Fatalf("Unexpected IGMPv3 result: joins=%v leaves=%v", joins, leaves)
+	}
+}
+
+// TestMulticastGroupsSubscribers tests membership expiry and removal
+func TestMulticastGroupsSubscribers(t *testing.T) {
+	g := newMulticastGroups(time.Minute)
+	a, b := &ClientConnection{}, &ClientConnection{}
+	group := [4]byte{239, 1, 2, 3}
+	now := time.Now()
+
+	g.join(group, a, now)
+	g.join(group, b, now.Add(-2*time.Minute))
+	if subs := g.subscribers(group, now); len(subs) != 1 || subs[0] != a {
+		t.Fatalf("Expected only the fresh member, got %v", subs)
+	}
+	g.expire(now)
+	g.removeClient(a)
+	if len(g.members) != 0 {
+		t.Fatalf("Expected no groups left, got %d", len(g.members))
+	}
+}
+
+// TestIGMPQueryAndBroadcast tests the generated general query and the
+// directed broadcast computation
+func TestIGMPQueryAndBroadcast(t *testing.T) {
+	query := buildIGMPQuery(net.IPv4(10, 0, 0, 1))
+	ihl := int(query[0]&0x0f) * 4
+	if internetChecksum(query[:ihl], 0) != 0 || internetChecksum(query[ihl:], 0) != 0 {
+		t.Errorf("Invalid IGMP query checksums")
+	}
+	if query[8] != 1 || query[ihl] != igmpQuery {
+		t.Errorf("Unexpected query TTL %d or type 0x%02x", query[8], query[ihl])
+	}
+
+	if got := directedBroadcast("10.0.0.2/24"); !got.Equal(net.IPv4(10, 0, 0, 255)) {
+		t.Errorf("Unexpected broadcast address %s", got)
+	}
+}
+
+// TestReplicateToClientsFullQueue tests that a broadcast is dropped for a
+// client whose send queue is full and still reaches the others
+func TestReplicateToClientsFullQueue(t *testing.T) {
+	newClient := func(port int) *ClientConnection {
+		return &ClientConnection{
+			conn:      addrConn{addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port}},
+			sendQueue: make(chan []byte, 1),
+			stopCh:    make(chan struct{}),
+		}
+	}
+	stalled, idle := newClient(1000), newClient(1001)
+	stalled.sendQueue <- []byte{0}
+	tun := &Tunnel{
+		config:  &config.Config{MTU: 1400},
+		clients: map[string]*ClientConnection{"10.0.0.2": stalled, "10.0.0.3": idle},
+	}
+
+	start := time.Now()
+	tun.replicateToClients([]byte{1, 2, 3}, net.IPv4bcast, nil)
+	if elapsed := time.Since(start); elapsed >= QueueSendTimeout {
+		t.Errorf("Expected replication not to wait for the full queue, took %v", elapsed)
+	}
+	if got := atomic.LoadUint64(&tun.fanoutDrops); got != 1 {
+		t.Errorf("Expected 1 dropped packet, got %d", got)
+	}
+	if len(idle.sendQueue) != 1 {
+		t.Fatalf("Expected the idle client to receive the broadcast")
+	}
+}
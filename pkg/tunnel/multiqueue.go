@@ -0,0 +1,137 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"log"
+	"runtime"
+)
+
+// TUN multi-queue support. With tun_queues > 1 the device is created with
+// IFF_MULTI_QUEUE and one reader goroutine runs per queue. The kernel picks
+// the queue for each outgoing flow by its hash, and packets written into the
+// device are spread over the queues by the same kind of flow hash, so every
+// flow stays on one queue and keeps its order. The queues feed one writer per
+// connection, which hands the frames to the crypto pipeline, started with a
+// worker per queue unless crypto_workers says otherwise.
+const maxTunQueues = 64
+
+// tunQueueCount returns the number of TUN queues to open.
+func (t *Tunnel) tunQueueCount() int {
+	n := t.config.TunQueues
+	if n <= 1 {
+		return 1
+	}
+	if runtime.GOOS != "linux" {
+		log.Printf("⚠️  Multi-queue TUN is only supported on Linux, using a single queue")
+		return 1
+	}
+	if n > maxTunQueues {
+		n = maxTunQueues
+	}
+	return n
+}
+
+// createDevice creates the TUN or TAP device according to the configuration
+// and returns all of its queues.
+func (t *Tunnel) createDevice(name string) ([]*TunDevice, error) {
+	n := t.tunQueueCount()
+	if t.config.TunOffload && !t.isTAP() {
+		devs, err := CreateTUNOffload(name, n)
+		if err == nil {
+			log.Printf("✅ TUN offloads enabled (checksum, TSO/GSO, GRO)")
+			return devs, nil
+		}
+		log.Printf("⚠️  Failed to enable TUN offloads (%v), continuing without", err)
+	}
+	if n > 1 {
+		return CreateMultiQueue(name, t.isTAP(), n)
+	}
+
+	var dev *TunDevice
+	var err error
+	if t.isTAP() {
+		dev, err = CreateTAP(name)
+	} else {
+		dev, err = CreateTUN(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []*TunDevice{dev}, nil
+}
+
+// startTUNReaders starts one reader goroutine per TUN queue.
+func (t *Tunnel) startTUNReaders(reader func(dev *TunDevice)) {
+	for _, dev := range t.tunQueues {
+		t.wg.Add(1)
+		go reader(dev)
+	}
+}
+
+// closeTUN closes every queue of the TUN device.
+func (t *Tunnel) closeTUN() {
+	for _, dev := range t.tunQueues {
+		if err := dev.Close(); err != nil {
+			log.Printf("Error closing TUN device: %v", err)
+		}
+	}
+}
+
+// tunQueueFor returns the queue a packet should be written to.
+func (t *Tunnel) tunQueueFor(packet []byte) *TunDevice {
+	if len(t.tunQueues) <= 1 {
+		return t.tunFile
+	}
+	return t.tunQueues[flowHash(packet, t.isTAP())%uint32(len(t.tunQueues))]
+}
+
+// flowHash hashes the flow identity of an inner packet: addresses, protocol
+// and, for unfragmented TCP/UDP, the ports. Ethernet frames are hashed by
+// their MAC addresses.
+func flowHash(packet []byte, tap bool) uint32 {
+	const (
+		fnvOffset = 2166136261
+		fnvPrime  = 16777619
+	)
+	h := uint32(fnvOffset)
+	mix := func(b []byte) {
+		for _, c := range b {
+			h ^= uint32(c)
+			h *= fnvPrime
+		}
+	}
+
+	if tap {
+		if len(packet) >= ethHeaderLen {
+			mix(packet[0:12])
+		}
+		return h
+	}
+	if len(packet) < 1 {
+		return h
+	}
+
+	switch packet[0] >> 4 {
+	case IPv4Version:
+		if len(packet) < IPv4MinHeaderLen {
+			return h
+		}
+		mix(packet[12:20])
+		mix(packet[9:10])
+		ihl := int(packet[0]&0x0f) * 4
+		fragmented := binary.BigEndian.Uint16(packet[6:8])&0x3fff != 0
+		if !fragmented && (packet[9] == protoTCP || packet[9] == protoUDP) && len(packet) >= ihl+4 {
+			mix(packet[ihl : ihl+4])
+		}
+	case IPv6Version:
+		if len(packet) < IPv6HeaderLen {
+			return h
+		}
+		mix(packet[8:40])
+		mix(packet[6:7])
+		if (packet[6] == protoTCP || packet[6] == protoUDP) && len(packet) >= IPv6HeaderLen+4 {
+			mix(packet[IPv6HeaderLen : IPv6HeaderLen+4])
+		}
+	}
+	return h
+}
@@ -0,0 +1,43 @@
+package tunnel
+
+import "testing"
+
+// TestFlowHashStableAndSpread tests that packets of one flow always hash to
+// the same value while different flows are spread
+func TestFlowHashStableAndSpread(t *testing.T) {
+	a := buildTestSYN(1460, 44)
+	b := buildTestSYN(1460, 44)
+	b[43] = 0xfe // Only the MSS option differs
+	if flowHash(a, false) != flowHash(b, false) {
+		t.Fatalf("Packets of the same flow hashed differently")
+	}
+
+	seen := make(map[uint32]bool)
+	for port := 0; port < 64; port++ {
+		p := buildTestSYN(1460, 44)
+		p[21] = byte(port) // source port low byte
+		seen[flowHash(p, false)%8] = true
+	}
+	if len(seen) < 4 {
+		t.Errorf("Flows poorly spread over 8 queues: %d used", len(seen))
+	}
+}
+
+// TestCryptoWorkersPerQueue tests that several TUN queues get a crypto worker
+// each unless the number of workers is configured
+func TestCryptoWorkersPerQueue(t *testing.T) {
+	tun := newProbeTestTunnel(t, "test-key")
+	tun.tunQueues = make([]*TunDevice, 4)
+	if n := tun.cryptoWorkerCount(); n != 4 {
+		t.Fatalf("Expected 4 crypto workers for 4 queues, got %d", n)
+	}
+	tun.config.CryptoWorkers = 2
+	if n := tun.cryptoWorkerCount(); n != 2 {
+		t.Fatalf("Expected the configured 2 crypto workers, got %d", n)
+	}
+	tun.config.CryptoWorkers = 0
+	tun.tunQueues = tun.tunQueues[:1]
+	if n := tun.cryptoWorkerCount(); n != 0 {
+		t.Fatalf("Expected inline crypto with one queue, got %d workers", n)
+	}
+}
@@ -0,0 +1,512 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"syscall"
+	"time"
+)
+
+// TUN offloads. With tun_offload the device is opened with IFF_VNET_HDR and
+// checksum/TSO offloads, so a bulk TCP sender hands the tunnel one GSO
+// super-packet (up to 64KB) per read instead of one packet per MTU. The
+// tunnel splits super-packets into MTU-sized segments itself, which the
+// batching writer then packs into as few frames as possible. In the other
+// direction, consecutive in-order TCP segments of one flow are coalesced
+// into a single GRO packet before being written to the TUN device.
+//
+// In server mode, a client's segments are held until the batch would make a
+// full GRO packet or for groFlushDelay after the first one, whichever comes
+// first, so coalescing spans as many reads as a burst takes.
+const (
+	virtioNetHdrLen = 10 // struct virtio_net_hdr (without num_buffers)
+
+	virtioNetHdrFNeedsCsum = 0x01
+
+	virtioNetHdrGSONone  = 0
+	virtioNetHdrGSOTCPv4 = 1
+	virtioNetHdrGSOTCPv6 = 4
+	virtioNetHdrGSOECN   = 0x80
+
+	maxGSOSize    = 65535 // Largest super-packet the kernel hands over
+	maxGROPackets = 64    // Max segments coalesced into one GRO packet
+
+	groFlushDelay   = time.Millisecond // Longest a segment waits for coalescing
+	tunWriteRetries = 5                // Writes retried on ENOBUFS, with exponential backoff
+
+	tcpFlagFIN = 0x01
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+	tcpFlagCWR = 0x80
+)
+
+var errInvalidGSO = errors.New("invalid GSO packet")
+
+// virtioNetHdr is the header preceding every packet on an IFF_VNET_HDR device.
+// Fields are in host byte order; all supported platforms are little-endian.
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func (h *virtioNetHdr) decode(b []byte) error {
+	if len(b) < virtioNetHdrLen {
+		return errInvalidGSO
+	}
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = binary.LittleEndian.Uint16(b[2:4])
+	h.gsoSize = binary.LittleEndian.Uint16(b[4:6])
+	h.csumStart = binary.LittleEndian.Uint16(b[6:8])
+	h.csumOffset = binary.LittleEndian.Uint16(b[8:10])
+	return nil
+}
+
+func (h *virtioNetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	binary.LittleEndian.PutUint16(b[2:4], h.hdrLen)
+	binary.LittleEndian.PutUint16(b[4:6], h.gsoSize)
+	binary.LittleEndian.PutUint16(b[6:8], h.csumStart)
+	binary.LittleEndian.PutUint16(b[8:10], h.csumOffset)
+}
+
+// pseudoHeaderSum returns the unfolded one's complement sum of the IPv4 or
+// IPv6 pseudo-header for an upper-layer packet of the given length.
+func pseudoHeaderSum(packet []byte, proto byte, length int) uint32 {
+	if packet[0]>>4 == IPv6Version {
+		var pseudo [40]byte
+		copy(pseudo[0:32], packet[8:40])
+		binary.BigEndian.PutUint32(pseudo[32:36], uint32(length))
+		pseudo[39] = proto
+		return checksumAdd(pseudo[:], 0)
+	}
+	var pseudo [12]byte
+	copy(pseudo[0:8], packet[12:20])
+	pseudo[9] = proto
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(length))
+	return checksumAdd(pseudo[:], 0)
+}
+
+// foldChecksum folds a one's complement sum to 16 bits without inverting it.
+func foldChecksum(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return uint16(sum)
+}
+
+// tcpSegment describes a TCP packet inside an IPv4 or IPv6 packet.
+type tcpSegment struct {
+	pkt     []byte
+	ipHdr   int // IP header length
+	tcpHdr  int // TCP header length
+	seq     uint32
+	flags   byte
+	payload int
+}
+
+// parseTCPSegment parses an unfragmented TCP packet. IPv6 extension headers
+// are not walked.
+func parseTCPSegment(pkt []byte) (tcpSegment, bool) {
+	seg := tcpSegment{pkt: pkt}
+	if len(pkt) < 1 {
+		return seg, false
+	}
+	switch pkt[0] >> 4 {
+	case IPv4Version:
+		if len(pkt) < IPv4MinHeaderLen || pkt[9] != protoTCP {
+			return seg, false
+		}
+		if binary.BigEndian.Uint16(pkt[6:8])&0x3fff != 0 { // MF or fragment offset
+			return seg, false
+		}
+		seg.ipHdr = int(pkt[0]&0x0f) * 4
+		if seg.ipHdr < IPv4MinHeaderLen || int(binary.BigEndian.Uint16(pkt[2:4])) != len(pkt) {
+			return seg, false
+		}
+	case IPv6Version:
+		if len(pkt) < IPv6HeaderLen || pkt[6] != protoTCP {
+			return seg, false
+		}
+		seg.ipHdr = IPv6HeaderLen
+		if int(binary.BigEndian.Uint16(pkt[4:6]))+IPv6HeaderLen != len(pkt) {
+			return seg, false
+		}
+	default:
+		return seg, false
+	}
+	if len(pkt) < seg.ipHdr+tcpMinHeaderLen {
+		return seg, false
+	}
+	tcp := pkt[seg.ipHdr:]
+	seg.tcpHdr = int(tcp[12]>>4) * 4
+	if seg.tcpHdr < tcpMinHeaderLen || len(tcp) < seg.tcpHdr {
+		return seg, false
+	}
+	seg.seq = binary.BigEndian.Uint32(tcp[4:8])
+	seg.flags = tcp[13]
+	seg.payload = len(tcp) - seg.tcpHdr
+	return seg, true
+}
+
+// splitOffloaded handles one read from an offload-enabled TUN device: it
+// completes partial checksums and splits GSO super-packets into segments of
+// at most gso_size payload, passing each resulting packet to emit. scratch
+// must be large enough for one segment. Returns false if emit did.
+func (t *Tunnel) splitOffloaded(frame, scratch []byte, emit func([]byte) bool) bool {
+	var hdr virtioNetHdr
+	if err := hdr.decode(frame); err != nil {
+		return true
+	}
+	pkt := frame[virtioNetHdrLen:]
+
+	if hdr.gsoType == virtioNetHdrGSONone {
+		if hdr.flags&virtioNetHdrFNeedsCsum != 0 {
+			if err := completeChecksum(pkt, hdr); err != nil {
+				log.Printf("⚠️  Dropping TUN packet: %v", err)
+				return true
+			}
+		}
+		return emit(pkt)
+	}
+
+	ok, err := gsoSplit(pkt, hdr, scratch, emit)
+	if err != nil {
+		log.Printf("⚠️  Dropping GSO packet from TUN: %v", err)
+	}
+	return ok
+}
+
+// completeChecksum fills in a partial (CHECKSUM_PARTIAL) checksum: the field
+// at csum_start+csum_offset already holds the pseudo-header sum.
+func completeChecksum(pkt []byte, hdr virtioNetHdr) error {
+	start := int(hdr.csumStart)
+	field := start + int(hdr.csumOffset)
+	if start >= len(pkt) || field+2 > len(pkt) {
+		return fmt.Errorf("checksum offset %d/%d out of range", start, hdr.csumOffset)
+	}
+	binary.BigEndian.PutUint16(pkt[field:], internetChecksum(pkt[start:], 0))
+	return nil
+}
+
+// gsoSplit segments a TCP GSO super-packet the way the kernel would: headers
+// are replicated, IPv4 IDs incremented, sequence numbers advanced, FIN/PSH
+// kept only on the last and CWR only on the first segment, and all
+// checksums recomputed.
+func gsoSplit(pkt []byte, hdr virtioNetHdr, scratch []byte, emit func([]byte) bool) (bool, error) {
+	gsoType := hdr.gsoType &^ virtioNetHdrGSOECN
+	if gsoType != virtioNetHdrGSOTCPv4 && gsoType != virtioNetHdrGSOTCPv6 {
+		return true, fmt.Errorf("unsupported GSO type %d", hdr.gsoType)
+	}
+	if hdr.gsoSize == 0 || len(pkt) < 1 {
+		return true, errInvalidGSO
+	}
+
+	v6 := pkt[0]>>4 == IPv6Version
+	var ipHdr int
+	if v6 {
+		if len(pkt) < IPv6HeaderLen || pkt[6] != protoTCP {
+			return true, errInvalidGSO
+		}
+		ipHdr = IPv6HeaderLen
+	} else {
+		if len(pkt) < IPv4MinHeaderLen || pkt[9] != protoTCP {
+			return true, errInvalidGSO
+		}
+		ipHdr = int(pkt[0]&0x0f) * 4
+	}
+	if len(pkt) < ipHdr+tcpMinHeaderLen {
+		return true, errInvalidGSO
+	}
+	tcpHdr := int(pkt[ipHdr+12]>>4) * 4
+	hdrLen := ipHdr + tcpHdr
+	if tcpHdr < tcpMinHeaderLen || len(pkt) < hdrLen {
+		return true, errInvalidGSO
+	}
+
+	payload := pkt[hdrLen:]
+	mss := int(hdr.gsoSize)
+	if hdrLen+mss > len(scratch) {
+		return true, fmt.Errorf("segment size %d exceeds buffer", hdrLen+mss)
+	}
+	firstSeq := binary.BigEndian.Uint32(pkt[ipHdr+4 : ipHdr+8])
+	firstID := binary.BigEndian.Uint16(pkt[4:6])
+	flags := pkt[ipHdr+13]
+
+	for i, off := 0, 0; ; i++ {
+		end := off + mss
+		if end > len(payload) {
+			end = len(payload)
+		}
+		segLen := end - off
+		seg := scratch[:hdrLen+segLen]
+		copy(seg, pkt[:hdrLen])
+		copy(seg[hdrLen:], payload[off:end])
+
+		if v6 {
+			binary.BigEndian.PutUint16(seg[4:6], uint16(tcpHdr+segLen))
+		} else {
+			binary.BigEndian.PutUint16(seg[2:4], uint16(len(seg)))
+			binary.BigEndian.PutUint16(seg[4:6], firstID+uint16(i))
+			seg[10], seg[11] = 0, 0
+			binary.BigEndian.PutUint16(seg[10:12], internetChecksum(seg[:ipHdr], 0))
+		}
+
+		tcp := seg[ipHdr:]
+		binary.BigEndian.PutUint32(tcp[4:8], firstSeq+uint32(off))
+		segFlags := flags
+		if end < len(payload) {
+			segFlags &^= tcpFlagFIN | tcpFlagPSH
+		}
+		if i > 0 {
+			segFlags &^= tcpFlagCWR
+		}
+		tcp[13] = segFlags
+		tcp[16], tcp[17] = 0, 0
+		sum := pseudoHeaderSum(seg, protoTCP, len(tcp))
+		binary.BigEndian.PutUint16(tcp[16:18], internetChecksum(tcp, sum))
+
+		if !emit(seg) {
+			return false, nil
+		}
+		if end == len(payload) {
+			break
+		}
+		off = end
+	}
+	return true, nil
+}
+
+// canCoalesce reports whether next continues the GRO run that starts with
+// head and currently ends with prev.
+func canCoalesce(head, prev, next tcpSegment, total int) bool {
+	if next.payload == 0 || next.payload > head.payload || prev.payload != head.payload {
+		return false
+	}
+	if next.ipHdr != head.ipHdr || next.tcpHdr != head.tcpHdr || total+next.payload > maxGSOSize {
+		return false
+	}
+	// Only plain ACK segments (the last one may carry PSH) are merged
+	if prev.flags != tcpFlagACK || (next.flags != tcpFlagACK && next.flags != tcpFlagACK|tcpFlagPSH) {
+		return false
+	}
+	if next.seq != prev.seq+uint32(prev.payload) {
+		return false
+	}
+
+	h, n := head.pkt, next.pkt
+	if h[0]>>4 != n[0]>>4 {
+		return false
+	}
+	if h[0]>>4 == IPv6Version {
+		// Traffic class/flow label, hop limit and addresses
+		if string(h[0:4]) != string(n[0:4]) || h[7] != n[7] || string(h[8:40]) != string(n[8:40]) {
+			return false
+		}
+	} else {
+		// TOS, DF, TTL, addresses and IP options
+		if h[1] != n[1] || h[6]&0x40 != n[6]&0x40 || h[8] != n[8] ||
+			string(h[12:head.ipHdr]) != string(n[12:next.ipHdr]) {
+			return false
+		}
+	}
+	ht, nt := h[head.ipHdr:], n[next.ipHdr:]
+	// Ports, ack number and TCP options must match exactly
+	return string(ht[0:4]) == string(nt[0:4]) && string(ht[8:12]) == string(nt[8:12]) &&
+		string(ht[tcpMinHeaderLen:head.tcpHdr]) == string(nt[tcpMinHeaderLen:next.tcpHdr])
+}
+
+// writeGRO writes packets to the TUN device, coalescing runs of in-order TCP
+// segments of the same flow into GRO super-packets. Packets are written in
+// their original order.
+func (t *Tunnel) writeGRO(packets [][]byte) error {
+	var firstErr error
+	for i := 0; i < len(packets); {
+		run := 1
+		head, ok := parseTCPSegment(packets[i])
+		total := 0
+		if ok && head.payload > 0 && (head.flags == tcpFlagACK || head.flags == tcpFlagACK|tcpFlagPSH) {
+			total = len(packets[i])
+			prev := head
+			for i+run < len(packets) && run < maxGROPackets && prev.flags == tcpFlagACK {
+				next, ok := parseTCPSegment(packets[i+run])
+				if !ok || !canCoalesce(head, prev, next, total) {
+					break
+				}
+				total += next.payload
+				prev = next
+				run++
+			}
+		}
+
+		var err error
+		if run == 1 {
+			err = tunWriteRetry(func() error {
+				_, err := t.tunQueueFor(packets[i]).Write(packets[i])
+				return err
+			})
+		} else {
+			err = t.writeCoalesced(head, packets[i+1:i+run], total)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		i += run
+	}
+	return firstErr
+}
+
+// writeCoalesced builds one GRO packet from head followed by the payloads of
+// rest and writes it with a GSO virtio-net header.
+func (t *Tunnel) writeCoalesced(head tcpSegment, rest [][]byte, total int) error {
+	hdrLen := head.ipHdr + head.tcpHdr
+	pkt := make([]byte, total)
+	copy(pkt, head.pkt)
+	off := len(head.pkt)
+	for _, p := range rest {
+		off += copy(pkt[off:], p[hdrLen:])
+	}
+
+	last := rest[len(rest)-1]
+	gsoType := uint8(virtioNetHdrGSOTCPv4)
+	if pkt[0]>>4 == IPv6Version {
+		gsoType = virtioNetHdrGSOTCPv6
+		binary.BigEndian.PutUint16(pkt[4:6], uint16(total-IPv6HeaderLen))
+	} else {
+		binary.BigEndian.PutUint16(pkt[2:4], uint16(total))
+		pkt[10], pkt[11] = 0, 0
+		binary.BigEndian.PutUint16(pkt[10:12], internetChecksum(pkt[:head.ipHdr], 0))
+	}
+
+	tcp := pkt[head.ipHdr:]
+	tcp[13] |= last[head.ipHdr+13] & tcpFlagPSH
+	copy(tcp[14:16], last[head.ipHdr+14:head.ipHdr+16]) // Latest window
+	// Partial checksum: the field holds the pseudo-header sum, the kernel
+	// (or the receiving stack) completes it over the TCP segment
+	binary.BigEndian.PutUint16(tcp[16:18], foldChecksum(pseudoHeaderSum(pkt, protoTCP, len(tcp))))
+
+	vh := virtioNetHdr{
+		flags:      virtioNetHdrFNeedsCsum,
+		gsoType:    gsoType,
+		hdrLen:     uint16(hdrLen),
+		gsoSize:    uint16(head.payload),
+		csumStart:  uint16(head.ipHdr),
+		csumOffset: 16,
+	}
+	var hdr [virtioNetHdrLen]byte
+	vh.encode(hdr[:])
+	dev := t.tunQueueFor(pkt)
+	return tunWriteRetry(func() error {
+		_, err := dev.WriteGSO(hdr[:], pkt)
+		return err
+	})
+}
+
+// tunWriteRetry runs a TUN write, retrying while the device is out of buffer
+// space (ENOBUFS) with exponential backoff
+func tunWriteRetry(write func() error) error {
+	delay := time.Millisecond
+	var err error
+	for retry := 0; retry < tunWriteRetries; retry++ {
+		if err = write(); !errors.Is(err, syscall.ENOBUFS) {
+			return err
+		}
+		if retry < tunWriteRetries-1 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return err
+}
+
+// tunWriteGRO collects the packets already waiting in the receive queue
+// behind first and writes them with GRO coalescing (client mode). batch is
+// reused between calls. Returns false when the writer should exit.
+func (t *Tunnel) tunWriteGRO(first []byte, batch [][]byte) ([][]byte, bool) {
+	batch = append(batch, first)
+collect:
+	for len(batch) < maxGROPackets {
+		select {
+		case packet := <-t.recvQueue:
+			batch = append(batch, packet)
+		default:
+			break collect
+		}
+	}
+
+	mtu := t.pathMTU(t.pmtu)
+	for _, packet := range batch {
+		t.clampMSS(packet, mtu)
+	}
+	if err := t.writeGRO(batch); err != nil {
+		select {
+		case <-t.stopCh:
+			return batch, false
+		default:
+		}
+		if errors.Is(err, syscall.EBADF) {
+			return batch, false
+		}
+		log.Printf("TUN write error: %v", err)
+	}
+	return batch, true
+}
+
+// queueClientGRO defers a packet from a client for coalescing (server mode).
+// A batch holding a full GRO packet is written right away, so steady load
+// does not hold it back; otherwise the batch is written groFlushDelay after
+// its first packet. Returns false when the reader should exit.
+func (t *Tunnel) queueClientGRO(client *ClientConnection, packet []byte) bool {
+	client.groMu.Lock()
+	defer client.groMu.Unlock()
+	client.groBatch = append(client.groBatch, packet)
+	client.groBytes += len(packet)
+	if len(client.groBatch) >= maxGROPackets || client.groBytes >= maxGSOSize {
+		return t.flushClientGROLocked(client)
+	}
+	if len(client.groBatch) == 1 {
+		if client.groTimer == nil {
+			client.groTimer = time.AfterFunc(groFlushDelay, func() { t.flushClientGRO(client) })
+		} else {
+			client.groTimer.Reset(groFlushDelay)
+		}
+	}
+	return true
+}
+
+// flushClientGRO writes the packets deferred for coalescing from a client
+// (server mode). Returns false when the reader should exit.
+func (t *Tunnel) flushClientGRO(client *ClientConnection) bool {
+	client.groMu.Lock()
+	defer client.groMu.Unlock()
+	return t.flushClientGROLocked(client)
+}
+
+func (t *Tunnel) flushClientGROLocked(client *ClientConnection) bool {
+	if len(client.groBatch) == 0 {
+		return true
+	}
+	if client.groTimer != nil {
+		client.groTimer.Stop()
+	}
+	err := t.writeGRO(client.groBatch)
+	for i := range client.groBatch {
+		client.groBatch[i] = nil
+	}
+	client.groBatch = client.groBatch[:0]
+	client.groBytes = 0
+	if err != nil {
+		if errors.Is(err, syscall.EBADF) {
+			return false
+		}
+		log.Printf("TUN write error: %v", err)
+	}
+	return true
+}
@@ -0,0 +1,156 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+)
+
+// buildTestTCP builds an IPv4 TCP packet with the given payload size and flags
+func buildTestTCP(seq uint32, payload int, flags byte) []byte {
+	pkt := make([]byte, IPv4MinHeaderLen+tcpMinHeaderLen+payload)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(pkt[6:8], ipv4FlagDF)
+	pkt[8] = 64
+	pkt[9] = protoTCP
+	copy(pkt[12:16], []byte{10, 0, 0, 2})
+	copy(pkt[16:20], []byte{10, 0, 0, 3})
+	binary.BigEndian.PutUint16(pkt[10:12], internetChecksum(pkt[:20], 0))
+
+	tcp := pkt[20:]
+	binary.BigEndian.PutUint16(tcp[0:2], 40000)
+	binary.BigEndian.PutUint16(tcp[2:4], 5201)
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	for i := tcpMinHeaderLen; i < len(tcp); i++ {
+		tcp[i] = byte(i)
+	}
+	binary.BigEndian.PutUint16(tcp[16:18], tcpChecksum(pkt))
+	return pkt
+}
+
+// TestGSOSplit tests that a TCP super-packet is split into valid segments
+func TestGSOSplit(t *testing.T) {
+	super := buildTestTCP(1000, 2500, tcpFlagACK|tcpFlagPSH)
+	hdr := virtioNetHdr{gsoType: virtioNetHdrGSOTCPv4, gsoSize: 1000}
+
+	var segs [][]byte
+	ok, err := gsoSplit(super, hdr, make([]byte, maxGSOSize), func(seg []byte) bool {
+		segs = append(segs, append([]byte(nil), seg...))
+		return true
+	})
+	if !ok || err != nil {
+		t.Fatalf("gsoSplit failed: %v", err)
+	}
+	if len(segs) != 3 {
+		t.Fatalf("Expected 3 segments, got %d", len(segs))
+	}
+
+	for i, seg := range segs {
+		if internetChecksum(seg[:20], 0) != 0 {
+			t.Errorf("Segment %d: invalid IP checksum", i)
+		}
+		if got := binary.BigEndian.Uint16(seg[36:38]); got != tcpChecksum(seg) {
+			t.Errorf("Segment %d: invalid TCP checksum", i)
+		}
+		if seq := binary.BigEndian.Uint32(seg[24:28]); seq != 1000+uint32(i*1000) {
+			t.Errorf("Segment %d: unexpected seq %d", i, seq)
+		}
+		if psh := seg[33]&tcpFlagPSH != 0; psh != (i == 2) {
+			t.Errorf("Segment %d: PSH=%v", i, psh)
+		}
+	}
+	if len(segs[2]) != 40+500 {
+		t.Errorf("Unexpected last segment size %d", len(segs[2]))
+	}
+}
+
+// TestCanCoalesce tests which consecutive segments may be merged for GRO
+func TestCanCoalesce(t *testing.T) {
+	head, _ := parseTCPSegment(buildTestTCP(0, 1000, tcpFlagACK))
+	next, _ := parseTCPSegment(buildTestTCP(1000, 1000, tcpFlagACK|tcpFlagPSH))
+	if !canCoalesce(head, head, next, len(head.pkt)) {
+		t.Fatalf("Expected in-order segment to coalesce")
+	}
+
+	gap, _ := parseTCPSegment(buildTestTCP(3000, 1000, tcpFlagACK))
+	if canCoalesce(head, head, gap, len(head.pkt)) {
+		t.Errorf("Out-of-order segment must not coalesce")
+	}
+	larger, _ := parseTCPSegment(buildTestTCP(1000, 1200, tcpFlagACK))
+	if canCoalesce(head, head, larger, len(head.pkt)) {
+		t.Errorf("Segment larger than the first must not coalesce")
+	}
+	fin, _ := parseTCPSegment(buildTestTCP(1000, 1000, tcpFlagACK|tcpFlagFIN))
+	if canCoalesce(head, head, fin, len(head.pkt)) {
+		t.Errorf("FIN segment must not coalesce")
+	}
+}
+
+// newPipeTun returns a TUN device with offloads that writes into a pipe
+func newPipeTun(t *testing.T) (*TunDevice, *os.File) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close(); w.Close() })
+	return &TunDevice{file: w, fd: int(w.Fd()), vnetHdr: true}, r
+}
+
+// readPipe returns the next write to the pipe, or nil if none arrives in time
+func readPipe(r *os.File, timeout time.Duration) []byte {
+	r.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, maxGSOSize+virtioNetHdrLen)
+	n, err := r.Read(buf)
+	if err != nil {
+		return nil
+	}
+	return buf[:n]
+}
+
+// TestClientGROCap tests that a full batch is written without waiting for
+// the flush delay
+func TestClientGROCap(t *testing.T) {
+	dev, r := newPipeTun(t)
+	tun := &Tunnel{tunFile: dev}
+	client := &ClientConnection{}
+
+	for i := 0; i < maxGROPackets; i++ {
+		tun.queueClientGRO(client, buildTestTCP(uint32(i*100), 100, tcpFlagACK))
+	}
+	client.groMu.Lock()
+	pending := len(client.groBatch) + client.groBytes
+	client.groMu.Unlock()
+	if pending != 0 {
+		t.Fatalf("Full batch not written at once")
+	}
+	got := readPipe(r, time.Second)
+	if want := virtioNetHdrLen + IPv4MinHeaderLen + tcpMinHeaderLen + maxGROPackets*100; len(got) != want {
+		t.Fatalf("Wrote %d bytes, want one GRO packet of %d", len(got), want)
+	}
+}
+
+// TestClientGROFlushDelay tests that a partial batch is coalesced and written
+// once its first packet waited the flush delay, with no further reads
+func TestClientGROFlushDelay(t *testing.T) {
+	dev, r := newPipeTun(t)
+	tun := &Tunnel{tunFile: dev}
+	client := &ClientConnection{}
+
+	for i := 0; i < 3; i++ {
+		tun.queueClientGRO(client, buildTestTCP(uint32(i*100), 100, tcpFlagACK))
+	}
+	got := readPipe(r, time.Second)
+	if want := virtioNetHdrLen + IPv4MinHeaderLen + tcpMinHeaderLen + 3*100; len(got) != want {
+		t.Fatalf("Wrote %d bytes, want one GRO packet of %d", len(got), want)
+	}
+
+	// The timer is reused for the next batch
+	tun.queueClientGRO(client, buildTestTCP(300, 100, tcpFlagACK))
+	if got := readPipe(r, time.Second); len(got) != virtioNetHdrLen+IPv4MinHeaderLen+tcpMinHeaderLen+100 {
+		t.Fatalf("Second batch not written, got %d bytes", len(got))
+	}
+}
@@ -0,0 +1,246 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+)
+
+// Padded container format (inside the encryption, replacing the frame):
+//
+//	[PacketTypePadded][len:2][frame][zeros]
+//
+// The peer strips the container right after decryption, so everything above
+// the cipher sees the original frame. The padding policy picks the container
+// size; cover traffic is a padded keepalive sent while the link is idle.
+const (
+	paddingHeaderLen = 1 + 2 // type + inner length
+
+	// Padding policies
+	PaddingOff    = "off"
+	PaddingRandom = "random" // Add 0-paddingRandomMax random bytes
+	PaddingBucket = "bucket" // Round up to the next of paddingBuckets
+	PaddingCell   = "cell"   // Pad every frame to the full MTU
+
+	paddingRandomMax     = 256
+	paddingStatsInterval = 5 * time.Minute
+)
+
+// paddingBuckets are the container sizes of the bucket policy below the MTU
+var paddingBuckets = []int{64, 128, 256, 512, 1024}
+
+var errInvalidPadding = errors.New("malformed padded frame")
+
+// paddingOverhead returns the room the padding policy needs in each frame
+func paddingOverhead(policy string) int {
+	if policy == "" || policy == PaddingOff {
+		return 0
+	}
+	return paddingHeaderLen
+}
+
+// paddedSize returns the container size policy picks for a frame of n bytes,
+// at most limit
+func paddedSize(policy string, n, limit int) int {
+	size := n + paddingHeaderLen
+	switch policy {
+	case PaddingRandom:
+		size += rand.IntN(paddingRandomMax + 1)
+	case PaddingBucket:
+		size = limit
+		for _, b := range paddingBuckets {
+			if b >= n+paddingHeaderLen {
+				size = b
+				break
+			}
+		}
+	case PaddingCell:
+		size = limit
+	}
+	if size > limit {
+		size = limit
+	}
+	return size
+}
+
+// padFrame wraps frame in a container of size bytes (zero padded)
+func padFrame(frame []byte, size int) []byte {
+	if size < len(frame)+paddingHeaderLen {
+		size = len(frame) + paddingHeaderLen
+	}
+	out := make([]byte, size)
+	out[0] = PacketTypePadded
+	binary.BigEndian.PutUint16(out[1:3], uint16(len(frame)))
+	copy(out[paddingHeaderLen:], frame)
+	return out
+}
+
+// unpadFrame returns the frame inside a padded container, and any other
+// frame unchanged
+func unpadFrame(plain []byte) ([]byte, error) {
+	if len(plain) < 1 || plain[0] != PacketTypePadded {
+		return plain, nil
+	}
+	if len(plain) < paddingHeaderLen {
+		return nil, errInvalidPadding
+	}
+	n := int(binary.BigEndian.Uint16(plain[1:3]))
+	if n < 1 || paddingHeaderLen+n > len(plain) {
+		return nil, errInvalidPadding
+	}
+	return plain[paddingHeaderLen : paddingHeaderLen+n], nil
+}
+
+// padForPeer applies the padding policy to a frame about to be encrypted
+// for a peer whose current MTU is mtu. PMTU probes keep their exact size.
+func (t *Tunnel) padForPeer(frame []byte, mtu int) []byte {
+	policy := t.config.Padding
+	pad := paddingOverhead(policy) > 0
+	// Cover frames are padded and counted when they are built
+	if len(frame) < 1 || frame[0] == PacketTypePadded || (!pad && t.coverInterval() == 0) {
+		return frame
+	}
+	atomic.AddUint64(&t.padStats.frames, 1)
+	atomic.AddUint64(&t.padStats.payloadBytes, uint64(len(frame)))
+
+	limit := mtu + 1 + paddingHeaderLen
+	if !pad || frame[0] == PacketTypePMTUProbe || frame[0] == PacketTypePMTUAck || len(frame)+paddingHeaderLen > limit {
+		return frame
+	}
+	padded := padFrame(frame, paddedSize(policy, len(frame), limit))
+	atomic.AddUint64(&t.padStats.paddingBytes, uint64(len(padded)-len(frame)))
+	return padded
+}
+
+// coverFrame builds a keepalive padded to a random size a data frame could
+// have, rounded like the padding policy rounds data frames
+func (t *Tunnel) coverFrame(mtu int) []byte {
+	limit := mtu + 1 + paddingOverhead(t.config.Padding)
+	n := 1 + IPv4MinHeaderLen + rand.IntN(mtu-IPv4MinHeaderLen+1)
+	size := n
+	if t.config.Padding != PaddingRandom {
+		size = paddedSize(t.config.Padding, n, limit)
+	}
+	if size > limit {
+		size = limit
+	}
+	frame := padFrame([]byte{PacketTypeKeepalive}, size)
+	atomic.AddUint64(&t.padStats.coverFrames, 1)
+	atomic.AddUint64(&t.padStats.coverBytes, uint64(len(frame)))
+	return frame
+}
+
+// coverInterval returns the mean idle gap between cover frames, 0 if disabled
+func (t *Tunnel) coverInterval() time.Duration {
+	if t.cipher == nil {
+		return 0
+	}
+	return time.Duration(t.config.CoverTraffic) * time.Millisecond
+}
+
+// coverTimer fires after a random idle gap: exponentially distributed around
+// the mean, so cover frames do not form a regular beat. A nil coverTimer
+// never fires.
+type coverTimer struct {
+	mean  time.Duration
+	timer *time.Timer
+}
+
+func newCoverTimer(mean time.Duration) *coverTimer {
+	if mean <= 0 {
+		return nil
+	}
+	c := &coverTimer{mean: mean}
+	c.timer = time.NewTimer(c.gap())
+	return c
+}
+
+func (c *coverTimer) gap() time.Duration {
+	gap := time.Duration(rand.ExpFloat64() * float64(c.mean))
+	if gap > 10*c.mean {
+		gap = 10 * c.mean
+	}
+	return gap
+}
+
+// C returns the channel the timer fires on
+func (c *coverTimer) C() <-chan time.Time {
+	if c == nil {
+		return nil
+	}
+	return c.timer.C
+}
+
+// reset starts a new idle gap, after real traffic or a cover frame
+func (c *coverTimer) reset() {
+	if c != nil {
+		c.timer.Reset(c.gap())
+	}
+}
+
+func (c *coverTimer) stop() {
+	if c != nil {
+		c.timer.Stop()
+	}
+}
+
+// PaddingStats counts what padding and cover traffic cost
+type PaddingStats struct {
+	Frames       uint64 // Frames sent, cover frames not included
+	PayloadBytes uint64 // Bytes of those frames
+	PaddingBytes uint64 // Bytes padding added to them, container headers included
+	CoverFrames  uint64 // Cover frames sent
+	CoverBytes   uint64 // Bytes of cover frames
+}
+
+// Overhead returns the bytes added for every byte of payload
+func (s PaddingStats) Overhead() float64 {
+	if s.PayloadBytes == 0 {
+		return 0
+	}
+	return float64(s.PaddingBytes+s.CoverBytes) / float64(s.PayloadBytes)
+}
+
+// paddingCounters are the counters of PaddingStats, updated atomically
+type paddingCounters struct {
+	frames, payloadBytes, paddingBytes, coverFrames, coverBytes uint64
+}
+
+// PaddingStats returns the padding and cover traffic counters
+func (t *Tunnel) PaddingStats() PaddingStats {
+	c := &t.padStats
+	return PaddingStats{
+		Frames:       atomic.LoadUint64(&c.frames),
+		PayloadBytes: atomic.LoadUint64(&c.payloadBytes),
+		PaddingBytes: atomic.LoadUint64(&c.paddingBytes),
+		CoverFrames:  atomic.LoadUint64(&c.coverFrames),
+		CoverBytes:   atomic.LoadUint64(&c.coverBytes),
+	}
+}
+
+// paddingStatsLoop logs the padding overhead while traffic flows
+func (t *Tunnel) paddingStatsLoop() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(paddingStatsInterval)
+	defer ticker.Stop()
+
+	var last PaddingStats
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case <-ticker.C:
+			s := t.PaddingStats()
+			if s == last {
+				continue
+			}
+			last = s
+			log.Printf("📦 Padding: %d frames, %d payload bytes, %d padding bytes, %d cover frames (%d bytes), overhead %.1f%%",
+				s.Frames, s.PayloadBytes, s.PaddingBytes, s.CoverFrames, s.CoverBytes, 100*s.Overhead())
+		}
+	}
+}
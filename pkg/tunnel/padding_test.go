@@ -0,0 +1,103 @@
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+	"github.com/openbmx/lightweight-tunnel/pkg/crypto"
+)
+
+// TestPaddedSize tests the container sizes each policy picks
+func TestPaddedSize(t *testing.T) {
+	const limit = 1400
+	if got := paddedSize(PaddingCell, 40, limit); got != limit {
+		t.Errorf("cell: %d", got)
+	}
+	for n, want := range map[int]int{1: 64, 61: 64, 62: 128, 1000: 1024, 1100: limit} {
+		if got := paddedSize(PaddingBucket, n, limit); got != want {
+			t.Errorf("bucket for %d bytes: %d, want %d", n, got, want)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		got := paddedSize(PaddingRandom, 100, limit)
+		if got < 100+paddingHeaderLen || got > 100+paddingHeaderLen+paddingRandomMax {
+			t.Fatalf("random: %d", got)
+		}
+	}
+	if got := paddedSize(PaddingRandom, limit-paddingHeaderLen-1, limit); got > limit {
+		t.Errorf("random exceeds the limit: %d", got)
+	}
+}
+
+// TestUnpadFrame tests that the frame inside a container comes back and that
+// malformed containers are rejected
+func TestUnpadFrame(t *testing.T) {
+	frame := []byte{PacketTypeData, 0x45, 0, 0, 20}
+	got, err := unpadFrame(padFrame(frame, 64))
+	if err != nil || !bytes.Equal(got, frame) {
+		t.Fatalf("unpadFrame = %x, %v", got, err)
+	}
+	if got, _ := unpadFrame(frame); !bytes.Equal(got, frame) {
+		t.Errorf("Unpadded frame changed: %x", got)
+	}
+	for _, bad := range [][]byte{{PacketTypePadded, 0}, {PacketTypePadded, 0, 0, 0}, {PacketTypePadded, 0, 9, 1}} {
+		if _, err := unpadFrame(bad); err != errInvalidPadding {
+			t.Errorf("Malformed container %x accepted", bad)
+		}
+	}
+}
+
+// TestPaddingRoundTrip tests that padded frames decrypt to the original, that
+// cells hide the frame length and that PMTU probes keep their size
+func TestPaddingRoundTrip(t *testing.T) {
+	c, err := crypto.NewCipher("padding-test-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := &Tunnel{config: &config.Config{MTU: 1300, Padding: PaddingCell}, cipher: c}
+
+	var sizes []int
+	for _, frame := range [][]byte{{PacketTypeKeepalive}, append([]byte{PacketTypeData}, make([]byte, 1300)...)} {
+		enc, err := tun.encryptPacket(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, len(enc))
+		plain, err := tun.decryptPacket(enc)
+		if err != nil || !bytes.Equal(plain, frame) {
+			t.Fatalf("Round trip of %d bytes: %d bytes, %v", len(frame), len(plain), err)
+		}
+	}
+	if sizes[0] != sizes[1] {
+		t.Errorf("Cells of different sizes: %v", sizes)
+	}
+
+	probe := append([]byte{PacketTypePMTUProbe}, make([]byte, 500)...)
+	enc, _ := tun.encryptPacket(probe)
+	if len(enc) != len(probe)+c.Overhead() {
+		t.Errorf("PMTU probe padded to %d bytes", len(enc))
+	}
+
+	s := tun.PaddingStats()
+	if s.Frames != 3 || s.PayloadBytes != 1+1301+501 || s.PaddingBytes == 0 {
+		t.Errorf("Stats %+v", s)
+	}
+}
+
+// TestCoverFrame tests that cover frames are keepalives within the MTU
+func TestCoverFrame(t *testing.T) {
+	tun := &Tunnel{config: &config.Config{MTU: 1300, Padding: PaddingBucket}}
+	for i := 0; i < 100; i++ {
+		frame := tun.coverFrame(1300)
+		if len(frame) > 1300+1+paddingHeaderLen {
+			t.Fatalf("Cover frame of %d bytes", len(frame))
+		}
+		if inner, err := unpadFrame(frame); err != nil || !bytes.Equal(inner, []byte{PacketTypeKeepalive}) {
+			t.Fatalf("Cover frame carries %x, %v", inner, err)
+		}
+	}
+	if s := tun.PaddingStats(); s.CoverFrames != 100 {
+		t.Errorf("Stats %+v", s)
+	}
+}
@@ -0,0 +1,404 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Packetization-layer path MTU discovery (RFC 8899 style) over the tunnel
+// connection itself. Probes are padded control frames sent as single fake-TCP
+// segments with DF set; the peer acknowledges each probe with the plaintext
+// size it received, so a probe only counts when it crossed the real path
+// intact.
+//
+// Probe format (after the PacketTypePMTUProbe byte): [id:4][padding...]
+// Ack format (after the PacketTypePMTUAck byte):     [id:4][size:2]
+const (
+	pmtuProbeHeaderLen = 1 + 4     // type + id
+	pmtuAckLen         = 1 + 4 + 2 // type + id + size
+
+	pmtuMinMTU          = 500             // Lowest MTU the search will settle on
+	pmtuProbeTimeout    = 1 * time.Second // Time to wait for a probe acknowledgement
+	pmtuMaxProbes       = 3               // Attempts per size before declaring it too big
+	pmtuStartDelay      = 2 * time.Second // Delay before the first search on a new connection
+	DefaultPMTUInterval = 600             // Default re-probe interval in seconds
+)
+
+var errPMTUProbeSend = errors.New("probe send failed")
+
+type pmtuAck struct {
+	id   uint32
+	size int
+}
+
+// pmtuProber searches for the largest tunnel MTU that gets through the path
+// of one connection and re-validates it periodically.
+type pmtuProber struct {
+	name     string // Peer description for logging
+	minMTU   int
+	maxMTU   int
+	interval time.Duration
+	timeout  time.Duration            // Time to wait for each probe acknowledgement
+	send     func(frame []byte) error // Encrypts and writes a control frame to the peer
+	onChange func(mtu int)            // Called when the effective MTU changes
+	stopCh   <-chan struct{}
+
+	mtu    int32  // Effective MTU (atomic), 0 until the first search succeeds
+	nextID uint32 // Last probe ID (atomic)
+	acks   chan pmtuAck
+	kick   chan struct{}
+}
+
+func newPMTUProber(name string, maxMTU int, interval time.Duration, send func([]byte) error, onChange func(int), stopCh <-chan struct{}) *pmtuProber {
+	minMTU := pmtuMinMTU
+	if minMTU > maxMTU {
+		minMTU = maxMTU
+	}
+	return &pmtuProber{
+		name:     name,
+		minMTU:   minMTU,
+		maxMTU:   maxMTU,
+		interval: interval,
+		timeout:  pmtuProbeTimeout,
+		send:     send,
+		onChange: onChange,
+		stopCh:   stopCh,
+		acks:     make(chan pmtuAck, 16),
+		kick:     make(chan struct{}, 1),
+	}
+}
+
+// MTU returns the probed MTU, or 0 if no search has completed yet.
+func (p *pmtuProber) MTU() int {
+	if p == nil {
+		return 0
+	}
+	return int(atomic.LoadInt32(&p.mtu))
+}
+
+// trigger requests a new search, e.g. after a reconnect.
+func (p *pmtuProber) trigger() {
+	if p == nil {
+		return
+	}
+	select {
+	case p.kick <- struct{}{}:
+	default:
+	}
+}
+
+// handleAck delivers a probe acknowledgement payload (without type byte).
+func (p *pmtuProber) handleAck(payload []byte) {
+	if p == nil || len(payload) < pmtuAckLen-1 {
+		return
+	}
+	ack := pmtuAck{
+		id:   binary.BigEndian.Uint32(payload[0:4]),
+		size: int(binary.BigEndian.Uint16(payload[4:6])),
+	}
+	select {
+	case p.acks <- ack:
+	default:
+	}
+}
+
+// run searches once after a short delay and then re-probes every interval
+// or whenever trigger is called, until stopCh is closed.
+func (p *pmtuProber) run() {
+	timer := time.NewTimer(pmtuStartDelay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-timer.C:
+		case <-p.kick:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+
+		p.search()
+		timer.Reset(p.interval)
+	}
+}
+
+// search confirms the current MTU and binary-searches for the largest size
+// that is acknowledged. If the peer never answers (e.g. it does not support
+// probing) the MTU is left unchanged.
+func (p *pmtuProber) search() {
+	current := p.MTU()
+	if current == 0 {
+		current = p.maxMTU
+	}
+
+	low, high := p.minMTU, p.maxMTU
+	acked := false
+
+	ok, err := p.probe(current)
+	if err != nil {
+		return
+	}
+	if ok {
+		acked = true
+		low = current
+	} else {
+		high = current - 1
+	}
+
+	for low < high {
+		mid := (low + high + 1) / 2
+		ok, err := p.probe(mid)
+		if err != nil {
+			return
+		}
+		if ok {
+			acked = true
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+
+	if !acked {
+		// Everything above the floor failed; make sure the floor itself works
+		if ok, err := p.probe(p.minMTU); err != nil || !ok {
+			log.Printf("⚠️  PMTU 探测无响应 (%s)，保持当前 MTU", p.name)
+			return
+		}
+	}
+
+	p.set(low)
+}
+
+// probe sends probes of the given MTU until one is acknowledged or
+// pmtuMaxProbes attempts time out. A probe the local stack refuses as too
+// big (EMSGSIZE from a known smaller route or interface MTU) fails the size
+// like a lost probe; other send errors abort the search.
+func (p *pmtuProber) probe(mtu int) (bool, error) {
+	for attempt := 0; attempt < pmtuMaxProbes; attempt++ {
+		id := atomic.AddUint32(&p.nextID, 1)
+		if err := p.send(buildPMTUProbe(id, mtu)); err != nil {
+			if errors.Is(err, syscall.EMSGSIZE) {
+				return false, nil
+			}
+			return false, fmt.Errorf("%w: %v", errPMTUProbeSend, err)
+		}
+
+		timer := time.NewTimer(p.timeout)
+	wait:
+		for {
+			select {
+			case ack := <-p.acks:
+				if ack.id == id && ack.size == mtu+1 {
+					timer.Stop()
+					return true, nil
+				}
+				// Stale ack from an earlier probe, keep waiting
+			case <-timer.C:
+				break wait
+			case <-p.stopCh:
+				timer.Stop()
+				return false, errors.New("prober stopped")
+			}
+		}
+	}
+	return false, nil
+}
+
+func (p *pmtuProber) set(mtu int) {
+	old := int(atomic.SwapInt32(&p.mtu, int32(mtu)))
+	if old == mtu {
+		return
+	}
+	if old == 0 {
+		log.Printf("📏 路径 MTU 探测完成 (%s): %d", p.name, mtu)
+	} else {
+		log.Printf("📏 路径 MTU 变化 (%s): %d -> %d", p.name, old, mtu)
+	}
+	if p.onChange != nil {
+		p.onChange(mtu)
+	}
+}
+
+// buildPMTUProbe builds a probe frame carrying an inner packet of mtu bytes,
+// i.e. a plaintext frame of mtu+1 bytes like a full data frame.
+func buildPMTUProbe(id uint32, mtu int) []byte {
+	size := mtu + 1
+	if size < pmtuProbeHeaderLen {
+		size = pmtuProbeHeaderLen
+	}
+	frame := make([]byte, size)
+	frame[0] = PacketTypePMTUProbe
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	return frame
+}
+
+// buildPMTUAck acknowledges a probe payload (without type byte), echoing its
+// ID and the plaintext frame size that arrived.
+func buildPMTUAck(probePayload []byte) []byte {
+	if len(probePayload) < pmtuProbeHeaderLen-1 {
+		return nil
+	}
+	frame := make([]byte, pmtuAckLen)
+	frame[0] = PacketTypePMTUAck
+	copy(frame[1:5], probePayload[0:4])
+	binary.BigEndian.PutUint16(frame[5:7], uint16(len(probePayload)+1))
+	return frame
+}
+
+// pathMTU returns the effective tunnel MTU for a connection, preferring the
+// probed value when one is available.
+func (t *Tunnel) pathMTU(p *pmtuProber) int {
+	if mtu := p.MTU(); mtu > 0 && mtu < t.config.MTU {
+		return mtu
+	}
+	return t.config.MTU
+}
+
+// pmtuInterval returns the configured re-probe interval.
+func (t *Tunnel) pmtuInterval() time.Duration {
+	interval := t.config.PMTUProbeInterval
+	if interval <= 0 {
+		interval = DefaultPMTUInterval
+	}
+	return time.Duration(interval) * time.Second
+}
+
+// sendControlToServer encrypts a control frame and writes it directly to the
+// server connection, bypassing FEC so it travels as exactly one segment.
+func (t *Tunnel) sendControlToServer(frame []byte) error {
+	conn := t.serverConn()
+	if conn == nil {
+		return errors.New("not connected")
+	}
+	encrypted, err := t.encryptPacket(frame)
+	if err != nil {
+		return err
+	}
+	return conn.WritePacket(encrypted)
+}
+
+// sendControlToClient encrypts a control frame and writes it directly to a
+// client connection, bypassing FEC.
+func (t *Tunnel) sendControlToClient(client *ClientConnection, frame []byte) error {
+	encrypted, err := t.encryptForClient(client, frame)
+	if err != nil {
+		return err
+	}
+	return client.currentConn().WritePacket(encrypted)
+}
+
+// startServerPMTUProbe starts probing the path to the server (client mode).
+func (t *Tunnel) startServerPMTUProbe() {
+	if t.pmtu == nil {
+		return
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		t.pmtu.run()
+	}()
+}
+
+// startClientPMTUProbe starts probing the path to a client (server mode). It
+// must be called before the client's reader goroutine starts.
+func (t *Tunnel) startClientPMTUProbe(client *ClientConnection) {
+	client.pmtu = newPMTUProber(client.currentConn().RemoteAddr().String(), t.config.MTU, t.pmtuInterval(),
+		func(frame []byte) error { return t.sendControlToClient(client, frame) },
+		func(mtu int) { t.applyServerPathMTU(client, mtu) }, client.stopCh)
+	client.wg.Add(1)
+	go func() {
+		defer client.wg.Done()
+		client.pmtu.run()
+	}()
+}
+
+// applyClientPathMTU lowers (or restores) the TUN MTU after the path MTU to
+// the server changed. With fragmentation enabled the TUN keeps its own MTU and
+// only the fragment size follows the path.
+func (t *Tunnel) applyClientPathMTU(mtu int) {
+	if t.config.EnableFragmentation && t.tunMTU() > mtu {
+		return
+	}
+	if err := t.setTUNMTU(t.deviceMTUFor(mtu)); err != nil {
+		log.Printf("⚠️  Failed to update TUN MTU to %d: %v", mtu, err)
+	}
+}
+
+// applyServerPathMTU applies the path MTU towards a client (server mode). The
+// TUN device is shared by all clients, so instead of lowering its MTU a host
+// route to the client carries the path MTU, and the kernel answers oversized
+// packets for that client alone. With fragmentation enabled oversized
+// packets are fragmented instead.
+func (t *Tunnel) applyServerPathMTU(client *ClientConnection, mtu int) {
+	if t.config.EnableFragmentation || t.isTAP() || runtime.GOOS != "linux" {
+		return
+	}
+	if t.tunName == "" || !isSafeTunName(t.tunName) {
+		return
+	}
+	t.clientsMux.RLock()
+	ip := client.clientIP
+	t.clientsMux.RUnlock()
+	if ip == nil {
+		return
+	}
+	route := ip.String() + "/32"
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if mtu >= t.config.MTU {
+		if client.mtuRoute != "" {
+			t.deleteRoute(client.mtuRoute)
+			client.mtuRoute = ""
+		}
+		return
+	}
+	cmd := exec.Command("ip", "route", "replace", route, "dev", t.tunName, "mtu", fmt.Sprintf("%d", mtu))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("⚠️  Failed to set path MTU %d for client %s: %v, output: %s", mtu, ip, err, output)
+		return
+	}
+	client.mtuRoute = route
+}
+
+// clearServerPathMTU removes the path MTU route of a departing client.
+func (t *Tunnel) clearServerPathMTU(client *ClientConnection) {
+	client.mu.Lock()
+	route := client.mtuRoute
+	client.mtuRoute = ""
+	client.mu.Unlock()
+	if route != "" {
+		t.deleteRoute(route)
+	}
+}
+
+// setTUNMTU changes the MTU of the TUN device at runtime.
+func (t *Tunnel) setTUNMTU(mtu int) error {
+	if t.tunName == "" {
+		return errors.New("TUN device not configured")
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("ifconfig", t.tunName, "mtu", fmt.Sprintf("%d", mtu))
+	} else {
+		cmd = exec.Command("ip", "link", "set", "dev", t.tunName, "mtu", fmt.Sprintf("%d", mtu))
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v, output: %s", err, output)
+	}
+	log.Printf("Updated %s MTU to %d", t.tunName, mtu)
+	return nil
+}
@@ -0,0 +1,91 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestPath returns a prober whose probes are acknowledged only when the
+// frame fits within pathLimit bytes, simulating a path with a smaller MTU
+func newTestPath(maxMTU, pathLimit int, stopCh chan struct{}) *pmtuProber {
+	var p *pmtuProber
+	send := func(frame []byte) error {
+		if len(frame) <= pathLimit {
+			ack := buildPMTUAck(frame[1:])
+			go p.handleAck(ack[1:])
+		}
+		return nil
+	}
+	p = newPMTUProber("test", maxMTU, time.Minute, send, nil, stopCh)
+	p.timeout = 20 * time.Millisecond
+	return p
+}
+
+// TestPMTUSearchFindsPathLimit tests that the binary search settles on the
+// largest MTU whose probe fits through the path
+func TestPMTUSearchFindsPathLimit(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	p := newTestPath(1371, 1201, stopCh)
+	p.search()
+	if got := p.MTU(); got != 1200 {
+		t.Fatalf("Expected MTU 1200, got %d", got)
+	}
+
+	// Path recovers: the next search raises the MTU back to the maximum
+	p.send = func(frame []byte) error {
+		ack := buildPMTUAck(frame[1:])
+		go p.handleAck(ack[1:])
+		return nil
+	}
+	p.search()
+	if got := p.MTU(); got != 1371 {
+		t.Fatalf("Expected MTU 1371 after recovery, got %d", got)
+	}
+}
+
+// TestPMTUSearchWithoutPeerSupport tests that an unresponsive peer leaves
+// the MTU unchanged
+func TestPMTUSearchWithoutPeerSupport(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	p := newTestPath(1371, 0, stopCh)
+	p.search()
+	if got := p.MTU(); got != 0 {
+		t.Fatalf("Expected MTU to stay unset, got %d", got)
+	}
+}
+
+// TestPMTUSearchLocalTooBig tests that probes the local stack refuses as too
+// big count as failed sizes, while other send errors abort the search
+func TestPMTUSearchLocalTooBig(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	p := newTestPath(1371, 1372, stopCh)
+	p.send = func(frame []byte) error {
+		if len(frame) > 1101 {
+			return fmt.Errorf("failed to send packet: %w", syscall.EMSGSIZE)
+		}
+		ack := buildPMTUAck(frame[1:])
+		go p.handleAck(ack[1:])
+		return nil
+	}
+	p.search()
+	if got := p.MTU(); got != 1100 {
+		t.Fatalf("Expected MTU 1100, got %d", got)
+	}
+
+	p.send = func(frame []byte) error {
+		return errors.New("connection closed")
+	}
+	p.search()
+	if got := p.MTU(); got != 1100 {
+		t.Fatalf("Expected MTU to stay 1100 after a send error, got %d", got)
+	}
+}
@@ -0,0 +1,266 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/crypto"
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// Active-probe resistance. A censor probing a suspected server completes a
+// handshake and sends junk, or replays a packet it recorded, and looks at
+// how the server reacts. With probe_resistance set, the server creates no
+// tunnel state for a connection until its first packet turned out to be a
+// valid encrypted PacketTypeAuth that was not seen before; any other
+// connection gets the reaction of an ordinary service and is dropped within
+// ProbeAuthWindow. Clients send their authentication as the first packet of
+// every connection and wait for the answer before using it.
+
+// Probe resistance modes
+const (
+	ProbeResistanceOff  = "off"
+	ProbeResistanceHTTP = "http" // Answer like nginx: 400 Bad Request (404 for requests), then close
+	ProbeResistanceTLS  = "tls"  // Answer like a TLS server: a fatal alert, then close
+	ProbeResistanceRST  = "rst"  // Stay silent, then reset like a closed service
+
+	// ProbeAuthWindow is how long a new connection has to authenticate
+	ProbeAuthWindow = AuthenticationTimeout
+)
+
+// firstAuth is the authentication a connection was admitted with
+type firstAuth struct {
+	payload []byte
+	cipher  *crypto.Cipher
+	gen     uint64
+	hop     bool // The connection continues a session on another port
+}
+
+// probeResistance reports whether the server admits connections only after
+// they authenticated, and so whether a client authenticates each connection
+// before using it
+func (t *Tunnel) probeResistance() bool {
+	mode := t.config.ProbeResistance
+	return mode != "" && mode != ProbeResistanceOff && t.cipher != nil
+}
+
+// authFirst reports whether connections open with an authentication, or a
+// hop of an existing session, before anything else is sent on them
+func (t *Tunnel) authFirst() bool {
+	return t.probeResistance() || t.hopEnabled()
+}
+
+// admitClient waits for the first packet of a new connection and hands the
+// connection to handleClient only if it is a fresh, valid authentication
+func (t *Tunnel) admitClient(conn faketcp.ConnAdapter) {
+	deadline := time.Now().Add(ProbeAuthWindow)
+	first, err := readPacketTimeout(conn, ProbeAuthWindow)
+	var hsErr *faketcp.HandshakeError
+	if errors.As(err, &hsErr) {
+		// Not even the framing handshake; answer what was sent
+		first = hsErr.Segment
+	}
+	if err == nil {
+		var auth *firstAuth
+		if auth, err = t.checkFirstAuth(first, time.Now()); err == nil {
+			if auth.hop {
+				t.resumeClient(conn, auth)
+			} else {
+				t.handleClient(conn, auth)
+			}
+			return
+		}
+	}
+	if !t.probeResistance() {
+		log.Printf("Unauthenticated connection from %s (%v), closing", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	log.Printf("🛡️  Unauthenticated connection from %s (%v), answering as %s", conn.RemoteAddr(), err, t.config.ProbeResistance)
+	t.deflectProbe(conn, first, deadline)
+}
+
+// checkFirstAuth checks that the first packet of a connection is an
+// authentication encrypted with our key, valid and not a replay
+func (t *Tunnel) checkFirstAuth(packet []byte, now time.Time) (*firstAuth, error) {
+	plain, cipher, gen, err := t.decryptWithFallback(packet)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed")
+	}
+	if cipher == nil || len(plain) < 1 || (plain[0] != PacketTypeAuth && (plain[0] != PacketTypeHop || !t.hopEnabled())) {
+		return nil, fmt.Errorf("first packet is not an authentication")
+	}
+	if _, _, err := parseAuthRequest(plain[1:], now); err != nil {
+		return nil, err
+	}
+	if !t.authReplay.check(packet, now) {
+		return nil, fmt.Errorf("replayed authentication")
+	}
+	return &firstAuth{payload: plain[1:], cipher: cipher, gen: gen, hop: plain[0] == PacketTypeHop}, nil
+}
+
+// deflectProbe answers an unauthenticated connection the way the configured
+// decoy service would and drops it. first is the packet it sent, nil if it
+// sent nothing. The decoy goes out under any framing, as the service's own
+// answer.
+func (t *Tunnel) deflectProbe(conn faketcp.ConnAdapter, first []byte, deadline time.Time) {
+	switch t.config.ProbeResistance {
+	case ProbeResistanceHTTP:
+		if first != nil {
+			faketcp.Unframed(conn).WritePacket(httpDecoy(first, time.Now()))
+		}
+	case ProbeResistanceTLS:
+		if first != nil {
+			faketcp.Unframed(conn).WritePacket(tlsDecoy(first))
+		}
+	case ProbeResistanceRST:
+		// A closed service does not answer; reset once the window is over
+		select {
+		case <-time.After(time.Until(deadline)):
+		case <-t.stopCh:
+		}
+		if a, ok := conn.(interface{ Abort() error }); ok {
+			a.Abort()
+			return
+		}
+	}
+	conn.Close()
+}
+
+// readPacketTimeout reads a non-empty packet, giving up after timeout. It
+// reads in place rather than in a goroutine that would outlive a timeout and
+// swallow the next packet: every adapter's ReadPacket gives up on its own
+// after ReadTimeoutDuration, and those honouring read deadlines at timeout.
+func readPacketTimeout(conn faketcp.ConnAdapter, timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	conn.SetReadDeadline(deadline)
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		data, err := conn.ReadPacket()
+		if err == nil && len(data) > 0 {
+			return data, nil
+		}
+		if netErr, ok := err.(net.Error); err != nil && (!ok || !netErr.Timeout()) {
+			return nil, err
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("timeout after %v", timeout)
+		}
+	}
+}
+
+// authenticateConn authenticates a new connection to the server before it is
+// used: a server with probe resistance drops connections whose first packet
+// is anything else. The response is read here, before netReader takes over.
+func (t *Tunnel) authenticateConn(conn faketcp.ConnAdapter) error {
+	packet, err := t.buildAuthPacket()
+	if err != nil {
+		return err
+	}
+	if err := conn.WritePacket(packet); err != nil {
+		return fmt.Errorf("failed to send auth packet: %v", err)
+	}
+
+	status, err := t.readStatus(conn, PacketTypeAuthResponse)
+	if err != nil {
+		return fmt.Errorf("authentication failed: %v", err)
+	}
+	if status != "OK" {
+		return fmt.Errorf("authentication rejected: %s", status)
+	}
+	t.authMux.Lock()
+	t.authenticated = true
+	t.authMux.Unlock()
+	return nil
+}
+
+// readStatus waits for the status answer of the given type on a new
+// connection, skipping anything else the server sent
+func (t *Tunnel) readStatus(conn faketcp.ConnAdapter, packetType byte) (string, error) {
+	deadline := time.Now().Add(AuthenticationTimeout)
+	for {
+		data, err := readPacketTimeout(conn, time.Until(deadline))
+		if err != nil {
+			return "", err
+		}
+		plain, err := t.decryptPacket(data)
+		if err != nil || len(plain) < 1 || plain[0] != packetType {
+			continue
+		}
+		return string(plain[1:]), nil
+	}
+}
+
+// authReplayCache remembers the authentications accepted as first packet
+// while their timestamp is valid, so that a recorded one cannot be replayed
+type authReplayCache struct {
+	mu   sync.Mutex
+	seen map[[sha256.Size]byte]time.Time
+}
+
+// check records an authentication packet and reports whether it is new
+func (c *authReplayCache) check(packet []byte, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen == nil {
+		c.seen = make(map[[sha256.Size]byte]time.Time)
+	}
+	for k, expires := range c.seen {
+		if now.After(expires) {
+			delete(c.seen, k)
+		}
+	}
+
+	key := sha256.Sum256(packet)
+	if _, ok := c.seen[key]; ok {
+		return false
+	}
+	// A timestamp is accepted this long on either side of now
+	c.seen[key] = now.Add(2 * AuthenticationTimeWindow * time.Second)
+	return true
+}
+
+// nginxPage is the body of an nginx error page
+func nginxPage(status string) string {
+	return "<html>\r\n<head><title>" + status + "</title></head>\r\n<body>\r\n<center><h1>" + status +
+		"</h1></center>\r\n<hr><center>nginx</center>\r\n</body>\r\n</html>\r\n"
+}
+
+// httpDecoy is nginx's answer to a request: 404 for something that looks like
+// HTTP, 400 for anything else
+func httpDecoy(request []byte, now time.Time) []byte {
+	status := "400 Bad Request"
+	for _, method := range []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ", "CONNECT ", "PATCH ", "TRACE "} {
+		if bytes.HasPrefix(request, []byte(method)) {
+			status = "404 Not Found"
+			break
+		}
+	}
+	body := nginxPage(status)
+	return []byte(fmt.Sprintf("HTTP/1.1 %s\r\nServer: nginx\r\nDate: %s\r\nContent-Type: text/html\r\n"+
+		"Content-Length: %d\r\nConnection: close\r\n\r\n%s",
+		status, now.UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT"), len(body), body))
+}
+
+// TLS alert descriptions
+const (
+	tlsAlertUnexpectedMessage = 10
+	tlsAlertHandshakeFailure  = 40
+)
+
+// tlsDecoy is a TLS server's fatal alert: handshake_failure for a
+// ClientHello it has no common parameters with, unexpected_message for
+// anything that is not a handshake record
+func tlsDecoy(record []byte) []byte {
+	desc := byte(tlsAlertUnexpectedMessage)
+	if len(record) >= 6 && record[0] == 0x16 && record[1] == 0x03 && record[5] == 0x01 {
+		desc = tlsAlertHandshakeFailure
+	}
+	return []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, desc}
+}
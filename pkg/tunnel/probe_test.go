@@ -0,0 +1,135 @@
+package tunnel
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+	"github.com/openbmx/lightweight-tunnel/pkg/crypto"
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+func newProbeTestTunnel(t *testing.T, key string) *Tunnel {
+	c, err := crypto.NewCipher(key)
+	if err != nil {
+		t.Fatalf("NewCipher: %v", err)
+	}
+	return &Tunnel{
+		config:     &config.Config{ProbeResistance: ProbeResistanceHTTP},
+		cipher:     c,
+		myTunnelIP: net.ParseIP("10.0.0.2"),
+		stopCh:     make(chan struct{}),
+	}
+}
+
+// TestCheckFirstAuth tests that only a fresh authentication encrypted with
+// the server's key admits a connection
+func TestCheckFirstAuth(t *testing.T) {
+	server := newProbeTestTunnel(t, "probe-test-key")
+	client := newProbeTestTunnel(t, "probe-test-key")
+	stranger := newProbeTestTunnel(t, "another-key")
+	now := time.Now()
+
+	auth, err := client.buildAuthPacket()
+	if err != nil {
+		t.Fatalf("buildAuthPacket: %v", err)
+	}
+	if _, err := server.checkFirstAuth(auth, now); err != nil {
+		t.Fatalf("Valid authentication rejected: %v", err)
+	}
+	if _, err := server.checkFirstAuth(auth, now); err == nil {
+		t.Errorf("Replayed authentication accepted")
+	}
+
+	other, _ := stranger.buildAuthPacket()
+	if _, err := server.checkFirstAuth(other, now); err == nil {
+		t.Errorf("Authentication with another key accepted")
+	}
+	if _, err := server.checkFirstAuth([]byte("GET / HTTP/1.1\r\n\r\n"), now); err == nil {
+		t.Errorf("Junk accepted")
+	}
+	keepalive, _ := client.cipher.Encrypt([]byte{PacketTypeKeepalive})
+	if _, err := server.checkFirstAuth(keepalive, now); err == nil {
+		t.Errorf("Encrypted non-authentication packet accepted")
+	}
+	late, _ := client.buildAuthPacket()
+	if _, err := server.checkFirstAuth(late, now.Add(2*AuthenticationTimeWindow*time.Second)); err == nil {
+		t.Errorf("Expired authentication accepted")
+	}
+}
+
+// TestProbeDecoys tests the answers given to unauthenticated connections
+func TestProbeDecoys(t *testing.T) {
+	resp := string(httpDecoy([]byte{0x17, 0x42}, time.Now()))
+	if !strings.HasPrefix(resp, "HTTP/1.1 400 Bad Request\r\nServer: nginx\r\n") {
+		t.Errorf("HTTP decoy for junk: %q", resp)
+	}
+	head, body, _ := strings.Cut(resp, "\r\n\r\n")
+	if !strings.Contains(head, "Content-Length: "+strconv.Itoa(len(body))) {
+		t.Errorf("Content-Length does not match body of %d bytes", len(body))
+	}
+	if resp := string(httpDecoy([]byte("GET /admin HTTP/1.1\r\n"), time.Now())); !strings.HasPrefix(resp, "HTTP/1.1 404 Not Found") {
+		t.Errorf("HTTP decoy for a request: %q", resp)
+	}
+
+	clientHello := []byte{0x16, 0x03, 0x01, 0x00, 0x40, 0x01}
+	if got := tlsDecoy(clientHello); !bytes.Equal(got, []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, tlsAlertHandshakeFailure}) {
+		t.Errorf("TLS decoy for a ClientHello: %x", got)
+	}
+	if got := tlsDecoy([]byte("junk")); got[6] != tlsAlertUnexpectedMessage {
+		t.Errorf("TLS decoy for junk: %x", got)
+	}
+}
+
+// TestReadPacketTimeoutKeepsNextPacket tests that a read that timed out does
+// not swallow the packet arriving after it
+func TestReadPacketTimeoutKeepsNextPacket(t *testing.T) {
+	listener, err := faketcp.ListenWithMode("127.0.0.1:0", faketcp.ModeTCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan faketcp.ConnAdapter, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	client, err := faketcp.DialWithMode(listener.Addr().String(), time.Second, faketcp.ModeTCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("Accept failed")
+	}
+	defer server.Close()
+
+	start := time.Now()
+	if _, err := readPacketTimeout(server, 100*time.Millisecond); err == nil {
+		t.Fatalf("Expected a timeout with nothing sent")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected the read to give up after about 100ms, took %v", elapsed)
+	}
+
+	if err := client.WritePacket([]byte("next")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := readPacketTimeout(server, time.Second)
+	if err != nil {
+		t.Fatalf("Expected the packet sent after the timeout, got %v", err)
+	}
+	if string(data) != "next" {
+		t.Fatalf("Expected %q, got %q", "next", data)
+	}
+}
@@ -0,0 +1,396 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TAP (Layer 2) mode. Ethernet frames are carried instead of IP packets so
+// remote LAN segments can be bridged (ARP, DHCP, non-IP protocols). The
+// server learns which client owns each source MAC address, forwards known
+// unicast frames to that client and floods broadcast, multicast and unknown
+// unicast frames to everyone else. Source MAC and IPv4 addresses are bound
+// to the client that uses them, so one client cannot take over the addresses
+// of another.
+const (
+	DeviceTypeTUN = "tun"
+	DeviceTypeTAP = "tap"
+
+	ethHeaderLen = 14 // dst MAC + src MAC + EtherType
+
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+	etherTypeVLAN = 0x8100
+
+	macAgingTime          = 300 * time.Second // Learned entries expire after this much silence
+	macAgingSweepInterval = 30 * time.Second
+	maxMACEntries         = 4096 // Bound on learned addresses; unknown MACs are flooded
+	macRefreshInterval    = time.Second
+	macMoveHoldTime       = 10 * time.Second // An address only moves to another client after this much silence
+	fanoutDropLogEvery    = 1000             // Log every this many fan-out drops after the first
+)
+
+type macAddr [6]byte
+
+func (m macAddr) String() string {
+	return net.HardwareAddr(m[:]).String()
+}
+
+// isMulticast reports whether the group bit is set (includes broadcast).
+func (m macAddr) isMulticast() bool {
+	return m[0]&0x01 != 0
+}
+
+// frameMACs returns the destination and source MAC of an Ethernet frame.
+func frameMACs(frame []byte) (dst, src macAddr, ok bool) {
+	if len(frame) < ethHeaderLen {
+		return dst, src, false
+	}
+	copy(dst[:], frame[0:6])
+	copy(src[:], frame[6:12])
+	return dst, src, true
+}
+
+// frameSourceIP returns the IPv4 source address of an IPv4 frame or the
+// sender address of an ARP frame, looking past one VLAN tag.
+func frameSourceIP(frame []byte) (ip [4]byte, ok bool) {
+	if len(frame) < ethHeaderLen {
+		return ip, false
+	}
+	offset := ethHeaderLen
+	etherType := binary.BigEndian.Uint16(frame[12:14])
+	if etherType == etherTypeVLAN && len(frame) >= ethHeaderLen+4 {
+		etherType = binary.BigEndian.Uint16(frame[16:18])
+		offset += 4
+	}
+	payload := frame[offset:]
+	switch etherType {
+	case etherTypeIPv4:
+		if len(payload) < IPv4MinHeaderLen {
+			return ip, false
+		}
+		copy(ip[:], payload[IPv4SrcIPOffset:IPv4SrcIPOffset+4])
+		return ip, true
+	case etherTypeARP:
+		// htype, ptype, hlen, plen, oper, sender MAC, sender IP
+		if len(payload) < 18 || binary.BigEndian.Uint16(payload[2:4]) != etherTypeIPv4 || payload[4] != 6 || payload[5] != 4 {
+			return ip, false
+		}
+		copy(ip[:], payload[14:18])
+		return ip, true
+	}
+	return ip, false
+}
+
+// clientAddr describes a client in log messages.
+func clientAddr(client *ClientConnection) string {
+	if conn := client.currentConn(); conn != nil {
+		return conn.RemoteAddr().String()
+	}
+	return "unknown"
+}
+
+type macEntry struct {
+	client       *ClientConnection
+	lastSeen     time.Time
+	lastRejected time.Time
+}
+
+// claim refreshes the entry for client. The address only moves over from
+// another client once that client has left it unused for macMoveHoldTime;
+// until then claim returns false and the frame should be dropped.
+func (e *macEntry) claim(addr string, client *ClientConnection, now time.Time) bool {
+	if e.client != client {
+		if now.Sub(e.lastSeen) < macMoveHoldTime {
+			if now.Sub(e.lastRejected) >= macRefreshInterval {
+				log.Printf("⚠️  %s is in use by client %s, dropping frames from %s", addr, clientAddr(e.client), clientAddr(client))
+			}
+			e.lastRejected = now
+			return false
+		}
+		log.Printf("%s moved from %s to %s", addr, clientAddr(e.client), clientAddr(client))
+		e.client = client
+	}
+	e.lastSeen = now
+	return true
+}
+
+// macTable maps learned MAC addresses, and the IPv4 addresses used behind
+// them, to the client connection behind them.
+type macTable struct {
+	mu      sync.RWMutex
+	entries map[macAddr]*macEntry
+	ips     map[[4]byte]*macEntry
+	ttl     time.Duration
+}
+
+func newMACTable(ttl time.Duration) *macTable {
+	return &macTable{
+		entries: make(map[macAddr]*macEntry),
+		ips:     make(map[[4]byte]*macEntry),
+		ttl:     ttl,
+	}
+}
+
+// learn records that mac was seen behind client. It returns false when mac
+// belongs to another client (see macEntry.claim).
+func (m *macTable) learn(mac macAddr, client *ClientConnection, now time.Time) bool {
+	if mac.isMulticast() {
+		return true
+	}
+
+	m.mu.RLock()
+	entry := m.entries[mac]
+	fresh := entry != nil && entry.client == client && now.Sub(entry.lastSeen) < macRefreshInterval
+	m.mu.RUnlock()
+	if fresh {
+		return true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry = m.entries[mac]
+	if entry == nil {
+		if len(m.entries) >= maxMACEntries {
+			return true
+		}
+		m.entries[mac] = &macEntry{client: client, lastSeen: now}
+		return true
+	}
+	return entry.claim("MAC "+mac.String(), client, now)
+}
+
+// bindIP binds an IPv4 source address to client, like the TUN path binds a
+// client to its tunnel IP. It returns false when ip belongs to another
+// client (see macEntry.claim). The unspecified address used by DHCP and ARP
+// probes is never bound.
+func (m *macTable) bindIP(ip [4]byte, client *ClientConnection, now time.Time) bool {
+	if ip == [4]byte{} {
+		return true
+	}
+
+	m.mu.RLock()
+	entry := m.ips[ip]
+	fresh := entry != nil && entry.client == client && now.Sub(entry.lastSeen) < macRefreshInterval
+	m.mu.RUnlock()
+	if fresh {
+		return true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry = m.ips[ip]
+	if entry == nil {
+		if len(m.ips) >= maxMACEntries {
+			return true
+		}
+		m.ips[ip] = &macEntry{client: client, lastSeen: now}
+		return true
+	}
+	return entry.claim("IP "+net.IP(ip[:]).String(), client, now)
+}
+
+// lookup returns the client owning mac, or nil if unknown or aged out.
+func (m *macTable) lookup(mac macAddr, now time.Time) *ClientConnection {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entry := m.entries[mac]
+	if entry == nil || now.Sub(entry.lastSeen) > m.ttl {
+		return nil
+	}
+	return entry.client
+}
+
+// removeClient forgets every address learned behind client.
+func (m *macTable) removeClient(client *ClientConnection) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for mac, entry := range m.entries {
+		if entry.client == client {
+			delete(m.entries, mac)
+		}
+	}
+	for ip, entry := range m.ips {
+		if entry.client == client {
+			delete(m.ips, ip)
+		}
+	}
+}
+
+// expire drops entries that have not been seen within the aging time.
+func (m *macTable) expire(now time.Time) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	removed := 0
+	for mac, entry := range m.entries {
+		if now.Sub(entry.lastSeen) > m.ttl {
+			delete(m.entries, mac)
+			removed++
+		}
+	}
+	for ip, entry := range m.ips {
+		if now.Sub(entry.lastSeen) > m.ttl {
+			delete(m.ips, ip)
+		}
+	}
+	return removed
+}
+
+// isTAP reports whether the tunnel runs in Layer 2 mode.
+func (t *Tunnel) isTAP() bool {
+	return t.config.DeviceType == DeviceTypeTAP
+}
+
+// deviceMTUFor converts a tunnel MTU (largest inner frame) into the MTU
+// configured on the device; TAP frames carry an extra Ethernet header.
+func (t *Tunnel) deviceMTUFor(mtu int) int {
+	if t.isTAP() {
+		return mtu - ethHeaderLen
+	}
+	return mtu
+}
+
+// macAgingLoop periodically expires stale MAC table entries (server mode).
+func (t *Tunnel) macAgingLoop() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(macAgingSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case now := <-ticker.C:
+			if n := t.macTable.expire(now); n > 0 {
+				log.Printf("MAC table: aged out %d entries", n)
+			}
+		}
+	}
+}
+
+// copyFrame copies a frame into a pooled buffer.
+func (t *Tunnel) copyFrame(frame []byte) []byte {
+	buf := t.getPacketBuffer()
+	if cap(buf) < len(frame) {
+		buf = make([]byte, len(frame))
+	}
+	buf = buf[:len(frame)]
+	copy(buf, frame)
+	return buf
+}
+
+// queueFrameToClient copies a frame into a pooled buffer and queues it for
+// a client without blocking the caller for long.
+func (t *Tunnel) queueFrameToClient(client *ClientConnection, frame []byte) {
+	buf := t.copyFrame(frame)
+
+	select {
+	case client.sendQueue <- buf:
+	case <-client.stopCh:
+		t.releasePacketBuffer(buf)
+	case <-time.After(QueueSendTimeout):
+		log.Printf("⚠️  Client send queue full for %s, dropping frame", client.currentConn().RemoteAddr())
+		t.releasePacketBuffer(buf)
+	}
+}
+
+// offerFrameToClient queues a copy of a frame for a client without waiting.
+// Fan-out uses it so one stalled client cannot hold up the others; the frame
+// is dropped and counted when the client's queue is full.
+func (t *Tunnel) offerFrameToClient(client *ClientConnection, frame []byte) {
+	buf := t.copyFrame(frame)
+
+	select {
+	case client.sendQueue <- buf:
+	default:
+		t.releasePacketBuffer(buf)
+		if n := atomic.AddUint64(&t.fanoutDrops, 1); n == 1 || n%fanoutDropLogEvery == 0 {
+			log.Printf("⚠️  Client send queue full for %s, dropped flooded frame (%d dropped so far)", client.currentConn().RemoteAddr(), n)
+		}
+	}
+}
+
+// floodFrame sends a frame to every connected client except the one it came
+// from (nil when the frame came from the local TAP device).
+func (t *Tunnel) floodFrame(frame []byte, from *ClientConnection) {
+	t.allClientsMux.RLock()
+	targets := make([]*ClientConnection, 0, len(t.allClients))
+	for client := range t.allClients {
+		if client != from {
+			targets = append(targets, client)
+		}
+	}
+	t.allClientsMux.RUnlock()
+
+	for _, client := range targets {
+		t.offerFrameToClient(client, frame)
+	}
+}
+
+// forwardFrameFromTAP forwards a frame read from the server's TAP device to
+// the client owning its destination MAC, or floods it. The frame buffer is
+// always released by the caller.
+func (t *Tunnel) forwardFrameFromTAP(frame []byte) {
+	dst, _, ok := frameMACs(frame)
+	if !ok {
+		return
+	}
+	if !dst.isMulticast() {
+		if client := t.macTable.lookup(dst, time.Now()); client != nil {
+			t.queueFrameToClient(client, frame)
+			return
+		}
+	}
+	t.floodFrame(frame, nil)
+}
+
+// handleClientFrame learns the source MAC of a frame received from a client,
+// drops it if its MAC or IPv4 source belongs to another client and forwards
+// it to another client and/or the local TAP device.
+// Returns false when the client reader should exit.
+func (t *Tunnel) handleClientFrame(client *ClientConnection, frame []byte) bool {
+	dst, src, ok := frameMACs(frame)
+	if !ok {
+		return true
+	}
+	now := time.Now()
+	if !t.macTable.learn(src, client, now) {
+		return true
+	}
+	if ip, ok := frameSourceIP(frame); ok && !t.macTable.bindIP(ip, client, now) {
+		return true
+	}
+
+	if !dst.isMulticast() {
+		if target := t.macTable.lookup(dst, now); target != nil {
+			if target == client {
+				// Destination is on the sender's own segment
+				return true
+			}
+			if !t.config.ClientIsolation {
+				t.queueFrameToClient(target, frame)
+				return true
+			}
+		}
+	}
+
+	// Broadcast, multicast, unknown unicast or isolated: deliver locally and
+	// flood to the other clients unless isolation is enabled.
+	if !t.config.ClientIsolation {
+		t.floodFrame(frame, client)
+	}
+	if err := t.writeTUNPacket(frame); err != nil {
+		select {
+		case <-t.stopCh:
+			return false
+		default:
+			log.Printf("TAP write error: %v", err)
+		}
+	}
+	return true
+}
@@ -0,0 +1,189 @@
+package tunnel
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// TestMACTableLearnAndAge tests learning, lookup, aging and removal of MAC
+// table entries
+func TestMACTableLearnAndAge(t *testing.T) {
+	table := newMACTable(time.Minute)
+	a, b := &ClientConnection{}, &ClientConnection{}
+	macA := macAddr{0x02, 0, 0, 0, 0, 0x0a}
+	macB := macAddr{0x02, 0, 0, 0, 0, 0x0b}
+	now := time.Now()
+
+	table.learn(macA, a, now)
+	table.learn(macB, b, now)
+	if got := table.lookup(macA, now); got != a {
+		t.Fatalf("Expected MAC A behind client A, got %p", got)
+	}
+
+	// Group addresses are never learned
+	broadcast := macAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	table.learn(broadcast, a, now)
+	if table.lookup(broadcast, now) != nil {
+		t.Fatalf("Broadcast address should not be learned")
+	}
+
+	// Stale entries are not returned and are removed by expire
+	later := now.Add(2 * time.Minute)
+	if table.lookup(macA, later) != nil {
+		t.Fatalf("Expected aged entry to be ignored")
+	}
+	table.learn(macB, b, later)
+	if n := table.expire(later); n != 1 {
+		t.Fatalf("Expected 1 expired entry, got %d", n)
+	}
+
+	table.removeClient(b)
+	if table.lookup(macB, later) != nil {
+		t.Fatalf("Expected entries of removed client to be gone")
+	}
+}
+
+// TestFrameMACs tests Ethernet header parsing
+func TestFrameMACs(t *testing.T) {
+	frame := []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // dst
+		0x02, 0x11, 0x22, 0x33, 0x44, 0x55, // src
+		0x08, 0x06, // ARP
+	}
+	dst, src, ok := frameMACs(frame)
+	if !ok {
+		t.Fatalf("Expected valid frame")
+	}
+	if !dst.isMulticast() || src.isMulticast() {
+		t.Errorf("Unexpected group bits: dst=%s src=%s", dst, src)
+	}
+	if src.String() != "02:11:22:33:44:55" {
+		t.Errorf("Unexpected source MAC %s", src)
+	}
+	if _, _, ok := frameMACs(frame[:ethHeaderLen-1]); ok {
+		t.Errorf("Expected truncated frame to be rejected")
+	}
+}
+
+// TestMACTableMoves tests that MAC and IPv4 addresses only move to another
+// client once their owner stopped using them
+func TestMACTableMoves(t *testing.T) {
+	table := newMACTable(time.Minute)
+	a, b := &ClientConnection{}, &ClientConnection{}
+	mac := macAddr{0x02, 0, 0, 0, 0, 0x0a}
+	ip := [4]byte{10, 0, 0, 2}
+	now := time.Now()
+
+	if !table.learn(mac, a, now) || !table.bindIP(ip, a, now) {
+		t.Fatalf("Expected new addresses to be bound to client A")
+	}
+	if table.learn(mac, b, now.Add(time.Second)) {
+		t.Fatalf("Expected MAC in use by client A to be rejected for client B")
+	}
+	if table.bindIP(ip, b, now.Add(time.Second)) {
+		t.Fatalf("Expected IP in use by client A to be rejected for client B")
+	}
+	if got := table.lookup(mac, now.Add(time.Second)); got != a {
+		t.Fatalf("Expected MAC to stay behind client A, got %p", got)
+	}
+
+	// The unspecified address is never bound
+	if !table.bindIP([4]byte{}, a, now) || !table.bindIP([4]byte{}, b, now) {
+		t.Fatalf("Expected unspecified address to be allowed for every client")
+	}
+
+	// Once client A fell silent the addresses move
+	later := now.Add(macMoveHoldTime)
+	if !table.learn(mac, b, later) || !table.bindIP(ip, b, later) {
+		t.Fatalf("Expected addresses unused by client A to move to client B")
+	}
+	if got := table.lookup(mac, later); got != b {
+		t.Fatalf("Expected MAC behind client B, got %p", got)
+	}
+
+	table.removeClient(b)
+	if !table.bindIP(ip, a, later) {
+		t.Fatalf("Expected IP of removed client to be free")
+	}
+}
+
+// TestFrameSourceIP tests IPv4 and ARP source address parsing
+func TestFrameSourceIP(t *testing.T) {
+	eth := func(etherType ...byte) []byte {
+		frame := make([]byte, 12, 64)
+		return append(frame, etherType...)
+	}
+
+	ipv4 := append(eth(0x08, 0x00), make([]byte, IPv4MinHeaderLen)...)
+	copy(ipv4[ethHeaderLen+IPv4SrcIPOffset:], []byte{10, 0, 0, 2})
+	if ip, ok := frameSourceIP(ipv4); !ok || ip != [4]byte{10, 0, 0, 2} {
+		t.Errorf("Unexpected IPv4 source %v (ok=%v)", ip, ok)
+	}
+
+	tagged := append(eth(0x81, 0x00, 0x00, 0x05, 0x08, 0x00), make([]byte, IPv4MinHeaderLen)...)
+	copy(tagged[ethHeaderLen+4+IPv4SrcIPOffset:], []byte{10, 0, 0, 3})
+	if ip, ok := frameSourceIP(tagged); !ok || ip != [4]byte{10, 0, 0, 3} {
+		t.Errorf("Unexpected VLAN tagged IPv4 source %v (ok=%v)", ip, ok)
+	}
+
+	arp := append(eth(0x08, 0x06), 0, 1, 0x08, 0x00, 6, 4, 0, 1)
+	arp = append(arp, 0x02, 0, 0, 0, 0, 0x0a, 10, 0, 0, 4)
+	if ip, ok := frameSourceIP(arp); !ok || ip != [4]byte{10, 0, 0, 4} {
+		t.Errorf("Unexpected ARP sender %v (ok=%v)", ip, ok)
+	}
+
+	if _, ok := frameSourceIP(ipv4[:ethHeaderLen+IPv4MinHeaderLen-1]); ok {
+		t.Errorf("Expected truncated IPv4 frame to be rejected")
+	}
+	if _, ok := frameSourceIP(eth(0x86, 0xdd)); ok {
+		t.Errorf("Expected IPv6 frame to have no IPv4 source")
+	}
+}
+
+// addrConn is a connection that only knows its remote address
+type addrConn struct {
+	faketcp.ConnAdapter
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.addr }
+
+// TestFloodFrameFullQueue tests that flooding drops a frame for a client
+// whose send queue is full instead of waiting, and still reaches the others
+func TestFloodFrameFullQueue(t *testing.T) {
+	newClient := func(port int) *ClientConnection {
+		return &ClientConnection{
+			conn:      addrConn{addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port}},
+			sendQueue: make(chan []byte, 1),
+			stopCh:    make(chan struct{}),
+		}
+	}
+	stalled, idle := newClient(1000), newClient(1001)
+	stalled.sendQueue <- []byte{0}
+	tun := &Tunnel{
+		config:     &config.Config{MTU: 1400},
+		allClients: map[*ClientConnection]struct{}{stalled: {}, idle: {}},
+	}
+
+	start := time.Now()
+	tun.floodFrame([]byte{1, 2, 3}, nil)
+	if elapsed := time.Since(start); elapsed >= QueueSendTimeout {
+		t.Errorf("Expected flooding not to wait for the full queue, took %v", elapsed)
+	}
+	if got := atomic.LoadUint64(&tun.fanoutDrops); got != 1 {
+		t.Errorf("Expected 1 dropped frame, got %d", got)
+	}
+	select {
+	case frame := <-idle.sendQueue:
+		if len(frame) != 3 || frame[0] != 1 {
+			t.Errorf("Expected the flooded frame, got %v", frame)
+		}
+	default:
+		t.Fatalf("Expected the idle client to receive the flooded frame")
+	}
+}
@@ -0,0 +1,103 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// Transports. rawtcp needs raw sockets (root or CAP_NET_RAW); udp carries the
+// fake TCP headers in UDP datagrams, tcp uses kernel TCP and ws/wss WebSocket
+// messages, none of them needs raw sockets. auto uses rawtcp where raw sockets
+// work and udp otherwise: an auto server listens on both, an auto client
+// falls back to udp when the raw handshake fails.
+const (
+	TransportRawTCP = "rawtcp"
+	TransportUDP    = "udp"
+	TransportTCP    = "tcp"
+	TransportWS     = "ws"
+	TransportWSS    = "wss"
+	TransportAuto   = "auto"
+)
+
+// transportModes returns the fake-TCP modes of a transport, preferred first
+func transportModes(transport string) ([]faketcp.Mode, error) {
+	switch transport {
+	case "", TransportRawTCP:
+		return []faketcp.Mode{faketcp.ModeRaw}, nil
+	case TransportUDP:
+		return []faketcp.Mode{faketcp.ModeUDP}, nil
+	case TransportTCP:
+		return []faketcp.Mode{faketcp.ModeTCP}, nil
+	case TransportWS:
+		return []faketcp.Mode{faketcp.ModeWS}, nil
+	case TransportWSS:
+		return []faketcp.Mode{faketcp.ModeWSS}, nil
+	case TransportAuto:
+		if err := faketcp.CheckRawSocketSupport(); err != nil {
+			log.Printf("⚠️  Raw sockets unavailable, using the udp transport: %v", err)
+			return []faketcp.Mode{faketcp.ModeUDP}, nil
+		}
+		return []faketcp.Mode{faketcp.ModeRaw, faketcp.ModeUDP}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q", transport)
+	}
+}
+
+// streamTransport reports whether a transport is a byte stream, which carries
+// packets of any size without segmenting them
+func streamTransport(transport string) bool {
+	return transport == TransportTCP || transport == TransportWS || transport == TransportWSS
+}
+
+// modes returns the transport modes of the tunnel, preferred first
+func (t *Tunnel) modes() []faketcp.Mode {
+	if len(t.transports) == 0 {
+		return []faketcp.Mode{faketcp.GetMode()}
+	}
+	return t.transports
+}
+
+// dial connects to addr with the first transport mode that succeeds
+func (t *Tunnel) dial(addr string, timeout time.Duration) (faketcp.ConnAdapter, error) {
+	var errs []error
+	for i, mode := range t.modes() {
+		conn, err := faketcp.DialWithMode(addr, timeout, mode)
+		if err == nil {
+			if i > 0 {
+				log.Printf("Fell back to %s", faketcp.ModeString(mode))
+			}
+			return conn, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %v", faketcp.ModeString(mode), err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// startFallbackListeners listens on the local address with the fallback
+// transport modes too, so clients that lack raw sockets can connect
+func (t *Tunnel) startFallbackListeners() error {
+	for _, mode := range t.modes()[1:] {
+		l, err := faketcp.ListenWithMode(t.config.LocalAddr, mode)
+		if err != nil {
+			t.closeExtraListeners()
+			return fmt.Errorf("failed to listen with %s: %v", faketcp.ModeString(mode), err)
+		}
+		log.Printf("Also accepting %s", faketcp.ModeString(mode))
+		t.extraListeners = append(t.extraListeners, l)
+	}
+	return nil
+}
+
+// closeExtraListeners closes the fallback and hop listeners
+func (t *Tunnel) closeExtraListeners() {
+	for _, l := range t.extraListeners {
+		if err := l.Close(); err != nil {
+			log.Printf("Error closing listener: %v", err)
+		}
+	}
+	t.extraListeners = nil
+}
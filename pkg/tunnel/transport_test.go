@@ -0,0 +1,70 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+func TestTransportModes(t *testing.T) {
+	for transport, want := range map[string]faketcp.Mode{
+		"":     faketcp.ModeRaw,
+		"udp":  faketcp.ModeUDP,
+		"tcp":  faketcp.ModeTCP,
+		"ws":   faketcp.ModeWS,
+		"wss":  faketcp.ModeWSS,
+		"auto": faketcp.ModeUDP, // Last resort whether or not raw sockets work
+	} {
+		modes, err := transportModes(transport)
+		if err != nil {
+			t.Fatalf("transportModes(%q): %v", transport, err)
+		}
+		if modes[len(modes)-1] != want {
+			t.Errorf("transportModes(%q) = %v", transport, modes)
+		}
+	}
+	if _, err := transportModes("quic"); err == nil {
+		t.Errorf("Unknown transport accepted")
+	}
+}
+
+// TestDialFallback tests that the client falls back to the next transport
+// when the preferred one cannot connect
+func TestDialFallback(t *testing.T) {
+	listener, err := faketcp.ListenWithMode("127.0.0.1:0", faketcp.ModeUDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan struct{})
+	defer func() {
+		listener.Close()
+		<-accepted
+	}()
+	go func() {
+		defer close(accepted)
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	// Nothing listens on the TCP port of the same number
+	tun := &Tunnel{
+		config:     &config.Config{},
+		transports: []faketcp.Mode{faketcp.ModeTCP, faketcp.ModeUDP},
+	}
+	conn, err := tun.dial(listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().Network() != "udp" {
+		t.Errorf("Connected over %s, want udp", conn.RemoteAddr().Network())
+	}
+
+	tun.transports = []faketcp.Mode{faketcp.ModeTCP}
+	if _, err := tun.dial(listener.Addr().String(), time.Second); err == nil {
+		t.Errorf("dial succeeded with no transport listening")
+	}
+}
@@ -14,8 +14,16 @@ const (
 	// TUN device constants (Linux)
 	TUNSETIFF       = 0x400454ca
 	IFF_TUN         = 0x0001
+	IFF_TAP         = 0x0002
 	IFF_NO_PI       = 0x1000
 	IFF_MULTI_QUEUE = 0x0100
+	IFF_VNET_HDR    = 0x4000
+
+	// TUN offload constants (Linux)
+	TUNSETOFFLOAD = 0x400454d0
+	TUN_F_CSUM    = 0x01 // Kernel may hand us packets with partial checksums
+	TUN_F_TSO4    = 0x02 // Kernel may hand us TCPv4 GSO super-packets
+	TUN_F_TSO6    = 0x04 // Kernel may hand us TCPv6 GSO super-packets
 
 	// macOS utun constants
 	AF_SYSTEM         = 32
@@ -37,6 +45,11 @@ type TunDevice struct {
 	fd     int
 	name   string
 	closed int32 // atomic flag to track if device is closed
+
+	// vnetHdr is set when the device was opened with IFF_VNET_HDR and
+	// offloads. Read then returns a virtio-net header before each packet, and
+	// Write adds an empty header to plain packets.
+	vnetHdr bool
 }
 
 // ifreq structure for ioctl calls (Linux)
@@ -70,8 +83,89 @@ func CreateTUN(name string) (*TunDevice, error) {
 	return createTUNLinux(name)
 }
 
+// CreateTAP creates a new TAP (Layer 2) device. TAP mode is only supported on Linux.
+func CreateTAP(name string) (*TunDevice, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("TAP mode is not supported on %s", runtime.GOOS)
+	}
+	return openLinuxDevice(name, IFF_TAP|IFF_NO_PI)
+}
+
+// CreateMultiQueue creates a TUN (or TAP) device with IFF_MULTI_QUEUE and
+// attaches the given number of queues to it. Each queue is an independent
+// file descriptor; the kernel steers every flow to a single queue, so per-flow
+// ordering is preserved. Multi-queue devices are only supported on Linux.
+func CreateMultiQueue(name string, tap bool, queues int) ([]*TunDevice, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("multi-queue TUN is not supported on %s", runtime.GOOS)
+	}
+	flags := uint16(IFF_TUN | IFF_NO_PI | IFF_MULTI_QUEUE)
+	if tap {
+		flags = IFF_TAP | IFF_NO_PI | IFF_MULTI_QUEUE
+	}
+
+	return openLinuxQueues(name, flags, queues)
+}
+
+// CreateTUNOffload creates a TUN device with virtio-net headers and enables
+// checksum and TCP segmentation offload, so the kernel hands over GSO
+// super-packets and accepts coalesced (GRO) packets. queues > 1 additionally
+// enables IFF_MULTI_QUEUE. Offloads are only supported on Linux.
+func CreateTUNOffload(name string, queues int) ([]*TunDevice, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("TUN offloads are not supported on %s", runtime.GOOS)
+	}
+	flags := uint16(IFF_TUN | IFF_NO_PI | IFF_VNET_HDR)
+	if queues > 1 {
+		flags |= IFF_MULTI_QUEUE
+	}
+
+	devs, err := openLinuxQueues(name, flags, queues)
+	if err != nil {
+		return nil, err
+	}
+	for _, dev := range devs {
+		dev.vnetHdr = true
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(dev.fd), uintptr(TUNSETOFFLOAD),
+			uintptr(TUN_F_CSUM|TUN_F_TSO4|TUN_F_TSO6))
+		if errno != 0 {
+			for _, d := range devs {
+				d.Close()
+			}
+			return nil, fmt.Errorf("failed to enable TUN offloads: %v", errno)
+		}
+	}
+	return devs, nil
+}
+
+// openLinuxQueues opens a device and attaches queues-1 additional queues to it.
+func openLinuxQueues(name string, flags uint16, queues int) ([]*TunDevice, error) {
+	first, err := openLinuxDevice(name, flags)
+	if err != nil {
+		return nil, err
+	}
+	devs := []*TunDevice{first}
+	for i := 1; i < queues; i++ {
+		// Attaching to the existing name adds another queue to the same interface
+		dev, err := openLinuxDevice(first.Name(), flags)
+		if err != nil {
+			for _, d := range devs {
+				d.Close()
+			}
+			return nil, fmt.Errorf("failed to attach queue %d: %v", i, err)
+		}
+		devs = append(devs, dev)
+	}
+	return devs, nil
+}
+
 // createTUNLinux creates a TUN device on Linux
 func createTUNLinux(name string) (*TunDevice, error) {
+	return openLinuxDevice(name, IFF_TUN|IFF_NO_PI)
+}
+
+// openLinuxDevice opens /dev/net/tun and attaches it to a TUN or TAP interface
+func openLinuxDevice(name string, flags uint16) (*TunDevice, error) {
 	// Open TUN device in blocking mode using syscall to avoid Go's runtime poller.
 	// Blocking I/O ensures packets are delivered immediately without the sleep-based
 	// polling overhead that would add per-packet latency.
@@ -83,7 +177,7 @@ func createTUNLinux(name string) (*TunDevice, error) {
 	// Prepare ifreq structure
 	var ifr ifreq
 	copy(ifr.Name[:], []byte(name))
-	ifr.Flags = IFF_TUN | IFF_NO_PI
+	ifr.Flags = flags
 
 	// Create TUN device using ioctl
 	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(TUNSETIFF), uintptr(unsafe.Pointer(&ifr)))
@@ -207,7 +301,8 @@ func createTUNmacOS(name string) (*TunDevice, error) {
 	}, nil
 }
 
-// Read reads a packet from the TUN device
+// Read reads a packet from the TUN device. On devices opened with offloads the
+// packet is preceded by a virtio-net header.
 func (t *TunDevice) Read(buf []byte) (int, error) {
 	// Check if device is already closed
 	if atomic.LoadInt32(&t.closed) != 0 {
@@ -257,6 +352,11 @@ func (t *TunDevice) Write(buf []byte) (int, error) {
 		return 0, syscall.EBADF
 	}
 
+	if t.vnetHdr {
+		var hdr [virtioNetHdrLen]byte
+		return t.WriteGSO(hdr[:], buf)
+	}
+
 	for {
 		n, err := syscall.Write(t.fd, buf)
 		if err == nil {
@@ -293,6 +393,42 @@ func (t *TunDevice) Write(buf []byte) (int, error) {
 	}
 }
 
+// WriteGSO writes a packet preceded by a virtio-net header using a single
+// writev call. It is only valid on devices opened with offloads. The returned
+// count excludes the header.
+func (t *TunDevice) WriteGSO(hdr, buf []byte) (int, error) {
+	if atomic.LoadInt32(&t.closed) != 0 {
+		return 0, syscall.EBADF
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	iov := [2]syscall.Iovec{{Base: &hdr[0]}, {Base: &buf[0]}}
+	iov[0].SetLen(len(hdr))
+	iov[1].SetLen(len(buf))
+	for {
+		n, _, errno := syscall.Syscall(syscall.SYS_WRITEV, uintptr(t.fd), uintptr(unsafe.Pointer(&iov[0])), uintptr(len(iov)))
+		if errno == 0 {
+			return int(n) - len(hdr), nil
+		}
+		if errno == syscall.EINTR {
+			if atomic.LoadInt32(&t.closed) != 0 {
+				return 0, syscall.EBADF
+			}
+			continue
+		}
+		if errno == syscall.EAGAIN {
+			if atomic.LoadInt32(&t.closed) != 0 {
+				return 0, syscall.EBADF
+			}
+			time.Sleep(tunPollInterval)
+			continue
+		}
+		return 0, errno
+	}
+}
+
 // Close closes the TUN device
 func (t *TunDevice) Close() error {
 	// Mark as closed atomically
@@ -41,6 +41,13 @@ const (
 	PacketTypeFECShard     = 0x09 // FEC encoded shard
 	PacketTypeAuth         = 0x0A // Authentication handshake packet
 	PacketTypeAuthResponse = 0x0B // Authentication response packet
+	PacketTypeBatch        = 0x0C // Several inner packets coalesced into one segment
+	PacketTypeFragment     = 0x0D // Fragment of an inner packet larger than the tunnel MTU
+	PacketTypePMTUProbe    = 0x0E // Padded path MTU probe
+	PacketTypePMTUAck      = 0x0F // Path MTU probe acknowledgement
+	PacketTypePadded       = 0x10 // Frame padded to hide its length, stripped after decryption
+	PacketTypeHop          = 0x11 // Client moves its session to a new connection (port hopping)
+	PacketTypeHopResponse  = 0x12 // Server's answer to a hop
 
 	// IPv4 constants
 	IPv4Version      = 4
@@ -112,6 +119,19 @@ type ClientConnection struct {
 	cipherGen    uint64
 	lastRecvTime time.Time // Last time we received a packet from this client
 	authenticated bool     // Whether this client has been authenticated (for encrypt_after_auth mode)
+	reassembler  *reassembler // Reassembles fragmented packets from this client
+	groBatch     [][]byte     // Packets waiting to be coalesced into the TUN device (offload mode)
+	groBytes     int          // Bytes in groBatch
+	groTimer     *time.Timer  // Writes groBatch once its first packet waited groFlushDelay
+	groMu        sync.Mutex   // Protects groBatch, groBytes and groTimer
+	txCrypto     *cryptoSequencer // Ordered encryption of frames to this client (crypto pipeline)
+	rxCrypto     *cryptoSequencer // Ordered decryption of frames from this client (crypto pipeline)
+	pmtu         *pmtuProber  // Path MTU prober towards this client
+	mtuRoute     string       // Host route carrying the path MTU to this client, if any
+	rxMu         sync.Mutex   // Serializes frames of the current and a draining connection
+	fecKey       string       // FEC session key, the first remote address (stable across hops)
+	readingConn  faketcp.ConnAdapter // Connection clientNetReader reads (protected by mu)
+	hoppedConn   faketcp.ConnAdapter // Connection hopped away from under clientNetReader, to drain (protected by mu)
 	mu           sync.RWMutex
 }
 
@@ -158,6 +178,54 @@ func (c *ClientConnection) getCipher() (*crypto.Cipher, uint64) {
 	return c.cipher, c.cipherGen
 }
 
+// currentConn returns the connection the client uses now, which changes
+// when it hops to another port
+func (c *ClientConnection) currentConn() faketcp.ConnAdapter {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.conn
+}
+
+// claimConn returns the current connection for the reader, and the one the
+// client hopped away from while the reader was on it, if any, to be drained
+func (c *ClientConnection) claimConn() (conn, hopped faketcp.ConnAdapter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hopped, c.hoppedConn = c.hoppedConn, nil
+	c.readingConn = c.conn
+	return c.conn, hopped
+}
+
+// serverConn returns the connection to the server (client mode), nil while
+// reconnecting
+func (t *Tunnel) serverConn() faketcp.ConnAdapter {
+	t.connMux.Lock()
+	defer t.connMux.Unlock()
+	return t.conn
+}
+
+// claimServerConn returns the server connection for netReader, and the one
+// the session hopped away from while netReader was on it, if any, to be
+// drained
+func (t *Tunnel) claimServerConn() (conn, hopped faketcp.ConnAdapter) {
+	t.connMux.Lock()
+	defer t.connMux.Unlock()
+	hopped, t.hoppedConn = t.hoppedConn, nil
+	t.readingConn = t.conn
+	return t.conn, hopped
+}
+
+// clearServerConn closes a failed server connection and clears it for
+// reconnecting, unless a hop or reconnect already replaced it
+func (t *Tunnel) clearServerConn(conn faketcp.ConnAdapter) {
+	t.connMux.Lock()
+	defer t.connMux.Unlock()
+	if t.conn == conn && conn != nil {
+		_ = conn.Close()
+		t.conn = nil
+	}
+}
+
 // Tunnel represents a lightweight tunnel
 type Tunnel struct {
 	config         *config.Config
@@ -172,12 +240,15 @@ type Tunnel struct {
 	configMux      sync.RWMutex
 	conn           faketcp.ConnAdapter          // Used in client mode (interface for both modes)
 	listener       faketcp.ListenerAdapter      // Used in server mode (interface for both modes)
+	extraListeners []faketcp.ListenerAdapter    // Fallback transport and hop range listeners (server mode)
+	transports     []faketcp.Mode               // Transport modes, preferred first
 	clients        map[string]*ClientConnection // Used in server mode (key: IP address)
 	clientsMux     sync.RWMutex
 	allClients     map[*ClientConnection]struct{} // Tracks all active clients (including those without registered tunnel IP)
 	allClientsMux  sync.RWMutex
 	tunName        string
 	tunFile        *TunDevice
+	tunQueues      []*TunDevice // All TUN queues; tunFile is the first (multi-queue mode)
 	stopCh         chan struct{}
 	stopOnce       sync.Once // Ensures Stop() is only executed once
 	wg             sync.WaitGroup
@@ -187,6 +258,24 @@ type Tunnel struct {
 	packetPool    *sync.Pool
 	packetBufSize int
 
+	// Fragmentation state
+	fragmentID  uint32       // Last fragment ID used for sending (atomic)
+	reassembler *reassembler // Reassembles fragmented packets from the server (client mode)
+
+	p2pReassemblersMu sync.Mutex
+	p2pReassemblers   map[string]*reassembler // Reassemble fragmented packets per P2P peer (client mode)
+
+	pmtu *pmtuProber // Path MTU prober towards the server (client mode)
+
+	macTable *macTable // Learned MAC address -> client mapping (server, TAP mode)
+
+	tunnelBroadcast net.IP           // Directed broadcast address of the tunnel subnet
+	mcastGroups     *multicastGroups // IGMP snooping state (server mode)
+
+	cryptoPool *cryptoPool      // Parallel crypto workers (nil when crypto runs inline)
+	txCrypto   *cryptoSequencer // Ordered encryption of frames to the server (client mode)
+	rxCrypto   *cryptoSequencer // Ordered decryption of frames from the server (client mode)
+
 	xdpAccel *xdp.Accelerator
 
 	// P2P and routing
@@ -197,6 +286,9 @@ type Tunnel struct {
 	publicAddr     string                // Public address as seen by server (for NAT traversal)
 	publicAddrMux  sync.RWMutex          // Protects publicAddr
 	connMux        sync.Mutex            // Protects t.conn during reconnects
+	readingConn    faketcp.ConnAdapter   // Connection netReader reads (protected by connMux)
+	hoppedConn     faketcp.ConnAdapter   // Connection hopped away from under netReader, to drain (protected by connMux)
+	rxMu           sync.Mutex            // Serializes frames of the current and a draining server connection
 
 	// Connection health tracking (client mode)
 	lastRecvTime time.Time  // Last time we received ANY packet from server
@@ -225,6 +317,11 @@ type Tunnel struct {
 	authenticated    bool              // Whether client is authenticated (client mode)
 	authMux          sync.Mutex        // Protects authenticated flag
 	authResponseChan chan error        // Channel for receiving auth response (client mode)
+	authReplay       authReplayCache   // Authentications accepted as first packet (server mode, probe resistance)
+
+	padStats paddingCounters // Padding and cover traffic overhead
+
+	fanoutDrops uint64 // Flooded/replicated frames dropped on full client queues
 }
 
 // prependPacketType adds a leading packet type byte to the payload.
@@ -246,10 +343,16 @@ func prependPacketType(packet []byte, packetType byte) ([]byte, bool) {
 	return newPacket, false
 }
 
+// isDataFrameType reports whether a frame type carries inner IP packets
+// (plain, batched or fragmented) rather than tunnel control messages.
+func isDataFrameType(packetType byte) bool {
+	return packetType == PacketTypeData || packetType == PacketTypeBatch || packetType == PacketTypeFragment
+}
+
 // getPacketBuffer pulls a reusable packet buffer sized for tunnel traffic.
 func (t *Tunnel) getPacketBuffer() []byte {
 	if t.packetPool == nil || t.packetBufSize == 0 {
-		return make([]byte, t.config.MTU+packetBufferSlack)
+		return make([]byte, t.tunMTU()+packetBufferSlack)
 	}
 	return t.packetPool.Get().([]byte)
 }
@@ -267,30 +370,75 @@ func (t *Tunnel) releasePacketBuffer(buf []byte) {
 
 // NewTunnel creates a new tunnel instance
 func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
-	// Force rawtcp mode - this is the only supported transport now
-	cfg.Transport = "rawtcp"
-	faketcp.SetMode(faketcp.ModeRaw)
-
-	// Check if raw socket is supported (requires root)
-	if err := faketcp.CheckRawSocketSupport(); err != nil {
-		if runtime.GOOS == "darwin" {
-			return nil, fmt.Errorf("⚠️  macOS 限制：Raw Socket 模式在 macOS 上可能无法发送 raw TCP 包\n"+
-				"这是 macOS 系统的安全限制，不是代码问题\n"+
-				"可能的解决方案：\n"+
-				"1. 在 Linux 服务器上运行（推荐）\n"+
-				"2. 使用虚拟机运行 Linux\n"+
-				"3. 检查 macOS 系统设置和权限\n"+
-				"错误详情: %v", err)
-		}
-		return nil, fmt.Errorf("Raw Socket模式需要root权限运行\n"+
-			"请使用以下命令运行: sudo ./lightweight-tunnel -m %s ...\n"+
-			"错误详情: %v", cfg.Mode, err)
+	modes, err := transportModes(cfg.Transport)
+	if err != nil {
+		return nil, err
+	}
+	faketcp.SetMode(modes[0])
+	if cfg.RSTFilter == "ebpf" {
+		faketcp.SetRSTFilter(faketcp.RSTFilterEBPF)
+	}
+	switch cfg.FirewallBackend {
+	case "iptables":
+		faketcp.SetFirewallBackend(faketcp.FirewallIPTables)
+	case "nftables":
+		faketcp.SetFirewallBackend(faketcp.FirewallNFTables)
+	}
+	if cfg.TCPProfile != "" {
+		if err := faketcp.SetProfile(cfg.TCPProfile); err != nil {
+			return nil, err
+		}
+	}
+	if err := faketcp.SetFraming(cfg.Framing, cfg.FramingHost); err != nil {
+		return nil, err
+	}
+	if err := faketcp.SetWebSocket(faketcp.WebSocketOptions{
+		Path:     cfg.WSPath,
+		Host:     cfg.WSHost,
+		Proxy:    cfg.WSProxy,
+		CertFile: cfg.WSCert,
+		KeyFile:  cfg.WSKey,
+		Insecure: cfg.WSInsecure,
+	}); err != nil {
+		return nil, err
+	}
+
+	// Check if raw socket is supported (requires root); auto checked already
+	if modes[0] == faketcp.ModeRaw && cfg.Transport != TransportAuto {
+		if err := faketcp.CheckRawSocketSupport(); err != nil {
+			if runtime.GOOS == "darwin" {
+				return nil, fmt.Errorf("⚠️  macOS 限制：Raw Socket 模式在 macOS 上可能无法发送 raw TCP 包\n"+
+					"这是 macOS 系统的安全限制，不是代码问题\n"+
+					"可能的解决方案：\n"+
+					"1. 在 Linux 服务器上运行（推荐）\n"+
+					"2. 使用虚拟机运行 Linux\n"+
+					"3. 检查 macOS 系统设置和权限\n"+
+					"错误详情: %v", err)
+			}
+			return nil, fmt.Errorf("Raw Socket模式需要root权限运行\n"+
+				"请使用以下命令运行: sudo ./lightweight-tunnel -m %s ...\n"+
+				"或使用无需 root 的传输: -transport udp、tcp 或 auto\n"+
+				"错误详情: %v", cfg.Mode, err)
+		}
+	}
+
+	// Remove drop-RST rules left behind by killed instances
+	if modes[0] == faketcp.ModeRaw {
+		if n, err := faketcp.CleanupRules(false); err != nil {
+			log.Printf("⚠️  清理残留防火墙规则失败: %v", err)
+		} else if n > 0 {
+			log.Printf("🧹 已清理 %d 条残留防火墙规则", n)
+		}
 	}
 
 	// Apply kernel-level optimizations (best effort)
 	applyKernelTunings(cfg.EnableKernelTune)
 
-	log.Printf("✅ 使用 Raw Socket 模式 (真正的TCP伪装，类似udp2raw)")
+	if modes[0] == faketcp.ModeRaw {
+		log.Printf("✅ 使用 Raw Socket 模式 (真正的TCP伪装，类似udp2raw)")
+	} else {
+		log.Printf("✅ 使用 %s 传输（无需 Raw Socket）", cfg.Transport)
+	}
 	log.Printf("✅ 性能优化：低延迟，高吞吐量")
 
 	// Auto-detect MTU if not specified or set to 0
@@ -351,11 +499,13 @@ func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
 		// plaintext_size = tunnel_packet_payload + 1 (packet type byte)
 		// Therefore: MTU + 1 + overhead <= 1400
 		// MTU <= 1400 - 1 - overhead
-		if cfg.Transport == "rawtcp" {
+		// The udp transport sends each packet in one datagram, which keeps it
+		// clear of IP fragmentation; the tcp and ws transports are byte streams.
+		if !streamTransport(cfg.Transport) {
 			const maxRawTCPSegment = 1400
 			const packetTypeOverhead = 1
 			encryptionOverhead := cipher.Overhead()
-			maxSafeMTU := maxRawTCPSegment - packetTypeOverhead - encryptionOverhead
+			maxSafeMTU := maxRawTCPSegment - packetTypeOverhead - encryptionOverhead - paddingOverhead(cfg.Padding)
 
 			if cfg.MTU > maxSafeMTU {
 				log.Printf("⚠️  Adjusting MTU from %d to %d to prevent TCP segmentation of encrypted packets", cfg.MTU, maxSafeMTU)
@@ -364,6 +514,18 @@ func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
 		}
 	}
 
+	// Framing records (fake TLS/HTTP) take room from every segment as well
+	if overhead := faketcp.FramingOverhead(); overhead > 0 && !streamTransport(cfg.Transport) {
+		maxFramedMTU := 1400 - 1 - overhead
+		if cipher != nil {
+			maxFramedMTU -= cipher.Overhead() + paddingOverhead(cfg.Padding)
+		}
+		if cfg.MTU > maxFramedMTU {
+			log.Printf("⚠️  Adjusting MTU from %d to %d to fit %s framing records into one segment", cfg.MTU, maxFramedMTU, cfg.Framing)
+			cfg.MTU = maxFramedMTU
+		}
+	}
+
 	// Create FEC encoder/decoder AFTER MTU adjustment
 	// This ensures FEC shard size accounts for encryption overhead
 	fecCodec, err := fec.NewFEC(cfg.FECDataShards, cfg.FECParityShards, cfg.MTU/cfg.FECDataShards)
@@ -371,7 +533,21 @@ func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
 		return nil, fmt.Errorf("failed to create FEC: %v", err)
 	}
 
-	packetBufSize := cfg.MTU + packetBufferSlack
+	// With fragmentation the TUN device carries packets larger than the tunnel MTU
+	if cfg.EnableFragmentation {
+		if cfg.TunMTU == 0 {
+			cfg.TunMTU = DefaultTunMTU
+		}
+		if cfg.TunMTU > cfg.MTU {
+			log.Printf("✅ 隧道分片已启用: TUN MTU %d, 隧道 MTU %d", cfg.TunMTU, cfg.MTU)
+		}
+	}
+
+	bufMTU := cfg.MTU
+	if cfg.EnableFragmentation && cfg.TunMTU > bufMTU {
+		bufMTU = cfg.TunMTU
+	}
+	packetBufSize := bufMTU + packetBufferSlack
 	if packetBufSize < packetBufferSlack {
 		packetBufSize = packetBufferSlack
 	}
@@ -389,6 +565,7 @@ func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
 		configFilePath:     configFilePath,
 		fec:                fecCodec,
 		cipher:             cipher,
+		transports:         modes,
 		stopCh:             make(chan struct{}),
 		myTunnelIP:         myIP,
 		packetBufSize:      packetBufSize,
@@ -399,6 +576,7 @@ func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
 		fecEnabled:         cfg.FECDataShards > 0 && cfg.FECParityShards > 0,
 		fecRecvSessions:    make(map[string]*fecRecvSession),
 		fecSessionID:       uint32(time.Now().UnixNano()),
+		tunnelBroadcast:    directedBroadcast(cfg.TunnelAddr),
 	}
 	t.packetPool = &sync.Pool{
 		New: func() any {
@@ -419,7 +597,8 @@ func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
 	}
 
 	// Initialize P2P manager if enabled
-	if cfg.P2PEnabled && cfg.Mode == "client" {
+	// P2P and mesh routing are keyed on IP addresses and are not used in TAP mode
+	if cfg.P2PEnabled && cfg.Mode == "client" && !t.isTAP() {
 		t.p2pManager = p2p.NewManager(cfg.P2PPort)
 		// Set configurable keepalive interval (defaults to 25 seconds for reduced network traffic)
 		keepaliveInterval := time.Duration(cfg.P2PKeepAliveInterval) * time.Second
@@ -435,6 +614,14 @@ func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
 		if cfg.EncryptAfterAuth && cfg.Key != "" {
 			t.authResponseChan = make(chan error, 1)
 		}
+		if cfg.EnableFragmentation {
+			t.reassembler = newReassembler(fragmentReassemblyTTL)
+			t.p2pReassemblers = make(map[string]*reassembler)
+		}
+		if cfg.EnablePMTUProbe {
+			t.pmtu = newPMTUProber(cfg.RemoteAddr, cfg.MTU, t.pmtuInterval(),
+				t.sendControlToServer, t.applyClientPathMTU, t.stopCh)
+		}
 		// Register server as a peer in the routing table so stats show the
 		// server route even when no other clients are present.
 		if t.routingTable != nil {
@@ -443,6 +630,12 @@ func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
 	} else {
 		// Server mode: multi-client support
 		t.clients = make(map[string]*ClientConnection)
+		if t.isTAP() {
+			t.macTable = newMACTable(macAgingTime)
+		}
+		if cfg.EnableMulticast && cfg.IGMPSnooping {
+			t.mcastGroups = newMulticastGroups(igmpMembershipInterval)
+		}
 		// Server also needs routing table for mesh routing
 		if cfg.EnableMeshRouting {
 			t.routingTable = routing.NewRoutingTable(cfg.MaxHops)
@@ -480,18 +673,23 @@ func parseTunnelIP(tunnelAddr string) (net.IP, error) {
 // Start starts the tunnel
 func (t *Tunnel) Start() error {
 	// Create TUN device
-	tunDev, err := t.createTUNWithFallback()
+	tunDevs, err := t.createTUNWithFallback()
 	if err != nil {
 		return fmt.Errorf("failed to create TUN device: %v", err)
 	}
-	t.tunFile = tunDev
-	t.tunName = tunDev.Name()
+	t.tunQueues = tunDevs
+	t.tunFile = tunDevs[0]
+	t.tunName = t.tunFile.Name()
 
-	log.Printf("Created TUN device: %s", t.tunName)
+	if t.isTAP() {
+		log.Printf("Created TAP device: %s", t.tunName)
+	} else {
+		log.Printf("Created TUN device: %s", t.tunName)
+	}
 
 	// Configure TUN device
 	if err := t.configureTUN(); err != nil {
-		t.tunFile.Close()
+		t.closeTUN()
 		return fmt.Errorf("failed to configure TUN: %v", err)
 	}
 
@@ -503,10 +701,12 @@ func (t *Tunnel) Start() error {
 		t.startFECCleanup()
 	}
 
+	t.startCryptoPipeline()
+
 	// Establish connection based on mode
 	if t.config.Mode == "client" {
 		if err := t.connectClient(); err != nil {
-			t.tunFile.Close()
+			t.closeTUN()
 			return fmt.Errorf("failed to connect as client: %v", err)
 		}
 
@@ -515,9 +715,13 @@ func (t *Tunnel) Start() error {
 			t.wg.Add(1)
 			go t.netReader()
 			netReaderStarted = true
-			if err := t.performClientAuthentication(); err != nil {
-				t.Stop()
-				return fmt.Errorf("failed to authenticate: %v", err)
+			// With probe resistance or port hopping the connection authenticated
+			// when it was opened
+			if !t.authFirst() {
+				if err := t.performClientAuthentication(); err != nil {
+					t.Stop()
+					return fmt.Errorf("failed to authenticate: %v", err)
+				}
 			}
 			log.Printf("✅ Authentication successful - data packets will not be encrypted")
 		}
@@ -525,7 +729,7 @@ func (t *Tunnel) Start() error {
 		// Start P2P manager if enabled
 		if t.config.P2PEnabled && t.p2pManager != nil {
 			if err := t.p2pManager.Start(); err != nil {
-				t.tunFile.Close()
+				t.closeTUN()
 				return fmt.Errorf("failed to start P2P manager: %v", err)
 			}
 
@@ -542,14 +746,13 @@ func (t *Tunnel) Start() error {
 		}
 
 		// Start client mode packet processing
+		t.startTUNReaders(t.tunReader)
 		if netReaderStarted {
-			t.wg.Add(3)
-			go t.tunReader()
+			t.wg.Add(2)
 			go t.tunWriter()
 			go t.netWriter()
 		} else {
-			t.wg.Add(4)
-			go t.tunReader()
+			t.wg.Add(3)
 			go t.tunWriter()
 			go t.netReader()
 			go t.netWriter()
@@ -559,6 +762,15 @@ func (t *Tunnel) Start() error {
 		t.wg.Add(1)
 		go t.keepalive()
 
+		// Start in-band path MTU probing
+		t.startServerPMTUProbe()
+
+		// Move the session to other server ports from time to time
+		if t.hopEnabled() {
+			t.wg.Add(1)
+			go t.hopLoop()
+		}
+
 		// Periodically announce routes to server
 		if len(t.getAdvertisedRoutes()) > 0 {
 			t.wg.Add(1)
@@ -567,7 +779,7 @@ func (t *Tunnel) Start() error {
 	} else {
 		// Server mode: start accepting clients
 		if err := t.startServer(); err != nil {
-			t.tunFile.Close()
+			t.closeTUN()
 			return fmt.Errorf("failed to start as server: %v", err)
 		}
 
@@ -576,6 +788,24 @@ func (t *Tunnel) Start() error {
 			t.wg.Add(1)
 			go t.configPushLoop()
 		}
+
+		// Age out learned MAC addresses in TAP mode
+		if t.macTable != nil {
+			t.wg.Add(1)
+			go t.macAgingLoop()
+		}
+
+		// Act as IGMP querier so snooped memberships stay fresh
+		if t.mcastGroups != nil {
+			t.wg.Add(1)
+			go t.igmpQuerierLoop()
+		}
+	}
+
+	// Report what padding and cover traffic cost
+	if paddingOverhead(t.config.Padding) > 0 || t.coverInterval() > 0 {
+		t.wg.Add(1)
+		go t.paddingStatsLoop()
 	}
 
 	log.Printf("Tunnel started in %s mode", t.config.Mode)
@@ -590,11 +820,7 @@ func (t *Tunnel) Stop() {
 		close(t.stopCh)
 
 		// Close TUN device FIRST - this will unblock Read/Write operations
-		if t.tunFile != nil {
-			if err := t.tunFile.Close(); err != nil {
-				log.Printf("Error closing TUN device: %v", err)
-			}
-		}
+		t.closeTUN()
 
 		// Close listener (server mode) - this will unblock Accept()
 		if t.listener != nil {
@@ -602,10 +828,11 @@ func (t *Tunnel) Stop() {
 				log.Printf("Error closing listener: %v", err)
 			}
 		}
+		t.closeExtraListeners()
 
 		// Close single connection (client mode) - this will unblock Read/Write
-		if t.conn != nil {
-			if err := t.conn.Close(); err != nil {
+		if conn := t.serverConn(); conn != nil {
+			if err := conn.Close(); err != nil {
 				log.Printf("Error closing connection: %v", err)
 			}
 		}
@@ -616,7 +843,7 @@ func (t *Tunnel) Stop() {
 			// Use stopOnce to safely close both connection and channel
 			client.stopOnce.Do(func() {
 				// Close connection first
-				if err := client.conn.Close(); err != nil {
+				if err := client.currentConn().Close(); err != nil {
 					log.Printf("Error closing client connection: %v", err)
 				}
 				// Then signal client goroutines to stop
@@ -629,7 +856,7 @@ func (t *Tunnel) Stop() {
 		t.allClientsMux.RLock()
 		for client := range t.allClients {
 			client.stopOnce.Do(func() {
-				if err := client.conn.Close(); err != nil {
+				if err := client.currentConn().Close(); err != nil {
 					log.Printf("Error closing client connection: %v", err)
 				}
 				close(client.stopCh)
@@ -712,11 +939,19 @@ func (t *Tunnel) removeClient(client *ClientConnection) {
 			delete(t.clients, ipStr)
 			log.Printf("Client unregistered: %s (remaining clients: %d)", ipStr, len(t.clients))
 		} else if exists {
-			log.Printf("Client %s no longer owns IP %s, skipping removal (already replaced)", client.conn.RemoteAddr(), ipStr)
+			log.Printf("Client %s no longer owns IP %s, skipping removal (already replaced)", client.currentConn().RemoteAddr(), ipStr)
 		}
 	}
 	t.clientsMux.Unlock()
 
+	if t.macTable != nil {
+		t.macTable.removeClient(client)
+	}
+	if t.mcastGroups != nil {
+		t.mcastGroups.removeClient(client)
+	}
+	t.clearServerPathMTU(client)
+
 	if clientIP != nil {
 		// Remove from routing table if mesh routing enabled (outside of lock)
 		if t.routingTable != nil {
@@ -761,7 +996,7 @@ func (t *Tunnel) broadcastPeerDisconnect(disconnectedIP net.IP) {
 			log.Printf("Failed to encrypt disconnect notification: %v", err)
 			continue
 		}
-		if err := client.conn.WritePacket(encryptedPacket); err != nil {
+		if err := client.currentConn().WritePacket(encryptedPacket); err != nil {
 			log.Printf("Failed to send disconnect notification to %s: %v", client.clientIP, err)
 		}
 	}
@@ -790,23 +1025,23 @@ func isSafeTunName(name string) bool {
 }
 
 // createTUNWithFallback tries to create the requested TUN name, falling back to auto assignment on conflict.
-func (t *Tunnel) createTUNWithFallback() (*TunDevice, error) {
+func (t *Tunnel) createTUNWithFallback() ([]*TunDevice, error) {
 	if t.config.TunName == "" {
-		return CreateTUN("")
+		return t.createDevice("")
 	}
 
 	if !isSafeTunName(t.config.TunName) {
 		log.Printf("Unsafe tun name %s, falling back to auto-generated name", t.config.TunName)
-		return CreateTUN("")
+		return t.createDevice("")
 	}
 
-	dev, err := CreateTUN(t.config.TunName)
+	devs, err := t.createDevice(t.config.TunName)
 	if err == nil {
-		return dev, nil
+		return devs, nil
 	}
 
 	log.Printf("Failed to create TUN %s (%v), falling back to auto-generated name", t.config.TunName, err)
-	return CreateTUN("")
+	return t.createDevice("")
 }
 
 // configureTUN configures the TUN device with IP address
@@ -840,12 +1075,13 @@ func (t *Tunnel) configureTUNLinux(ip, netmask string) error {
 	}
 
 	// Set MTU
-	cmd = exec.Command("ip", "link", "set", "dev", t.tunName, "mtu", fmt.Sprintf("%d", t.config.MTU))
+	deviceMTU := t.deviceMTUFor(t.tunMTU())
+	cmd = exec.Command("ip", "link", "set", "dev", t.tunName, "mtu", fmt.Sprintf("%d", deviceMTU))
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to set MTU: %v, output: %s", err, output)
 	}
 
-	log.Printf("Configured %s with IP %s/%s, MTU %d", t.tunName, ip, netmask, t.config.MTU)
+	log.Printf("Configured %s with IP %s/%s, MTU %d", t.tunName, ip, netmask, deviceMTU)
 	return nil
 }
 
@@ -931,12 +1167,12 @@ func (t *Tunnel) configureTUNmacOS(ip, netmask string) error {
 	}
 
 	// Set MTU
-	cmd = exec.Command("ifconfig", actualInterfaceName, "mtu", fmt.Sprintf("%d", t.config.MTU))
+	cmd = exec.Command("ifconfig", actualInterfaceName, "mtu", fmt.Sprintf("%d", t.tunMTU()))
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to set MTU: %v, output: %s", err, output)
 	}
 
-	log.Printf("Configured %s with IP %s/%s, MTU %d", actualInterfaceName, ip, netmask, t.config.MTU)
+	log.Printf("Configured %s with IP %s/%s, MTU %d", actualInterfaceName, ip, netmask, t.tunMTU())
 	return nil
 }
 
@@ -989,12 +1225,20 @@ func (t *Tunnel) connectClient() error {
 	mode := faketcp.GetMode()
 	log.Printf("Using %s for firewall bypass", faketcp.ModeString(mode))
 
-	conn, err := faketcp.DialWithMode(t.config.RemoteAddr, timeout, mode)
+	conn, err := t.dial(t.config.RemoteAddr, timeout)
 	if err != nil {
 		return err
 	}
+	if t.authFirst() {
+		if err := t.authenticateConn(conn); err != nil {
+			conn.Close()
+			return err
+		}
+	}
 
+	t.connMux.Lock()
 	t.conn = conn
+	t.connMux.Unlock()
 	log.Printf("Connected to server: %s -> %s", conn.LocalAddr(), conn.RemoteAddr())
 
 	return nil
@@ -1006,6 +1250,41 @@ type AuthenticationRequest struct {
 	TunnelIP  string `json:"tunnel_ip"` // Client's tunnel IP address
 }
 
+// buildAuthPacket builds an encrypted authentication request
+func (t *Tunnel) buildAuthPacket() ([]byte, error) {
+	return t.buildAuthRequest(PacketTypeAuth)
+}
+
+// buildAuthRequest builds an encrypted authentication request of the given
+// type: PacketTypeAuth, or PacketTypeHop to move the session to a new connection
+func (t *Tunnel) buildAuthRequest(packetType byte) ([]byte, error) {
+	authReq := AuthenticationRequest{
+		Timestamp: time.Now().Unix(),
+		TunnelIP:  t.myTunnelIP.String(),
+	}
+	authData, err := json.Marshal(authReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal auth request: %v", err)
+	}
+
+	authPacket := make([]byte, len(authData)+1)
+	authPacket[0] = packetType
+	copy(authPacket[1:], authData)
+
+	// Always encrypted for security
+	t.cipherMux.RLock()
+	cipher := t.cipher
+	t.cipherMux.RUnlock()
+	if cipher == nil {
+		return nil, fmt.Errorf("cipher not available for authentication")
+	}
+	encryptedAuth, err := cipher.Encrypt(authPacket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt auth packet: %v", err)
+	}
+	return encryptedAuth, nil
+}
+
 // performClientAuthentication performs the authentication handshake with server
 // Includes retry logic for improved reliability on high-latency or lossy networks
 func (t *Tunnel) performClientAuthentication() error {
@@ -1021,38 +1300,17 @@ func (t *Tunnel) performClientAuthentication() error {
 			time.Sleep(backoff)
 		}
 		
-		// Create authentication request
-		authReq := AuthenticationRequest{
-			Timestamp: time.Now().Unix(),
-			TunnelIP:  t.myTunnelIP.String(),
-		}
-		
-		// Marshal to JSON
-		authData, err := json.Marshal(authReq)
-		if err != nil {
-			return fmt.Errorf("failed to marshal auth request: %v", err)
-		}
-		
-		authPacket := make([]byte, len(authData)+1)
-		authPacket[0] = PacketTypeAuth
-		copy(authPacket[1:], authData)
-		
-		// Encrypt the authentication packet (always encrypted for security)
-		t.cipherMux.RLock()
-		cipher := t.cipher
-		t.cipherMux.RUnlock()
-		
-		if cipher == nil {
-			return fmt.Errorf("cipher not available for authentication")
-		}
-		
-		encryptedAuth, err := cipher.Encrypt(authPacket)
+		encryptedAuth, err := t.buildAuthPacket()
 		if err != nil {
-			return fmt.Errorf("failed to encrypt auth packet: %v", err)
+			return err
 		}
 		
 		// Send authentication packet
-		if err := t.conn.WritePacket(encryptedAuth); err != nil {
+		conn := t.serverConn()
+		if conn == nil {
+			return fmt.Errorf("not connected")
+		}
+		if err := conn.WritePacket(encryptedAuth); err != nil {
 			lastErr = fmt.Errorf("failed to send auth packet: %v", err)
 			log.Printf("⚠️  Authentication send failed: %v", lastErr)
 			continue
@@ -1130,11 +1388,17 @@ func (t *Tunnel) reconnectToServer() error {
 		}
 
 		log.Printf("Attempting to reconnect to server at %s (backoff %ds)", t.config.RemoteAddr, backoff)
-		mode := faketcp.GetMode()
-		conn, err := faketcp.DialWithMode(t.config.RemoteAddr, timeout, mode)
+		conn, err := t.dial(t.config.RemoteAddr, timeout)
+		if err == nil && t.authFirst() {
+			if err = t.authenticateConn(conn); err != nil {
+				conn.Close()
+			}
+		}
 		if err == nil {
 			t.conn = conn
 			log.Printf("Reconnected to server: %s -> %s", conn.LocalAddr(), conn.RemoteAddr())
+			// The new connection may take a different path
+			t.pmtu.trigger()
 			return nil
 		}
 
@@ -1164,13 +1428,26 @@ func (t *Tunnel) startServer() error {
 	// Store listener for later cleanup
 	t.listener = listener
 
-	// Start TUN reader for server mode
-	t.wg.Add(1)
-	go t.tunReaderServer()
+	// Accept clients without raw sockets and on the other ports they hop to
+	if err := t.startFallbackListeners(); err != nil {
+		listener.Close()
+		return err
+	}
+	if err := t.startHopListeners(); err != nil {
+		listener.Close()
+		return err
+	}
+
+	// Start TUN readers for server mode (one per queue)
+	t.startTUNReaders(t.tunReaderServer)
 
 	// Start accepting clients in a goroutine
 	t.wg.Add(1)
 	go t.acceptClients(listener)
+	for _, l := range t.extraListeners {
+		t.wg.Add(1)
+		go t.acceptClients(l)
+	}
 
 	if t.config.MultiClient {
 		log.Printf("Multi-client mode enabled (max: %d clients)", t.config.MaxClients)
@@ -1221,13 +1498,20 @@ func (t *Tunnel) acceptClients(listener faketcp.ListenerAdapter) {
 			continue
 		}
 
-		// Start handling this client
-		go t.handleClient(conn)
+		// Start handling this client, once it authenticated if probe
+		// resistance or port hopping is enabled
+		if t.authFirst() {
+			go t.admitClient(conn)
+		} else {
+			go t.handleClient(conn, nil)
+		}
 	}
 }
 
-// handleClient handles a single client connection
-func (t *Tunnel) handleClient(conn faketcp.ConnAdapter) {
+// handleClient handles a single client connection. auth is the
+// authentication the connection opened with, if it was admitted by probe
+// resistance.
+func (t *Tunnel) handleClient(conn faketcp.ConnAdapter, auth *firstAuth) {
 	log.Printf("Client connected: %s", conn.RemoteAddr())
 
 	client := &ClientConnection{
@@ -1235,15 +1519,33 @@ func (t *Tunnel) handleClient(conn faketcp.ConnAdapter) {
 		sendQueue: make(chan []byte, t.config.SendQueueSize),
 		recvQueue: make(chan []byte, t.config.RecvQueueSize),
 		stopCh:    make(chan struct{}),
+		fecKey:    conn.RemoteAddr().String(),
+	}
+	if t.config.EnableFragmentation {
+		client.reassembler = newReassembler(fragmentReassemblyTTL)
 	}
 
 	t.trackClientConnection(client)
 
+	// Answer the authentication before anything else is sent
+	if auth != nil {
+		if auth.cipher != nil {
+			client.setCipherWithGen(auth.cipher, auth.gen)
+		}
+		t.handleClientAuthentication(client, auth.payload)
+	}
+
+	if t.config.EnablePMTUProbe {
+		t.startClientPMTUProbe(client)
+	}
+
 	// Send client's public address for NAT traversal (if P2P enabled)
 	if t.config.P2PEnabled {
 		go t.sendPublicAddrToClient(client)
 	}
 
+	t.startClientCrypto(client)
+
 	// Start client goroutines
 	client.wg.Add(3)
 	go t.clientNetReader(client)
@@ -1256,18 +1558,33 @@ func (t *Tunnel) handleClient(conn faketcp.ConnAdapter) {
 	// Wait for client to disconnect
 	client.wg.Wait()
 
+	// Close the connection, which sends our FIN in raw socket mode (no-op if
+	// already closed). It is another one than conn if the client hopped.
+	conn = client.currentConn()
+	conn.Close()
+
 	t.untrackClientConnection(client)
 	// Clean up client
 	t.removeClient(client)
 	log.Printf("Client disconnected: %s", conn.RemoteAddr())
 }
 
-// tunReader reads packets from TUN device and queues them for sending (client mode)
-func (t *Tunnel) tunReader() {
+// tunReader reads packets from a TUN queue and queues them for sending (client mode)
+func (t *Tunnel) tunReader(dev *TunDevice) {
 	defer t.wg.Done()
 
 	// Use a fixed buffer to avoid allocations in the hot path
-	const maxPacketSize = 1500
+	maxPacketSize := 1500
+	if mtu := t.tunMTU() + 4; mtu > maxPacketSize {
+		// Room for the inner MTU plus the macOS protocol family header
+		maxPacketSize = mtu
+	}
+	var segBuf []byte
+	if dev.vnetHdr {
+		// Offloads: reads may return GSO super-packets of up to 64KB
+		maxPacketSize = virtioNetHdrLen + maxGSOSize
+		segBuf = make([]byte, maxGSOSize)
+	}
 	buf := make([]byte, maxPacketSize)
 
 	log.Printf("tunReader started (blocking mode)")
@@ -1283,7 +1600,7 @@ func (t *Tunnel) tunReader() {
 		// Read from TUN device (blocking mode on both Linux and macOS for consistency)
 		// Blocking mode ensures immediate packet delivery when data is available
 		// This prevents TUN buffer overflow which causes "No buffer space available" errors
-		n, err := t.tunFile.Read(buf)
+		n, err := dev.Read(buf)
 		if err != nil {
 			if errors.Is(err, syscall.EBADF) {
 				return
@@ -1337,75 +1654,115 @@ func (t *Tunnel) tunReader() {
 			}
 		}
 
-		// Skip packets that are too small or not IPv4
-		if n < IPv4MinHeaderLen {
-			if n+packetStart < 200 {
-				log.Printf("⚠️  Packet too small: %d bytes (min: %d)", n, IPv4MinHeaderLen)
+
+		// With offloads enabled the kernel may hand us a GSO super-packet;
+		// split it into MTU-sized segments first
+		if dev.vnetHdr {
+			if !t.splitOffloaded(buf[:n], segBuf, t.sendTUNPacket) {
+				return
 			}
 			continue
 		}
 
+		if !t.sendTUNPacket(buf[packetStart : packetStart+n]) {
+			return
+		}
+	}
+}
+
+// sendTUNPacket validates a packet read from the TUN device and queues it
+// for the server or a P2P peer (client mode). Returns false when the tunnel
+// is stopping.
+func (t *Tunnel) sendTUNPacket(data []byte) bool {
+	mtu := t.pathMTU(t.pmtu)
+	if t.isTAP() {
+		// Ethernet frames are forwarded as-is, whatever the EtherType
+		if len(data) < ethHeaderLen {
+			return true
+		}
+	} else {
+		// Skip packets that are too small or not IPv4
+		if len(data) < IPv4MinHeaderLen {
+			if len(data) < 200 {
+				log.Printf("⚠️  Packet too small: %d bytes (min: %d)", len(data), IPv4MinHeaderLen)
+			}
+			return true
+		}
+
+		// Answer oversized DF packets with ICMP instead of forwarding them
+		if t.replyPacketTooBig(data, mtu) {
+			return true
+		}
+
 		// Check if packet is IPv4 (skip non-IPv4 packets like IPv6)
-		version := buf[packetStart] >> 4
+		version := data[0] >> 4
 		if version != IPv4Version {
-			if n+packetStart < 200 {
-				log.Printf("⚠️  Not IPv4 packet: version=%d (first byte: 0x%02x)", version, buf[packetStart])
+			if len(data) < 200 {
+				log.Printf("⚠️  Not IPv4 packet: version=%d (first byte: 0x%02x)", version, data[0])
 			}
-			continue
+			return true
 		}
+	}
 
-		// Copy packet to a buffer from pool (we can't reuse buf as it may be overwritten)
-		// Skip the protocol family header if present (macOS)
-		packetBuf := t.getPacketBuffer()
-		packet := packetBuf[:n]
-		copy(packet, buf[packetStart:packetStart+n])
+	// Copy packet to a buffer from pool (we can't reuse the read buffer as it may be overwritten)
+	packetBuf := t.getPacketBuffer()
+	packet := packetBuf[:len(data)]
+	copy(packet, data)
+	t.clampMSS(packet, mtu)
 
-		// Use intelligent routing if P2P is enabled
-		if t.config.P2PEnabled && t.routingTable != nil {
-			queued, err := t.sendPacketWithRouting(packet)
-			if !queued {
-				t.releasePacketBuffer(packetBuf)
-			}
-			if err != nil {
-				log.Printf("Failed to send packet: %v", err)
-			}
-		} else {
-			// Default: queue for server
-			// Use immediate drop if queue is full to prevent blocking TUN read
-			// This is critical on macOS to prevent TUN buffer overflow
+	// Use intelligent routing if P2P is enabled
+	if t.config.P2PEnabled && t.routingTable != nil {
+		queued, err := t.sendPacketWithRouting(packet)
+		if !queued {
+			t.releasePacketBuffer(packetBuf)
+		}
+		if err != nil {
+			log.Printf("Failed to send packet: %v", err)
+		}
+	} else {
+		// Default: queue for server
+		// Use immediate drop if queue is full to prevent blocking TUN read
+		// This is critical on macOS to prevent TUN buffer overflow
+		select {
+		case t.sendQueue <- packet:
+			// Successfully queued - packet will be sent by netWriter
+		case <-t.stopCh:
+			t.releasePacketBuffer(packetBuf)
+			return false
+		case <-time.After(QueueSendTimeout):
+			// Wait for queue space before dropping
+			// This handles temporary bursts without immediately dropping packets
+			queueSize := len(t.sendQueue)
 			select {
 			case t.sendQueue <- packet:
-				// Successfully queued - packet will be sent by netWriter
+				// Successfully queued after waiting
 			case <-t.stopCh:
 				t.releasePacketBuffer(packetBuf)
-				return
-			case <-time.After(QueueSendTimeout):
-				// Wait for queue space before dropping
-				// This handles temporary bursts without immediately dropping packets
-				queueSize := len(t.sendQueue)
-				select {
-				case t.sendQueue <- packet:
-					// Successfully queued after waiting
-				case <-t.stopCh:
-					t.releasePacketBuffer(packetBuf)
-					return
-				default:
-					// Queue is still full after timeout, drop to prevent TUN buffer overflow
-					t.releasePacketBuffer(packetBuf)
-					// Only log occasionally to avoid log spam
-					if queueSize > 0 && queueSize%500 == 0 {
-						log.Printf("⚠️  Send queue full (size: %d), dropping packets to prevent TUN buffer overflow", queueSize)
-					}
+				return false
+			default:
+				// Queue is still full after timeout, drop to prevent TUN buffer overflow
+				t.releasePacketBuffer(packetBuf)
+				// Only log occasionally to avoid log spam
+				if queueSize > 0 && queueSize%500 == 0 {
+					log.Printf("⚠️  Send queue full (size: %d), dropping packets to prevent TUN buffer overflow", queueSize)
 				}
 			}
 		}
 	}
+	return true
 }
 
-// tunReaderServer reads packets from TUN device and routes them to clients (server mode)
-func (t *Tunnel) tunReaderServer() {
+// tunReaderServer reads packets from a TUN queue and routes them to clients (server mode)
+func (t *Tunnel) tunReaderServer(dev *TunDevice) {
 	defer t.wg.Done()
 
+	var offBuf, segBuf []byte
+	if dev.vnetHdr {
+		// Offloads: reads may return GSO super-packets of up to 64KB
+		offBuf = make([]byte, virtioNetHdrLen+maxGSOSize)
+		segBuf = make([]byte, maxGSOSize)
+	}
+
 	for {
 		select {
 		case <-t.stopCh:
@@ -1413,10 +1770,28 @@ func (t *Tunnel) tunReaderServer() {
 		default:
 		}
 
+		if dev.vnetHdr {
+			n, err := dev.Read(offBuf)
+			if err != nil {
+				select {
+				case <-t.stopCh:
+				default:
+					if !errors.Is(err, syscall.EBADF) {
+						log.Printf("TUN read error: %v", err)
+					}
+				}
+				return
+			}
+			if !t.splitOffloaded(offBuf[:n], segBuf, t.routeTUNSegment) {
+				return
+			}
+			continue
+		}
+
 		buf := t.getPacketBuffer()
 		// Leave one byte headroom so prependPacketType can reuse the buffer without reallocating.
 		readBuf := buf[:t.packetBufSize-1]
-		n, err := t.tunFile.Read(readBuf)
+		n, err := dev.Read(readBuf)
 		if err != nil {
 			if errors.Is(err, syscall.EBADF) {
 				t.releasePacketBuffer(buf)
@@ -1445,116 +1820,171 @@ func (t *Tunnel) tunReaderServer() {
 			}
 		}
 
-		if n < IPv4MinHeaderLen {
-			t.releasePacketBuffer(buf)
-			continue
+		if !t.routeTUNPacket(buf, readBuf[packetStart:packetStart+n]) {
+			return
 		}
+	}
+}
+
+// routeTUNSegment copies a segment split from a GSO super-packet into a pooled
+// buffer and routes it (server mode).
+func (t *Tunnel) routeTUNSegment(data []byte) bool {
+	buf := t.getPacketBuffer()
+	if len(data) >= len(buf) {
+		t.releasePacketBuffer(buf)
+		return true
+	}
+	packet := buf[:len(data)]
+	copy(packet, data)
+	return t.routeTUNPacket(buf, packet)
+}
+
+// routeTUNPacket routes a packet read from the TUN device to the client owning
+// its destination (server mode). buf is the pooled buffer backing packet and is
+// either queued or released. Returns false when the tunnel is stopping.
+func (t *Tunnel) routeTUNPacket(buf, packet []byte) bool {
+	// TAP mode: forward by destination MAC instead of destination IP
+	if t.macTable != nil {
+		t.forwardFrameFromTAP(packet)
+		t.releasePacketBuffer(buf)
+		return true
+	}
+
+	if len(packet) < IPv4MinHeaderLen {
+		t.releasePacketBuffer(buf)
+		return true
+	}
+
+	// Parse destination IP from packet (IPv4)
+	// IP header: version(4 bits) + IHL(4 bits) + ... + dst IP (4 bytes starting at offset 16 for IPv4)
+	if packet[0]>>4 != IPv4Version {
+		// Not IPv4, skip
+		t.releasePacketBuffer(buf)
+		return true
+	}
+
+	dstIP := net.IP(packet[IPv4DstIPOffset : IPv4DstIPOffset+4])
+
+	// Extract source IP for logging
+	srcIP := net.IP(packet[IPv4SrcIPOffset : IPv4SrcIPOffset+4])
+	protocol := packet[9] // Protocol field in IP header
 
-		packet := readBuf[packetStart : packetStart+n]
+	// Replicate multicast and broadcast to the clients instead of a single destination
+	if t.config.EnableMulticast && t.isMulticastOrBroadcast(dstIP) {
+		t.replicateToClients(packet, dstIP, nil)
+		t.releasePacketBuffer(buf)
+		return true
+	}
 
-		// Parse destination IP from packet (IPv4)
-		// IP header: version(4 bits) + IHL(4 bits) + ... + dst IP (4 bytes starting at offset 16 for IPv4)
-		if packet[0]>>4 != IPv4Version {
-			// Not IPv4, skip
+	// Answer oversized DF packets with ICMP and clamp SYN MSS to the client's path
+	if t.config.ICMPFeedback || t.config.MSSClamp {
+		mtu := t.clientPathMTU(dstIP)
+		if t.replyPacketTooBig(packet, mtu) {
 			t.releasePacketBuffer(buf)
-			continue
+			return true
 		}
+		t.clampMSS(packet, mtu)
+	}
 
-		dstIP := net.IP(packet[IPv4DstIPOffset : IPv4DstIPOffset+4])
-
-		// Extract source IP for logging
-		srcIP := net.IP(packet[IPv4SrcIPOffset : IPv4SrcIPOffset+4])
-		protocol := packet[9] // Protocol field in IP header
+	// Check if packet is destined for server itself
+	// NOTE: This should rarely/never happen because packets destined for the server
+	// come from client connections (via clientNetReader), not from the server's own TUN device.
+	// Packets read from TUN are generated BY the server's OS going TO clients.
+	// However, we keep this check for defensive programming.
+	if dstIP.Equal(t.myTunnelIP) {
+		log.Printf("WARNING: Unexpected packet from TUN destined for server itself (dstIP=%s). This might indicate a routing loop.", dstIP)
+		// Drop the packet to prevent infinite loop
+		t.releasePacketBuffer(buf)
+		return true
+	}
 
-		// Check if packet is destined for server itself
-		// NOTE: This should rarely/never happen because packets destined for the server
-		// come from client connections (via clientNetReader), not from the server's own TUN device.
-		// Packets read from TUN are generated BY the server's OS going TO clients.
-		// However, we keep this check for defensive programming.
-		if dstIP.Equal(t.myTunnelIP) {
-			log.Printf("WARNING: Unexpected packet from TUN destined for server itself (dstIP=%s). This might indicate a routing loop.", dstIP)
-			// Drop the packet to prevent infinite loop
+	// Enforce client isolation: if enabled, block forwarding between clients
+	// This prevents packets from being forwarded from TUN back to clients
+	// even if kernel routing would normally route them
+	if t.config.ClientIsolation {
+		// Check if destination is a registered client
+		if t.getClientByIP(dstIP) != nil {
+			// Drop packet - client isolation prevents client-to-client communication
+			log.Printf("Client isolation: dropping packet to client %s from TUN (likely kernel route)", dstIP)
 			t.releasePacketBuffer(buf)
-			continue
+			return true
 		}
+	}
 
-		// Enforce client isolation: if enabled, block forwarding between clients
-		// This prevents packets from being forwarded from TUN back to clients
-		// even if kernel routing would normally route them
-		if t.config.ClientIsolation {
-			// Check if destination is a registered client
-			if t.getClientByIP(dstIP) != nil {
-				// Drop packet - client isolation prevents client-to-client communication
-				log.Printf("Client isolation: dropping packet to client %s from TUN (likely kernel route)", dstIP)
+	// Find the client with this destination IP
+	client := t.getClientByIP(dstIP)
+	if client != nil {
+		select {
+		case client.sendQueue <- packet:
+			// Successfully queued
+		case <-t.stopCh:
+			t.releasePacketBuffer(buf)
+			return false
+		case <-time.After(QueueSendTimeout):
+			// Wait for queue space before logging and dropping
+			select {
+			case client.sendQueue <- packet:
+			case <-t.stopCh:
+				t.releasePacketBuffer(buf)
+				return false
+			default:
+				log.Printf("⚠️  Client send queue full for %s after timeout, dropping packet (client: %s)", dstIP, client.clientIP)
 				t.releasePacketBuffer(buf)
-				continue
 			}
 		}
-
-		// Find the client with this destination IP
-		client := t.getClientByIP(dstIP)
-		if client != nil {
+	} else {
+		// Try advertised routes
+		if routeClient := t.findRouteClient(dstIP); routeClient != nil {
 			select {
-			case client.sendQueue <- packet:
+			case routeClient.sendQueue <- packet:
 				// Successfully queued
 			case <-t.stopCh:
 				t.releasePacketBuffer(buf)
-				return
+				return false
 			case <-time.After(QueueSendTimeout):
-				// Wait for queue space before logging and dropping
 				select {
-				case client.sendQueue <- packet:
+				case routeClient.sendQueue <- packet:
 				case <-t.stopCh:
 					t.releasePacketBuffer(buf)
-					return
+					return false
 				default:
-					log.Printf("⚠️  Client send queue full for %s after timeout, dropping packet (client: %s)", dstIP, client.clientIP)
+					log.Printf("⚠️  Route client queue full for %s after timeout, dropping packet", dstIP)
 					t.releasePacketBuffer(buf)
 				}
 			}
 		} else {
-			// Try advertised routes
-			if routeClient := t.findRouteClient(dstIP); routeClient != nil {
-				select {
-				case routeClient.sendQueue <- packet:
-					// Successfully queued
-				case <-t.stopCh:
-					t.releasePacketBuffer(buf)
-					return
-				case <-time.After(QueueSendTimeout):
-					select {
-					case routeClient.sendQueue <- packet:
-					case <-t.stopCh:
-						t.releasePacketBuffer(buf)
-						return
-					default:
-						log.Printf("⚠️  Route client queue full for %s after timeout, dropping packet", dstIP)
-						t.releasePacketBuffer(buf)
-					}
-				}
-			} else {
-				// No client found - this is expected for packets to server itself or external destinations
-				// But log for debugging to see if responses are being dropped
-				// Always log ICMP packets as they are likely responses that should be forwarded
-				if len(packet) < 200 || protocol == 1 {
-					log.Printf("⚠️  Server TUN packet to %s: no client found (src=%s, protocol=%d, may be server itself or external)", dstIP, srcIP, protocol)
-				}
-				t.releasePacketBuffer(buf)
+			// No client found - this is expected for packets to server itself or external destinations
+			// But log for debugging to see if responses are being dropped
+			// Always log ICMP packets as they are likely responses that should be forwarded
+			if len(packet) < 200 || protocol == 1 {
+				log.Printf("⚠️  Server TUN packet to %s: no client found (src=%s, protocol=%d, may be server itself or external)", dstIP, srcIP, protocol)
 			}
+			t.releasePacketBuffer(buf)
 		}
-		// If no client found, packet is dropped
 	}
+	// If no client found, packet is dropped
+	return true
 }
 
 // tunWriter writes packets from receive queue to TUN device
 func (t *Tunnel) tunWriter() {
 	defer t.wg.Done()
 
+	var groBatch [][]byte
 	for {
 		select {
 		case <-t.stopCh:
 			return
 		case packet := <-t.recvQueue:
+			if t.tunFile.vnetHdr {
+				var ok bool
+				if groBatch, ok = t.tunWriteGRO(packet, groBatch[:0]); !ok {
+					return
+				}
+				continue
+			}
+			t.clampMSS(packet, t.pathMTU(t.pmtu))
+
 			// Write to TUN device - the Write method handles ENOBUFS retries internally
 			// Extract protocol for better logging
 			protocol := byte(0)
@@ -1583,8 +2013,9 @@ func (t *Tunnel) tunWriter() {
 			maxRetries := 5
 			retryDelay := 1 * time.Millisecond
 			var err error
+			dev := t.tunQueueFor(packet)
 			for retry := 0; retry < maxRetries; retry++ {
-				_, err = t.tunFile.Write(writePacket)
+				_, err = dev.Write(writePacket)
 				if err == nil {
 					if protocol == 1 && retry > 0 {
 						log.Printf("✅ Successfully wrote ICMP packet to TUN after %d retries", retry)
@@ -1696,7 +2127,7 @@ func (t *Tunnel) netReader() {
 		}
 
 		// Ensure we have a live connection
-		if t.conn == nil {
+		if t.serverConn() == nil {
 			if err := t.reconnectToServer(); err != nil {
 				// Only return if tunnel is explicitly stopping
 				// reconnectToServer only returns error when stopCh is closed
@@ -1708,8 +2139,22 @@ func (t *Tunnel) netReader() {
 			t.lastRecvMux.Unlock()
 		}
 
-		packet, err := t.conn.ReadPacket()
-		if err != nil {
+		conn, hopped := t.claimServerConn()
+		if hopped != nil {
+			// The session hopped: drain the old connection on the side and
+			// read the new one from now on
+			t.drainHopped(hopped, &t.wg, t.receiveFromServer)
+		}
+		if conn == nil {
+			continue
+		}
+		packet, err := conn.ReadPacket()
+		if current := t.serverConn(); current != conn && current != nil {
+			// The session hopped; the next claim hands conn to a drain reader
+			if err != nil {
+				continue
+			}
+		} else if err != nil {
 			// Check if it's a timeout - if so, continue to allow checking stopCh and idle timeout
 			// Don't treat timeout as fatal - keepalive should prevent idle timeout
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
@@ -1732,12 +2177,7 @@ func (t *Tunnel) netReader() {
 			}
 
 			// Close and clear current connection, then attempt reconnect
-			t.connMux.Lock()
-			if t.conn != nil {
-				_ = t.conn.Close()
-				t.conn = nil
-			}
-			t.connMux.Unlock()
+			t.clearServerConn(conn)
 
 			// Keep trying to reconnect - only exits if tunnel is stopping
 			if err := t.reconnectToServer(); err != nil {
@@ -1745,8 +2185,9 @@ func (t *Tunnel) netReader() {
 				return
 			}
 			
-			// Re-authenticate if in encrypt_after_auth mode
-			if t.config.EncryptAfterAuth && t.cipher != nil {
+			// Re-authenticate if in encrypt_after_auth mode (already done
+			// when reconnecting with probe resistance or port hopping)
+			if t.config.EncryptAfterAuth && t.cipher != nil && !t.authFirst() {
 				t.authMux.Lock()
 				t.authenticated = false
 				t.authMux.Unlock()
@@ -1782,293 +2223,453 @@ func (t *Tunnel) netReader() {
 		if len(packet) < 1 {
 			continue
 		}
+		if !t.receiveFromServer(packet) {
+			return
+		}
+	}
+}
 
-		// Update last receive time for any packet received
-		t.lastRecvMux.Lock()
-		t.lastRecvTime = time.Now()
-		t.lastRecvMux.Unlock()
+// receiveFromServer handles a frame read from the server connection.
+// Returns false when the tunnel is stopping. After a hop the old connection
+// is drained by a second reader, so frames are handled one at a time.
+func (t *Tunnel) receiveFromServer(packet []byte) bool {
+	t.rxMu.Lock()
+	defer t.rxMu.Unlock()
 
-		// Check if this is an FEC shard (before decryption)
-		// FEC shards are NOT encrypted themselves - they contain pieces of encrypted data
-		if len(packet) > 0 && packet[0] == PacketTypeFECShard {
-			if t.fecEnabled {
-				reconstructedPacket, err := t.processFECShard(t.config.RemoteAddr, packet[1:])
+	// Update last receive time for any packet received
+	t.lastRecvMux.Lock()
+	t.lastRecvTime = time.Now()
+	t.lastRecvMux.Unlock()
+
+	// Check if this is an FEC shard (before decryption)
+	// FEC shards are NOT encrypted themselves - they contain pieces of encrypted data
+	if len(packet) > 0 && packet[0] == PacketTypeFECShard {
+		if t.fecEnabled {
+			reconstructedPacket, err := t.processFECShard(t.config.RemoteAddr, packet[1:])
+			if err != nil {
+				log.Printf("FEC shard processing error: %v", err)
+				return true
+			}
+			
+			if reconstructedPacket != nil && t.rxCrypto != nil {
+				return t.rxCrypto.submit(reconstructedPacket, nil)
+			}
+			if reconstructedPacket != nil {
+				// Successfully reconstructed encrypted packet
+				// Now decrypt it
+				decryptedPacket, err := t.decryptPacket(reconstructedPacket)
 				if err != nil {
-					log.Printf("FEC shard processing error: %v", err)
-					continue
+					log.Printf("FEC reconstructed packet decryption error: %v", err)
+					return true
 				}
 				
-				if reconstructedPacket != nil {
-					// Successfully reconstructed encrypted packet
-					// Now decrypt it
-					decryptedPacket, err := t.decryptPacket(reconstructedPacket)
-					if err != nil {
-						log.Printf("FEC reconstructed packet decryption error: %v", err)
-						continue
+				if len(decryptedPacket) < 1 {
+					return true
+				}
+				
+				// Process the decrypted packet
+				packetType := decryptedPacket[0]
+				payload := decryptedPacket[1:]
+				
+				if packetType == PacketTypeData {
+					// Queue for TUN device
+					if !enqueueWithTimeout(t.recvQueue, payload, t.stopCh) {
+						select {
+						case <-t.stopCh:
+							return false
+						default:
+							log.Printf("Receive queue full after timeout, dropping FEC reconstructed packet")
+						}
 					}
-					
-					if len(decryptedPacket) < 1 {
-						continue
+				} else if packetType == PacketTypeBatch {
+					packets, err := splitBatch(payload)
+					if err != nil {
+						log.Printf("⚠️  Invalid FEC reconstructed batch: %v", err)
+						return true
 					}
-					
-					// Process the decrypted packet
-					packetType := decryptedPacket[0]
-					payload := decryptedPacket[1:]
-					
-					if packetType == PacketTypeData {
-						// Queue for TUN device
-						if !enqueueWithTimeout(t.recvQueue, payload, t.stopCh) {
-							select {
-							case <-t.stopCh:
-								return
-							default:
-								log.Printf("Receive queue full after timeout, dropping FEC reconstructed packet")
-							}
+					for _, p := range packets {
+						if !t.deliverFromServer(p) {
+							return false
 						}
 					}
+				} else if packetType == PacketTypeFragment {
+					if !t.deliverFragmentFromServer(payload) {
+						return false
+					}
 				}
-				// If reconstructedPacket is nil, we need more shards
 			}
-			continue
+			// If reconstructedPacket is nil, we need more shards
 		}
+		return true
+	}
 
-		// Decrypt if cipher is available (for non-FEC packets)
-		// Note: decryptPacket handles both encrypted and unencrypted packets
-		decryptedPacket, err := t.decryptPacket(packet)
-		if err != nil {
-			// Log decryption errors with more detail
-			firstBytesLen := 16
-			if len(packet) < firstBytesLen {
-				firstBytesLen = len(packet)
-			}
-			log.Printf("❌ Decryption error: %v (packet len: %d, first bytes: %x)", err, len(packet), packet[:firstBytesLen])
-			continue
-		}
+	// Decrypt if cipher is available (for non-FEC packets)
+	// Note: decryptPacket handles both encrypted and unencrypted packets
+	if t.rxCrypto != nil {
+		return t.rxCrypto.submit(packet, nil)
+	}
+	decryptedPacket, err := t.decryptPacket(packet)
+	if err != nil {
+		logDecryptionError(err, packet)
+		return true
+	}
+	return t.handleServerPacket(decryptedPacket)
+}
 
-		if len(decryptedPacket) < 1 {
-			log.Printf("⚠️  Decrypted packet too small: %d bytes", len(decryptedPacket))
-			continue
-		}
+// logDecryptionError logs a frame from the server that failed to decrypt.
+func logDecryptionError(err error, packet []byte) {
+	// Log decryption errors with more detail
+	firstBytesLen := 16
+	if len(packet) < firstBytesLen {
+		firstBytesLen = len(packet)
+	}
+	log.Printf("❌ Decryption error: %v (packet len: %d, first bytes: %x)", err, len(packet), packet[:firstBytesLen])
+}
 
-		// Check packet type
-		packetType := decryptedPacket[0]
-		payload := decryptedPacket[1:]
+// handleServerPacket processes one decrypted packet received from the server.
+// Returns false when the tunnel is stopping.
+func (t *Tunnel) handleServerPacket(decryptedPacket []byte) bool {
+	if len(decryptedPacket) < 1 {
+		log.Printf("⚠️  Decrypted packet too small: %d bytes", len(decryptedPacket))
+		return true
+	}
 
-		switch packetType {
-		case PacketTypeData:
-			// Queue for TUN device
-			// Extract protocol for better logging
-			protocol := byte(0)
-			var srcIPStr, dstIPStr string
-			if len(payload) >= 10 {
-				protocol = payload[9]
-				if len(payload) >= IPv4DstIPOffset+4 {
-					srcIP := net.IP(payload[IPv4SrcIPOffset : IPv4SrcIPOffset+4])
-					dstIP := net.IP(payload[IPv4DstIPOffset : IPv4DstIPOffset+4])
-					srcIPStr = srcIP.String()
-					dstIPStr = dstIP.String()
-				}
-			}
+	// Check packet type
+	packetType := decryptedPacket[0]
+	payload := decryptedPacket[1:]
 
-			// Log ICMP packets and small packets to verify flow
-			if protocol == 1 {
-				log.Printf("✅ Received ICMP packet from server: %d bytes, %s -> %s (queue size: %d)", len(payload), srcIPStr, dstIPStr, len(t.recvQueue))
-			} else if len(payload) < 200 {
-				log.Printf("✅ Received PacketTypeData: %d bytes (queue size: %d)", len(payload), len(t.recvQueue))
+	switch packetType {
+	case PacketTypeData:
+		if !t.deliverFromServer(payload) {
+			return false
+		}
+	case PacketTypeBatch:
+		packets, err := splitBatch(payload)
+		if err != nil {
+			log.Printf("⚠️  Invalid batch from server: %v", err)
+			break
+		}
+		for _, p := range packets {
+			if !t.deliverFromServer(p) {
+				return false
 			}
-
-			// Try to enqueue with timeout - for ICMP, we want to ensure it gets through
-			if !enqueueWithTimeout(t.recvQueue, payload, t.stopCh) {
-				select {
-				case <-t.stopCh:
-					return
-				default:
-					if protocol == 1 {
-						log.Printf("❌ Receive queue full after timeout, dropping ICMP packet (queue size: %d)", len(t.recvQueue))
-					} else {
-						log.Printf("⚠️  Receive queue full after timeout, dropping packet (queue size: %d)", len(t.recvQueue))
-					}
-				}
-			} else if protocol == 1 {
-				// Successfully queued ICMP packet
-				log.Printf("✅ ICMP packet queued successfully (queue size: %d)", len(t.recvQueue))
+		}
+	case PacketTypeFragment:
+		if !t.deliverFragmentFromServer(payload) {
+			return false
+		}
+	case PacketTypePMTUProbe:
+		if ack := buildPMTUAck(payload); ack != nil {
+			if err := t.sendControlToServer(ack); err != nil {
+				log.Printf("Failed to acknowledge PMTU probe: %v", err)
 			}
-		case PacketTypeAuthResponse:
-			// Handle authentication response (client mode)
-			// This should only be received in encrypt_after_auth mode
-			if !t.config.EncryptAfterAuth {
-				log.Printf("⚠️  Received unexpected auth response (encrypt_after_auth is disabled)")
-				break
+		}
+	case PacketTypePMTUAck:
+		t.pmtu.handleAck(payload)
+	case PacketTypeAuthResponse:
+		// Handle authentication response (client mode)
+		// This should only be received in encrypt_after_auth mode
+		if !t.config.EncryptAfterAuth {
+			log.Printf("⚠️  Received unexpected auth response (encrypt_after_auth is disabled)")
+			break
+		}
+		
+		if t.authResponseChan == nil {
+			log.Printf("⚠️  Received auth response but channel is nil - this shouldn't happen")
+			break
+		}
+		
+		responseData := string(payload)
+		if responseData != "OK" {
+			select {
+			case t.authResponseChan <- fmt.Errorf("authentication rejected: %s", responseData):
+			default:
+				log.Printf("⚠️  Failed to send auth error to channel (channel full or closed): %s", responseData)
 			}
-			
-			if t.authResponseChan == nil {
-				log.Printf("⚠️  Received auth response but channel is nil - this shouldn't happen")
-				break
+		} else {
+			// Set here, in order, so the server's data frames that follow
+			// in the clear are not taken for ciphertext
+			t.authMux.Lock()
+			t.authenticated = true
+			t.authMux.Unlock()
+			select {
+			case t.authResponseChan <- nil:
+			default:
+				log.Printf("⚠️  Failed to send auth success to channel (channel full or closed)")
 			}
-			
-			responseData := string(payload)
-			if responseData != "OK" {
-				select {
-				case t.authResponseChan <- fmt.Errorf("authentication rejected: %s", responseData):
-				default:
-					log.Printf("⚠️  Failed to send auth error to channel (channel full or closed): %s", responseData)
+		}
+	case PacketTypeKeepalive:
+		// Keepalive received, update last receive time to prevent idle timeout
+		// This is critical - keepalive packets should reset the idle timer
+		t.lastRecvMux.Lock()
+		t.lastRecvTime = time.Now()
+		t.lastRecvMux.Unlock()
+		// No other action needed for keepalive
+	case PacketTypePublicAddr:
+		// Server sent us our public address
+		publicAddr := string(payload)
+		t.publicAddrMux.Lock()
+		t.publicAddr = publicAddr
+		t.publicAddrMux.Unlock()
+		log.Printf("Received public address from server: %s", publicAddr)
+
+		// Detect NAT type if enabled and announce peer info after detection
+		if t.config.EnableNATDetection && t.p2pManager != nil {
+			go func() {
+				// Perform NAT detection
+				t.p2pManager.DetectNATType(t.config.RemoteAddr)
+
+				// After NAT detection completes, announce peer info to server
+				// This ensures peer info is available when P2P connections are requested
+				log.Printf("NAT detection complete, announcing peer info to server")
+				if err := t.announcePeerInfo(); err != nil {
+					log.Printf("Failed to announce peer info after NAT detection: %v", err)
+					// Retry with exponential backoff
+					go t.retryAnnouncePeerInfo()
+				} else {
+					log.Printf("Successfully announced peer info to server")
 				}
-			} else {
-				select {
-				case t.authResponseChan <- nil:
-				default:
-					log.Printf("⚠️  Failed to send auth success to channel (channel full or closed)")
+			}()
+		} else if t.config.P2PEnabled && t.p2pManager != nil {
+			// If NAT detection is disabled but P2P is enabled, announce immediately
+			go func() {
+				// Wait a bit for connection to stabilize
+				time.Sleep(1 * time.Second)
+				log.Printf("P2P enabled without NAT detection, announcing peer info to server")
+				if err := t.announcePeerInfo(); err != nil {
+					log.Printf("Failed to announce peer info: %v", err)
+					go t.retryAnnouncePeerInfo()
+				} else {
+					log.Printf("Successfully announced peer info to server")
 				}
+			}()
+		}
+	case PacketTypePeerInfo:
+		// Received peer info from server about another client
+		if t.config.P2PEnabled && t.p2pManager != nil {
+			t.handlePeerInfoFromServer(payload)
+		}
+	case PacketTypePunch:
+		// Server requests immediate simultaneous hole-punching
+		if t.config.P2PEnabled && t.p2pManager != nil {
+			t.handlePunchFromServer(payload)
+		}
+	case PacketTypeRouteInfo:
+		t.handleRouteInfoPayload(payload)
+	case PacketTypeConfigUpdate:
+		t.handleConfigUpdate(payload)
+	}
+	return true
+}
+
+// deliverFromServer queues a data payload received from the server for the TUN device.
+// Returns false when the tunnel is stopping.
+func (t *Tunnel) deliverFromServer(payload []byte) bool {
+	// Queue for TUN device
+	// Extract protocol for better logging
+	protocol := byte(0)
+	var srcIPStr, dstIPStr string
+	if len(payload) >= 10 && !t.isTAP() {
+		protocol = payload[9]
+		if len(payload) >= IPv4DstIPOffset+4 {
+			srcIP := net.IP(payload[IPv4SrcIPOffset : IPv4SrcIPOffset+4])
+			dstIP := net.IP(payload[IPv4DstIPOffset : IPv4DstIPOffset+4])
+			srcIPStr = srcIP.String()
+			dstIPStr = dstIP.String()
+		}
+	}
+
+	// Log ICMP packets and small packets to verify flow
+	if protocol == 1 {
+		log.Printf("✅ Received ICMP packet from server: %d bytes, %s -> %s (queue size: %d)", len(payload), srcIPStr, dstIPStr, len(t.recvQueue))
+	} else if len(payload) < 200 {
+		log.Printf("✅ Received PacketTypeData: %d bytes (queue size: %d)", len(payload), len(t.recvQueue))
+	}
+
+	// Try to enqueue with timeout - for ICMP, we want to ensure it gets through
+	if !enqueueWithTimeout(t.recvQueue, payload, t.stopCh) {
+		select {
+		case <-t.stopCh:
+			return false
+		default:
+			if protocol == 1 {
+				log.Printf("❌ Receive queue full after timeout, dropping ICMP packet (queue size: %d)", len(t.recvQueue))
+			} else {
+				log.Printf("⚠️  Receive queue full after timeout, dropping packet (queue size: %d)", len(t.recvQueue))
 			}
-		case PacketTypeKeepalive:
-			// Keepalive received, update last receive time to prevent idle timeout
-			// This is critical - keepalive packets should reset the idle timer
-			t.lastRecvMux.Lock()
-			t.lastRecvTime = time.Now()
-			t.lastRecvMux.Unlock()
-			// No other action needed for keepalive
-		case PacketTypePublicAddr:
-			// Server sent us our public address
-			publicAddr := string(payload)
-			t.publicAddrMux.Lock()
-			t.publicAddr = publicAddr
-			t.publicAddrMux.Unlock()
-			log.Printf("Received public address from server: %s", publicAddr)
-
-			// Detect NAT type if enabled and announce peer info after detection
-			if t.config.EnableNATDetection && t.p2pManager != nil {
-				go func() {
-					// Perform NAT detection
-					t.p2pManager.DetectNATType(t.config.RemoteAddr)
-
-					// After NAT detection completes, announce peer info to server
-					// This ensures peer info is available when P2P connections are requested
-					log.Printf("NAT detection complete, announcing peer info to server")
-					if err := t.announcePeerInfo(); err != nil {
-						log.Printf("Failed to announce peer info after NAT detection: %v", err)
-						// Retry with exponential backoff
-						go t.retryAnnouncePeerInfo()
-					} else {
-						log.Printf("Successfully announced peer info to server")
-					}
-				}()
-			} else if t.config.P2PEnabled && t.p2pManager != nil {
-				// If NAT detection is disabled but P2P is enabled, announce immediately
-				go func() {
-					// Wait a bit for connection to stabilize
-					time.Sleep(1 * time.Second)
-					log.Printf("P2P enabled without NAT detection, announcing peer info to server")
-					if err := t.announcePeerInfo(); err != nil {
-						log.Printf("Failed to announce peer info: %v", err)
-						go t.retryAnnouncePeerInfo()
-					} else {
-						log.Printf("Successfully announced peer info to server")
-					}
-				}()
-			}
-		case PacketTypePeerInfo:
-			// Received peer info from server about another client
-			if t.config.P2PEnabled && t.p2pManager != nil {
-				t.handlePeerInfoFromServer(payload)
-			}
-		case PacketTypePunch:
-			// Server requests immediate simultaneous hole-punching
-			if t.config.P2PEnabled && t.p2pManager != nil {
-				t.handlePunchFromServer(payload)
-			}
-		case PacketTypeRouteInfo:
-			t.handleRouteInfoPayload(payload)
-		case PacketTypeConfigUpdate:
-			t.handleConfigUpdate(payload)
 		}
+	} else if protocol == 1 {
+		// Successfully queued ICMP packet
+		log.Printf("✅ ICMP packet queued successfully (queue size: %d)", len(t.recvQueue))
+	}
+	return true
+}
+
+// deliverFragmentFromServer feeds a fragment from the server into the
+// reassembler and queues the inner packet once complete.
+// Returns false when the tunnel is stopping.
+func (t *Tunnel) deliverFragmentFromServer(payload []byte) bool {
+	if t.reassembler == nil {
+		return true
+	}
+	packet, err := t.reassembler.add(payload, time.Now())
+	if err != nil {
+		log.Printf("⚠️  Invalid fragment from server: %v", err)
+		return true
 	}
+	if packet == nil {
+		return true
+	}
+	return t.deliverFromServer(packet)
 }
 
 // netWriter writes packets from send queue to network connection
 func (t *Tunnel) netWriter() {
 	defer t.wg.Done()
 
-	for {
-		select {
-		case <-t.stopCh:
-			return
-		case packet := <-t.sendQueue:
-			func() {
-				defer t.releasePacketBuffer(packet)
+	// Cover frames fill idle gaps
+	cover := newCoverTimer(t.coverInterval())
+	defer cover.stop()
 
-				fullPacket, _ := prependPacketType(packet, PacketTypeData)
-
-				// Encrypt if cipher is available
-				encryptedPacket, err := t.encryptPacket(fullPacket)
-				if err != nil {
-					log.Printf("Encryption error: %v", err)
-					return
+	batch := make([][]byte, 0, maxBatchPackets)
+	var pending []byte
+	defer func() {
+		// A leftover packet is still owned by the writer when it stops
+		if pending != nil {
+			t.releasePacketBuffer(pending)
+		}
+	}()
+	for {
+		packet := pending
+		pending = nil
+		if packet == nil {
+			select {
+			case <-t.stopCh:
+				return
+			case packet = <-t.sendQueue:
+			case <-cover.C():
+				frame := t.coverFrame(t.pathMTU(t.pmtu))
+				if t.txCrypto != nil {
+					if !t.txCrypto.submit(frame, nil) {
+						return
+					}
+				} else {
+					t.writeFrameToServer(frame)
 				}
+				cover.reset()
+				continue
+			}
+		}
+		cover.reset()
 
-				// Ensure we have a live connection before writing
-				if t.conn == nil {
-					if err := t.reconnectToServer(); err != nil {
-						// Only returns error when stopCh is closed
+		mtu := t.pathMTU(t.pmtu)
+		if t.needsFragmentation(packet, mtu) {
+			for _, frame := range t.buildFragmentFrames(packet, mtu) {
+				if t.txCrypto != nil {
+					if !t.txCrypto.submit(frame, nil) {
 						return
 					}
+					continue
 				}
+				t.writeFrameToServer(frame)
+			}
+			t.releasePacketBuffer(packet)
+			continue
+		}
 
-				// Packet logging removed to reduce log noise
+		if t.config.EnableBatching {
+			batch, pending = collectBatch(batch[:0], packet, t.sendQueue, mtu+1, t.batchLatency(), t.stopCh, nil)
+		} else {
+			batch = append(batch[:0], packet)
+		}
 
-				// Send with FEC if enabled
-				var sendErr error
-				if t.fecEnabled {
-					sendErr = t.sendPacketWithFEC(t.conn, encryptedPacket)
-				} else {
-					sendErr = t.conn.WritePacket(encryptedPacket)
-				}
+		frame := t.buildDataFrame(batch)
+		if t.txCrypto != nil {
+			if !t.txCrypto.submit(frame, batch) {
+				return
+			}
+			continue
+		}
+		t.writeFrameToServer(frame)
+		t.releaseBatch(batch, frame)
+	}
+}
 
-				if sendErr != nil {
-					select {
-					case <-t.stopCh:
-						// Tunnel is stopping, no need to log
-						return
-					default:
-						log.Printf("Network write error: %v (send queue size: %d), attempting reconnection...", sendErr, len(t.sendQueue))
-					}
+// writeFrameToServer encrypts and sends one data frame to the server.
+func (t *Tunnel) writeFrameToServer(frame []byte) {
+	// Encrypt if cipher is available
+	encryptedPacket, err := t.encryptPacket(frame)
+	if err != nil {
+		log.Printf("Encryption error: %v", err)
+		return
+	}
+	t.sendFrameToServer(encryptedPacket)
+}
 
-					// Close and clear connection then try to reconnect
-					t.connMux.Lock()
-					if t.conn != nil {
-						_ = t.conn.Close()
-						t.conn = nil
-					}
-					t.connMux.Unlock()
+// sendFrameToServer sends one encrypted frame to the server, reconnecting and
+// retrying once if the write fails.
+func (t *Tunnel) sendFrameToServer(encryptedPacket []byte) {
+	// Ensure we have a live connection before writing
+	conn := t.serverConn()
+	if conn == nil {
+		if err := t.reconnectToServer(); err != nil {
+			// Only returns error when stopCh is closed
+			return
+		}
+		if conn = t.serverConn(); conn == nil {
+			return
+		}
+	}
 
-					// Keep trying to reconnect - only exits if tunnel is stopping
-					reconnectStart := time.Now()
-					if err := t.reconnectToServer(); err != nil {
-						// Only returns error when stopCh is closed
-						return
-					}
-					reconnectDuration := time.Since(reconnectStart)
-					log.Printf("⚠️  Reconnection took %v (send queue size: %d), retrying packet send", reconnectDuration, len(t.sendQueue))
+	// Packet logging removed to reduce log noise
+
+	// Send with FEC if enabled
+	var sendErr error
+	if t.fecEnabled {
+		sendErr = t.sendPacketWithFEC(conn, encryptedPacket)
+	} else {
+		sendErr = conn.WritePacket(encryptedPacket)
+	}
 
-					// Re-announce P2P info after reconnection to re-establish P2P connections
-					t.reannounceP2PInfoAfterReconnect()
+	if sendErr != nil {
+		select {
+		case <-t.stopCh:
+			// Tunnel is stopping, no need to log
+			return
+		default:
+			log.Printf("Network write error: %v (send queue size: %d), attempting reconnection...", sendErr, len(t.sendQueue))
+		}
 
-					if t.conn != nil {
-						var retryErr error
-						if t.fecEnabled {
-							retryErr = t.sendPacketWithFEC(t.conn, encryptedPacket)
-						} else {
-							retryErr = t.conn.WritePacket(encryptedPacket)
-						}
-						if retryErr != nil {
-							log.Printf("❌ Network write retry failed: %v, packet will be lost (queue size: %d)", retryErr, len(t.sendQueue))
-							// Don't return - continue processing queue
-							// Accept packet loss to maintain tunnel connectivity for subsequent packets.
-							// This is better than exiting the goroutine, which would prevent any future
-							// packets from being sent even after the connection is restored.
-						}
-					}
-				}
-			}()
+		// Close and clear connection then try to reconnect, unless it was
+		// already replaced
+		t.clearServerConn(conn)
+
+		// Keep trying to reconnect - only exits if tunnel is stopping
+		reconnectStart := time.Now()
+		if err := t.reconnectToServer(); err != nil {
+			// Only returns error when stopCh is closed
+			return
+		}
+		reconnectDuration := time.Since(reconnectStart)
+		log.Printf("⚠️  Reconnection took %v (send queue size: %d), retrying packet send", reconnectDuration, len(t.sendQueue))
+
+		// Re-announce P2P info after reconnection to re-establish P2P connections
+		t.reannounceP2PInfoAfterReconnect()
+
+		if conn := t.serverConn(); conn != nil {
+			var retryErr error
+			if t.fecEnabled {
+				retryErr = t.sendPacketWithFEC(conn, encryptedPacket)
+			} else {
+				retryErr = conn.WritePacket(encryptedPacket)
+			}
+			if retryErr != nil {
+				log.Printf("❌ Network write retry failed: %v, packet will be lost (queue size: %d)", retryErr, len(t.sendQueue))
+				// Don't return - continue processing queue
+				// Accept packet loss to maintain tunnel connectivity for subsequent packets.
+				// This is better than exiting the goroutine, which would prevent any future
+				// packets from being sent even after the connection is restored.
+			}
 		}
 	}
 }
@@ -2094,14 +2695,18 @@ func (t *Tunnel) keepalive() {
 				continue
 			}
 			// Ensure we have a live connection
-			if t.conn == nil {
+			conn := t.serverConn()
+			if conn == nil {
 				if err := t.reconnectToServer(); err != nil {
 					// Only returns error when stopCh is closed
 					return
 				}
+				if conn = t.serverConn(); conn == nil {
+					continue
+				}
 			}
 
-			if err := t.conn.WritePacket(encryptedPacket); err != nil {
+			if err := conn.WritePacket(encryptedPacket); err != nil {
 				select {
 				case <-t.stopCh:
 					// Tunnel is stopping, no need to log
@@ -2111,12 +2716,7 @@ func (t *Tunnel) keepalive() {
 				}
 
 				// Close and clear connection then attempt reconnect
-				t.connMux.Lock()
-				if t.conn != nil {
-					_ = t.conn.Close()
-					t.conn = nil
-				}
-				t.connMux.Unlock()
+				t.clearServerConn(conn)
 
 				// Keep trying to reconnect - only exits if tunnel is stopping
 				if err := t.reconnectToServer(); err != nil {
@@ -2160,15 +2760,26 @@ func (t *Tunnel) clientNetReader(client *ClientConnection) {
 
 		if timeSinceLastRecv > IdleConnectionTimeout {
 			log.Printf("Client connection from %s idle for %v (threshold: %v), closing...",
-				client.conn.RemoteAddr(), timeSinceLastRecv, IdleConnectionTimeout)
+				client.currentConn().RemoteAddr(), timeSinceLastRecv, IdleConnectionTimeout)
 			client.stopOnce.Do(func() {
 				close(client.stopCh)
 			})
 			return
 		}
 
-		packet, err := client.conn.ReadPacket()
-		if err != nil {
+		conn, hopped := client.claimConn()
+		if hopped != nil {
+			// The client hopped: drain the old connection on the side and
+			// read the new one from now on
+			t.drainHopped(hopped, &client.wg, func(p []byte) bool { return t.receiveFromClient(client, p) })
+		}
+		packet, err := conn.ReadPacket()
+		if client.currentConn() != conn {
+			// The client hopped; the next claim hands conn to a drain reader
+			if err != nil {
+				continue
+			}
+		} else if err != nil {
 			// Check if it's a timeout - if so, continue to allow checking stopCh and idle timeout
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				continue
@@ -2179,7 +2790,7 @@ func (t *Tunnel) clientNetReader(client *ClientConnection) {
 			case <-client.stopCh:
 				// Client already stopped, no need to log
 			default:
-				log.Printf("Client network read error from %s: %v", client.conn.RemoteAddr(), err)
+				log.Printf("Client network read error from %s: %v", conn.RemoteAddr(), err)
 			}
 			client.stopOnce.Do(func() {
 				close(client.stopCh)
@@ -2190,357 +2801,486 @@ func (t *Tunnel) clientNetReader(client *ClientConnection) {
 		if len(packet) < 1 {
 			continue
 		}
-
-		// Update last receive time for any packet received
+		if !t.receiveFromClient(client, packet) {
+			return
+		}
+	}
+}
+
+// receiveFromClient handles a frame read from a client connection. Returns
+// false when the client reader should exit. After a hop the old connection
+// is drained by a second reader, so frames are handled one at a time.
+func (t *Tunnel) receiveFromClient(client *ClientConnection, packet []byte) bool {
+	client.rxMu.Lock()
+	defer client.rxMu.Unlock()
+
+	// Update last receive time for any packet received
+	client.mu.Lock()
+	client.lastRecvTime = time.Now()
+	client.mu.Unlock()
+
+	// Check if this is an FEC shard (before decryption)
+	// FEC shards are NOT encrypted themselves - they contain pieces of encrypted data
+	if len(packet) > 0 && packet[0] == PacketTypeFECShard {
+		if !t.fecEnabled {
+			return true
+		}
+		reconstructedPacket, err := t.processFECShard(client.fecKey, packet[1:])
+		if err != nil {
+			log.Printf("FEC shard processing error from client %s: %v", client.currentConn().RemoteAddr(), err)
+			return true
+		}
+		if reconstructedPacket == nil {
+			// Need more shards
+			return true
+		}
+		// Successfully reconstructed encrypted packet, decrypt it below
+		packet = reconstructedPacket
+	}
+
+	if client.rxCrypto != nil {
+		return client.rxCrypto.submit(packet, nil)
+	}
+
+	// Decrypt if cipher is available (supports previous key during grace)
+	packet, usedCipher, gen, err := t.decryptPacketFromClient(client, packet)
+	if err != nil {
+		log.Printf("Client decryption error from %s (wrong key?): %v", client.currentConn().RemoteAddr(), err)
+		return true
+	}
+	if usedCipher != nil {
+		client.setCipherWithGen(usedCipher, gen)
+	}
+	return t.handleClientPacket(client, packet)
+}
+
+// handleClientPacket processes one decrypted packet received from a client.
+// Returns false when the client reader should exit.
+func (t *Tunnel) handleClientPacket(client *ClientConnection, packet []byte) bool {
+	if len(packet) < 1 {
+		return true
+	}
+
+	// Check packet type
+	packetType := packet[0]
+	payload := packet[1:]
+
+	switch packetType {
+	case PacketTypeAuth:
+		// Handle authentication request (only in encrypt_after_auth mode)
+		if t.config.EncryptAfterAuth {
+			t.handleClientAuthentication(client, payload)
+		}
+	case PacketTypeData:
+		if !t.handleClientData(client, payload) {
+			return false
+		}
+	case PacketTypeBatch:
+		packets, err := splitBatch(payload)
+		if err != nil {
+			log.Printf("⚠️  Invalid batch from client %s: %v", client.currentConn().RemoteAddr(), err)
+			break
+		}
+		for _, p := range packets {
+			if !t.handleClientData(client, p) {
+				return false
+			}
+		}
+	case PacketTypeFragment:
+		if client.reassembler == nil {
+			break
+		}
+		inner, err := client.reassembler.add(payload, time.Now())
+		if err != nil {
+			log.Printf("⚠️  Invalid fragment from client %s: %v", client.currentConn().RemoteAddr(), err)
+			break
+		}
+		if inner != nil && !t.handleClientData(client, inner) {
+			return false
+		}
+	case PacketTypePMTUProbe:
+		if ack := buildPMTUAck(payload); ack != nil {
+			if err := t.sendControlToClient(client, ack); err != nil {
+				log.Printf("Failed to acknowledge PMTU probe from %s: %v", client.currentConn().RemoteAddr(), err)
+			}
+		}
+	case PacketTypePMTUAck:
+		client.pmtu.handleAck(payload)
+	case PacketTypeKeepalive:
+		// Keepalive received, update last receive time to prevent idle timeout
+		// This is critical for server-side client connections too
 		client.mu.Lock()
 		client.lastRecvTime = time.Now()
 		client.mu.Unlock()
-
-		// Check if this is an FEC shard (before decryption)
-		// FEC shards are NOT encrypted themselves - they contain pieces of encrypted data
-		if len(packet) > 0 && packet[0] == PacketTypeFECShard {
-			if t.fecEnabled {
-				reconstructedPacket, err := t.processFECShard(client.conn.RemoteAddr().String(), packet[1:])
-				if err != nil {
-					log.Printf("FEC shard processing error from client %s: %v", client.conn.RemoteAddr(), err)
-					continue
-				}
-				
-				if reconstructedPacket != nil {
-					// Successfully reconstructed encrypted packet
-					// Now decrypt it
-					decryptedPacket, usedCipher, gen, err := t.decryptPacketFromClient(client, reconstructedPacket)
-					if err != nil {
-						log.Printf("FEC reconstructed packet decryption error from %s: %v", client.conn.RemoteAddr(), err)
-						continue
-					}
-					
-					if usedCipher != nil {
-						client.setCipherWithGen(usedCipher, gen)
-					}
-					
-					if len(decryptedPacket) < 1 {
-						continue
+		// No other action needed for keepalive
+	case PacketTypePeerInfo:
+		// Handle peer info from client (server mode) - store but don't broadcast
+		if t.config.P2PEnabled {
+			peerInfoStr := string(payload)
+			log.Printf("Received and stored peer info from client: %s", peerInfoStr)
+
+			// Parse peer info to get tunnel IP
+			parts := strings.Split(peerInfoStr, "|")
+			if len(parts) >= 3 {
+				tunnelIP := net.ParseIP(parts[0])
+				if tunnelIP != nil {
+					// Register client if not yet registered
+					if client.clientIP == nil {
+						t.addClient(client, tunnelIP)
 					}
-					
-					// Process the decrypted packet - use the packet variable for the rest of the code
-					packet = decryptedPacket
-				} else {
-					// Need more shards
-					continue
+
+					// Store peer info for on-demand P2P connection establishment
+					// No automatic broadcast - connections established only when needed
+					client.mu.Lock()
+					client.lastPeerInfo = peerInfoStr
+					client.mu.Unlock()
+					log.Printf("Stored peer info for %s, ready for on-demand P2P", tunnelIP)
 				}
-			} else {
-				continue
-			}
-		} else {
-			// Decrypt if cipher is available (supports previous key during grace)
-			var err error
-			var usedCipher *crypto.Cipher
-			var gen uint64
-			packet, usedCipher, gen, err = t.decryptPacketFromClient(client, packet)
-			if err != nil {
-				log.Printf("Client decryption error from %s (wrong key?): %v", client.conn.RemoteAddr(), err)
-				continue
 			}
+		}
+	case PacketTypeP2PRequest:
+		// Handle P2P connection request from client (server mode)
+		t.handleP2PRequest(client, payload)
+	case PacketTypeRouteInfo:
+		// Register routes advertised by client and respond with server routes
+		routes := parseRouteList(string(payload))
+		if len(routes) > 0 {
+			t.registerClientRoutes(client, routes)
+			go t.sendRoutesToClient(client)
+		}
+	}
+	return true
+}
+
+// handleClientData processes a data packet received from a client: it registers
+// the client's tunnel IP, enforces source IP binding and relays the packet to
+// another client or the TUN device. Returns false when the client reader should exit.
+func (t *Tunnel) handleClientData(client *ClientConnection, payload []byte) bool {
+	if t.macTable != nil {
+		return t.handleClientFrame(client, payload)
+	}
+	if len(payload) < IPv4MinHeaderLen {
+		return true
+	}
+	t.clampMSS(payload, t.pathMTU(client.pmtu))
+
+	// Extract source IP from the packet to register client
+	if payload[0]>>4 == IPv4Version { // IPv4
+		srcIP := net.IP(payload[IPv4SrcIPOffset : IPv4SrcIPOffset+4])
 
-			if usedCipher != nil {
-				client.setCipherWithGen(usedCipher, gen)
+		// Register client IP if not yet registered
+		if client.clientIP == nil {
+			// First packet from this client, register its IP
+			t.addClient(client, srcIP)
+			if t.mcastGroups != nil {
+				// Ask the new client for its group memberships right away
+				t.queueFrameToClient(client, buildIGMPQuery(t.myTunnelIP))
 			}
+		} else if !client.clientIP.Equal(srcIP) {
+			// Client is trying to send packets with a different source IP
+			// This is a potential DoS/hijacking attempt
+			log.Printf("WARNING: Client %s trying to send packet with different source IP %s (registered as %s). Dropping packet.",
+				client.currentConn().RemoteAddr(), srcIP, client.clientIP)
+			return true
 		}
 
-		if len(packet) < 1 {
-			continue
+		// Route packet based on destination
+		dstIP := net.IP(payload[IPv4DstIPOffset : IPv4DstIPOffset+4])
+
+		// Log received data packet for debugging
+		protocol := byte(0)
+		if len(payload) >= 10 {
+			protocol = payload[9]
+		}
+		if protocol == 1 {
+			log.Printf("📥 Server received ICMP PacketTypeData: %d bytes, src=%s, dst=%s", len(payload), srcIP, dstIP)
+		} else {
+			log.Printf("📥 Server received PacketTypeData: %d bytes, src=%s, dst=%s", len(payload), srcIP, dstIP)
 		}
 
-		// Check packet type
-		packetType := packet[0]
-		payload := packet[1:]
+		// Multicast and broadcast go to the other clients and to the TUN device
+		if t.config.EnableMulticast && t.isMulticastOrBroadcast(dstIP) {
+			t.snoopIGMP(client, payload)
+			if !t.config.ClientIsolation {
+				t.replicateToClients(payload, dstIP, client)
+			}
+		}
 
-		switch packetType {
-		case PacketTypeAuth:
-			// Handle authentication request (only in encrypt_after_auth mode)
-			if t.config.EncryptAfterAuth {
-				t.handleClientAuthentication(client, payload)
+		// Check if destination is another client
+		if t.config.ClientIsolation {
+			// In isolation mode, only send to TUN device (server)
+			// Clients cannot communicate with each other
+			// On macOS, utun devices require a 4-byte protocol family header (AF_INET = 2) before the IP packet
+			var writePacket []byte
+			if runtime.GOOS == "darwin" {
+				// Prepend AF_INET (2) in big-endian format: 0x00 0x00 0x00 0x02
+				writePacket = make([]byte, 4+len(payload))
+				writePacket[0] = 0
+				writePacket[1] = 0
+				writePacket[2] = 0
+				writePacket[3] = 2 // AF_INET in big-endian (last byte)
+				copy(writePacket[4:], payload)
+			} else {
+				writePacket = payload
 			}
-		case PacketTypeData:
-			if len(payload) < IPv4MinHeaderLen {
-				continue
+			if _, err := t.tunQueueFor(payload).Write(writePacket); err != nil {
+				select {
+				case <-t.stopCh:
+					// Tunnel is stopping, no need to log
+				default:
+					log.Printf("TUN write error: %v", err)
+				}
+				return false
 			}
-
-			// Extract source IP from the packet to register client
-			if payload[0]>>4 == IPv4Version { // IPv4
-				srcIP := net.IP(payload[IPv4SrcIPOffset : IPv4SrcIPOffset+4])
-
-				// Register client IP if not yet registered
-				if client.clientIP == nil {
-					// First packet from this client, register its IP
-					t.addClient(client, srcIP)
-				} else if !client.clientIP.Equal(srcIP) {
-					// Client is trying to send packets with a different source IP
-					// This is a potential DoS/hijacking attempt
-					log.Printf("WARNING: Client %s trying to send packet with different source IP %s (registered as %s). Dropping packet.",
-						client.conn.RemoteAddr(), srcIP, client.clientIP)
-					continue
+		} else {
+			// Check if packet is for another client
+			targetClient := t.getClientByIP(dstIP)
+			if targetClient != nil && targetClient != client {
+				// Forward to target client (server relay mode)
+				// This is expected when P2P is not yet established or when P2P fails
+				//
+				// IMPORTANT: payload comes from aead.Open which allocates a new slice
+				// We need to copy it into a pooled buffer so it can be properly recycled
+				forwardBuf := t.getPacketBuffer()
+				forwardPacket := forwardBuf[:len(payload)]
+				copy(forwardPacket, payload)
+
+				queued := false
+				select {
+				case targetClient.sendQueue <- forwardPacket:
+					queued = true
+				case <-t.stopCh:
+					t.releasePacketBuffer(forwardBuf)
+					return false
+				case <-client.stopCh:
+					t.releasePacketBuffer(forwardBuf)
+					return false
+				case <-time.After(QueueSendTimeout):
+					// Wait for queue space
+					select {
+					case targetClient.sendQueue <- forwardPacket:
+						queued = true
+					case <-t.stopCh:
+						t.releasePacketBuffer(forwardBuf)
+						return false
+					case <-client.stopCh:
+						t.releasePacketBuffer(forwardBuf)
+						return false
+					default:
+						log.Printf("⚠️  Target client send queue full for %s after timeout, dropping packet", dstIP)
+						t.releasePacketBuffer(forwardBuf)
+					}
 				}
-
-				// Route packet based on destination
-				dstIP := net.IP(payload[IPv4DstIPOffset : IPv4DstIPOffset+4])
-
-				// Log received data packet for debugging
-				protocol := byte(0)
-				if len(payload) >= 10 {
-					protocol = payload[9]
+				// Only release if not queued (clientNetWriter will release if queued)
+				if !queued {
+					t.releasePacketBuffer(forwardBuf)
 				}
-				if protocol == 1 {
-					log.Printf("📥 Server received ICMP PacketTypeData: %d bytes, src=%s, dst=%s", len(payload), srcIP, dstIP)
-				} else {
-					log.Printf("📥 Server received PacketTypeData: %d bytes, src=%s, dst=%s", len(payload), srcIP, dstIP)
+			} else if t.tunFile.vnetHdr {
+				// Offloads: defer the write so consecutive segments can be coalesced
+				if !t.queueClientGRO(client, payload) {
+					return false
+				}
+			} else {
+				// Send to TUN device (for server or unknown destination)
+				// Extract protocol for logging
+				protocol := payload[9] // Protocol field in IP header
+				if protocol == 1 {     // ICMP
+					log.Printf("📥 Server writing ICMP request to TUN: %d bytes, src=%s, dst=%s", len(payload), srcIP, dstIP)
 				}
 
-				// Check if destination is another client
-				if t.config.ClientIsolation {
-					// In isolation mode, only send to TUN device (server)
-					// Clients cannot communicate with each other
-					// On macOS, utun devices require a 4-byte protocol family header (AF_INET = 2) before the IP packet
-					var writePacket []byte
-					if runtime.GOOS == "darwin" {
-						// Prepend AF_INET (2) in big-endian format: 0x00 0x00 0x00 0x02
-						writePacket = make([]byte, 4+len(payload))
-						writePacket[0] = 0
-						writePacket[1] = 0
-						writePacket[2] = 0
-						writePacket[3] = 2 // AF_INET in big-endian (last byte)
-						copy(writePacket[4:], payload)
-					} else {
-						writePacket = payload
-					}
-					if _, err := t.tunFile.Write(writePacket); err != nil {
-						select {
-						case <-t.stopCh:
-							// Tunnel is stopping, no need to log
-						default:
-							log.Printf("TUN write error: %v", err)
-						}
-						return
-					}
+				// On macOS, utun devices require a 4-byte protocol family header (AF_INET = 2) before the IP packet
+				var writePacket []byte
+				if runtime.GOOS == "darwin" {
+					// Prepend AF_INET (2) in big-endian format: 0x00 0x00 0x00 0x02
+					writePacket = make([]byte, 4+len(payload))
+					writePacket[0] = 0
+					writePacket[1] = 0
+					writePacket[2] = 0
+					writePacket[3] = 2 // AF_INET in big-endian (last byte)
+					copy(writePacket[4:], payload)
 				} else {
-					// Check if packet is for another client
-					targetClient := t.getClientByIP(dstIP)
-					if targetClient != nil && targetClient != client {
-						// Forward to target client (server relay mode)
-						// This is expected when P2P is not yet established or when P2P fails
-						//
-						// IMPORTANT: payload comes from aead.Open which allocates a new slice
-						// We need to copy it into a pooled buffer so it can be properly recycled
-						forwardBuf := t.getPacketBuffer()
-						forwardPacket := forwardBuf[:len(payload)]
-						copy(forwardPacket, payload)
-
-						queued := false
-						select {
-						case targetClient.sendQueue <- forwardPacket:
-							queued = true
-						case <-t.stopCh:
-							t.releasePacketBuffer(forwardBuf)
-							return
-						case <-client.stopCh:
-							t.releasePacketBuffer(forwardBuf)
-							return
-						case <-time.After(QueueSendTimeout):
-							// Wait for queue space
-							select {
-							case targetClient.sendQueue <- forwardPacket:
-								queued = true
-							case <-t.stopCh:
-								t.releasePacketBuffer(forwardBuf)
-								return
-							case <-client.stopCh:
-								t.releasePacketBuffer(forwardBuf)
-								return
-							default:
-								log.Printf("⚠️  Target client send queue full for %s after timeout, dropping packet", dstIP)
-								t.releasePacketBuffer(forwardBuf)
+					writePacket = payload
+				}
+
+				// Retry on ENOBUFS with exponential backoff (same as client tunWriter)
+				maxRetries := 5
+				retryDelay := 1 * time.Millisecond
+				var err error
+				dev := t.tunQueueFor(payload)
+				for retry := 0; retry < maxRetries; retry++ {
+					_, err = dev.Write(writePacket)
+					if err == nil {
+						if protocol == 1 {
+							if retry > 0 {
+								log.Printf("✅ Server successfully wrote ICMP request to TUN after %d retries: %d bytes", retry, len(payload))
+							} else {
+								log.Printf("✅ Server successfully wrote ICMP request to TUN: %d bytes", len(payload))
 							}
 						}
-						// Only release if not queued (clientNetWriter will release if queued)
-						if !queued {
-							t.releasePacketBuffer(forwardBuf)
+						break
+					}
+
+					if err == syscall.ENOBUFS {
+						// TUN buffer is full, wait a bit and retry
+						if retry < maxRetries-1 {
+							time.Sleep(retryDelay)
+							retryDelay *= 2 // Exponential backoff
+							continue
 						}
-					} else {
-						// Send to TUN device (for server or unknown destination)
-						// Extract protocol for logging
-						protocol := payload[9] // Protocol field in IP header
-						if protocol == 1 {     // ICMP
-							log.Printf("📥 Server writing ICMP request to TUN: %d bytes, src=%s, dst=%s", len(payload), srcIP, dstIP)
+						// Last retry failed
+						if protocol == 1 {
+							log.Printf("❌ Server TUN write buffer full (ENOBUFS) after %d retries, dropping ICMP packet", maxRetries)
+						} else {
+							log.Printf("⚠️  Server TUN write buffer full (ENOBUFS) after %d retries, dropping packet", maxRetries)
 						}
+						return false
+					}
 
-						// On macOS, utun devices require a 4-byte protocol family header (AF_INET = 2) before the IP packet
-						var writePacket []byte
-						if runtime.GOOS == "darwin" {
-							// Prepend AF_INET (2) in big-endian format: 0x00 0x00 0x00 0x02
-							writePacket = make([]byte, 4+len(payload))
-							writePacket[0] = 0
-							writePacket[1] = 0
-							writePacket[2] = 0
-							writePacket[3] = 2 // AF_INET in big-endian (last byte)
-							copy(writePacket[4:], payload)
+					// Other errors are more serious
+					select {
+					case <-t.stopCh:
+						return false
+					default:
+						if protocol == 1 {
+							log.Printf("❌ Server TUN write error for ICMP: %v", err)
 						} else {
-							writePacket = payload
+							log.Printf("TUN write error: %v", err)
 						}
+						return false
+					}
+				}
+			}
+		}
+	}
+	return true
+}
 
-						// Retry on ENOBUFS with exponential backoff (same as client tunWriter)
-						maxRetries := 5
-						retryDelay := 1 * time.Millisecond
-						var err error
-						for retry := 0; retry < maxRetries; retry++ {
-							_, err = t.tunFile.Write(writePacket)
-							if err == nil {
-								if protocol == 1 {
-									if retry > 0 {
-										log.Printf("✅ Server successfully wrote ICMP request to TUN after %d retries: %d bytes", retry, len(payload))
-									} else {
-										log.Printf("✅ Server successfully wrote ICMP request to TUN: %d bytes", len(payload))
-									}
-								}
-								break
-							}
+// clientNetWriter writes packets from client send queue to network
+func (t *Tunnel) clientNetWriter(client *ClientConnection) {
+	defer client.wg.Done()
 
-							if err == syscall.ENOBUFS {
-								// TUN buffer is full, wait a bit and retry
-								if retry < maxRetries-1 {
-									time.Sleep(retryDelay)
-									retryDelay *= 2 // Exponential backoff
-									continue
-								}
-								// Last retry failed
-								if protocol == 1 {
-									log.Printf("❌ Server TUN write buffer full (ENOBUFS) after %d retries, dropping ICMP packet", maxRetries)
-								} else {
-									log.Printf("⚠️  Server TUN write buffer full (ENOBUFS) after %d retries, dropping packet", maxRetries)
-								}
-								return
-							}
+	// Cover frames fill idle gaps
+	cover := newCoverTimer(t.coverInterval())
+	defer cover.stop()
 
-							// Other errors are more serious
-							select {
-							case <-t.stopCh:
-								return
-							default:
-								if protocol == 1 {
-									log.Printf("❌ Server TUN write error for ICMP: %v", err)
-								} else {
-									log.Printf("TUN write error: %v", err)
-								}
-								return
-							}
-						}
+	batch := make([][]byte, 0, maxBatchPackets)
+	var pending []byte
+	defer func() {
+		// A leftover packet is still owned by the writer when it stops
+		if pending != nil {
+			t.releasePacketBuffer(pending)
+		}
+	}()
+	for {
+		packet := pending
+		pending = nil
+		if packet == nil {
+			select {
+			case <-t.stopCh:
+				return
+			case <-client.stopCh:
+				return
+			case packet = <-client.sendQueue:
+			case <-cover.C():
+				frame := t.coverFrame(t.pathMTU(client.pmtu))
+				if client.txCrypto != nil {
+					if !client.txCrypto.submit(frame, nil) {
+						return
 					}
+				} else {
+					t.writeFrameToClient(client, frame, nil)
 				}
+				cover.reset()
+				continue
 			}
-		case PacketTypeKeepalive:
-			// Keepalive received, update last receive time to prevent idle timeout
-			// This is critical for server-side client connections too
-			client.mu.Lock()
-			client.lastRecvTime = time.Now()
-			client.mu.Unlock()
-			// No other action needed for keepalive
-		case PacketTypePeerInfo:
-			// Handle peer info from client (server mode) - store but don't broadcast
-			if t.config.P2PEnabled {
-				peerInfoStr := string(payload)
-				log.Printf("Received and stored peer info from client: %s", peerInfoStr)
-
-				// Parse peer info to get tunnel IP
-				parts := strings.Split(peerInfoStr, "|")
-				if len(parts) >= 3 {
-					tunnelIP := net.ParseIP(parts[0])
-					if tunnelIP != nil {
-						// Register client if not yet registered
-						if client.clientIP == nil {
-							t.addClient(client, tunnelIP)
-						}
+		}
+		cover.reset()
 
-						// Store peer info for on-demand P2P connection establishment
-						// No automatic broadcast - connections established only when needed
-						client.mu.Lock()
-						client.lastPeerInfo = peerInfoStr
-						client.mu.Unlock()
-						log.Printf("Stored peer info for %s, ready for on-demand P2P", tunnelIP)
+		mtu := t.pathMTU(client.pmtu)
+		if t.needsFragmentation(packet, mtu) {
+			for _, frame := range t.buildFragmentFrames(packet, mtu) {
+				if client.txCrypto != nil {
+					if !client.txCrypto.submit(frame, nil) {
+						return
 					}
+					continue
 				}
+				t.writeFrameToClient(client, frame, nil)
 			}
-		case PacketTypeP2PRequest:
-			// Handle P2P connection request from client (server mode)
-			t.handleP2PRequest(client, payload)
-		case PacketTypeRouteInfo:
-			// Register routes advertised by client and respond with server routes
-			routes := parseRouteList(string(payload))
-			if len(routes) > 0 {
-				t.registerClientRoutes(client, routes)
-				go t.sendRoutesToClient(client)
+			t.releasePacketBuffer(packet)
+			continue
+		}
+
+		if t.config.EnableBatching {
+			batch, pending = collectBatch(batch[:0], packet, client.sendQueue, mtu+1, t.batchLatency(), t.stopCh, client.stopCh)
+		} else {
+			batch = append(batch[:0], packet)
+		}
+
+		frame := t.buildDataFrame(batch)
+		if client.txCrypto != nil {
+			if !client.txCrypto.submit(frame, batch) {
+				return
 			}
+			continue
 		}
+		t.writeFrameToClient(client, frame, batch)
+		t.releaseBatch(batch, frame)
 	}
 }
 
-// clientNetWriter writes packets from client send queue to network
-func (t *Tunnel) clientNetWriter(client *ClientConnection) {
-	defer client.wg.Done()
+// writeFrameToClient encrypts and sends one data frame to a client.
+func (t *Tunnel) writeFrameToClient(client *ClientConnection, frame []byte, batch [][]byte) {
+	// Encrypt if cipher is available
+	encryptedPacket, err := t.encryptForClient(client, frame)
+	if err != nil {
+		log.Printf("Client encryption error: %v", err)
+		return
+	}
+	t.sendFrameToClient(client, encryptedPacket, batch)
+}
 
-	for {
+// sendFrameToClient sends one encrypted frame to a client. The client is
+// stopped if the write fails.
+func (t *Tunnel) sendFrameToClient(client *ClientConnection, encryptedPacket []byte, batch [][]byte) {
+	// Extract protocol for error logging
+	protocol := byte(0)
+	if len(batch) == 1 && len(batch[0]) >= 10 {
+		protocol = batch[0][9]
+	}
+
+	// Send with FEC if enabled
+	conn := client.currentConn()
+	var sendErr error
+	if t.fecEnabled {
+		sendErr = t.sendPacketWithFEC(conn, encryptedPacket)
+	} else {
+		sendErr = conn.WritePacket(encryptedPacket)
+	}
+
+	if sendErr != nil && client.currentConn() != conn {
+		// The client hopped and the old connection closed under the write;
+		// the frame is lost but the session lives on
+		return
+	}
+	if sendErr != nil {
 		select {
 		case <-t.stopCh:
-			return
+			// Tunnel is stopping, no need to log
 		case <-client.stopCh:
-			return
-		case packet := <-client.sendQueue:
-			func() {
-				defer t.releasePacketBuffer(packet)
-
-				// Extract protocol for error logging
-				protocol := byte(0)
-				if len(packet) >= 10 {
-					protocol = packet[9]
-				}
-
-				fullPacket, _ := prependPacketType(packet, PacketTypeData)
-
-				// Encrypt if cipher is available
-				encryptedPacket, err := t.encryptForClient(client, fullPacket)
-				if err != nil {
-					log.Printf("Client encryption error: %v", err)
-					return
-				}
-
-				// Send with FEC if enabled
-				var sendErr error
-				if t.fecEnabled {
-					sendErr = t.sendPacketWithFEC(client.conn, encryptedPacket)
-				} else {
-					sendErr = client.conn.WritePacket(encryptedPacket)
-				}
-
-				if sendErr != nil {
-					select {
-					case <-t.stopCh:
-						// Tunnel is stopping, no need to log
-					case <-client.stopCh:
-						// Client already stopped, no need to log
-					default:
-						if protocol == 1 {
-							log.Printf("❌ Server network write error sending ICMP to %s: %v", client.conn.RemoteAddr(), sendErr)
-						} else {
-							log.Printf("Client network write error to %s: %v", client.conn.RemoteAddr(), sendErr)
-						}
-					}
-					client.stopOnce.Do(func() {
-						close(client.stopCh)
-					})
-				} else if protocol == 1 {
-					log.Printf("✅ Server successfully sent ICMP reply to client %s: %d bytes", client.clientIP, len(packet))
-				}
-			}()
+			// Client already stopped, no need to log
+		default:
+			if protocol == 1 {
+				log.Printf("❌ Server network write error sending ICMP to %s: %v", conn.RemoteAddr(), sendErr)
+			} else {
+				log.Printf("Client network write error to %s: %v", conn.RemoteAddr(), sendErr)
+			}
 		}
+		client.stopOnce.Do(func() {
+			close(client.stopCh)
+		})
+	} else if protocol == 1 {
+		log.Printf("✅ Server successfully sent ICMP reply to client %s: %d bytes", client.clientIP, len(batch[0]))
 	}
 }
 
@@ -2566,14 +3306,19 @@ func (t *Tunnel) clientKeepalive(client *ClientConnection) {
 				log.Printf("Client keepalive encryption error: %v", err)
 				continue
 			}
-			if err := client.conn.WritePacket(encryptedPacket); err != nil {
+			conn := client.currentConn()
+			if err := conn.WritePacket(encryptedPacket); err != nil {
+				if client.currentConn() != conn {
+					// Hopped meanwhile; the next keepalive uses the new connection
+					continue
+				}
 				select {
 				case <-t.stopCh:
 					// Tunnel is stopping, no need to log
 				case <-client.stopCh:
 					// Client already stopped, no need to log
 				default:
-					log.Printf("Client keepalive error to %s: %v", client.conn.RemoteAddr(), err)
+					log.Printf("Client keepalive error to %s: %v", conn.RemoteAddr(), err)
 				}
 				client.stopOnce.Do(func() {
 					close(client.stopCh)
@@ -2607,13 +3352,20 @@ func (t *Tunnel) handleP2PPacket(peerIP net.IP, data []byte) {
 
 	switch packetType {
 	case PacketTypeData:
-		// Queue for TUN device
-		select {
-		case t.recvQueue <- payload:
-		case <-t.stopCh:
+		// The P2P receive buffer is reused, so queue a copy for the TUN device
+		t.queueP2PPacket(peerIP, append(t.getPacketBuffer()[:0], payload...))
+	case PacketTypeFragment:
+		reasm := t.p2pReassembler(peerIP)
+		if reasm == nil {
+			return
+		}
+		packet, err := reasm.add(payload, time.Now())
+		if err != nil {
+			log.Printf("⚠️  Invalid fragment from P2P peer %s: %v", peerIP, err)
 			return
-		default:
-			log.Printf("Receive queue full, dropping P2P packet from %s", peerIP)
+		}
+		if packet != nil {
+			t.queueP2PPacket(peerIP, packet)
 		}
 	case PacketTypePeerInfo:
 		// Handle peer information advertisement
@@ -2624,6 +3376,17 @@ func (t *Tunnel) handleP2PPacket(peerIP net.IP, data []byte) {
 	}
 }
 
+// queueP2PPacket queues an inner packet received from a P2P peer for the TUN
+// device, dropping it if the receive queue is full.
+func (t *Tunnel) queueP2PPacket(peerIP net.IP, packet []byte) {
+	select {
+	case t.recvQueue <- packet:
+	case <-t.stopCh:
+	default:
+		log.Printf("Receive queue full, dropping P2P packet from %s", peerIP)
+	}
+}
+
 // handlePeerInfoPacket handles peer information advertisements
 func (t *Tunnel) handlePeerInfoPacket(fromIP net.IP, data []byte) {
 	// Parse peer information from packet
@@ -2875,6 +3638,11 @@ func (t *Tunnel) handlePeerDisconnect(peerIP net.IP) {
 	if t.p2pManager != nil {
 		t.p2pManager.RemovePeer(peerIP)
 	}
+
+	// Drop fragments still waiting for reassembly
+	t.p2pReassemblersMu.Lock()
+	delete(t.p2pReassemblers, peerIP.String())
+	t.p2pReassemblersMu.Unlock()
 }
 
 // handleRouteInfoPacket handles route information updates
@@ -3054,7 +3822,7 @@ func (t *Tunnel) sendRoutesToClient(client *ClientConnection) {
 		return
 	}
 
-	if err := client.conn.WritePacket(encryptedPacket); err != nil {
+	if err := client.currentConn().WritePacket(encryptedPacket); err != nil {
 		log.Printf("Failed to send routes to client: %v", err)
 	}
 }
@@ -3297,6 +4065,11 @@ func (t *Tunnel) sendPacketWithRouting(packet []byte) (bool, error) {
 	}
 
 	dstIP := net.IP(packet[IPv4DstIPOffset : IPv4DstIPOffset+4])
+
+	// Multicast and broadcast are replicated by the server, never sent via P2P
+	if t.config.EnableMulticast && t.isMulticastOrBroadcast(dstIP) {
+		return t.sendViaServer(packet)
+	}
 	
 	// Validate IP address - ensure it's a valid unicast address
 	// Filter out obviously invalid IPs (network addresses, etc.)
@@ -3313,18 +4086,7 @@ func (t *Tunnel) sendPacketWithRouting(packet []byte) (bool, error) {
 	// On-demand P2P: Check if we have a P2P connection
 	if t.p2pManager != nil && t.p2pManager.IsConnected(dstIP) {
 		// Direct P2P connection exists, use it
-		fullPacket := make([]byte, len(packet)+1)
-		fullPacket[0] = PacketTypeData
-		copy(fullPacket[1:], packet)
-
-		// Encrypt the packet before sending via P2P
-		encryptedPacket, err := t.encryptPacket(fullPacket)
-		if err != nil {
-			log.Printf("P2P encryption error: %v", err)
-			return t.sendViaServer(packet)
-		}
-
-		if err := t.p2pManager.SendPacket(dstIP, encryptedPacket); err != nil {
+		if err := t.sendViaP2P(dstIP, packet); err != nil {
 			log.Printf("P2P send failed to %s, falling back to server: %v", dstIP, err)
 			return t.sendViaServer(packet)
 		}
@@ -3346,6 +4108,32 @@ func (t *Tunnel) sendPacketWithRouting(packet []byte) (bool, error) {
 	return t.sendViaServer(packet)
 }
 
+// sendViaP2P encrypts a packet and sends it directly to a peer. Like on the
+// server route, a packet larger than the tunnel MTU is split into fragments.
+func (t *Tunnel) sendViaP2P(dstIP net.IP, packet []byte) error {
+	var frames [][]byte
+	if mtu := t.pathMTU(t.pmtu); t.needsFragmentation(packet, mtu) {
+		frames = t.buildFragmentFrames(packet, mtu)
+	} else {
+		fullPacket := make([]byte, len(packet)+1)
+		fullPacket[0] = PacketTypeData
+		copy(fullPacket[1:], packet)
+		frames = [][]byte{fullPacket}
+	}
+
+	for _, frame := range frames {
+		// Encrypt the packet before sending via P2P
+		encryptedPacket, err := t.encryptPacket(frame)
+		if err != nil {
+			return fmt.Errorf("encryption error: %v", err)
+		}
+		if err := t.p2pManager.SendPacket(dstIP, encryptedPacket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // shouldRequestP2P checks if we should request a P2P connection to the target IP
 // Returns false if a request is already pending or was recently made
 func (t *Tunnel) shouldRequestP2P(targetIP net.IP) bool {
@@ -3558,7 +4346,8 @@ func runSysctl(setting string) error {
 }
 
 func (t *Tunnel) shouldSkipOuterEncryption(data []byte) bool {
-	if len(data) < 1 || data[0] != PacketTypeData {
+	// The classifier inspects IP headers; Ethernet frames are always encrypted
+	if len(data) < 1 || data[0] != PacketTypeData || t.isTAP() {
 		return false
 	}
 
@@ -3586,7 +4375,7 @@ func (t *Tunnel) encryptPacket(data []byte) ([]byte, error) {
 	if t.config.EncryptAfterAuth && len(data) > 0 {
 		packetType := data[0]
 		// Only skip encryption for data packets after authentication
-		if packetType == PacketTypeData {
+		if isDataFrameType(packetType) {
 			t.authMux.Lock()
 			isAuthenticated := t.authenticated
 			t.authMux.Unlock()
@@ -3602,7 +4391,7 @@ func (t *Tunnel) encryptPacket(data []byte) ([]byte, error) {
 	if t.shouldSkipOuterEncryption(data) {
 		return data, nil
 	}
-	return c.Encrypt(data)
+	return c.Encrypt(t.padForPeer(data, t.pathMTU(t.pmtu)))
 }
 
 func (t *Tunnel) decryptWithFallback(data []byte) ([]byte, *crypto.Cipher, uint64, error) {
@@ -3617,7 +4406,7 @@ func (t *Tunnel) decryptWithFallback(data []byte) ([]byte, *crypto.Cipher, uint6
 	// In encrypt_after_auth mode, check if this is an authenticated data packet
 	if t.config.EncryptAfterAuth && len(data) > 0 {
 		packetType := data[0]
-		if packetType == PacketTypeData {
+		if isDataFrameType(packetType) {
 			t.authMux.Lock()
 			isAuthenticated := t.authenticated
 			t.authMux.Unlock()
@@ -3636,6 +4425,9 @@ func (t *Tunnel) decryptWithFallback(data []byte) ([]byte, *crypto.Cipher, uint6
 			if prev != nil && t.isPrevCipherActive(prev) {
 				t.deactivatePrevCipher(prev, "new key confirmed in use")
 			}
+			if plain, err = unpadFrame(plain); err != nil {
+				return nil, nil, 0, err
+			}
 			return plain, active, activeGen, nil
 		} else {
 			activeErr = err
@@ -3646,6 +4438,9 @@ func (t *Tunnel) decryptWithFallback(data []byte) ([]byte, *crypto.Cipher, uint6
 		if time.Now().After(exp) && t.isPrevCipherActive(prev) {
 			t.deactivatePrevCipher(prev, "grace period expired")
 		} else if plain, err := prev.Decrypt(data); err == nil {
+			if plain, err = unpadFrame(plain); err != nil {
+				return nil, nil, 0, err
+			}
 			return plain, prev, prevGen, nil
 		}
 	}
@@ -3675,7 +4470,7 @@ func (t *Tunnel) decryptPacketFromClient(client *ClientConnection, data []byte)
 	// Check if this is an authenticated client in encrypt_after_auth mode
 	if t.config.EncryptAfterAuth && client != nil && len(data) > 0 {
 		packetType := data[0]
-		if packetType == PacketTypeData {
+		if isDataFrameType(packetType) {
 			client.mu.RLock()
 			isAuthenticated := client.authenticated
 			client.mu.RUnlock()
@@ -3700,7 +4495,7 @@ func (t *Tunnel) encryptForClient(client *ClientConnection, data []byte) ([]byte
 	if t.config.EncryptAfterAuth && client != nil && len(data) > 0 {
 		packetType := data[0]
 		// Only skip encryption for data packets after authentication
-		if packetType == PacketTypeData {
+		if isDataFrameType(packetType) {
 			client.mu.RLock()
 			isAuthenticated := client.authenticated
 			client.mu.RUnlock()
@@ -3715,7 +4510,7 @@ func (t *Tunnel) encryptForClient(client *ClientConnection, data []byte) ([]byte
 	
 	if client != nil {
 		if c, _ := client.getCipher(); c != nil {
-			return c.Encrypt(data)
+			return c.Encrypt(t.padForPeer(data, t.pathMTU(client.pmtu)))
 		}
 	}
 	return t.encryptPacket(data)
@@ -3836,27 +4631,10 @@ func (t *Tunnel) expirePrevCipher(prev *crypto.Cipher) {
 
 // handleClientAuthentication handles authentication request from client (server mode)
 func (t *Tunnel) handleClientAuthentication(client *ClientConnection, payload []byte) {
-	// Parse authentication request
-	var authReq AuthenticationRequest
-	if err := json.Unmarshal(payload, &authReq); err != nil {
-		log.Printf("Invalid authentication request from %s: failed to parse JSON: %v", client.conn.RemoteAddr(), err)
-		t.sendAuthResponse(client, "INVALID")
-		return
-	}
-	
-	// Validate timestamp (prevent replay attacks)
-	now := time.Now().Unix()
-	if now-authReq.Timestamp > AuthenticationTimeWindow || authReq.Timestamp-now > AuthenticationTimeWindow {
-		log.Printf("Authentication request from %s rejected: timestamp out of range", client.conn.RemoteAddr())
-		t.sendAuthResponse(client, "EXPIRED")
-		return
-	}
-	
-	// Validate tunnel IP
-	tunnelIP := net.ParseIP(authReq.TunnelIP)
-	if tunnelIP == nil {
-		log.Printf("Invalid authentication request from %s: bad IP %s", client.conn.RemoteAddr(), authReq.TunnelIP)
-		t.sendAuthResponse(client, "INVALID")
+	tunnelIP, status, err := parseAuthRequest(payload, time.Now())
+	if err != nil {
+		log.Printf("Authentication request from %s rejected: %v", client.currentConn().RemoteAddr(), err)
+		t.sendAuthResponse(client, status)
 		return
 	}
 	
@@ -3865,13 +4643,37 @@ func (t *Tunnel) handleClientAuthentication(client *ClientConnection, payload []
 	client.authenticated = true
 	client.mu.Unlock()
 	
-	log.Printf("✅ Client %s authenticated successfully (IP: %s) - data packets will not be encrypted", 
-		client.conn.RemoteAddr(), tunnelIP)
+	if t.config.EncryptAfterAuth {
+		log.Printf("✅ Client %s authenticated successfully (IP: %s) - data packets will not be encrypted", 
+			client.currentConn().RemoteAddr(), tunnelIP)
+	} else {
+		log.Printf("✅ Client %s authenticated successfully (IP: %s)", client.currentConn().RemoteAddr(), tunnelIP)
+	}
 	
 	// Send success response
 	t.sendAuthResponse(client, "OK")
 }
 
+// parseAuthRequest validates an authentication request and returns the
+// client's tunnel IP, or the status to reject it with
+func parseAuthRequest(payload []byte, now time.Time) (net.IP, string, error) {
+	var authReq AuthenticationRequest
+	if err := json.Unmarshal(payload, &authReq); err != nil {
+		return nil, "INVALID", fmt.Errorf("failed to parse JSON: %v", err)
+	}
+
+	// Validate timestamp (prevent replay attacks)
+	if d := now.Unix() - authReq.Timestamp; d > AuthenticationTimeWindow || -d > AuthenticationTimeWindow {
+		return nil, "EXPIRED", fmt.Errorf("timestamp out of range")
+	}
+
+	tunnelIP := net.ParseIP(authReq.TunnelIP)
+	if tunnelIP == nil {
+		return nil, "INVALID", fmt.Errorf("bad IP %s", authReq.TunnelIP)
+	}
+	return tunnelIP, "OK", nil
+}
+
 // sendAuthResponse sends authentication response to client
 func (t *Tunnel) sendAuthResponse(client *ClientConnection, status string) {
 	responsePacket := make([]byte, len(status)+1)
@@ -3894,8 +4696,8 @@ func (t *Tunnel) sendAuthResponse(client *ClientConnection, status string) {
 		return
 	}
 	
-	if err := client.conn.WritePacket(encryptedResponse); err != nil {
-		log.Printf("Failed to send auth response to %s: %v", client.conn.RemoteAddr(), err)
+	if err := client.currentConn().WritePacket(encryptedResponse); err != nil {
+		log.Printf("Failed to send auth response to %s: %v", client.currentConn().RemoteAddr(), err)
 	}
 }
 
@@ -4053,7 +4855,7 @@ func (t *Tunnel) retryAnnouncePeerInfo() {
 // sendPublicAddrToClient sends the client's public address for NAT traversal (server mode)
 func (t *Tunnel) sendPublicAddrToClient(client *ClientConnection) {
 	// Get client's public address from connection
-	remoteAddr := client.conn.RemoteAddr()
+	remoteAddr := client.currentConn().RemoteAddr()
 	if remoteAddr == nil {
 		log.Printf("Cannot send public address: client has no remote address")
 		return
@@ -4075,7 +4877,7 @@ func (t *Tunnel) sendPublicAddrToClient(client *ClientConnection) {
 
 	// Send directly to network connection (bypass sendQueue which is for data packets)
 	// This avoids double-wrapping by clientNetWriter
-	if err := client.conn.WritePacket(encryptedPacket); err != nil {
+	if err := client.currentConn().WritePacket(encryptedPacket); err != nil {
 		log.Printf("Failed to send public address to client: %v", err)
 		// Signal client to disconnect on write error (consistent with clientNetWriter behavior)
 		client.stopOnce.Do(func() {
@@ -4147,7 +4949,7 @@ func (t *Tunnel) pushConfigUpdate() error {
 			log.Printf("Failed to encrypt config update for client: %v", err)
 			continue
 		}
-		if err := client.conn.WritePacket(encryptedPacket); err != nil {
+		if err := client.currentConn().WritePacket(encryptedPacket); err != nil {
 			log.Printf("Failed to send config update to client: %v", err)
 		}
 	}
@@ -4382,7 +5184,7 @@ func (t *Tunnel) sendPeerInfoAndPunch(client *ClientConnection, peerInfo string)
 		return
 	}
 
-	if err := client.conn.WritePacket(encryptedPeerInfo); err != nil {
+	if err := client.currentConn().WritePacket(encryptedPeerInfo); err != nil {
 		log.Printf("Failed to send peer info: %v", err)
 		return
 	}
@@ -4398,7 +5200,7 @@ func (t *Tunnel) sendPeerInfoAndPunch(client *ClientConnection, peerInfo string)
 		return
 	}
 
-	if err := client.conn.WritePacket(encryptedPunch); err != nil {
+	if err := client.currentConn().WritePacket(encryptedPunch); err != nil {
 		log.Printf("Failed to send punch packet: %v", err)
 	}
 }